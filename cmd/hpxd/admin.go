@@ -0,0 +1,501 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/zcubbs/hpxd/pkg/drift"
+	"github.com/zcubbs/hpxd/pkg/files"
+	"github.com/zcubbs/hpxd/pkg/haproxy"
+	"github.com/zcubbs/hpxd/pkg/history"
+	"github.com/zcubbs/hpxd/pkg/httpserver"
+	"github.com/zcubbs/hpxd/pkg/maintenance"
+	"github.com/zcubbs/hpxd/pkg/metrics"
+)
+
+const (
+	defaultAdminAddress = "127.0.0.1:9103"
+	defaultHistoryLimit = 20
+
+	// defaultOverrideDuration is how long emergency overrides last by
+	// default
+	defaultOverrideDuration = time.Hour
+	// pausedFile marks a paused instance in its state directory, so pauses
+	// survive restarts
+	pausedFile = "paused"
+)
+
+// rollbackTimeout is how long a rollback request waits for the update loop
+// to apply it.
+var rollbackTimeout = 2 * time.Minute
+
+// AdminConfig configures the admin API. Address is either a TCP address
+// or a unix socket, as `unix:/path/to/socket`.
+type AdminConfig struct {
+	Enabled bool   `mapstructure:"enabled"`
+	Address string `mapstructure:"address"`
+}
+
+// validationReport is the result of the last validation.
+type validationReport struct {
+	Revision    string               `json:"revision"`
+	Valid       bool                 `json:"valid"`
+	Error       string               `json:"error,omitempty"`
+	Diagnostics []haproxy.Diagnostic `json:"diagnostics,omitempty"`
+}
+
+// statusReport is the state of an instance, as served by `GET /status`.
+type statusReport struct {
+	Revision    string            `json:"revision"`
+	AppliedAt   *time.Time        `json:"appliedAt,omitempty"`
+	LastSync    *time.Time        `json:"lastSync,omitempty"`
+	LastError   string            `json:"lastError,omitempty"`
+	LastErrorAt *time.Time        `json:"lastErrorAt,omitempty"`
+	Validation  *validationReport `json:"validation,omitempty"`
+	// Held is why the last fetched revision isn't applied yet
+	Held   string `json:"held,omitempty"`
+	Paused bool   `json:"paused"`
+	DryRun bool   `json:"dryRun"`
+	// Override is the emergency override of maintenance restrictions, if any
+	Override *maintenance.Override `json:"override,omitempty"`
+	// DryRunResult is what the last revision evaluated in dry-run mode
+	// would have changed
+	DryRunResult *dryRunReport `json:"dryRunResult,omitempty"`
+}
+
+// instanceState tracks the state of an instance for the admin API.
+type instanceState struct {
+	mu     sync.Mutex
+	report statusReport
+}
+
+func (s *instanceState) update(f func(r *statusReport)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f(&s.report)
+}
+
+func (s *instanceState) snapshot() statusReport {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.report
+}
+
+// setError records the last error of the instance.
+func (s *instanceState) setError(err error) {
+	now := time.Now().UTC()
+	s.update(func(r *statusReport) {
+		r.LastError, r.LastErrorAt = err.Error(), &now
+	})
+}
+
+// setSynced records that the source of the instance was just fetched.
+func (s *instanceState) setSynced() {
+	now := time.Now().UTC()
+	s.update(func(r *statusReport) { r.LastSync = &now })
+}
+
+// setHeld records why the last fetched revision isn't applied.
+func (s *instanceState) setHeld(reason string) {
+	s.update(func(r *statusReport) { r.Held = reason })
+}
+
+// setApplied records a successfully applied revision.
+func (s *instanceState) setApplied(revision string) {
+	now := time.Now().UTC()
+	s.update(func(r *statusReport) {
+		r.Revision, r.AppliedAt = revision, &now
+		r.Held, r.LastError, r.LastErrorAt = "", "", nil
+	})
+}
+
+// setValidation records the result of the validation of revision.
+func (s *instanceState) setValidation(revision string, diags []haproxy.Diagnostic, err error) {
+	v := &validationReport{Revision: revision, Valid: err == nil, Diagnostics: diags}
+	if err != nil {
+		v.Error = err.Error()
+	}
+	s.update(func(r *statusReport) { r.Validation = v })
+}
+
+// rollbackRequest asks the update loop of an instance to apply a release
+// of its history again.
+type rollbackRequest struct {
+	revision string
+	done     chan rollbackResult
+}
+
+type rollbackResult struct {
+	release *history.Release
+	err     error
+}
+
+// paused reports whether applies of the instance are paused.
+func (inst *instance) paused() bool {
+	_, err := os.Stat(filepath.Join(inst.config.StateDir, pausedFile))
+	return err == nil
+}
+
+// setPaused pauses or resumes applies of the instance.
+func (inst *instance) setPaused(paused bool) error {
+	path := filepath.Join(inst.config.StateDir, pausedFile)
+	if !paused {
+		if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		inst.log.Info("Applies resumed")
+		return nil
+	}
+
+	if err := os.MkdirAll(inst.config.StateDir, 0750); err != nil {
+		return err
+	}
+	if err := os.WriteFile(path, []byte(time.Now().UTC().Format(time.RFC3339)+"\n"), 0600); err != nil {
+		return err
+	}
+	inst.log.Warn("Applies paused, fetched revisions are held until resumed")
+	return nil
+}
+
+// startAdminEndpoint serves the admin API:
+//
+//	GET  /status             state of every instance
+//	GET  /history            applied releases of every instance
+//	POST /sync               sync right away
+//	POST /pause, /resume     hold and resume applies
+//	POST /rollback?to=<rev>  apply a release of the history again
+//	POST /dry-run?enabled=   turn dry-run mode on (default) or off
+//	POST /override?for=&reason=  let changes through maintenance restrictions
+//	POST /approve?id=        approve the update held by the blast-radius guard
+//
+// Requests act on every instance, or on the one selected with `?instance=`.
+// Rollbacks and approvals need an instance when several are managed. With the TLS and
+// authentication settings of `server`, GET endpoints need the read role and
+// POST endpoints the admin role.
+func startAdminEndpoint(config *Configuration, instances []*instance) *http.Server {
+	address := config.Admin.Address
+	listener, err := httpserver.Listen(address, config.Server.TLS)
+	if err != nil {
+		logrus.Fatalf("Error starting admin endpoint: %v", err)
+	}
+	if len(config.Server.Auth) == 0 && !strings.HasPrefix(address, "unix:") && !isLoopback(address) {
+		logrus.Warnf("Admin API listens on %s without authentication", address)
+	}
+
+	server := &http.Server{Handler: newAdminHandler(config, instances), ReadHeaderTimeout: 3 * time.Second}
+	go func() {
+		if err := server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logrus.Fatalf("Error serving admin endpoint: %v", err)
+		}
+	}()
+	logrus.Infof("Admin API listening on %s", address)
+	return server
+}
+
+// newAdminHandler returns the handler of the admin API, requiring the roles
+// of startAdminEndpoint.
+func newAdminHandler(config *Configuration, instances []*instance) http.Handler {
+	auth := httpserver.NewAuthenticator(config.Server.Auth)
+	mux := http.NewServeMux()
+	handle := func(path string, role httpserver.Role, handler http.HandlerFunc) {
+		mux.Handle(path, auth.Require(role, handler))
+	}
+	handle("/status", httpserver.RoleRead, adminHandler(http.MethodGet, instances, func(inst *instance) (interface{}, error) {
+		report := inst.state.snapshot()
+		report.Paused, report.DryRun = inst.paused(), inst.dryRun()
+		// A corrupt override doesn't let anything through, see emergencyOverride
+		report.Override, _ = inst.overrides.Active(time.Now())
+		return report, nil
+	}))
+	handle("/history", httpserver.RoleRead, adminHandler(http.MethodGet, instances, func(inst *instance) (interface{}, error) {
+		return inst.history.List()
+	}))
+	handle("/sync", httpserver.RoleAdmin, adminHandler(http.MethodPost, instances, func(inst *instance) (interface{}, error) {
+		requestSync(inst.syncRequests)
+		return "sync requested", nil
+	}))
+	handle("/pause", httpserver.RoleAdmin, adminHandler(http.MethodPost, instances, func(inst *instance) (interface{}, error) {
+		return "paused", inst.setPaused(true)
+	}))
+	handle("/resume", httpserver.RoleAdmin, adminHandler(http.MethodPost, instances, func(inst *instance) (interface{}, error) {
+		if err := inst.setPaused(false); err != nil {
+			return nil, err
+		}
+		requestSync(inst.syncRequests)
+		return "resumed", nil
+	}))
+	handle("/dry-run", httpserver.RoleAdmin, func(w http.ResponseWriter, r *http.Request) {
+		enabled := true
+		if value := r.URL.Query().Get("enabled"); value != "" {
+			var err error
+			if enabled, err = strconv.ParseBool(value); err != nil {
+				writeJSON(w, http.StatusBadRequest, map[string]string{"error": "enabled must be true or false"})
+				return
+			}
+		}
+		adminHandler(http.MethodPost, instances, func(inst *instance) (interface{}, error) {
+			inst.setDryRun(enabled)
+			if !enabled {
+				requestSync(inst.syncRequests)
+				return "dry-run disabled", nil
+			}
+			return "dry-run enabled", nil
+		})(w, r)
+	})
+	handle("/override", httpserver.RoleAdmin, func(w http.ResponseWriter, r *http.Request) {
+		duration := defaultOverrideDuration
+		if value := r.URL.Query().Get("for"); value != "" {
+			var err error
+			if duration, err = time.ParseDuration(value); err != nil || duration < 0 {
+				writeJSON(w, http.StatusBadRequest, map[string]string{"error": "for must be a positive duration, such as 2h"})
+				return
+			}
+		}
+		reason := r.URL.Query().Get("reason")
+		if duration > 0 && reason == "" {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "missing reason of the override"})
+			return
+		}
+		adminHandler(http.MethodPost, instances, func(inst *instance) (interface{}, error) {
+			return grantOverride(inst, duration, reason)
+		})(w, r)
+	})
+	handle("/rollback", httpserver.RoleAdmin, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+			return
+		}
+		inst, err := findInstance(instances, r.URL.Query().Get("instance"))
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		}
+		release, err := requestRollback(inst, r.URL.Query().Get("to"))
+		if err != nil {
+			writeJSON(w, http.StatusConflict, map[string]string{"error": err.Error()})
+			return
+		}
+		writeJSON(w, http.StatusOK, release)
+	})
+	handle("/approve", httpserver.RoleAdmin, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+			return
+		}
+		inst, err := findInstance(instances, r.URL.Query().Get("instance"))
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		}
+		pending, err := approveUpdate(inst, r.URL.Query().Get("id"))
+		if err != nil {
+			writeJSON(w, http.StatusConflict, map[string]string{"error": err.Error()})
+			return
+		}
+		writeJSON(w, http.StatusOK, pending)
+	})
+	return mux
+}
+
+// adminHandler runs action on the instances selected by the request, and
+// serves the results keyed by instance name.
+func adminHandler(method string, instances []*instance, action func(inst *instance) (interface{}, error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != method {
+			writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+			return
+		}
+
+		selected := instances
+		if name := r.URL.Query().Get("instance"); name != "" {
+			inst, err := findInstance(instances, name)
+			if err != nil {
+				writeJSON(w, http.StatusNotFound, map[string]string{"error": err.Error()})
+				return
+			}
+			selected = []*instance{inst}
+		}
+
+		results := make(map[string]interface{}, len(selected))
+		for _, inst := range selected {
+			result, err := action(inst)
+			if err != nil {
+				writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+				return
+			}
+			results[inst.name] = result
+		}
+		writeJSON(w, http.StatusOK, results)
+	}
+}
+
+// requestRollback hands a rollback over to the update loop of the instance
+// and waits for its result.
+func requestRollback(inst *instance, revision string) (*history.Release, error) {
+	req := rollbackRequest{revision: revision, done: make(chan rollbackResult, 1)}
+	select {
+	case inst.rollbacks <- req:
+	default:
+		return nil, errors.New("a rollback is already in progress")
+	}
+	requestSync(inst.syncRequests)
+
+	select {
+	case result := <-req.done:
+		return result.release, result.err
+	case <-time.After(rollbackTimeout):
+		return nil, errors.New("timed out waiting for the rollback, it will still be applied")
+	}
+}
+
+// rollback applies the configuration of revision kept in the history of the
+// instance again, with the auxiliary files synced with it. The configuration
+// is rendered and validated like any update, and recorded as a new release.
+func rollback(ctx context.Context, inst *instance, validator *haproxy.Validator, detector *drift.Detector, revision string) (*history.Release, error) {
+	if inst.dryRun() {
+		return nil, errors.New("dry-run mode is enabled, rollbacks aren't applied")
+	}
+	release, err := inst.history.Find(revision)
+	if err != nil {
+		return nil, err
+	}
+	inst.log.Infof("Rolling back to revision %s (release #%d)", release.Revision, release.ID)
+
+	configPath := inst.history.ObjectPath(release.Config)
+	candidate, err := inst.renderer.render(configPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to render configuration: %w", err)
+	}
+	synced := make([]files.File, 0, len(release.Files))
+	for target, hash := range release.Files {
+		synced = append(synced, files.File{Source: inst.history.ObjectPath(hash), Target: target, TargetRoot: target})
+	}
+	sort.Slice(synced, func(i, j int) bool { return synced[i].Target < synced[j].Target })
+
+	diags, err := validateCandidate(ctx, inst, candidate.path, synced, validator)
+	if ctx.Err() != nil {
+		return nil, fmt.Errorf("rollback interrupted: %w", ctx.Err())
+	}
+	inst.state.setValidation(release.Revision, diags, err)
+	if err != nil {
+		return nil, fmt.Errorf("configuration of %s is invalid: %w", release.Revision, err)
+	}
+
+	if err := deployFiles(inst, candidate.path, synced); err != nil {
+		inst.state.setError(fmt.Errorf("rollback failed: %w", err))
+		return nil, fmt.Errorf("failed to deploy configuration of %s: %w", release.Revision, err)
+	}
+	recordDesiredState(inst, detector, candidate.path, synced)
+	inst.renderer.setApplied(candidate, synced)
+
+	if err := reloadHAProxy(inst); err != nil {
+		inst.state.setError(fmt.Errorf("reload failed: %w", err))
+		return nil, fmt.Errorf("failed to reload HAProxy: %w", err)
+	}
+	metrics.HaproxyReloadCounter.WithLabelValues(inst.name).Inc()
+	inst.log.Infof("Rolled back to revision %s and reloaded HAProxy", release.Revision)
+	inst.state.setApplied(release.Revision)
+	if from := inst.source.Revision(); from != release.Revision {
+		setRolledBack(inst, from)
+	} else {
+		setRolledBack(inst, "")
+	}
+
+	return recordRelease(inst, release.Revision, "rollback", configPath, synced), nil
+}
+
+// rolledBackFile keeps the revision of the source the last rollback
+// replaced in the state directory of an instance.
+const rolledBackFile = "rolled-back"
+
+// readRolledBack returns the revision of the source the last rollback
+// recorded in stateDir replaced, if any.
+func readRolledBack(stateDir string) string {
+	data, err := os.ReadFile(filepath.Join(stateDir, rolledBackFile))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(data))
+}
+
+// setRolledBack records that revision of the source was rolled back, so it
+// isn't applied again, even after a restart, until the source moves past it.
+// An empty revision forgets the rollback.
+func setRolledBack(inst *instance, revision string) {
+	inst.rolledBackFrom = revision
+	path := filepath.Join(inst.config.StateDir, rolledBackFile)
+	var err error
+	if revision == "" {
+		if err = os.Remove(path); os.IsNotExist(err) {
+			err = nil
+		}
+	} else if err = os.MkdirAll(inst.config.StateDir, 0750); err == nil {
+		err = files.WriteAtomic(path, []byte(revision+"\n"))
+	}
+	if err != nil {
+		inst.log.Errorf("Failed to record the rolled back revision: %v", err)
+	}
+}
+
+// rolledBack reports whether the revision of the source is the one the last
+// rollback replaced. The rollback is forgotten once the source moves past it.
+func rolledBack(inst *instance) bool {
+	if inst.rolledBackFrom == "" {
+		return false
+	}
+	if inst.source.Revision() == inst.rolledBackFrom {
+		return true
+	}
+	inst.log.Infof("Source moved past rolled back revision %s", inst.rolledBackFrom)
+	setRolledBack(inst, "")
+	return false
+}
+
+// recordRelease adds the configuration at configPath, as fetched from the
+// source, and the synced files to the history of the instance.
+func recordRelease(inst *instance, revision, reason, configPath string, synced []files.File) *history.Release {
+	sources := make(map[string]string, len(synced))
+	for _, f := range synced {
+		sources[f.Target] = f.Source
+	}
+	release, err := inst.history.Record(revision, reason, configPath, sources)
+	if err != nil {
+		inst.log.Errorf("Failed to record release in history: %v", err)
+		return nil
+	}
+	return &release
+}
+
+// isLoopback reports whether the TCP address only listens on the loopback
+// interface.
+func isLoopback(address string) bool {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	_ = encoder.Encode(v)
+}
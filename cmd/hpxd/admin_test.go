@@ -0,0 +1,277 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/zcubbs/hpxd/pkg/drift"
+	"github.com/zcubbs/hpxd/pkg/haproxy"
+	"github.com/zcubbs/hpxd/pkg/httpserver"
+	"github.com/zcubbs/hpxd/pkg/local"
+)
+
+func newTestInstances(t *testing.T, names ...string) []*instance {
+	t.Helper()
+	instances := make([]*instance, 0, len(names))
+	for _, name := range names {
+		config := &Configuration{StateDir: t.TempDir(), HistoryLimit: defaultHistoryLimit}
+		instances = append(instances, newInstance(name, config, len(names) > 1))
+	}
+	return instances
+}
+
+func adminRequest(t *testing.T, handler http.Handler, method, target, token string) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequest(method, target, nil)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestAdminAPI_Roles(t *testing.T) {
+	config := &Configuration{Server: httpserver.Config{Auth: []httpserver.Credential{
+		{Token: "reader", Role: httpserver.RoleRead},
+		{Token: "admin", Role: httpserver.RoleAdmin},
+	}}}
+	handler := newAdminHandler(config, newTestInstances(t, defaultInstanceName))
+
+	tests := []struct {
+		method, path, token string
+		status              int
+	}{
+		{http.MethodGet, "/status", "", http.StatusUnauthorized},
+		{http.MethodGet, "/status", "reader", http.StatusOK},
+		{http.MethodGet, "/history", "reader", http.StatusOK},
+		{http.MethodGet, "/status", "admin", http.StatusOK},
+		{http.MethodPost, "/sync", "reader", http.StatusForbidden},
+		{http.MethodPost, "/pause", "reader", http.StatusForbidden},
+		{http.MethodPost, "/rollback?to=abc", "reader", http.StatusForbidden},
+		{http.MethodPost, "/approve", "reader", http.StatusForbidden},
+		{http.MethodPost, "/sync", "admin", http.StatusOK},
+		{http.MethodGet, "/sync", "admin", http.StatusMethodNotAllowed},
+	}
+	for _, tt := range tests {
+		if rec := adminRequest(t, handler, tt.method, tt.path, tt.token); rec.Code != tt.status {
+			t.Errorf("%s %s with token %q: expected status %d, but got %d", tt.method, tt.path, tt.token, tt.status, rec.Code)
+		}
+	}
+}
+
+func TestAdminAPI_PauseResume(t *testing.T) {
+	instances := newTestInstances(t, defaultInstanceName)
+	inst := instances[0]
+	handler := newAdminHandler(&Configuration{}, instances)
+
+	if rec := adminRequest(t, handler, http.MethodPost, "/pause", ""); rec.Code != http.StatusOK || !inst.paused() {
+		t.Fatalf("Expected the instance to be paused, but got status %d: %s", rec.Code, rec.Body)
+	}
+	var reports map[string]statusReport
+	rec := adminRequest(t, handler, http.MethodGet, "/status", "")
+	if err := json.Unmarshal(rec.Body.Bytes(), &reports); err != nil || !reports[inst.name].Paused {
+		t.Errorf("Expected the status to report the pause, but got: %s, %v", rec.Body, err)
+	}
+
+	if rec := adminRequest(t, handler, http.MethodPost, "/resume", ""); rec.Code != http.StatusOK || inst.paused() {
+		t.Fatalf("Expected the instance to be resumed, but got status %d: %s", rec.Code, rec.Body)
+	}
+	select {
+	case <-inst.syncRequests:
+	default:
+		t.Errorf("Expected resuming to request a sync")
+	}
+}
+
+func TestAdminAPI_Status(t *testing.T) {
+	instances := newTestInstances(t, defaultInstanceName)
+	handler := newAdminHandler(&Configuration{}, instances)
+
+	body := adminRequest(t, handler, http.MethodGet, "/status", "").Body.String()
+	for _, field := range []string{"appliedAt", "lastSync", "lastErrorAt"} {
+		if strings.Contains(body, field) {
+			t.Errorf("Expected %s to be omitted before it's set, but got: %s", field, body)
+		}
+	}
+
+	instances[0].state.setApplied("abc")
+	var reports map[string]statusReport
+	rec := adminRequest(t, handler, http.MethodGet, "/status", "")
+	if err := json.Unmarshal(rec.Body.Bytes(), &reports); err != nil {
+		t.Fatal(err)
+	}
+	if r := reports[defaultInstanceName]; r.Revision != "abc" || r.AppliedAt == nil {
+		t.Errorf("Expected the applied revision, but got: %s", rec.Body)
+	}
+}
+
+func TestAdminAPI_InstanceSelection(t *testing.T) {
+	instances := newTestInstances(t, "edge", "internal")
+	handler := newAdminHandler(&Configuration{}, instances)
+
+	if rec := adminRequest(t, handler, http.MethodPost, "/pause?instance=edge", ""); rec.Code != http.StatusOK {
+		t.Fatalf("Expected the pause to succeed, but got status %d: %s", rec.Code, rec.Body)
+	}
+	if !instances[0].paused() || instances[1].paused() {
+		t.Errorf("Expected only the selected instance to be paused")
+	}
+
+	var reports map[string]statusReport
+	rec := adminRequest(t, handler, http.MethodGet, "/status", "")
+	if err := json.Unmarshal(rec.Body.Bytes(), &reports); err != nil || len(reports) != 2 {
+		t.Errorf("Expected the status of every instance, but got: %s, %v", rec.Body, err)
+	}
+
+	if rec := adminRequest(t, handler, http.MethodGet, "/status?instance=unknown", ""); rec.Code != http.StatusNotFound {
+		t.Errorf("Expected an unknown instance to be rejected, but got status %d", rec.Code)
+	}
+	for _, path := range []string{"/rollback?to=abc", "/approve"} {
+		if rec := adminRequest(t, handler, http.MethodPost, path, ""); rec.Code != http.StatusBadRequest {
+			t.Errorf("Expected %s to require an instance, but got status %d", path, rec.Code)
+		}
+	}
+}
+
+func TestAdminAPI_RollbackTimeout(t *testing.T) {
+	timeout := rollbackTimeout
+	rollbackTimeout = 10 * time.Millisecond
+	defer func() { rollbackTimeout = timeout }()
+
+	handler := newAdminHandler(&Configuration{}, newTestInstances(t, defaultInstanceName))
+
+	// Nothing runs the update loop, so the rollback is never applied
+	rec := adminRequest(t, handler, http.MethodPost, "/rollback?to=abc", "")
+	if rec.Code != http.StatusConflict || !strings.Contains(rec.Body.String(), "timed out") {
+		t.Errorf("Expected the rollback to time out, but got status %d: %s", rec.Code, rec.Body)
+	}
+	rec = adminRequest(t, handler, http.MethodPost, "/rollback?to=abc", "")
+	if rec.Code != http.StatusConflict || !strings.Contains(rec.Body.String(), "already in progress") {
+		t.Errorf("Expected the pending rollback to block another one, but got status %d: %s", rec.Code, rec.Body)
+	}
+}
+
+func TestRollback_DeployFailure(t *testing.T) {
+	dir := t.TempDir()
+	inst := newTestInstances(t, defaultInstanceName)[0]
+	inst.config.HaproxyConfigPath = filepath.Join(dir, "haproxy.cfg")
+	inst.config.VersionCheck = versionCheckOff
+	inst.renderer = newRenderer(nil, nil, inst.config)
+
+	binary := filepath.Join(dir, "haproxy")
+	if err := os.WriteFile(binary, []byte("#!/bin/sh\nexit 0\n"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	for path, content := range map[string]string{
+		inst.config.HaproxyConfigPath:     "live\n",
+		filepath.Join(dir, "release.cfg"): "release\n",
+		filepath.Join(dir, "hosts.map"):   "a b\n",
+		filepath.Join(dir, "blocked"):     "not a directory\n",
+	} {
+		if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The map can't be written, as its directory is a file
+	target := filepath.Join(dir, "blocked", "hosts.map")
+	if _, err := inst.history.Record("abc", "update", filepath.Join(dir, "release.cfg"),
+		map[string]string{target: filepath.Join(dir, "hosts.map")}); err != nil {
+		t.Fatal(err)
+	}
+
+	detector := drift.NewDetector(filepath.Join(inst.config.StateDir, "drift"))
+	_, err := rollback(context.Background(), inst, haproxy.NewValidator(binary), detector, "abc")
+	if err == nil || !strings.Contains(err.Error(), "failed to deploy") {
+		t.Fatalf("Expected the rollback to fail to deploy, but got: %v", err)
+	}
+	if content, _ := os.ReadFile(inst.config.HaproxyConfigPath); string(content) != "live\n" {
+		t.Errorf("Expected the live configuration to be left alone, but got: %q", content)
+	}
+	if releases, _ := inst.history.List(); len(releases) != 1 {
+		t.Errorf("Expected the failed rollback not to be recorded, but got: %v", releases)
+	}
+}
+
+func TestRollback_Restart(t *testing.T) {
+	dir, bin, repo := t.TempDir(), t.TempDir(), t.TempDir()
+	writeScript(t, filepath.Join(bin, "sudo"), "exit 0\n")
+	writeScript(t, filepath.Join(bin, "haproxy"), "exit 0\n")
+	t.Setenv("PATH", bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	config := &Configuration{
+		StateDir:          filepath.Join(dir, "state"),
+		HistoryLimit:      defaultHistoryLimit,
+		HaproxyConfigPath: filepath.Join(dir, "haproxy.cfg"),
+		HaproxyBinary:     filepath.Join(bin, "haproxy"),
+		VersionCheck:      versionCheckOff,
+		PollingInterval:   10 * time.Millisecond,
+		Drift:             DriftConfig{Mode: driftModeOff},
+	}
+	writeSource := func(content string) {
+		t.Helper()
+		if err := os.WriteFile(filepath.Join(repo, "haproxy.cfg"), []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// start creates the instance as the daemon does, and runs its loop
+	// until it has polled the source a few times
+	start := func() *instance {
+		t.Helper()
+		inst := newInstance(defaultInstanceName, config, false)
+		handler, err := local.NewHandler(repo, "haproxy.cfg", time.Millisecond)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { _ = handler.Close() })
+		inst.source = handler
+		inst.renderer = newRenderer(nil, nil, config)
+		inst.haproxyHandler = haproxy.NewHandlerForUnit(config.HaproxyConfigPath, "")
+
+		ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+		defer cancel()
+		update(ctx, inst)
+		return inst
+	}
+	live := func() string {
+		content, _ := os.ReadFile(config.HaproxyConfigPath)
+		return string(content)
+	}
+
+	writeSource("good\n")
+	good := start().source.Revision()
+	writeSource("bad\n")
+	inst := start()
+	if live() != "bad\n" {
+		t.Fatalf("Expected both revisions to be applied, but got: %q", live())
+	}
+
+	detector := drift.NewDetector(filepath.Join(config.StateDir, "drift"))
+	if _, err := rollback(context.Background(), inst, haproxy.NewValidator(config.HaproxyBinary), detector, good); err != nil {
+		t.Fatalf("Failed to roll back: %v", err)
+	}
+	if live() != "good\n" {
+		t.Fatalf("Expected the rollback to be deployed, but got: %q", live())
+	}
+
+	// The source still holds the rolled back revision after a restart
+	start()
+	if live() != "good\n" {
+		t.Errorf("Expected the rollback to survive a restart, but got: %q", live())
+	}
+
+	writeSource("fixed\n")
+	start()
+	if live() != "fixed\n" {
+		t.Errorf("Expected the next revision to be applied, but got: %q", live())
+	}
+	if _, err := os.Stat(filepath.Join(config.StateDir, rolledBackFile)); !os.IsNotExist(err) {
+		t.Errorf("Expected the rollback to be forgotten, but got: %v", err)
+	}
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/zcubbs/hpxd/pkg/history"
+)
+
+// adminClient talks to the admin API of a running daemon.
+type adminClient struct {
+	baseURL  string
+	client   *http.Client
+	token    string
+	username string
+	password string
+}
+
+// adminFlags registers the flags locating the admin API and its
+// credentials, and returns a function creating the client once they're
+// parsed.
+//
+// The address and TLS settings default to the ones of the configuration,
+// when it can be read. The token defaults to `HPXD_ADMIN_TOKEN`.
+func adminFlags(fs *flag.FlagSet) func() *adminClient {
+	configPath := configFlag(fs)
+	address := fs.String("admin", "", "Address of the admin API, or unix:<path> for a unix socket (default from the configuration)")
+	token := fs.String("token", os.Getenv("HPXD_ADMIN_TOKEN"), "Bearer token")
+	user := fs.String("user", "", "Basic auth credentials, as `username:password`")
+	useTLS := fs.Bool("tls", false, "Connect with TLS (default when the configuration enables it)")
+	caFile := fs.String("cacert", "", "CA certificates to verify the daemon with (default: the system CAs and the configured certificate)")
+	certFile := fs.String("cert", "", "Client certificate, for mutual TLS")
+	keyFile := fs.String("key", "", "Key of the client certificate")
+
+	return func() *adminClient {
+		logrus.SetOutput(os.Stderr)
+
+		var serverCert string
+		if config, err := loadConfig(*configPath); err == nil {
+			if *address == "" {
+				*address = config.Admin.Address
+			}
+			if config.Server.TLS.Enabled() {
+				*useTLS, serverCert = true, config.Server.TLS.CertFile
+			}
+		} else {
+			logrus.Debugf("Not reading the admin API settings from the configuration: %v", err)
+		}
+		if *address == "" {
+			*address = defaultAdminAddress
+		}
+
+		c, err := newAdminClient(*address, *useTLS, []string{*caFile, serverCert}, *certFile, *keyFile)
+		if err != nil {
+			logrus.Fatal(err)
+		}
+		c.token = *token
+		if *user != "" {
+			c.username, c.password, _ = strings.Cut(*user, ":")
+		}
+		return c
+	}
+}
+
+// newAdminClient returns a client of the admin API listening on address.
+// With TLS, the daemon is verified against the system CAs and the
+// certificates of caFiles, and the client certificate, if any, is presented.
+func newAdminClient(address string, useTLS bool, caFiles []string, certFile, keyFile string) (*adminClient, error) {
+	transport := &http.Transport{}
+	host := address
+	if strings.HasPrefix(address, "unix:") {
+		path := strings.TrimPrefix(strings.TrimPrefix(address, "unix:"), "//")
+		transport.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", path)
+		}
+		host = "localhost"
+	} else if strings.HasPrefix(address, ":") {
+		host = "localhost" + address
+	}
+
+	scheme := "http"
+	if useTLS {
+		scheme = "https"
+		roots, err := x509.SystemCertPool()
+		if err != nil {
+			roots = x509.NewCertPool()
+		}
+		for _, file := range caFiles {
+			if file == "" {
+				continue
+			}
+			pem, err := os.ReadFile(filepath.Clean(file))
+			if err != nil {
+				return nil, err
+			}
+			roots.AppendCertsFromPEM(pem)
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: roots, MinVersion: tls.VersionTLS12}
+		if certFile != "" {
+			cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+			if err != nil {
+				return nil, fmt.Errorf("failed to load client certificate: %w", err)
+			}
+			transport.TLSClientConfig.Certificates = []tls.Certificate{cert}
+		}
+	}
+
+	return &adminClient{
+		baseURL: scheme + "://" + host,
+		// Rollbacks wait for the daemon to apply them
+		client: &http.Client{Transport: transport, Timeout: rollbackTimeout + 10*time.Second},
+	}, nil
+}
+
+// do sends a request to the admin API and decodes its response into out.
+func (c *adminClient) do(method, path string, query url.Values, out interface{}) error {
+	req, err := http.NewRequest(method, c.baseURL+path+"?"+query.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	} else if c.username != "" {
+		req.SetBasicAuth(c.username, c.password)
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to reach the admin API: %w", err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 16<<20))
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		var apiErr struct {
+			Error string `json:"error"`
+		}
+		if json.Unmarshal(body, &apiErr) == nil && apiErr.Error != "" {
+			return errors.New(apiErr.Error)
+		}
+		return fmt.Errorf("admin API answered %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	return json.Unmarshal(body, out)
+}
+
+// instanceQuery selects an instance, or all of them when name is empty.
+func instanceQuery(name string) url.Values {
+	query := url.Values{}
+	if name != "" {
+		query.Set("instance", name)
+	}
+	return query
+}
+
+// runStatus prints the state of every instance of a running daemon.
+func runStatus(args []string) {
+	fs := newFlagSet("status")
+	client, name := adminFlags(fs), instanceFlag(fs)
+	asJSON := fs.Bool("json", false, "Print the raw JSON status")
+	_ = fs.Parse(args)
+
+	var reports map[string]statusReport
+	if err := client().do(http.MethodGet, "/status", instanceQuery(*name), &reports); err != nil {
+		logrus.Fatal(err)
+	}
+	if *asJSON {
+		printJSON(reports)
+		return
+	}
+
+	for _, n := range sortedKeys(reports) {
+		r := reports[n]
+		fmt.Printf("%s:\n", n)
+		fmt.Printf("  revision:   %s\n", orNone(r.Revision))
+		if r.AppliedAt != nil {
+			fmt.Printf("  applied:    %s\n", r.AppliedAt.Format(time.RFC3339))
+		}
+		if r.LastSync != nil {
+			fmt.Printf("  last sync:  %s\n", r.LastSync.Format(time.RFC3339))
+		}
+		if v := r.Validation; v != nil {
+			result := "valid"
+			if !v.Valid {
+				result = "invalid: " + v.Error
+			}
+			fmt.Printf("  validation: %s is %s\n", v.Revision, result)
+		}
+		if r.Held != "" {
+			fmt.Printf("  held:       %s\n", r.Held)
+		}
+		fmt.Printf("  paused:     %t\n", r.Paused)
+		fmt.Printf("  dry run:    %t\n", r.DryRun)
+		if o := r.Override; o != nil {
+			fmt.Printf("  override:   until %s: %s\n", o.Until.Format(time.RFC3339), o.Reason)
+		}
+		if d := r.DryRunResult; d != nil {
+			changes := "no changes"
+			if len(d.Changes) > 0 {
+				changes = "would change " + strings.Join(d.Changes, ", ")
+			}
+			fmt.Printf("  evaluated:  %s %s\n", d.Revision, changes)
+			for _, v := range d.Guard {
+				fmt.Printf("              would be held: %s\n", v)
+			}
+		}
+		if r.LastError != "" && r.LastErrorAt != nil {
+			fmt.Printf("  last error: %s (%s)\n", r.LastError, r.LastErrorAt.Format(time.RFC3339))
+		}
+	}
+}
+
+// runHistory prints the configurations applied by every instance of a
+// running daemon.
+func runHistory(args []string) {
+	fs := newFlagSet("history")
+	client, name := adminFlags(fs), instanceFlag(fs)
+	asJSON := fs.Bool("json", false, "Print the raw JSON history")
+	_ = fs.Parse(args)
+
+	var releases map[string][]history.Release
+	if err := client().do(http.MethodGet, "/history", instanceQuery(*name), &releases); err != nil {
+		logrus.Fatal(err)
+	}
+	if *asJSON {
+		printJSON(releases)
+		return
+	}
+
+	for _, n := range sortedKeys(releases) {
+		fmt.Printf("%s:\n", n)
+		for _, r := range releases[n] {
+			fmt.Printf("  #%-4d %-12.12s  %s  %s\n", r.ID, r.Revision, r.AppliedAt.Format(time.RFC3339), r.Reason)
+		}
+	}
+}
+
+// runRollback rolls a running daemon back to a configuration of its
+// history, and waits for it to be applied.
+func runRollback(args []string) {
+	fs := newFlagSet("rollback")
+	client, name := adminFlags(fs), instanceFlag(fs)
+	_ = fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	query := instanceQuery(*name)
+	query.Set("to", fs.Arg(0))
+	var release *history.Release
+	if err := client().do(http.MethodPost, "/rollback", query, &release); err != nil {
+		logrus.Fatalf("Rollback failed: %v", err)
+	}
+	if release == nil {
+		fmt.Printf("Rolled back to %s\n", fs.Arg(0))
+		return
+	}
+	fmt.Printf("Rolled back to revision %s, recorded as release #%d\n", release.Revision, release.ID)
+}
+
+func printJSON(v interface{}) {
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(v); err != nil {
+		logrus.Fatal(err)
+	}
+}
+
+func sortedKeys[T any](m map[string]T) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func orNone(s string) string {
+	if s == "" {
+		return "none"
+	}
+	return s
+}
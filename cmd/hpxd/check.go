@@ -0,0 +1,300 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/zcubbs/hpxd/pkg/checkreport"
+	"github.com/zcubbs/hpxd/pkg/cmd"
+	"github.com/zcubbs/hpxd/pkg/discovery"
+	"github.com/zcubbs/hpxd/pkg/files"
+	"github.com/zcubbs/hpxd/pkg/guard"
+	"github.com/zcubbs/hpxd/pkg/haproxy"
+	"github.com/zcubbs/hpxd/pkg/hostpath"
+)
+
+// checker runs the checks of a node on a checkout of the configuration
+// repository, collecting their results.
+type checker struct {
+	inst     *instance
+	repo     string
+	previous string
+	target   string
+	report   checkreport.Report
+
+	// path is the configuration selected for the node, relative to repo
+	path   string
+	synced []files.File
+}
+
+// runCheck runs the checks hpxd runs on a node, on a checkout of the
+// configuration repository instead of a fetched revision, and reports their
+// results. It exits with status 1 when a check fails or can't run.
+//
+// The node is described by `-host` and its labels, so the configuration is
+// selected as the node would select it. The blast-radius guard compares the
+// configuration with its `-previous` revision instead of the live one.
+func runCheck(args []string) {
+	fs := newFlagSet("check")
+	configPath, name := configFlag(fs), instanceFlag(fs)
+	repo := fs.String("repo", ".", "Checkout of the configuration repository")
+	host := fs.String("host", "", "Hostname of the node to check for (default: the hostname of the configuration, or of this host)")
+	labels := fs.String("labels", "", "Labels of the node, as comma-separated key=value pairs")
+	labelsFile := fs.String("labels-file", "", "File holding the labels of the node (default: hostLabelsFile)")
+	previous := fs.String("previous", "HEAD~1", "Revision the blast-radius guard compares the configuration with")
+	format := fs.String("format", checkreport.FormatText, "Report format: text, json, junit or sarif")
+	output := fs.String("output", "", "File to write the report to (default: stdout)")
+	_ = fs.Parse(args)
+
+	inst := loadInstance(*configPath, *name)
+	// Diagnostics are part of the report
+	quiet := logrus.New()
+	quiet.SetOutput(io.Discard)
+	inst.log = logrus.NewEntry(quiet)
+	inst.config.VersionCheck = versionCheckOff
+	if *host != "" {
+		inst.config.Hostname = *host
+	}
+	if *labelsFile != "" {
+		inst.config.HostLabelsFile = *labelsFile
+	}
+
+	c := &checker{
+		inst:     inst,
+		repo:     *repo,
+		previous: *previous,
+		report:   checkreport.Report{Version: Version},
+	}
+	c.run(*labels)
+
+	w := os.Stdout
+	if *output != "" {
+		f, err := os.Create(filepath.Clean(*output))
+		if err != nil {
+			logrus.Fatal(err)
+		}
+		defer func() { _ = f.Close() }()
+		w = f
+	}
+	if err := checkreport.Write(w, *format, c.report); err != nil {
+		logrus.Fatal(err)
+	}
+	if c.report.Failed() {
+		if w != os.Stdout {
+			_ = w.Close()
+		}
+		os.Exit(1)
+	}
+}
+
+// run runs every check. Checks needing the configuration are skipped when
+// none could be selected.
+func (c *checker) run(labels string) {
+	c.check("select", "Selection of the configuration of the node", func() (string, []checkreport.Finding, error) {
+		return c.selectConfig(labels)
+	})
+	if c.path == "" {
+		return
+	}
+	c.check("template", "Server pool markers of the configuration", c.checkTemplate)
+	c.check("files", "Auxiliary files synced with the configuration", c.checkFiles)
+	c.check("guard", "Blast-radius thresholds against the previous revision", c.checkGuard)
+	c.check("haproxy", "Validation with haproxy -c, with the auxiliary files", c.checkHAProxy)
+}
+
+// errSkipped is returned by checks that don't apply.
+type errSkipped struct{ reason string }
+
+func (e errSkipped) Error() string { return e.reason }
+
+// check runs a check and records its result. A check fails when it returns
+// findings of error severity, and errors when it returns an error.
+func (c *checker) check(name, description string, run func() (string, []checkreport.Finding, error)) {
+	start := time.Now()
+	message, findings, err := run()
+	result := checkreport.Result{
+		Check:       name,
+		Description: description,
+		Target:      c.target,
+		Status:      checkreport.StatusPass,
+		Message:     message,
+		Findings:    findings,
+	}
+	for _, f := range findings {
+		if f.Severity == checkreport.SeverityError {
+			result.Status = checkreport.StatusFail
+		}
+	}
+	if skipped, ok := err.(errSkipped); ok {
+		result.Status, result.Message = checkreport.StatusSkipped, skipped.reason
+	} else if err != nil {
+		result.Status, result.Message = checkreport.StatusError, err.Error()
+	}
+	result.Duration = time.Since(start)
+	c.report.Results = append(c.report.Results, result)
+}
+
+// selectConfig selects the configuration of the node with its facts, as
+// the node does.
+func (c *checker) selectConfig(labels string) (string, []checkreport.Finding, error) {
+	config := c.inst.config
+	facts, err := hostpath.LoadFacts(config.Hostname, config.HostLabelsFile)
+	if err != nil {
+		return "", nil, err
+	}
+	c.target = facts.Hostname
+	for _, pair := range strings.Split(labels, ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		key, value, ok := strings.Cut(pair, "=")
+		if !ok {
+			return "", nil, fmt.Errorf("invalid label %s, expected key=value", pair)
+		}
+		facts.Labels[strings.ToLower(strings.TrimSpace(key))] = strings.TrimSpace(value)
+	}
+
+	selector, err := hostpath.NewSelector(config.PathRules, config.Path, facts)
+	if err != nil {
+		return "", nil, err
+	}
+	path, err := selector.Select(c.repo)
+	if err != nil {
+		return "", []checkreport.Finding{{Severity: checkreport.SeverityError, Message: err.Error()}}, nil
+	}
+	c.path = path
+	return "selected " + path, nil, nil
+}
+
+// checkTemplate checks that the pool markers of the configuration refer to
+// configured pools, in backends. Pools are rendered empty, as they're
+// resolved on the node.
+func (c *checker) checkTemplate() (string, []checkreport.Finding, error) {
+	if len(c.inst.config.Pools) == 0 {
+		return "", nil, errSkipped{"no server pools configured"}
+	}
+	content, err := os.ReadFile(filepath.Join(c.repo, c.path))
+	if err != nil {
+		return "", nil, err
+	}
+	pools := make(map[string][]discovery.Server, len(c.inst.config.Pools))
+	for _, p := range c.inst.config.Pools {
+		pools[p.Name] = nil
+	}
+
+	_, usages, err := discovery.Render(content, pools)
+	if err != nil {
+		return "", []checkreport.Finding{c.finding(checkreport.SeverityError, err.Error())}, nil
+	}
+	return fmt.Sprintf("%d pool marker(s)", len(usages)), nil, nil
+}
+
+// checkFiles resolves the auxiliary files synced with the configuration.
+func (c *checker) checkFiles() (string, []checkreport.Finding, error) {
+	if len(c.inst.config.SyncFiles) == 0 {
+		return "", nil, errSkipped{"no syncFiles configured"}
+	}
+	synced, err := files.Resolve(c.repo, c.inst.config.SyncFiles)
+	if err != nil {
+		return "", []checkreport.Finding{{Severity: checkreport.SeverityError, Message: err.Error()}}, nil
+	}
+	c.synced = synced
+	return fmt.Sprintf("%d file(s)", len(synced)), nil, nil
+}
+
+// checkGuard runs the blast-radius guard between the configuration of the
+// previous revision and the one of the checkout.
+func (c *checker) checkGuard() (string, []checkreport.Finding, error) {
+	thresholds := c.inst.config.Guard
+	if !thresholds.Enabled() {
+		return "", nil, errSkipped{"no blast-radius thresholds configured"}
+	}
+	before, err := cmd.RunCmdOutput("git", "-C", c.repo, "show", c.previous+":"+filepath.ToSlash(c.path))
+	if err != nil {
+		return "", nil, errSkipped{fmt.Sprintf("%s doesn't exist at %s", c.path, c.previous)}
+	}
+	live, err := haproxy.ParseConfig(bytes.NewReader(before))
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to parse %s at %s: %w", c.path, c.previous, err)
+	}
+	desired, err := haproxy.ParseConfigFile(filepath.Join(c.repo, c.path))
+	if err != nil {
+		return "", nil, err
+	}
+
+	var findings []checkreport.Finding
+	for _, v := range guard.Check(live, desired, thresholds) {
+		findings = append(findings, c.finding(checkreport.SeverityError, v.Message))
+	}
+	if len(findings) > 0 {
+		return "the update would be held pending approval", findings, nil
+	}
+	return "compared with " + c.previous, nil, nil
+}
+
+// checkHAProxy validates the configuration with the auxiliary files, as
+// the node does before applying it.
+func (c *checker) checkHAProxy() (string, []checkreport.Finding, error) {
+	binary := c.inst.config.HaproxyBinary
+	if _, err := exec.LookPath(binary); err != nil {
+		return "", nil, fmt.Errorf("haproxy binary not found: %w", err)
+	}
+	if c.synced == nil && len(c.inst.config.SyncFiles) > 0 {
+		return "", nil, errSkipped{"auxiliary files couldn't be resolved"}
+	}
+
+	diags, err := validateCandidate(context.Background(), c.inst, filepath.Join(c.repo, c.path), c.synced, haproxy.NewValidator(binary))
+	var findings []checkreport.Finding
+	alerts := 0
+	for _, d := range diags {
+		f := checkreport.Finding{Severity: checkreport.SeverityNote, File: c.relative(d.File), Line: d.Line, Message: d.Message}
+		switch d.Severity {
+		case haproxy.SeverityAlert:
+			f.Severity = checkreport.SeverityError
+			alerts++
+		case haproxy.SeverityWarning:
+			f.Severity = checkreport.SeverityWarning
+		}
+		findings = append(findings, f)
+	}
+	if err != nil {
+		if alerts == 0 {
+			// warningsAsErrors, or a failure without diagnostics
+			findings = append(findings, c.finding(checkreport.SeverityError, err.Error()))
+		}
+		return "configuration is invalid", findings, nil
+	}
+	return "configuration is valid", findings, nil
+}
+
+// finding returns a finding about the selected configuration.
+func (c *checker) finding(severity, message string) checkreport.Finding {
+	return checkreport.Finding{Severity: severity, File: filepath.ToSlash(c.path), Message: message}
+}
+
+// relative returns path relative to the repository when it's inside it.
+func (c *checker) relative(path string) string {
+	if path == "" {
+		return ""
+	}
+	root, err := filepath.Abs(c.repo)
+	if err != nil {
+		return path
+	}
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return path
+	}
+	if rel, err := filepath.Rel(root, abs); err == nil && !strings.HasPrefix(rel, "..") {
+		return filepath.ToSlash(rel)
+	}
+	return path
+}
@@ -0,0 +1,303 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	"github.com/zcubbs/hpxd/pkg/files"
+	"github.com/zcubbs/hpxd/pkg/guard"
+	"github.com/zcubbs/hpxd/pkg/haproxy"
+	"github.com/zcubbs/hpxd/pkg/textdiff"
+)
+
+const defaultConfigPath = "./configs"
+
+// command is a subcommand of hpxd.
+type command struct {
+	name    string
+	args    string
+	summary string
+	run     func(args []string)
+}
+
+func commands() []command {
+	return []command{
+		{"run", "[flags]", "Run the daemon (default)", runDaemon},
+		{"validate", "[flags] <file>", "Validate a configuration file offline", runValidate},
+		{"check", "[flags]", "Run the checks of a node on a checkout of the configuration repository", runCheck},
+		{"render", "[flags] [file]", "Print the configuration as it would be applied", runRender},
+		{"diff", "[flags]", "Compare the configuration of the source with the live one", runDiff},
+		{"status", "[flags]", "Show the state of a running daemon", runStatus},
+		{"history", "[flags]", "List the configurations applied by a running daemon", runHistory},
+		{"rollback", "[flags] <revision|#id>", "Roll a running daemon back to a configuration of its history", runRollback},
+		{"approve", "[flags]", "Approve the update held by the blast-radius guard", runApprove},
+		{"version", "", "Print the version", runVersion},
+	}
+}
+
+// main is the entry point of the hpxd application. It runs the command named
+// by the first argument, or the daemon when there is none, so that
+// `hpxd -config <dir>` keeps running the daemon.
+func main() {
+	name, args := "run", os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		name, args = args[0], args[1:]
+	}
+
+	for _, c := range commands() {
+		if c.name == name {
+			c.run(args)
+			return
+		}
+	}
+	if name == "help" {
+		usage(os.Stdout)
+		return
+	}
+	fmt.Fprintf(os.Stderr, "Unknown command %s\n\n", name)
+	usage(os.Stderr)
+	os.Exit(2)
+}
+
+func usage(w io.Writer) {
+	fmt.Fprintln(w, "Usage: hpxd <command> [flags]")
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "Commands:")
+	for _, c := range commands() {
+		fmt.Fprintf(w, "  %-10s %s\n", c.name, c.summary)
+	}
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "Run `hpxd <command> -h` for the flags of a command.")
+}
+
+// newFlagSet returns the flag set of the command called name.
+func newFlagSet(name string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	fs.Usage = func() {
+		for _, c := range commands() {
+			if c.name == name {
+				fmt.Fprintf(fs.Output(), "Usage: hpxd %s %s\n\n%s.\n\nFlags:\n", c.name, c.args, c.summary)
+			}
+		}
+		fs.PrintDefaults()
+	}
+	return fs
+}
+
+// configFlag registers the `-config` flag, and its `-c` shorthand.
+func configFlag(fs *flag.FlagSet) *string {
+	var path string
+	fs.StringVar(&path, "config", defaultConfigPath, "Path to the configuration file, or to the directory holding hpxd.yaml")
+	fs.StringVar(&path, "c", defaultConfigPath, "Shorthand for -config")
+	return &path
+}
+
+func instanceFlag(fs *flag.FlagSet) *string {
+	return fs.String("instance", "", "Instance to act on, when several are managed")
+}
+
+// loadInstance loads and validates the configuration, and returns the
+// instance called name. Logs go to stderr, so they don't mix with the
+// output of the command.
+func loadInstance(configPath, name string) *instance {
+	logrus.SetOutput(os.Stderr)
+	logrus.SetLevel(logrus.WarnLevel)
+
+	config, err := loadConfig(configPath)
+	if err != nil {
+		logrus.Fatal(err)
+	}
+	instances, err := loadInstances(config)
+	if err != nil {
+		logrus.Fatal(err)
+	}
+	if err := validateInstances(instances); err != nil {
+		logrus.Fatal(err)
+	}
+	inst, err := findInstance(instances, name)
+	if err != nil {
+		logrus.Fatal(err)
+	}
+	return inst
+}
+
+// runValidate runs the validation pipeline of the daemon on a configuration
+// file, with the auxiliary files synced with it resolved below `-root`.
+// Server pools and Kubernetes backends aren't rendered, and the version of
+// the running HAProxy isn't checked, so no network nor running HAProxy is
+// needed.
+func runValidate(args []string) {
+	fs := newFlagSet("validate")
+	configPath, name := configFlag(fs), instanceFlag(fs)
+	root := fs.String("root", ".", "Root of the configuration tree the sources of syncFiles are relative to")
+	_ = fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	file := fs.Arg(0)
+
+	inst := loadInstance(*configPath, *name)
+	inst.config.VersionCheck = versionCheckOff
+
+	synced, err := files.Resolve(*root, inst.config.SyncFiles)
+	if err != nil {
+		fmt.Printf("%s is invalid: %v\n", file, err)
+		os.Exit(1)
+	}
+	diags, err := validateCandidate(context.Background(), inst, file, synced, haproxy.NewValidator(inst.config.HaproxyBinary))
+	if err != nil {
+		fmt.Printf("%s is invalid: %v\n", file, err)
+		os.Exit(1)
+	}
+	fmt.Printf("%s is valid (%d warning(s))\n", file, len(haproxy.Filter(diags, haproxy.SeverityWarning)))
+}
+
+// runRender prints the configuration as the daemon would apply it: fetched
+// from the source, or read from file, and rendered with the server pools
+// and Kubernetes backends.
+func runRender(args []string) {
+	fs := newFlagSet("render")
+	configPath, name := configFlag(fs), instanceFlag(fs)
+	_ = fs.Parse(args)
+
+	inst := loadInstance(*configPath, *name)
+	candidate, _, _ := fetchCandidate(inst, fs.Arg(0))
+	defer removeStaging()
+	content, err := os.ReadFile(filepath.Clean(candidate))
+	if err != nil {
+		logrus.Fatal(err)
+	}
+	_, _ = os.Stdout.Write(content)
+}
+
+// runDiff prints the differences between the configuration of the source,
+// as it would be applied, and the live configuration and auxiliary files.
+// Like diff(1), it exits with status 1 when there are differences.
+func runDiff(args []string) {
+	fs := newFlagSet("diff")
+	configPath, name := configFlag(fs), instanceFlag(fs)
+	_ = fs.Parse(args)
+
+	inst := loadInstance(*configPath, *name)
+	candidate, synced, revision := fetchCandidate(inst, "")
+	defer removeStaging()
+
+	targets := map[string]string{inst.config.HaproxyConfigPath: candidate}
+	order := []string{inst.config.HaproxyConfigPath}
+	for _, f := range synced {
+		targets[f.Target] = f.Source
+		order = append(order, f.Target)
+	}
+
+	different := false
+	for _, target := range order {
+		live, err := os.ReadFile(filepath.Clean(target))
+		if err != nil && !os.IsNotExist(err) {
+			logrus.Fatal(err)
+		}
+		desired, err := os.ReadFile(filepath.Clean(targets[target]))
+		if err != nil {
+			logrus.Fatal(err)
+		}
+		if d := textdiff.Unified(target, target+" ("+revision+")", live, desired); d != "" {
+			fmt.Print(d)
+			different = true
+		}
+	}
+	if different {
+		removeStaging()
+		os.Exit(1)
+	}
+	fmt.Fprintf(os.Stderr, "Live configuration matches revision %s\n", revision)
+}
+
+// fetchCandidate renders the configuration at file, or fetched from the
+// source of the instance when file is empty, and returns the rendered
+// configuration, the auxiliary files synced with it and its revision.
+//
+// Everything is staged in a fresh directory, so the source is always fetched
+// as new, which removeStaging removes.
+func fetchCandidate(inst *instance, file string) (string, []files.File, string) {
+	root, err := os.MkdirTemp("", "hpxd-cli-")
+	if err != nil {
+		logrus.Fatalf("Failed to create staging directory: %v", err)
+	}
+	stagingRoot = root
+	logrus.RegisterExitHandler(removeStaging)
+	inst.open()
+	inst.renderer.dir = stagingDir(inst.name, "rendered")
+	refreshPools(inst)
+
+	configPath, revision := file, "local file"
+	var synced []files.File
+	if file == "" {
+		if configPath, _, err = inst.source.PullAndUpdate(context.Background()); err != nil {
+			logrus.Fatalf("Failed to fetch configuration: %v", err)
+		}
+		revision = inst.source.Revision()
+		if synced, err = files.Resolve(inst.source.RepoPath(), inst.config.SyncFiles); err != nil {
+			logrus.Fatal(err)
+		}
+	}
+
+	candidate, err := inst.renderer.render(configPath)
+	if err != nil {
+		logrus.Fatalf("Failed to render configuration: %v", err)
+	}
+	return candidate.path, synced, revision
+}
+
+// removeStaging removes the staging directory of fetchCandidate.
+func removeStaging() {
+	if stagingRoot != "" {
+		_ = os.RemoveAll(stagingRoot)
+	}
+}
+
+// runApprove approves the update held by the blast-radius guard of a
+// running daemon, through its admin API when `-admin` is given or the
+// configuration enables it. Otherwise, the approval is written to the state
+// directory of the configuration.
+func runApprove(args []string) {
+	fs := newFlagSet("approve")
+	client, name := adminFlags(fs), instanceFlag(fs)
+	id := fs.String("id", "", "Only approve the held update if its ID starts with this value")
+	_ = fs.Parse(args)
+
+	if fs.Lookup("admin").Value.String() == "" {
+		inst := loadInstance(fs.Lookup("config").Value.String(), *name)
+		if !inst.config.Admin.Enabled {
+			approveHeldUpdate(inst.config, *id)
+			return
+		}
+	}
+
+	query := instanceQuery(*name)
+	if *id != "" {
+		query.Set("id", *id)
+	}
+	var pending *guard.Pending
+	if err := client().do(http.MethodPost, "/approve", query, &pending); err != nil {
+		logrus.Fatalf("Approval failed: %v", err)
+	}
+	if pending == nil {
+		fmt.Println("Update approved, it will be applied on the next poll.")
+		return
+	}
+	for _, v := range pending.Violations {
+		fmt.Printf("- %s\n", v.Message)
+	}
+	fmt.Printf("Update %s approved, it will be applied on the next poll.\n", pending.ID)
+}
+
+func runVersion([]string) {
+	fmt.Printf("hpxd %s (%s) built on %s\n", Version, Commit, Date)
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+func TestRunRender_Twice(t *testing.T) {
+	t.Setenv("TMPDIR", t.TempDir())
+	dir := t.TempDir()
+	repo := filepath.Join(dir, "repo")
+	config := "global\n    daemon\n"
+	if err := os.MkdirAll(repo, 0750); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(repo, "haproxy.cfg"), []byte(config), 0600); err != nil {
+		t.Fatal(err)
+	}
+	for _, args := range [][]string{
+		{"init", "-q", "-b", "main"},
+		{"add", "haproxy.cfg"},
+		{"-c", "user.name=hpxd", "-c", "user.email=hpxd@example.com", "commit", "-q", "-m", "init"},
+	} {
+		if output, err := exec.Command("git", append([]string{"-C", repo}, args...)...).CombinedOutput(); err != nil {
+			t.Fatalf("git %v failed: %v: %s", args, err, output)
+		}
+	}
+
+	configPath := filepath.Join(dir, "hpxd.yaml")
+	settings := "repoURL: " + repo + "\nbranch: main\npath: haproxy.cfg\n" +
+		"haproxyConfigPath: " + filepath.Join(dir, "live.cfg") + "\nstateDir: " + filepath.Join(dir, "state") + "\n"
+	if err := os.WriteFile(configPath, []byte(settings), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	stdout := os.Stdout
+	defer func() { os.Stdout = stdout }()
+	for i := 0; i < 2; i++ {
+		output := filepath.Join(dir, "rendered.cfg")
+		f, err := os.Create(output)
+		if err != nil {
+			t.Fatal(err)
+		}
+		os.Stdout = f
+		runRender([]string{"-config", configPath})
+		os.Stdout = stdout
+		_ = f.Close()
+
+		content, err := os.ReadFile(output)
+		if err != nil || string(content) != config {
+			t.Errorf("Expected run %d to render the configuration, but got: %q, %v", i+1, content, err)
+		}
+	}
+
+	if entries, err := os.ReadDir(os.TempDir()); err != nil || len(entries) != 0 {
+		t.Errorf("Expected the staging directories to be removed, but got: %v, %v", entries, err)
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/zcubbs/hpxd/pkg/commitstatus"
+	"github.com/zcubbs/hpxd/pkg/git"
+	"github.com/zcubbs/hpxd/pkg/haproxy"
+	"github.com/zcubbs/hpxd/pkg/source"
+)
+
+// commitStatusConfig returns the `commitStatus` settings, with the
+// repository defaulting to the one of `repoURL`.
+func commitStatusConfig(config *Configuration) commitstatus.Config {
+	c := config.CommitStatus
+	if c.Repository == "" {
+		c.Repository = commitstatus.RepositoryFromURL(config.RepoURL)
+	}
+	return c
+}
+
+// newCommitStatusReporter returns the commit status reporter of the
+// instance, or nil when it's disabled.
+func newCommitStatusReporter(inst *instance) *commitstatus.Reporter {
+	config := commitStatusConfig(inst.config)
+	if !config.Enabled {
+		return nil
+	}
+
+	client, err := commitstatus.NewClient(config)
+	if err != nil {
+		inst.log.Fatalf("Error creating commit status client: %v", err)
+	}
+	return commitstatus.NewReporter(client, config.Interval)
+}
+
+// reportCommitStatus posts the outcome of an update as a status of the
+// commit it comes from. description is prefixed with the outcome and
+// suffixed with the name of the node.
+func reportCommitStatus(inst *instance, state commitstatus.State, description string) {
+	if inst.commitStatus == nil {
+		return
+	}
+	g := gitHandlerOf(inst.source)
+	if g == nil {
+		return
+	}
+	sha := g.Revision()
+
+	context := inst.config.CommitStatus.Context + "/" + inst.hostname
+	if inst.name != defaultInstanceName {
+		context += "/" + inst.name
+	}
+	inst.commitStatus.Report(commitstatus.Status{
+		SHA:         sha,
+		State:       state,
+		Context:     context,
+		Description: description,
+		TargetURL:   inst.config.CommitStatus.TargetURL,
+	})
+}
+
+// reportInvalid posts the validation error of an update, summarized with
+// its first alert.
+func reportInvalid(inst *instance, diags []haproxy.Diagnostic, err error) {
+	description := fmt.Sprintf("Rejected on %s: %v", inst.hostname, err)
+	if alerts := haproxy.Filter(diags, haproxy.SeverityAlert); len(alerts) > 0 {
+		description = fmt.Sprintf("Rejected on %s, %d alert(s): %s", inst.hostname, len(alerts), alerts[0])
+	}
+	reportCommitStatus(inst, commitstatus.StateFailure, description)
+}
+
+// reportApplied posts the outcome of applying an update, along with the
+// number of warnings reported by the validation.
+func reportApplied(inst *instance, diags []haproxy.Diagnostic, failure error) {
+	if failure != nil {
+		reportCommitStatus(inst, commitstatus.StateError, fmt.Sprintf("Failed on %s: %v", inst.hostname, failure))
+		return
+	}
+
+	description := "Applied on " + inst.hostname
+	if warnings := haproxy.Filter(diags, haproxy.SeverityWarning); len(warnings) > 0 {
+		description += fmt.Sprintf(" with %d warning(s), first: %s", len(warnings), warnings[0])
+	}
+	reportCommitStatus(inst, commitstatus.StateSuccess, description)
+}
+
+// gitHandlerOf returns the git repository the configuration of s comes
+// from, or nil if it doesn't come from git.
+func gitHandlerOf(s source.Source) *git.Handler {
+	switch s := s.(type) {
+	case *git.Handler:
+		return s
+	case *source.Selected:
+		return gitHandlerOf(s.Source)
+	case *source.Composite:
+		return gitHandlerOf(s.Base())
+	}
+	return nil
+}
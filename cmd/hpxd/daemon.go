@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// daemon keeps what the `run` command started, so it can be stopped
+// gracefully.
+type daemon struct {
+	instances []*instance
+	// servers are the webhook, rollout and admin endpoints, and metrics the
+	// metrics one, stopped last
+	servers []*http.Server
+	metrics *http.Server
+
+	// cancel stops the update loops, tracked by loops
+	cancel context.CancelFunc
+	loops  sync.WaitGroup
+	// timeout is `shutdownTimeout`
+	timeout time.Duration
+}
+
+// handleSignals serves the signals sent to the daemon until it stops:
+//
+//	SIGTERM, SIGINT  stop gracefully
+//	SIGHUP           restart with the configuration read again, if it's valid
+//	SIGUSR1          sync every instance now
+func (d *daemon) handleSignals(signals chan os.Signal, configPath string) {
+	for sig := range signals {
+		switch sig {
+		case syscall.SIGUSR1:
+			logrus.Info("Received SIGUSR1, syncing now")
+			for _, inst := range d.instances {
+				requestSync(inst.syncRequests)
+			}
+		case syscall.SIGHUP:
+			if _, _, err := loadDaemonConfig(configPath); err != nil {
+				logrus.Errorf("Received SIGHUP, keeping the current configuration as the new one is invalid: %v", err)
+				continue
+			}
+			logrus.Info("Received SIGHUP, restarting with the new configuration")
+			d.shutdown(signals)
+			restart()
+		default:
+			logrus.Infof("Shutting down (%s)", sig)
+			d.shutdown(signals)
+			logrus.Info("hpxd stopped")
+			return
+		}
+	}
+}
+
+// shutdown stops the daemon gracefully. The webhook, rollout and admin
+// endpoints stop accepting requests and finish serving the current ones,
+// the update loops finish their cycle in progress, and the metrics endpoint
+// is stopped last.
+//
+// If that takes longer than `shutdownTimeout`, or if SIGTERM or SIGINT is
+// received again, hpxd exits right away.
+func (d *daemon) shutdown(signals <-chan os.Signal) {
+	ctx, cancel := context.WithTimeout(context.Background(), d.timeout)
+	defer cancel()
+
+	stopServers(ctx, d.servers)
+
+	d.cancel()
+	stopped := make(chan struct{})
+	go func() {
+		d.loops.Wait()
+		close(stopped)
+	}()
+	for waiting := true; waiting; {
+		select {
+		case <-stopped:
+			waiting = false
+		case <-ctx.Done():
+			logrus.Fatalf("Update cycles still running after %s, exiting", d.timeout)
+		case sig := <-signals:
+			if sig == syscall.SIGTERM || sig == syscall.SIGINT {
+				logrus.Fatalf("Received %s again, exiting without waiting for the update cycles", sig)
+			}
+		}
+	}
+
+	if d.metrics != nil {
+		stopServers(ctx, []*http.Server{d.metrics})
+	}
+}
+
+// stopServers shuts servers down, and closes them if they're still serving
+// requests when ctx is done.
+func stopServers(ctx context.Context, servers []*http.Server) {
+	var wg sync.WaitGroup
+	for _, server := range servers {
+		wg.Add(1)
+		go func(server *http.Server) {
+			defer wg.Done()
+			if err := server.Shutdown(ctx); err != nil {
+				logrus.Warnf("Closing endpoint with requests in progress: %v", err)
+				_ = server.Close()
+			}
+		}(server)
+	}
+	wg.Wait()
+}
+
+// restart replaces the process with a new hpxd started with the same
+// arguments and environment, which reads the configuration again. The
+// process keeps its PID, so service managers don't notice.
+func restart() {
+	executable, err := os.Executable()
+	if err == nil {
+		err = syscall.Exec(executable, os.Args, os.Environ())
+	}
+	logrus.Fatalf("Error restarting hpxd: %v", err)
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"time"
+
+	"github.com/zcubbs/hpxd/pkg/drift"
+	"github.com/zcubbs/hpxd/pkg/files"
+	"github.com/zcubbs/hpxd/pkg/haproxy"
+	"github.com/zcubbs/hpxd/pkg/metrics"
+)
+
+// Supported values of the `drift.mode` setting.
+const (
+	driftModeOff     = "off"
+	driftModeDetect  = "detect"
+	driftModeEnforce = "enforce"
+)
+
+// DriftConfig configures drift detection.
+//
+// In `detect` mode drift is only logged and exposed as a metric. In
+// `enforce` mode the last applied configuration is also restored and
+// HAProxy is reloaded.
+type DriftConfig struct {
+	Mode     string        `mapstructure:"mode"`
+	Interval time.Duration `mapstructure:"interval"`
+}
+
+// recordDesiredState records the configuration and auxiliary files that were
+// just applied as the desired state of the node.
+func recordDesiredState(inst *instance, detector *drift.Detector, configPath string, synced []files.File) {
+	desired := map[string]string{inst.config.HaproxyConfigPath: configPath}
+	for _, f := range synced {
+		desired[f.Target] = f.Source
+	}
+
+	if err := detector.Record(desired); err != nil {
+		inst.log.Errorf("Failed to record desired state: %v", err)
+	}
+}
+
+// checkDrift compares the deployed files with the desired state and, in
+// enforce mode, restores the desired state and reloads HAProxy. The restored
+// configuration is validated first, and HAProxy isn't reloaded if it's
+// invalid. While maintenance restrictions forbid changes, the drift is left
+// for a later check to correct.
+func checkDrift(inst *instance, validator *haproxy.Validator, detector *drift.Detector) {
+	drifts, err := detector.Check()
+	if err != nil {
+		inst.log.Errorf("Failed to check for drift: %v", err)
+		return
+	}
+
+	metrics.DriftedFiles.WithLabelValues(inst.name).Set(float64(len(drifts)))
+	if len(drifts) == 0 {
+		return
+	}
+	for _, d := range drifts {
+		inst.log.Warnf("Drift detected: %s was %s outside of hpxd", d.Target, d.Reason)
+	}
+
+	if inst.config.Drift.Mode != driftModeEnforce {
+		return
+	}
+	if inst.paused() {
+		inst.log.Warn("Applies are paused, not restoring drifted files")
+		return
+	}
+	if inst.dryRun() {
+		inst.log.Warn("Dry run: not restoring drifted files")
+		return
+	}
+	if delay, reason := reloadDelay(inst); delay > 0 {
+		inst.log.Warnf("Not restoring drifted files yet: %s", reason)
+		return
+	}
+	if !maintenanceAllows(inst, "drift correction") {
+		return
+	}
+
+	if err := detector.Restore(drifts); err != nil {
+		inst.log.Errorf("Failed to restore desired state: %v", err)
+		return
+	}
+	if _, err := validator.Validate(inst.config.HaproxyConfigPath, ""); err != nil {
+		inst.log.Errorf("Restored configuration is invalid, not reloading HAProxy: %v", err)
+		return
+	}
+	if err := reloadHAProxy(inst); err != nil {
+		inst.log.Errorf("Failed to reload HAProxy after restoring desired state: %v", err)
+		return
+	}
+
+	metrics.DriftCorrectionsCounter.WithLabelValues(inst.name).Inc()
+	metrics.DriftedFiles.WithLabelValues(inst.name).Set(0)
+	inst.log.Infof("Restored %d drifted file(s) and reloaded HAProxy", len(drifts))
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/zcubbs/hpxd/pkg/files"
+	"github.com/zcubbs/hpxd/pkg/guard"
+	"github.com/zcubbs/hpxd/pkg/haproxy"
+	"github.com/zcubbs/hpxd/pkg/metrics"
+	"github.com/zcubbs/hpxd/pkg/textdiff"
+)
+
+// dryRunReport is what the last evaluated revision would have changed,
+// had the instance not been in dry-run mode.
+type dryRunReport struct {
+	Revision    string    `json:"revision"`
+	EvaluatedAt time.Time `json:"evaluatedAt"`
+	// Changes lists the deployed files the revision would write
+	Changes []string `json:"changes"`
+	// Diff is the unified diff of the deployed files with the revision
+	Diff string `json:"diff,omitempty"`
+	// Guard lists the thresholds of the blast-radius guard the revision
+	// would exceed, holding it pending approval
+	Guard []string `json:"guard,omitempty"`
+}
+
+// dryRun reports whether the instance is in dry-run mode, in which fetched
+// revisions are rendered and validated but never applied.
+func (inst *instance) dryRun() bool {
+	return inst.dryRunMode.Load()
+}
+
+// setDryRun turns dry-run mode on or off until the daemon restarts.
+func (inst *instance) setDryRun(enabled bool) {
+	if inst.dryRunMode.Swap(enabled) == enabled {
+		return
+	}
+	if enabled {
+		inst.log.Warn("Dry-run mode enabled, fetched revisions are validated but not applied")
+		return
+	}
+	metrics.DryRunPendingChanges.WithLabelValues(inst.name).Set(0)
+	inst.state.update(func(r *statusReport) { r.DryRunResult = nil })
+	inst.log.Info("Dry-run mode disabled, applying the last fetched revision")
+}
+
+// reportDryRun logs and exposes what applying the valid candidate
+// configuration at configPath, with the synced files, would change: the
+// deployed files it would write, how, and whether the blast-radius guard
+// would hold it. Nothing is written and HAProxy isn't reloaded.
+func reportDryRun(inst *instance, revision, configPath string, synced []files.File) {
+	report := &dryRunReport{Revision: revision, EvaluatedAt: time.Now().UTC(), Changes: []string{}}
+
+	targets := []files.File{{Source: configPath, Target: inst.config.HaproxyConfigPath}}
+	for _, target := range append(targets, synced...) {
+		live, err := os.ReadFile(filepath.Clean(target.Target))
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			inst.log.Errorf("Dry run: failed to read %s: %v", target.Target, err)
+			continue
+		}
+		desired, err := os.ReadFile(filepath.Clean(target.Source))
+		if err != nil {
+			inst.log.Errorf("Dry run: failed to read %s: %v", target.Source, err)
+			continue
+		}
+		diff := textdiff.Unified(target.Target, target.Target+" ("+revision+")", live, desired)
+		if diff == "" {
+			continue
+		}
+		report.Changes = append(report.Changes, target.Target)
+		report.Diff += diff
+		inst.log.Infof("Dry run: revision %s would update %s", revision, target.Target)
+	}
+	if report.Diff != "" {
+		inst.log.Debugf("Dry run: changes of revision %s:\n%s", revision, report.Diff)
+	}
+
+	if inst.config.Guard.Enabled() {
+		live, err := haproxy.ParseConfigFile(inst.config.HaproxyConfigPath)
+		desired, derr := haproxy.ParseConfigFile(configPath)
+		if err == nil && derr == nil {
+			for _, v := range guard.Check(live, desired, inst.config.Guard) {
+				report.Guard = append(report.Guard, v.Message)
+				inst.log.Warnf("Dry run: blast-radius guard would hold revision %s: %s", revision, v.Message)
+			}
+		}
+	}
+
+	if len(report.Changes) == 0 {
+		inst.log.Infof("Dry run: revision %s is valid and matches the deployed configuration", revision)
+	} else {
+		inst.log.Infof("Dry run: revision %s is valid, applying it would change %d file(s) and reload HAProxy",
+			revision, len(report.Changes))
+	}
+	metrics.DryRunPendingChanges.WithLabelValues(inst.name).Set(float64(len(report.Changes)))
+	inst.state.update(func(r *statusReport) { r.DryRunResult = report })
+}
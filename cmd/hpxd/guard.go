@@ -0,0 +1,140 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/sirupsen/logrus"
+	"github.com/zcubbs/hpxd/pkg/guard"
+	"github.com/zcubbs/hpxd/pkg/haproxy"
+	"github.com/zcubbs/hpxd/pkg/metrics"
+)
+
+// guardUpdate runs the blast-radius guard against the candidate configuration
+// at configPath. It returns true if the update must be held until approved.
+//
+// The candidate is compared with the live HAProxy configuration. An update
+// that doesn't exceed any threshold, or that was approved through
+// `hpxd approve` or the admin API, is let through. The approval is kept
+// until the update is applied, see consumeApproval, so it survives the
+// update being held by the gates that follow the guard.
+func guardUpdate(inst *instance, configPath string, approvals *guard.ApprovalStore) bool {
+	if !inst.config.Guard.Enabled() {
+		return false
+	}
+
+	content, err := os.ReadFile(filepath.Clean(configPath))
+	if err != nil {
+		inst.log.Errorf("Failed to read candidate config for the blast-radius guard: %v", err)
+		return true
+	}
+	id := guard.Fingerprint(content)
+
+	if approvals.IsApproved(id) {
+		if inst.approvedUpdate != id {
+			inst.log.Infof("Update %s was approved", id)
+			inst.approvedUpdate = id
+		}
+		metrics.GuardPendingApproval.WithLabelValues(inst.name).Set(0)
+		return false
+	}
+
+	live, err := haproxy.ParseConfigFile(inst.config.HaproxyConfigPath)
+	if errors.Is(err, os.ErrNotExist) {
+		// Nothing deployed yet, so nothing can be removed
+		return false
+	}
+	if err != nil {
+		inst.log.Errorf("Failed to parse live HAProxy configuration, holding update %s: %v", id, err)
+		return true
+	}
+
+	desired, err := haproxy.ParseConfigFile(configPath)
+	if err != nil {
+		inst.log.Errorf("Failed to parse candidate HAProxy configuration, holding update %s: %v", id, err)
+		return true
+	}
+
+	violations := guard.Check(live, desired, inst.config.Guard)
+	if len(violations) == 0 {
+		// A safe update supersedes any update still waiting for approval
+		clearHeldUpdate(inst, approvals)
+		return false
+	}
+
+	if pending, err := approvals.Pending(); err == nil && pending != nil && pending.ID == id {
+		inst.log.Debugf("Update %s is still waiting for approval", id)
+		return true
+	}
+
+	if err := approvals.Hold(id, violations); err != nil {
+		inst.log.Errorf("Failed to record held update %s: %v", id, err)
+	}
+	for _, v := range violations {
+		inst.log.Warnf("Blast-radius guard: %s", v.Message)
+		metrics.GuardHeldUpdatesCounter.WithLabelValues(inst.name, v.Kind).Inc()
+	}
+	metrics.GuardPendingApproval.WithLabelValues(inst.name).Set(1)
+	inst.log.Warnf("Update %s is held pending approval, run `hpxd approve -config <dir> -id %s` to apply it", id, id[:12])
+
+	return true
+}
+
+// consumeApproval forgets the approval of the update that was just applied.
+func consumeApproval(inst *instance, approvals *guard.ApprovalStore) {
+	if !inst.config.Guard.Enabled() || inst.approvedUpdate == "" {
+		return
+	}
+	clearHeldUpdate(inst, approvals)
+	inst.approvedUpdate = ""
+}
+
+// clearHeldUpdate forgets the update held by the guard, if any.
+func clearHeldUpdate(inst *instance, approvals *guard.ApprovalStore) {
+	if err := approvals.Clear(); err != nil {
+		inst.log.Errorf("Failed to clear held update: %v", err)
+	}
+	metrics.GuardPendingApproval.WithLabelValues(inst.name).Set(0)
+}
+
+// approveUpdate approves the update held by the blast-radius guard of the
+// instance, for the admin API, and returns it. With id, the held update is
+// only approved if its ID starts with id.
+func approveUpdate(inst *instance, id string) (*guard.Pending, error) {
+	id, err := inst.approvals.Approve(id)
+	if err != nil {
+		return nil, err
+	}
+	pending, err := inst.approvals.Pending()
+	if err != nil {
+		return nil, err
+	}
+	inst.log.Infof("Update %s approved through the admin API", id)
+	requestSync(inst.syncRequests)
+	return pending, nil
+}
+
+// approveHeldUpdate approves the update held by the blast-radius guard of
+// the daemon sharing the same configuration. With id, the held update is
+// only approved if its ID starts with id.
+func approveHeldUpdate(config *Configuration, id string) {
+	approvals := guard.NewApprovalStore(config.StateDir)
+
+	pending, err := approvals.Pending()
+	if err != nil {
+		logrus.Fatalf("Failed to read held update: %v", err)
+	}
+	if pending != nil {
+		for _, v := range pending.Violations {
+			fmt.Printf("- %s\n", v.Message)
+		}
+	}
+
+	id, err = approvals.Approve(id)
+	if err != nil {
+		logrus.Fatalf("Failed to approve update: %v", err)
+	}
+	fmt.Printf("Update %s approved, it will be applied on the next poll.\n", id)
+}
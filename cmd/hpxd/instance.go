@@ -0,0 +1,265 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"github.com/zcubbs/hpxd/pkg/commitstatus"
+	"github.com/zcubbs/hpxd/pkg/git"
+	"github.com/zcubbs/hpxd/pkg/guard"
+	"github.com/zcubbs/hpxd/pkg/haproxy"
+	"github.com/zcubbs/hpxd/pkg/history"
+	"github.com/zcubbs/hpxd/pkg/maintenance"
+	"github.com/zcubbs/hpxd/pkg/rollout"
+	"github.com/zcubbs/hpxd/pkg/source"
+)
+
+// defaultInstanceName names the only instance when no `instances` are
+// configured.
+const defaultInstanceName = "default"
+
+// instance is a managed HAProxy instance, with its own configuration
+// source, target paths, validator and reloader.
+type instance struct {
+	name   string
+	config *Configuration
+	// log tags every entry with the name of the instance when several are
+	// managed
+	log *logrus.Entry
+	// hostname and paths are the name and the candidate configuration
+	// paths of the host
+	hostname string
+	paths    []string
+
+	source         source.Source
+	renderer       *renderer
+	haproxyHandler *haproxy.Handler
+	syncRequests   chan struct{}
+
+	rollout      *rollout.Rollout
+	commitStatus *commitstatus.Reporter
+	// statusRecords queues the status records pushed to the repository
+	statusRecords chan git.StatusRecord
+	// rolloutReason is why the held revision waits, logged when it changes
+	rolloutReason string
+
+	// schedule and overrides restrict when revisions are applied, and
+	// maintenanceReason is why the held revision is queued
+	schedule          *maintenance.Schedule
+	overrides         *maintenance.OverrideStore
+	maintenanceReason string
+
+	// lastReload and lastChange are when HAProxy was last reloaded and a new
+	// revision last fetched, for the reload limits. reloadReason is why the
+	// reload is held, and discoveryPending tells discovery changes wait for
+	// a reload.
+	lastReload       time.Time
+	lastChange       time.Time
+	reloadReason     string
+	discoveryPending bool
+
+	// approvals keeps the update held by the blast-radius guard, and
+	// approvedUpdate is the approved one waiting to be applied
+	approvals      *guard.ApprovalStore
+	approvedUpdate string
+
+	// state, history and rollbacks back the admin API. rolledBackFrom is
+	// the revision of the source the last rollback replaced.
+	state          *instanceState
+	history        *history.Store
+	rollbacks      chan rollbackRequest
+	rolledBackFrom string
+	// dryRunMode starts as `dryRun` and can be switched through the admin API
+	dryRunMode atomic.Bool
+}
+
+func newInstance(name string, config *Configuration, multiple bool) *instance {
+	log := logrus.NewEntry(logrus.StandardLogger())
+	if multiple {
+		log = log.WithField("instance", name)
+	}
+	return &instance{
+		name:         name,
+		config:       config,
+		log:          log,
+		syncRequests: make(chan struct{}, 1),
+		state:        &instanceState{},
+		history:      history.NewStore(filepath.Join(config.StateDir, "history"), config.HistoryLimit),
+		rollbacks:    make(chan rollbackRequest, 1),
+		overrides:    maintenance.NewOverrideStore(filepath.Join(config.StateDir, overrideFile)),
+		approvals:    guard.NewApprovalStore(config.StateDir),
+		// A rollback outlives restarts
+		rolledBackFrom: readRolledBack(config.StateDir),
+	}
+}
+
+// loadInstances returns the managed instances.
+//
+// Without `instances`, the top-level settings describe the only instance.
+// Otherwise every entry of `instances` is decoded over the top-level
+// settings, which act as defaults, and gets its own state directory below
+// the top-level `stateDir` unless it sets one.
+func loadInstances(config *Configuration) ([]*instance, error) {
+	if len(config.Instances) == 0 {
+		return []*instance{newInstance(defaultInstanceName, config, false)}, nil
+	}
+
+	defaults := viper.AllSettings()
+	delete(defaults, "instances")
+
+	instances := make([]*instance, 0, len(config.Instances))
+	names := make(map[string]bool, len(config.Instances))
+	for i, overrides := range config.Instances {
+		name, _ := lookup(overrides, "name").(string)
+		if name == "" {
+			return nil, fmt.Errorf("missing required config: instances[%d].name", i)
+		}
+		if names[name] {
+			return nil, fmt.Errorf("invalid config: duplicate instance name %s", name)
+		}
+		names[name] = true
+
+		v := viper.New()
+		if err := v.MergeConfigMap(defaults); err != nil {
+			return nil, err
+		}
+		if err := v.MergeConfigMap(overrides); err != nil {
+			return nil, fmt.Errorf("instance %s: %w", name, err)
+		}
+		var c Configuration
+		if err := v.Unmarshal(&c); err != nil {
+			return nil, fmt.Errorf("instance %s: %w", name, err)
+		}
+		c.Instances = nil
+		c.Version, c.Commit, c.Date = config.Version, config.Commit, config.Date
+		if lookup(overrides, "stateDir") == nil {
+			c.StateDir = filepath.Join(config.StateDir, name)
+		}
+
+		instances = append(instances, newInstance(name, &c, true))
+	}
+	return instances, nil
+}
+
+// validateInstances checks the configuration of every instance, and that
+// instances don't manage the same HAProxy configuration.
+func validateInstances(instances []*instance) error {
+	targets := make(map[string]string, len(instances))
+	for _, inst := range instances {
+		if err := validateConfig(inst.config); err != nil {
+			if len(instances) == 1 {
+				return err
+			}
+			return fmt.Errorf("instance %s: %w", inst.name, err)
+		}
+
+		target := filepath.Clean(inst.config.HaproxyConfigPath)
+		if other, ok := targets[target]; ok {
+			return fmt.Errorf("invalid config: instances %s and %s both manage %s", other, inst.name, target)
+		}
+		targets[target] = inst.name
+	}
+	return nil
+}
+
+// findInstance returns the instance called name. The name may be omitted
+// when there is only one instance.
+func findInstance(instances []*instance, name string) (*instance, error) {
+	if name == "" {
+		if len(instances) > 1 {
+			return nil, errors.New("several instances are managed, select one with -instance")
+		}
+		return instances[0], nil
+	}
+	for _, inst := range instances {
+		if inst.name == name {
+			return inst, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown instance %s", name)
+}
+
+// open creates the source, server pools, Kubernetes watcher and renderer
+// of the instance.
+func (inst *instance) open() {
+	selector, err := newPathSelector(inst.config)
+	if err != nil {
+		inst.log.Fatalf("Error selecting the configuration path: %v", err)
+	}
+	inst.hostname = selector.Facts().Hostname
+	inst.paths = selector.Candidates()
+	if selector.HasRules() {
+		inst.log.Infof("Selecting the configuration of host %s among %s",
+			inst.hostname, strings.Join(inst.paths, ", "))
+	}
+	inst.source, err = newSource(inst.config, inst.name, selector)
+	if err != nil {
+		inst.log.Fatalf("Error creating %s source: %v", inst.config.SourceType, err)
+	}
+	pools, err := newPools(inst.config)
+	if err != nil {
+		inst.log.Fatalf("Error creating server pools: %v", err)
+	}
+	watcher := startKubernetesWatcher(inst)
+	inst.renderer = newRenderer(pools, watcher, inst.config)
+}
+
+// start opens the instance, creates its reloader, rollout, commit status
+// reporter and status recorder, and turns the changes of its source and
+// discovery into sync requests.
+func (inst *instance) start() {
+	inst.open()
+	inst.haproxyHandler = haproxy.NewHandlerForUnit(inst.config.HaproxyConfigPath, inst.config.HaproxyUnit)
+	inst.rollout = newRollout(inst)
+	inst.commitStatus = newCommitStatusReporter(inst)
+	startStatusRecorder(inst)
+	inst.schedule = newSchedule(inst)
+	if inst.config.DryRun {
+		inst.dryRunMode.Store(true)
+		inst.log.Warn("Running in dry-run mode, fetched revisions are validated but not applied")
+	}
+
+	forwardSourceChanges(inst.source, inst.syncRequests)
+	if pools := inst.renderer.pools; pools != nil {
+		forwardChanges(pools.Changes(), inst.syncRequests)
+	}
+	if watcher := inst.renderer.kubernetes; watcher != nil {
+		forwardChanges(watcher.Changes(), inst.syncRequests)
+	}
+}
+
+// stagingRoot is where sources stage their content, the temporary directory
+// unless set. Commands fetching a configuration once stage it in a fresh
+// directory of their own, so they never touch the trees of a running daemon
+// nor find the ones of a previous run unchanged.
+var stagingRoot string
+
+// stagingDir returns the directory a source of the instance stages its
+// content in. The default instance keeps the historical locations.
+func stagingDir(instanceName, name string) string {
+	root := stagingRoot
+	if root == "" {
+		root = os.TempDir()
+	}
+	if instanceName == defaultInstanceName {
+		return filepath.Join(root, "hpxd-"+name)
+	}
+	return filepath.Join(root, "hpxd-"+instanceName+"-"+name)
+}
+
+// lookup returns the value of key in m, ignoring case as viper does.
+func lookup(m map[string]interface{}, key string) interface{} {
+	for k, v := range m {
+		if strings.EqualFold(k, key) {
+			return v
+		}
+	}
+	return nil
+}
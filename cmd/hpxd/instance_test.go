@@ -0,0 +1,231 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// loadTestConfig loads settings as the configuration file of the daemon.
+func loadTestConfig(t *testing.T, settings string) *Configuration {
+	t.Helper()
+	viper.Reset()
+	t.Cleanup(viper.Reset)
+
+	path := filepath.Join(t.TempDir(), "hpxd.yaml")
+	if err := os.WriteFile(path, []byte(settings), 0600); err != nil {
+		t.Fatal(err)
+	}
+	config, err := loadConfig(path)
+	if err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+	return config
+}
+
+const testDefaults = `
+repoURL: https://git.example.com/lb.git
+branch: main
+path: haproxy.cfg
+haproxyConfigPath: /etc/haproxy/haproxy.cfg
+stateDir: /var/lib/hpxd
+pollingInterval: 30s
+reload:
+  minInterval: 10s
+`
+
+// expectedInstance is what TestLoadInstances checks of an instance.
+type expectedInstance struct {
+	name            string
+	configPath      string
+	stateDir        string
+	pollingInterval time.Duration
+	reload          ReloadConfig
+}
+
+func TestLoadInstances(t *testing.T) {
+	tests := []struct {
+		name      string
+		instances string
+		expected  []expectedInstance
+		err       string
+	}{
+		{
+			name: "single instance",
+			expected: []expectedInstance{
+				{defaultInstanceName, "/etc/haproxy/haproxy.cfg", "/var/lib/hpxd", 30 * time.Second, ReloadConfig{MinInterval: 10 * time.Second}},
+			},
+		},
+		{
+			name: "defaults and overrides",
+			instances: `
+instances:
+  - name: edge
+    haproxyConfigPath: /etc/haproxy-edge/haproxy.cfg
+  - name: internal
+    haproxyConfigPath: /etc/haproxy-internal/haproxy.cfg
+    pollingInterval: 1m
+    reload:
+      debounce: 5s
+`,
+			expected: []expectedInstance{
+				{"edge", "/etc/haproxy-edge/haproxy.cfg", "/var/lib/hpxd/edge", 30 * time.Second, ReloadConfig{MinInterval: 10 * time.Second}},
+				{"internal", "/etc/haproxy-internal/haproxy.cfg", "/var/lib/hpxd/internal", time.Minute,
+					ReloadConfig{MinInterval: 10 * time.Second, Debounce: 5 * time.Second}},
+			},
+		},
+		{
+			name: "own state directory",
+			instances: `
+instances:
+  - name: edge
+    stateDir: /srv/hpxd-edge
+  - name: internal
+    haproxyConfigPath: /etc/haproxy-internal/haproxy.cfg
+`,
+			expected: []expectedInstance{
+				{"edge", "/etc/haproxy/haproxy.cfg", "/srv/hpxd-edge", 30 * time.Second, ReloadConfig{MinInterval: 10 * time.Second}},
+				{"internal", "/etc/haproxy-internal/haproxy.cfg", "/var/lib/hpxd/internal", 30 * time.Second, ReloadConfig{MinInterval: 10 * time.Second}},
+			},
+		},
+		{
+			name: "missing name",
+			instances: `
+instances:
+  - haproxyConfigPath: /etc/haproxy-edge/haproxy.cfg
+`,
+			err: "missing required config: instances[0].name",
+		},
+		{
+			name: "duplicate name",
+			instances: `
+instances:
+  - name: edge
+  - name: edge
+`,
+			err: "duplicate instance name edge",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			instances, err := loadInstances(loadTestConfig(t, testDefaults+tt.instances))
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("Expected error %q, but got: %v", tt.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Failed to load instances: %v", err)
+			}
+			if len(instances) != len(tt.expected) {
+				t.Fatalf("Expected %d instances, but got %d", len(tt.expected), len(instances))
+			}
+			for i, e := range tt.expected {
+				inst := instances[i]
+				got := expectedInstance{inst.name, inst.config.HaproxyConfigPath, inst.config.StateDir,
+					inst.config.PollingInterval, inst.config.Reload}
+				if got != e {
+					t.Errorf("Expected instance %+v, but got %+v", e, got)
+				}
+				if inst.config.RepoURL != "https://git.example.com/lb.git" || len(inst.config.Instances) != 0 {
+					t.Errorf("Expected instance %s to inherit the source and no instances, but got %q, %d instances",
+						inst.name, inst.config.RepoURL, len(inst.config.Instances))
+				}
+			}
+		})
+	}
+}
+
+func TestStagingDir(t *testing.T) {
+	root := stagingRoot
+	defer func() { stagingRoot = root }()
+
+	tests := []struct {
+		root, instance, name string
+		expected             string
+	}{
+		{"", defaultInstanceName, "source", filepath.Join(os.TempDir(), "hpxd-source")},
+		{"", "edge", "source", filepath.Join(os.TempDir(), "hpxd-edge-source")},
+		{"/run/hpxd", defaultInstanceName, "rendered", "/run/hpxd/hpxd-rendered"},
+		{"/run/hpxd", "edge", "input-maps", "/run/hpxd/hpxd-edge-input-maps"},
+	}
+	for _, tt := range tests {
+		stagingRoot = tt.root
+		if got := stagingDir(tt.instance, tt.name); got != tt.expected {
+			t.Errorf("stagingDir(%q, %q) with root %q: expected %s, but got %s", tt.instance, tt.name, tt.root, tt.expected, got)
+		}
+	}
+}
+
+func TestValidateInstances(t *testing.T) {
+	tests := []struct {
+		name      string
+		instances string
+		err       string
+	}{
+		{
+			name: "distinct targets",
+			instances: `
+instances:
+  - name: edge
+    haproxyConfigPath: /etc/haproxy-edge/haproxy.cfg
+  - name: internal
+    haproxyConfigPath: /etc/haproxy-internal/haproxy.cfg
+`,
+		},
+		{
+			name: "inherited target",
+			instances: `
+instances:
+  - name: edge
+  - name: internal
+`,
+			err: "instances edge and internal both manage /etc/haproxy/haproxy.cfg",
+		},
+		{
+			name: "same target spelled differently",
+			instances: `
+instances:
+  - name: edge
+    haproxyConfigPath: /etc/haproxy-edge/haproxy.cfg
+  - name: internal
+    haproxyConfigPath: /etc/haproxy-edge/../haproxy-edge//haproxy.cfg
+`,
+			err: "instances edge and internal both manage /etc/haproxy-edge/haproxy.cfg",
+		},
+		{
+			name: "invalid instance",
+			instances: `
+instances:
+  - name: edge
+    haproxyConfigPath: /etc/haproxy-edge/haproxy.cfg
+  - name: internal
+    haproxyConfigPath: /etc/haproxy-internal/haproxy.cfg
+    historyLimit: 0
+`,
+			err: "instance internal: invalid config: historyLimit must be at least 1",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			instances, err := loadInstances(loadTestConfig(t, testDefaults+tt.instances))
+			if err != nil {
+				t.Fatalf("Failed to load instances: %v", err)
+			}
+			err = validateInstances(instances)
+			if tt.err == "" && err != nil {
+				t.Errorf("Expected the instances to be valid, but got: %v", err)
+			}
+			if tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)) {
+				t.Errorf("Expected error %q, but got: %v", tt.err, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"time"
+
+	"github.com/zcubbs/hpxd/pkg/kubernetes"
+)
+
+// kubernetesSyncTimeout is how long startup waits for the Kubernetes
+// objects to be listed.
+const kubernetesSyncTimeout = 30 * time.Second
+
+// startKubernetesWatcher starts watching the Kubernetes services when it's
+// enabled, or returns nil.
+func startKubernetesWatcher(inst *instance) *kubernetes.Watcher {
+	if !inst.config.Kubernetes.Enabled {
+		return nil
+	}
+
+	watcher, err := kubernetes.NewWatcher(inst.config.Kubernetes)
+	if err != nil {
+		inst.log.Fatalf("Error creating Kubernetes watcher: %v", err)
+	}
+	if !watcher.WaitSynced(kubernetesSyncTimeout) {
+		inst.log.Warn("Kubernetes objects aren't synced yet, configurations will be applied once they are")
+	}
+	return watcher
+}
@@ -8,27 +8,45 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"errors"
-	"flag"
 	"fmt"
 	"io"
 	"net/http"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"syscall"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/viper"
+	"github.com/zcubbs/hpxd/pkg/commitstatus"
+	"github.com/zcubbs/hpxd/pkg/drift"
+	"github.com/zcubbs/hpxd/pkg/files"
 	"github.com/zcubbs/hpxd/pkg/git"
+	"github.com/zcubbs/hpxd/pkg/guard"
 	"github.com/zcubbs/hpxd/pkg/haproxy"
+	"github.com/zcubbs/hpxd/pkg/hostpath"
+	"github.com/zcubbs/hpxd/pkg/httpserver"
+	"github.com/zcubbs/hpxd/pkg/kubernetes"
+	"github.com/zcubbs/hpxd/pkg/maintenance"
 	"github.com/zcubbs/hpxd/pkg/metrics"
+	"github.com/zcubbs/hpxd/pkg/rollout"
 )
 
 const (
 	defaultPollingInterval = 5 * time.Second
 	prometheusDefaultPort  = 9100
 	defaultLogLevel        = "info"
+	defaultStateDir        = "./data"
+	defaultDriftInterval   = time.Minute
+	defaultLocalDebounce   = 500 * time.Millisecond
+	defaultShutdownTimeout = 30 * time.Second
+
+	defaultCommitStatusContext  = "hpxd"
+	defaultCommitStatusInterval = 5 * time.Second
 )
 
 var (
@@ -38,42 +56,116 @@ var (
 )
 
 type Configuration struct {
-	RepoURL string `mapstructure:"repoURL"`
-	Branch  string `mapstructure:"branch"`
-	Path    string `mapstructure:"path"`
+	SourceConfig `mapstructure:",squash"`
+	Inputs       []InputConfig `mapstructure:"inputs"`
+
+	// PathRules select the configuration of the host in a tree shared by a
+	// fleet, with the facts of the host: Hostname, defaulting to the system
+	// hostname, and the labels of HostLabelsFile. See hostpath.
+	PathRules      []hostpath.Rule `mapstructure:"pathRules"`
+	Hostname       string          `mapstructure:"hostname"`
+	HostLabelsFile string          `mapstructure:"hostLabelsFile"`
+
+	HaproxyConfigPath string          `mapstructure:"haproxyConfigPath"`
+	SyncFiles         []files.Mapping `mapstructure:"syncFiles"`
+
+	HaproxyBinary  string `mapstructure:"haproxyBinary"`
+	HaproxyPidFile string `mapstructure:"haproxyPidFile"`
+	HaproxyUnit    string `mapstructure:"haproxyUnit"`
+	// Reload limits how often HAProxy is reloaded
+	Reload       ReloadConfig `mapstructure:"reload"`
+	VersionCheck string       `mapstructure:"versionCheck"`
+
+	WarningsAsErrors bool `mapstructure:"warningsAsErrors"`
+	// DryRun validates fetched revisions and reports what applying them
+	// would change, without ever writing the deployed files or reloading
+	DryRun bool `mapstructure:"dryRun"`
+
+	PollingInterval  time.Duration `mapstructure:"pollingInterval"`
+	EnablePrometheus bool          `mapstructure:"enablePrometheus"`
+	PrometheusPort   int           `mapstructure:"prometheusPort"`
+	// PrometheusAddress is the address metrics are served on, overriding
+	// PrometheusPort
+	PrometheusAddress string `mapstructure:"prometheusAddress"`
+
+	// Server configures TLS and authentication of the metrics and admin
+	// endpoints
+	Server httpserver.Config `mapstructure:"server"`
 
-	GitUsername string `mapstructure:"gitUsername"`
-	GitPassword string `mapstructure:"gitPassword"`
+	LogLevel string `mapstructure:"logLevel"`
 
-	HaproxyConfigPath string        `mapstructure:"haproxyConfigPath"`
-	PollingInterval   time.Duration `mapstructure:"pollingInterval"`
-	EnablePrometheus  bool          `mapstructure:"enablePrometheus"`
-	PrometheusPort    int           `mapstructure:"prometheusPort"`
+	// ShutdownTimeout bounds how long stopping waits for the in-flight
+	// update cycles and HTTP requests
+	ShutdownTimeout time.Duration `mapstructure:"shutdownTimeout"`
 
-	LogLevel string `mapstructure:"logLevel"`
+	StateDir string `mapstructure:"stateDir"`
+	// HistoryLimit is how many applied configurations are kept for
+	// rollbacks
+	HistoryLimit int              `mapstructure:"historyLimit"`
+	Guard        guard.Thresholds `mapstructure:"guard"`
+	Drift        DriftConfig      `mapstructure:"drift"`
+
+	Webhook WebhookConfig `mapstructure:"webhook"`
+	Admin   AdminConfig   `mapstructure:"admin"`
+
+	Pools      []PoolConfig      `mapstructure:"pools"`
+	RuntimeAPI string            `mapstructure:"runtimeAPI"`
+	Kubernetes kubernetes.Config `mapstructure:"kubernetes"`
+
+	// Maintenance restricts when fetched revisions are applied
+	Maintenance maintenance.Config `mapstructure:"maintenance"`
+
+	Rollout      rollout.Config      `mapstructure:"rollout"`
+	CommitStatus commitstatus.Config `mapstructure:"commitStatus"`
+	StatusRecord StatusRecordConfig  `mapstructure:"statusRecord"`
+
+	// Instances lists the managed HAProxy instances, each overriding the
+	// top-level settings. See loadInstances.
+	Instances []map[string]interface{} `mapstructure:"instances"`
 
 	Version string
 	Commit  string
 	Date    string
 }
 
-// setupConfig reads the configuration file and initializes the Configuration struct.
-// By default, it looks for a file named 'hpxd.yaml' in the './configs' directory,
-// but a different path can be provided via the `-config` CLI flag.
-// example: `./hpxd -config=/path/to/configs`
-func setupConfig() *Configuration {
-	var configPath string
-	flag.StringVar(&configPath, "config", "./configs", "Path to configuration directory")
-	flag.Parse()
-
-	viper.SetConfigName("hpxd")
+// loadConfig reads the configuration file and initializes the Configuration struct.
+// configPath is either the configuration file, or a directory holding a file
+// named 'hpxd.yaml'; the `-config` flag of every command defaults to './configs'.
+// example: `./hpxd run -config /path/to/configs`
+func loadConfig(configPath string) (*Configuration, error) {
 	viper.SetConfigType("yaml")
-	viper.AddConfigPath(configPath)
+	if info, err := os.Stat(configPath); err == nil && !info.IsDir() {
+		viper.SetConfigFile(configPath)
+	} else {
+		viper.SetConfigName("hpxd")
+		viper.AddConfigPath(configPath)
+	}
 
+	viper.SetDefault("sourceType", sourceTypeGit)
+	viper.SetDefault("localDebounce", defaultLocalDebounce)
+	viper.SetDefault("s3.pathStyle", true)
 	viper.SetDefault("enablePrometheus", false)
 	viper.SetDefault("prometheusPort", prometheusDefaultPort)
 	viper.SetDefault("pollingInterval", defaultPollingInterval)
 	viper.SetDefault("logLevel", defaultLogLevel)
+	viper.SetDefault("shutdownTimeout", defaultShutdownTimeout)
+	viper.SetDefault("stateDir", defaultStateDir)
+	viper.SetDefault("historyLimit", defaultHistoryLimit)
+	viper.SetDefault("haproxyBinary", haproxy.DefaultBinary)
+	viper.SetDefault("haproxyUnit", haproxy.DefaultUnit)
+	viper.SetDefault("versionCheck", versionCheckWarn)
+	viper.SetDefault("drift.mode", driftModeDetect)
+	viper.SetDefault("drift.interval", defaultDriftInterval)
+	viper.SetDefault("webhook.address", defaultWebhookAddress)
+	viper.SetDefault("webhook.path", defaultWebhookPath)
+	viper.SetDefault("admin.address", defaultAdminAddress)
+	viper.SetDefault("kubernetes.mode", kubernetes.ModeNodePort)
+	viper.SetDefault("rollout.store", rollout.StoreFile)
+	viper.SetDefault("commitStatus.context", defaultCommitStatusContext)
+	viper.SetDefault("commitStatus.interval", defaultCommitStatusInterval)
+	viper.SetDefault("statusRecord.mode", statusRecordOff)
+	viper.SetDefault("statusRecord.notesRef", git.DefaultNotesRef)
+	viper.SetDefault("statusRecord.branch", defaultStatusBranch)
 
 	err := viper.BindEnv("gitUsername", "HPXD_GIT_USERNAME")
 	if err != nil {
@@ -83,41 +175,170 @@ func setupConfig() *Configuration {
 	if err != nil {
 		logrus.Errorf("Error binding env var HPXD_GIT_PASSWORD: %v", err)
 	}
+	err = viper.BindEnv("statusRecord.username", "HPXD_STATUS_GIT_USERNAME")
+	if err != nil {
+		logrus.Errorf("Error binding env var HPXD_STATUS_GIT_USERNAME: %v", err)
+	}
+	err = viper.BindEnv("statusRecord.password", "HPXD_STATUS_GIT_PASSWORD")
+	if err != nil {
+		logrus.Errorf("Error binding env var HPXD_STATUS_GIT_PASSWORD: %v", err)
+	}
+	err = viper.BindEnv("http.bearerToken", "HPXD_HTTP_TOKEN")
+	if err != nil {
+		logrus.Errorf("Error binding env var HPXD_HTTP_TOKEN: %v", err)
+	}
+	err = viper.BindEnv("s3.accessKey", "HPXD_S3_ACCESS_KEY")
+	if err != nil {
+		logrus.Errorf("Error binding env var HPXD_S3_ACCESS_KEY: %v", err)
+	}
+	err = viper.BindEnv("s3.secretKey", "HPXD_S3_SECRET_KEY")
+	if err != nil {
+		logrus.Errorf("Error binding env var HPXD_S3_SECRET_KEY: %v", err)
+	}
+	err = viper.BindEnv("consul.token", "HPXD_CONSUL_TOKEN")
+	if err != nil {
+		logrus.Errorf("Error binding env var HPXD_CONSUL_TOKEN: %v", err)
+	}
+	err = viper.BindEnv("etcd.password", "HPXD_ETCD_PASSWORD")
+	if err != nil {
+		logrus.Errorf("Error binding env var HPXD_ETCD_PASSWORD: %v", err)
+	}
+	err = viper.BindEnv("webhook.secret", "HPXD_WEBHOOK_SECRET")
+	if err != nil {
+		logrus.Errorf("Error binding env var HPXD_WEBHOOK_SECRET: %v", err)
+	}
+	err = viper.BindEnv("kubernetes.token", "HPXD_KUBERNETES_TOKEN")
+	if err != nil {
+		logrus.Errorf("Error binding env var HPXD_KUBERNETES_TOKEN: %v", err)
+	}
+	err = viper.BindEnv("rollout.token", "HPXD_ROLLOUT_TOKEN")
+	if err != nil {
+		logrus.Errorf("Error binding env var HPXD_ROLLOUT_TOKEN: %v", err)
+	}
+	err = viper.BindEnv("commitStatus.token", "HPXD_COMMIT_STATUS_TOKEN")
+	if err != nil {
+		logrus.Errorf("Error binding env var HPXD_COMMIT_STATUS_TOKEN: %v", err)
+	}
 
 	if err := viper.ReadInConfig(); err != nil {
-		logrus.Fatalf("Error reading config file, %s", err)
+		return nil, fmt.Errorf("error reading config file, %w", err)
 	}
 
 	var config Configuration
 	if err := viper.Unmarshal(&config); err != nil {
-		logrus.Fatalf("Unable to unmarshal into struct, %v", err)
+		return nil, fmt.Errorf("unable to unmarshal into struct, %w", err)
 	}
 
 	config.Version = Version
 	config.Commit = Commit
 	config.Date = Date
 
-	return &config
+	return &config, nil
 }
 
 // validateConfig checks that the mandatory fields in the Configuration struct are set.
 // It returns an error if any required field is missing.
 func validateConfig(config *Configuration) error {
-	if config.RepoURL == "" {
-		return errors.New("missing required config: repoURL")
+	if err := validateSourceConfig(config.SourceConfig, ""); err != nil {
+		return err
 	}
 
-	if config.Branch == "" {
-		return errors.New("missing required config: branch")
+	if err := validateInputs(config.Inputs); err != nil {
+		return err
+	}
+
+	if err := validatePools(config.Pools); err != nil {
+		return err
+	}
+
+	switch config.Kubernetes.Mode {
+	case kubernetes.ModeNodePort, kubernetes.ModeEndpoints:
+	default:
+		return fmt.Errorf("invalid config: kubernetes.mode must be one of %s or %s",
+			kubernetes.ModeNodePort, kubernetes.ModeEndpoints)
 	}
 
 	if config.Path == "" {
 		return errors.New("missing required config: path")
 	}
 
+	for i, r := range config.PathRules {
+		if err := r.Validate(); err != nil {
+			return fmt.Errorf("invalid config: pathRules[%d]: %w", i, err)
+		}
+	}
+
 	if config.HaproxyConfigPath == "" {
 		return errors.New("missing required config: haproxyConfigPath")
 	}
+
+	switch config.VersionCheck {
+	case versionCheckOff, versionCheckWarn, versionCheckStrict:
+	default:
+		return fmt.Errorf("invalid config: versionCheck must be one of %s, %s or %s",
+			versionCheckOff, versionCheckWarn, versionCheckStrict)
+	}
+
+	if err := config.Server.Validate(); err != nil {
+		return fmt.Errorf("invalid config: server: %w", err)
+	}
+
+	if config.Webhook.Enabled && config.Webhook.Secret == "" {
+		return errors.New("missing required config: webhook.secret")
+	}
+
+	if config.ShutdownTimeout <= 0 {
+		return errors.New("invalid config: shutdownTimeout must be positive")
+	}
+
+	if config.HistoryLimit < 1 {
+		return errors.New("invalid config: historyLimit must be at least 1")
+	}
+
+	if err := config.Reload.Validate(); err != nil {
+		return fmt.Errorf("invalid config: reload: %w", err)
+	}
+
+	if err := config.Maintenance.Validate(); err != nil {
+		return fmt.Errorf("invalid config: maintenance: %w", err)
+	}
+
+	if config.Rollout.Enabled {
+		if err := config.Rollout.Validate(); err != nil {
+			return fmt.Errorf("invalid config: rollout: %w", err)
+		}
+	}
+
+	if config.Rollout.Listen != "" && config.Rollout.Dir == "" {
+		return errors.New("missing required config: rollout.dir")
+	}
+
+	if config.CommitStatus.Enabled {
+		if config.SourceType != sourceTypeGit {
+			return errors.New("invalid config: commitStatus requires the git source")
+		}
+		if err := commitStatusConfig(config).Validate(); err != nil {
+			return fmt.Errorf("invalid config: commitStatus: %w", err)
+		}
+	}
+
+	switch config.StatusRecord.Mode {
+	case statusRecordOff:
+	case statusRecordNotes, statusRecordBranch:
+		if config.SourceType != sourceTypeGit {
+			return errors.New("invalid config: statusRecord requires the git source")
+		}
+	default:
+		return fmt.Errorf("invalid config: statusRecord.mode must be one of %s, %s or %s",
+			statusRecordOff, statusRecordNotes, statusRecordBranch)
+	}
+
+	switch config.Drift.Mode {
+	case driftModeOff, driftModeDetect, driftModeEnforce:
+	default:
+		return fmt.Errorf("invalid config: drift.mode must be one of %s, %s or %s",
+			driftModeOff, driftModeDetect, driftModeEnforce)
+	}
 	return nil
 }
 
@@ -154,32 +375,58 @@ func initializeLogger(level string) {
 	}
 }
 
-// startMetricsEndpoint starts a Prometheus metrics endpoint on the specified port.
-// It also registers the application's version, commit, and build date.
-func startMetricsEndpoint(port int) {
+// startMetricsEndpoint starts a Prometheus metrics endpoint on `prometheusAddress`,
+// or on every interface on `prometheusPort`, with the TLS and authentication
+// settings of `server`. Scrapers need the read role.
+// It also registers the application's version, commit, and build date, and
+// returns the server so it can be shut down.
+func startMetricsEndpoint(config *Configuration) *http.Server {
 	// register app version info
 	metrics.ApplicationInfo.WithLabelValues(Version, Commit, Date).Set(1)
-	http.Handle("/metrics", promhttp.Handler())
+
+	address := config.PrometheusAddress
+	if address == "" {
+		address = fmt.Sprintf(":%d", config.PrometheusPort)
+	}
+	listener, err := httpserver.Listen(address, config.Server.TLS)
+	if err != nil {
+		logrus.Fatalf("Error starting metrics endpoint: %v", err)
+	}
+
+	mux := http.NewServeMux()
+	auth := httpserver.NewAuthenticator(config.Server.Auth)
+	mux.Handle("/metrics", auth.Require(httpserver.RoleRead, promhttp.Handler()))
+	server := &http.Server{
+		Handler:           mux,
+		ReadHeaderTimeout: 3 * time.Second,
+	}
 	go func() {
-		server := &http.Server{
-			Addr:              fmt.Sprintf(":%d", port),
-			ReadHeaderTimeout: 3 * time.Second,
-		}
-		err := server.ListenAndServe()
-		if err != nil {
-			logrus.Fatalf("Error starting metrics endpoint: %v", err)
+		err := server.Serve(listener)
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logrus.Fatalf("Error serving metrics endpoint: %v", err)
 		}
 	}()
+	return server
 }
 
-// main is the entry point of the hpxd application. It sets up the configuration,
+// runDaemon is the `run` command, the default one. It sets up the configuration,
 // starts required services, and initiates the main update loop to fetch and apply
-// HAProxy configurations.
-func main() {
-	config := setupConfig()
-	if err := validateConfig(config); err != nil {
+// HAProxy configurations, until it's stopped by a signal. See handleSignals.
+func runDaemon(args []string) {
+	fs := newFlagSet("run")
+	configPath := configFlag(fs)
+	dryRun := fs.Bool("dry-run", false, "Validate and report fetched revisions without applying them, overriding dryRun")
+	_ = fs.Parse(args)
+
+	config, instances, err := loadDaemonConfig(*configPath)
+	if err != nil {
 		logrus.Fatal(err)
 	}
+	if *dryRun {
+		for _, inst := range instances {
+			inst.config.DryRun = true
+		}
+	}
 
 	// Initialize logger with specified log level
 	initializeLogger(config.LogLevel)
@@ -190,78 +437,324 @@ func main() {
 		config.Date,
 	)
 
-	gitHandler := git.NewHandler(
-		config.RepoURL,
-		config.Branch,
-		config.GitUsername,
-		config.GitPassword,
-		config.Path,
-		config.HaproxyConfigPath,
-	)
-	haproxyHandler := haproxy.NewHandler(config.HaproxyConfigPath)
+	for _, inst := range instances {
+		inst.start()
+	}
 
+	d := &daemon{instances: instances, timeout: config.ShutdownTimeout}
 	if config.EnablePrometheus {
-		startMetricsEndpoint(config.PrometheusPort)
+		d.metrics = startMetricsEndpoint(config)
 	}
 
-	update(gitHandler, haproxyHandler, config)
+	for _, inst := range instances {
+		if inst.config.Webhook.Enabled {
+			d.servers = append(d.servers, startWebhookEndpoint(config, instances))
+			break
+		}
+	}
+
+	if config.Rollout.Listen != "" {
+		d.servers = append(d.servers, startRolloutEndpoint(config))
+	}
+
+	if config.Admin.Enabled {
+		d.servers = append(d.servers, startAdminEndpoint(config, instances))
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT, syscall.SIGHUP, syscall.SIGUSR1)
+
+	var ctx context.Context
+	ctx, d.cancel = context.WithCancel(context.Background())
+	for _, inst := range instances {
+		d.loops.Add(1)
+		go func(inst *instance) {
+			defer d.loops.Done()
+			update(ctx, inst)
+		}(inst)
+	}
+	d.handleSignals(signals, *configPath)
+}
+
+// loadDaemonConfig loads the configuration and the instances it describes,
+// and validates them.
+func loadDaemonConfig(configPath string) (*Configuration, []*instance, error) {
+	config, err := loadConfig(configPath)
+	if err != nil {
+		return nil, nil, err
+	}
+	instances, err := loadInstances(config)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := validateInstances(instances); err != nil {
+		return nil, nil, err
+	}
+	return config, instances, nil
 }
 
 // update is the main loop of hpxd. This is what happens in the loop:
 //
-// 1. HAProxy's configuration is fetched from git.
+// 1. HAProxy's configuration is fetched from the source, git by default.
 //
-// 2. The fetched configuration is validated. If it's invalid, the loop continues.
+// 2. The fetched configuration is rendered and validated, along with the
+// auxiliary files it references. If it's invalid, the loop continues.
 //
-// 3. If the configuration is valid, it's applied and HAProxy is reloaded.
-func update(gitHandler *git.Handler, haproxyHandler *haproxy.Handler, config *Configuration) {
-	for {
-		configPath, updated, err := gitHandler.PullAndUpdate()
+// 3. If the configuration is valid and applyGate lets it through, it's
+// applied, the auxiliary files are synced and HAProxy is reloaded. Otherwise
+// it's held and evaluated again on the next iteration.
+//
+// The loop runs until ctx is done. Fetches, validations and health checks in
+// progress are stopped, but files being deployed and HAProxy being reloaded
+// are always finished, so neither is ever left half-done.
+func update(ctx context.Context, inst *instance) {
+	config, source, renderer := inst.config, inst.source, inst.renderer
+	detector := drift.NewDetector(filepath.Join(config.StateDir, "drift"))
+	validator := haproxy.NewValidator(config.HaproxyBinary)
+	var heldConfigPath string
+	// shadowedConfigPath is the last revision evaluated in dry-run mode
+	var shadowedConfigPath string
+	var lastDriftCheck time.Time
+	// fresh is set until the first revision is evaluated. Sources report
+	// their content as new after a restart, and a revision matching the
+	// deployed files is only adopted rather than applied again.
+	fresh := true
+
+	for ctx.Err() == nil {
+		select {
+		case req := <-inst.rollbacks:
+			release, err := rollback(ctx, inst, validator, detector, req.revision)
+			if err == nil {
+				// The rolled back configuration supersedes any held one
+				heldConfigPath = ""
+			}
+			req.done <- rollbackResult{release: release, err: err}
+		default:
+		}
+
+		if config.Drift.Mode != driftModeOff && time.Since(lastDriftCheck) >= config.Drift.Interval {
+			checkDrift(inst, validator, detector)
+			lastDriftCheck = time.Now()
+		}
+
+		configPath, updated, err := source.PullAndUpdate(ctx)
 		if err != nil {
-			logrus.Errorf("Error while pulling updates: %v", err)
+			if ctx.Err() != nil {
+				return
+			}
+			inst.log.Errorf("Error while pulling updates: %v", err)
 			// Update Prometheus metric for failed Git pull
-			metrics.GitPullCounter.WithLabelValues("failure").Inc()
-			time.Sleep(config.PollingInterval)
+			metrics.GitPullCounter.WithLabelValues(inst.name, "failure").Inc()
+			inst.state.setError(fmt.Errorf("pull failed: %w", err))
+			wait(ctx, config.PollingInterval, inst.syncRequests)
 			continue
 		}
 
+		inst.state.setSynced()
+		if updated && rolledBack(inst) {
+			// The rolled back revision is only applied again with a new one,
+			// even when it's fetched again after a restart
+			updated = false
+			inst.log.Infof("Revision %s was rolled back, waiting for a new revision", source.Revision())
+		}
 		if updated {
-			// Temporarily create a handler for validation
-			tempHandler := haproxy.NewHandler(configPath)
+			inst.lastChange = time.Now()
+		}
 
-			// Check if new configuration is valid
-			if err := tempHandler.ValidateConfig(); err != nil {
-				logrus.Errorf("Pulled HAProxy configuration is invalid: %v", err)
+		changedPools := refreshPools(inst)
+
+		if shadowedConfigPath != "" && !inst.dryRun() {
+			// Dry-run mode was turned off, apply the last evaluated revision
+			if heldConfigPath == "" {
+				heldConfigPath = shadowedConfigPath
+			}
+			shadowedConfigPath = ""
+		}
+
+		if !updated && heldConfigPath != "" {
+			configPath, updated = heldConfigPath, true
+		}
+
+		if inst.paused() {
+			if updated {
+				// Keep the revision until applies are resumed
+				heldConfigPath = configPath
+				inst.state.setHeld("applies are paused")
+				inst.log.Debugf("Applies are paused, holding revision %s", source.Revision())
+			}
+			wait(ctx, config.PollingInterval, inst.syncRequests)
+			continue
+		}
+
+		if delay := debounceDelay(inst); updated && delay > 0 {
+			// Let a burst of revisions settle, and apply the last one
+			heldConfigPath = configPath
+			inst.state.setHeld("waiting for changes to settle")
+			inst.log.Debugf("Waiting %s for changes to settle before applying revision %s",
+				delay.Round(time.Second), source.Revision())
+			wait(ctx, min(delay, config.PollingInterval), inst.syncRequests)
+			continue
+		}
+
+		if !updated && renderer.applied != nil && !inst.dryRun() &&
+			(len(changedPools) > 0 || renderer.kubernetesChanged() || inst.discoveryPending) {
+			applyDiscoveryChanges(ctx, inst, validator, detector)
+		}
+
+		// interval is shortened while a reload is held by the reload limits
+		interval := config.PollingInterval
+
+		if updated {
+			candidate, err := renderer.render(configPath)
+			if err != nil {
+				// Discovery may not be ready yet, try again on the next
+				// iteration
+				inst.log.Warnf("Failed to render HAProxy configuration, retrying: %v", err)
+				inst.state.setError(fmt.Errorf("render failed: %w", err))
+				heldConfigPath = configPath
+				wait(ctx, config.PollingInterval, inst.syncRequests)
+				continue
+			}
+
+			var diags []haproxy.Diagnostic
+			synced, err := files.Resolve(source.RepoPath(), config.SyncFiles)
+			if err == nil {
+				// Check if new configuration is valid
+				diags, err = validateCandidate(ctx, inst, candidate.path, synced, validator)
+			}
+			if ctx.Err() != nil {
+				// hpxd is stopping, the revision is evaluated again on the
+				// next start
+				return
+			}
+			inst.state.setValidation(source.Revision(), diags, err)
+
+			if err != nil {
+				inst.log.Errorf("Pulled HAProxy configuration is invalid: %v", err)
 				// Update Prometheus metric for invalid config
-				metrics.InvalidConfigCounter.Inc()
+				metrics.InvalidConfigCounter.WithLabelValues(inst.name).Inc()
+				if !inst.dryRun() {
+					reportRollout(ctx, inst, source.Revision(), err)
+					reportInvalid(inst, diags, err)
+					recordStatus(inst, validator, resultInvalid, err)
+				}
+				inst.state.setError(fmt.Errorf("revision %s is invalid: %w", source.Revision(), err))
+				heldConfigPath, shadowedConfigPath = "", ""
+			} else if inst.dryRun() {
+				// Report what applying the revision would change, and keep
+				// it until dry-run mode is turned off
+				heldConfigPath, shadowedConfigPath = "", configPath
+				inst.state.setHeld("dry-run mode is enabled")
+				reportDryRun(inst, source.Revision(), candidate.path, synced)
+			} else if fresh && deployed(inst, candidate.path, synced) {
+				heldConfigPath = ""
+				renderer.setApplied(candidate, synced)
+				inst.state.setApplied(source.Revision())
+				inst.log.Infof("Revision %s is already deployed", source.Revision())
+			} else if held, retry := applyGate(inst, candidate.path); held != "" {
+				heldConfigPath = configPath
+				inst.state.setHeld(held)
+				if retry > 0 {
+					interval = min(retry, interval)
+				}
 			} else {
+				heldConfigPath = ""
 				// If valid, update the actual config and reload HAProxy
-				copyConfig(configPath, config.HaproxyConfigPath)
-
-				if err := haproxyHandler.Reload(); err != nil {
-					logrus.Errorf("Failed to reload HAProxy: %v", err)
+				err := deployFiles(inst, candidate.path, synced)
+				if err != nil {
+					// HAProxy keeps running the previous configuration, try
+					// the revision again on the next iteration
+					heldConfigPath = configPath
+					inst.log.Errorf("Failed to deploy revision %s, not reloading HAProxy: %v", source.Revision(), err)
+					inst.state.setError(fmt.Errorf("deploy failed: %w", err))
 				} else {
-					// Update Prometheus metric for successful HAProxy reload
-					metrics.HaproxyReloadCounter.Inc()
-					logrus.Info("Configuration updated and HAProxy reloaded successfully!")
+					recordDesiredState(inst, detector, candidate.path, synced)
+					renderer.setApplied(candidate, synced)
+
+					if err = reloadHAProxy(inst); err != nil {
+						inst.log.Errorf("Failed to reload HAProxy: %v", err)
+						inst.state.setError(fmt.Errorf("reload failed: %w", err))
+					} else {
+						// Update Prometheus metric for successful HAProxy reload
+						metrics.HaproxyReloadCounter.WithLabelValues(inst.name).Inc()
+						inst.log.Infof("Configuration updated to revision %s and HAProxy reloaded successfully!", source.Revision())
+						inst.state.setApplied(source.Revision())
+						recordRelease(inst, source.Revision(), "update", configPath, synced)
+						consumeApproval(inst, inst.approvals)
+					}
 				}
+				failure := reportRollout(ctx, inst, source.Revision(), err)
+				reportApplied(inst, diags, failure)
+				result := resultApplied
+				if failure != nil {
+					result = resultFailed
+				}
+				recordStatus(inst, validator, result, failure)
 			}
+			fresh = false
+		}
+		wait(ctx, interval, inst.syncRequests)
+	}
+}
+
+// applyGate tells whether the candidate configuration of the fetched
+// revision may be applied now. The blast-radius guard, the maintenance
+// restrictions, the wave of a staged rollout and the reload limits are
+// checked in that order. When one of them holds the revision, the reason is
+// returned, along with how soon to check again when that's sooner than the
+// polling interval.
+func applyGate(inst *instance, candidatePath string) (held string, retry time.Duration) {
+	revision := inst.source.Revision()
+	switch {
+	case guardUpdate(inst, candidatePath, inst.approvals):
+		// The update removes too much, keep it until it's approved
+		reportCommitStatus(inst, commitstatus.StatePending, "Held on "+inst.hostname+" by the blast-radius guard, pending approval")
+		return "pending approval of the blast-radius guard", 0
+	case !maintenanceAllows(inst, "revision "+revision):
+		// Changes aren't allowed now, queue the revision
+		reportCommitStatus(inst, commitstatus.StatePending, "Queued on "+inst.hostname+": "+inst.maintenanceReason)
+		return inst.maintenanceReason, 0
+	case !rolloutAllows(inst, revision):
+		// The wave of the host doesn't apply this revision yet
+		reportCommitStatus(inst, commitstatus.StatePending, "Waiting on "+inst.hostname+": "+inst.rolloutReason)
+		return inst.rolloutReason, 0
+	}
+	if delay, reason := reloadDelay(inst); delay > 0 {
+		// HAProxy was reloaded too recently, or old workers are still
+		// draining
+		return reason, delay
+	}
+	return "", 0
+}
+
+// deployed reports whether the configuration at configPath and the synced
+// auxiliary files match the deployed ones.
+func deployed(inst *instance, configPath string, synced []files.File) bool {
+	targets := []files.File{{Source: configPath, Target: inst.config.HaproxyConfigPath}}
+	for _, target := range append(targets, synced...) {
+		live, err := os.ReadFile(filepath.Clean(target.Target))
+		if err != nil {
+			return false
+		}
+		desired, err := os.ReadFile(filepath.Clean(target.Source))
+		if err != nil || !bytes.Equal(live, desired) {
+			return false
 		}
-		time.Sleep(config.PollingInterval)
 	}
+	return true
 }
 
 // copyConfig copies the fetched HAProxy configuration
 // from the temporary storage to the specified destination path.
-func copyConfig(src, dest string) {
+// The destination is replaced atomically, see files.WriteAtomic.
+func copyConfig(src, dest string) error {
 	input, err := os.ReadFile(filepath.Clean(src))
 	if err != nil {
-		logrus.Errorf("Failed to read config from source: %v", err)
-		return
+		return fmt.Errorf("failed to read config from source: %w", err)
 	}
 
-	err = os.WriteFile(dest, input, 0600)
-	if err != nil {
-		logrus.Errorf("Error writing config to destination: %v", err)
+	if err := files.WriteAtomic(dest, input); err != nil {
+		return fmt.Errorf("failed to write config to destination: %w", err)
 	}
+	return nil
 }
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/zcubbs/hpxd/pkg/local"
+)
+
+func TestApplyGate(t *testing.T) {
+	inst := newTestInstances(t, defaultInstanceName)[0]
+	handler, err := local.NewHandler(t.TempDir(), "haproxy.cfg", time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = handler.Close() }()
+	inst.source = handler
+
+	if held, retry := applyGate(inst, "haproxy.cfg"); held != "" || retry != 0 {
+		t.Errorf("Expected the revision to be let through, but got: %q, %s", held, retry)
+	}
+
+	inst.config.Reload.MinInterval = time.Minute
+	inst.lastReload = time.Now()
+	held, retry := applyGate(inst, "haproxy.cfg")
+	if !strings.Contains(held, "reloaded less than 1m0s ago") || retry <= 0 || retry > time.Minute {
+		t.Errorf("Expected the reload limit to hold the revision, but got: %q, %s", held, retry)
+	}
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"time"
+
+	"github.com/zcubbs/hpxd/pkg/maintenance"
+	"github.com/zcubbs/hpxd/pkg/metrics"
+)
+
+// overrideFile keeps the emergency override of an instance in its state
+// directory.
+const overrideFile = "maintenance-override.json"
+
+// newSchedule returns the maintenance schedule of the instance, or nil when
+// changes aren't restricted.
+func newSchedule(inst *instance) *maintenance.Schedule {
+	if !inst.config.Maintenance.Enabled() {
+		return nil
+	}
+	schedule, err := maintenance.NewSchedule(inst.config.Maintenance)
+	if err != nil {
+		inst.log.Fatalf("Error creating the maintenance schedule: %v", err)
+	}
+	return schedule
+}
+
+// maintenanceAllows reports whether change, such as a revision, may be
+// applied now: within a maintenance window, outside of blackouts and
+// freezes, or with an emergency override. Changes that may not are queued
+// until they may.
+func maintenanceAllows(inst *instance, change string) bool {
+	if inst.schedule == nil {
+		return true
+	}
+
+	reason := maintenanceRestriction(inst)
+	if reason != "" {
+		if override := emergencyOverride(inst); override != "" {
+			inst.log.Warnf("Applying %s despite change restrictions (%s) with %s", change, reason, override)
+			reason = ""
+		}
+	}
+	if reason == "" {
+		inst.maintenanceReason = ""
+		metrics.MaintenanceQueued.WithLabelValues(inst.name).Set(0)
+		return true
+	}
+
+	if reason != inst.maintenanceReason {
+		inst.log.Infof("Queuing %s: %s", change, reason)
+		inst.maintenanceReason = reason
+	}
+	metrics.MaintenanceQueued.WithLabelValues(inst.name).Set(1)
+	return false
+}
+
+// maintenanceRestriction returns why changes may not be applied now, or an
+// empty string if they may. Freeze files that can't be read count as
+// freezes.
+func maintenanceRestriction(inst *instance) string {
+	config := inst.config.Maintenance
+	freezeFiles := []string{config.NodeFreezeFile}
+	if config.FreezeFile != "" {
+		freezeFiles = append(freezeFiles, filepath.Join(inst.source.RepoPath(), config.FreezeFile))
+	}
+	for _, path := range freezeFiles {
+		if path == "" {
+			continue
+		}
+		frozen, reason, err := maintenance.Frozen(path)
+		if err != nil {
+			inst.log.Errorf("Failed to read freeze file %s: %v", path, err)
+			return "freeze file " + path + " can't be read"
+		}
+		if frozen {
+			return "change freeze: " + reason
+		}
+	}
+
+	if d := inst.schedule.Check(time.Now()); !d.Allowed {
+		return d.Reason
+	}
+	return ""
+}
+
+// emergencyOverride returns what lets changes through despite restrictions:
+// an override granted through the admin API, or the override trailer in
+// the message of the fetched commit. It returns an empty string if there is
+// none.
+func emergencyOverride(inst *instance) string {
+	if o, err := inst.overrides.Active(time.Now()); err != nil {
+		inst.log.Errorf("Failed to read the emergency override: %v", err)
+	} else if o != nil {
+		return fmt.Sprintf("an override until %s: %s", o.Until.Format(time.RFC3339), o.Reason)
+	}
+
+	key := inst.config.Maintenance.OverrideTrailer
+	g := gitHandlerOf(inst.source)
+	if key == "" || g == nil {
+		return ""
+	}
+	value, err := g.Trailer(key)
+	if err != nil {
+		inst.log.Errorf("Failed to read the %s trailer: %v", key, err)
+		return ""
+	}
+	if value != "" {
+		return fmt.Sprintf("the %s trailer: %s", key, value)
+	}
+	return ""
+}
+
+// grantOverride lets changes through maintenance restrictions for
+// duration, or revokes the override when duration is 0.
+func grantOverride(inst *instance, duration time.Duration, reason string) (interface{}, error) {
+	if duration == 0 {
+		if err := inst.overrides.Clear(); err != nil {
+			return nil, err
+		}
+		inst.log.Info("Emergency override revoked")
+		return "override revoked", nil
+	}
+
+	override, err := inst.overrides.Grant(time.Now().Add(duration), reason)
+	if err != nil {
+		return nil, err
+	}
+	inst.log.Warnf("Emergency override granted until %s: %s", override.Until.Format(time.RFC3339), reason)
+	requestSync(inst.syncRequests)
+	return override, nil
+}
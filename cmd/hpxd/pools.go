@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/zcubbs/hpxd/pkg/discovery"
+	"github.com/zcubbs/hpxd/pkg/metrics"
+)
+
+// Supported values of the `type` setting of server pools.
+const (
+	poolTypeDNS    = "dns"
+	poolTypeConsul = "consul"
+	poolTypeFile   = "file"
+)
+
+// PoolConfig configures a server pool, filled from service discovery and
+// used in configurations with a `# hpxd:pool <name>` marker.
+//
+// DNS pools resolve the SRV records of DNS, Consul pools the healthy
+// instances of Service (optionally with Tag) through the `consul` settings,
+// and file pools read the JSON list of servers in File.
+type PoolConfig struct {
+	Name    string `mapstructure:"name"`
+	Type    string `mapstructure:"type"`
+	DNS     string `mapstructure:"dns"`
+	Service string `mapstructure:"service"`
+	Tag     string `mapstructure:"tag"`
+	File    string `mapstructure:"file"`
+}
+
+// newPools creates the configured server pools, or returns nil if there
+// are none.
+func newPools(config *Configuration) (*discovery.Pools, error) {
+	if len(config.Pools) == 0 {
+		return nil, nil
+	}
+
+	providers := make(map[string]discovery.Provider, len(config.Pools))
+	for _, pool := range config.Pools {
+		switch pool.Type {
+		case poolTypeDNS:
+			providers[pool.Name] = discovery.NewDNS(pool.DNS)
+		case poolTypeConsul:
+			providers[pool.Name] = discovery.NewConsulCatalog(config.Consul, pool.Service, pool.Tag)
+		case poolTypeFile:
+			provider, err := discovery.NewFile(pool.File)
+			if err != nil {
+				return nil, fmt.Errorf("pool %s: %w", pool.Name, err)
+			}
+			providers[pool.Name] = provider
+		}
+	}
+	return discovery.NewPools(providers), nil
+}
+
+// validatePools checks the settings required by every server pool.
+func validatePools(pools []PoolConfig) error {
+	names := make(map[string]bool, len(pools))
+	for i, pool := range pools {
+		if pool.Name == "" {
+			return fmt.Errorf("missing required config: pools[%d].name", i)
+		}
+		if names[pool.Name] {
+			return fmt.Errorf("invalid config: duplicate pool name %s", pool.Name)
+		}
+		names[pool.Name] = true
+
+		prefix := fmt.Sprintf("pools[%s].", pool.Name)
+		switch pool.Type {
+		case poolTypeDNS:
+			if pool.DNS == "" {
+				return errors.New("missing required config: " + prefix + "dns")
+			}
+		case poolTypeConsul:
+			if pool.Service == "" {
+				return errors.New("missing required config: " + prefix + "service")
+			}
+		case poolTypeFile:
+			if pool.File == "" {
+				return errors.New("missing required config: " + prefix + "file")
+			}
+		default:
+			return fmt.Errorf("invalid config: %stype must be one of %s", prefix,
+				strings.Join([]string{poolTypeDNS, poolTypeConsul, poolTypeFile}, ", "))
+		}
+	}
+	return nil
+}
+
+// refreshPools resolves the server pools and returns the names of those
+// that changed.
+func refreshPools(inst *instance) []string {
+	pools := inst.renderer.pools
+	if pools == nil {
+		return nil
+	}
+
+	changed, err := pools.Refresh(context.Background())
+	if err != nil {
+		inst.log.Warnf("Failed to resolve server pools, keeping their last servers: %v", err)
+	}
+	for name, servers := range pools.Snapshot() {
+		metrics.PoolServers.WithLabelValues(inst.name, name).Set(float64(len(servers)))
+	}
+	if len(changed) > 0 {
+		inst.log.Infof("Server pools changed: %s", strings.Join(changed, ", "))
+	}
+	return changed
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/zcubbs/hpxd/pkg/haproxy"
+	"github.com/zcubbs/hpxd/pkg/metrics"
+)
+
+// oldWorkersRetry is how often reloads held by old workers are retried,
+// when the polling interval is longer.
+const oldWorkersRetry = 5 * time.Second
+
+// ReloadConfig limits how often HAProxy is reloaded, as every reload
+// spawns new workers while the old ones drain their connections.
+//
+// MinInterval is the minimum time between two reloads. Debounce is how long
+// fetched revisions must stay unchanged before being applied, so a burst of
+// commits is applied at once. With MaxOldWorkers, a reload is only allowed
+// while fewer old workers than that are still running, as listed by the
+// master CLI at MasterSocket.
+type ReloadConfig struct {
+	MinInterval   time.Duration `mapstructure:"minInterval"`
+	Debounce      time.Duration `mapstructure:"debounce"`
+	MasterSocket  string        `mapstructure:"masterSocket"`
+	MaxOldWorkers int           `mapstructure:"maxOldWorkers"`
+}
+
+// Validate checks the limits.
+func (c ReloadConfig) Validate() error {
+	if c.MinInterval < 0 || c.Debounce < 0 || c.MaxOldWorkers < 0 {
+		return errors.New("minInterval, debounce and maxOldWorkers can't be negative")
+	}
+	if c.MaxOldWorkers > 0 && c.MasterSocket == "" {
+		return errors.New("maxOldWorkers requires masterSocket")
+	}
+	return nil
+}
+
+// debounceDelay returns how long the revision fetched last must stay
+// unchanged before being applied.
+func debounceDelay(inst *instance) time.Duration {
+	debounce := inst.config.Reload.Debounce
+	if debounce == 0 || inst.lastChange.IsZero() {
+		return 0
+	}
+	return max(debounce-time.Since(inst.lastChange), 0)
+}
+
+// reloadDelay returns how long to wait before HAProxy may be reloaded
+// again and why, or 0 if it may be reloaded now.
+//
+// Old workers are only counted when `reload.maxOldWorkers` is set. If the
+// master CLI can't be reached, reloads aren't held.
+func reloadDelay(inst *instance) (time.Duration, string) {
+	config := inst.config.Reload
+	delay, reason := time.Duration(0), ""
+	if config.MinInterval > 0 && !inst.lastReload.IsZero() {
+		if remaining := config.MinInterval - time.Since(inst.lastReload); remaining > 0 {
+			delay = remaining
+			reason = fmt.Sprintf("HAProxy was reloaded less than %s ago", config.MinInterval)
+		}
+	}
+
+	if delay == 0 && config.MaxOldWorkers > 0 {
+		processes, err := haproxy.NewRuntimeClient(config.MasterSocket).Processes()
+		if err != nil {
+			inst.log.Warnf("Failed to count old HAProxy workers, not holding the reload: %v", err)
+		} else {
+			old := 0
+			for _, p := range processes {
+				if p.Old && p.Type == "worker" {
+					old++
+				}
+			}
+			metrics.HaproxyOldWorkers.WithLabelValues(inst.name).Set(float64(old))
+			if old >= config.MaxOldWorkers {
+				delay = oldWorkersRetry
+				reason = fmt.Sprintf("%d old HAProxy worker(s) still draining, another reload would exceed %d",
+					old, config.MaxOldWorkers)
+			}
+		}
+	}
+
+	if reason != inst.reloadReason {
+		if reason != "" {
+			inst.log.Infof("Holding the reload of HAProxy: %s", reason)
+		}
+		inst.reloadReason = reason
+	}
+	deferred := 0.0
+	if delay > 0 {
+		deferred = 1
+	}
+	metrics.ReloadDeferred.WithLabelValues(inst.name).Set(deferred)
+	return delay, reason
+}
+
+// reloadHAProxy reloads HAProxy and records when, for `reload.minInterval`.
+func reloadHAProxy(inst *instance) error {
+	err := inst.haproxyHandler.Reload()
+	if err == nil {
+		inst.lastReload = time.Now()
+	}
+	return err
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/zcubbs/hpxd/pkg/discovery"
+	"github.com/zcubbs/hpxd/pkg/drift"
+	"github.com/zcubbs/hpxd/pkg/files"
+	"github.com/zcubbs/hpxd/pkg/haproxy"
+	"github.com/zcubbs/hpxd/pkg/kubernetes"
+	"github.com/zcubbs/hpxd/pkg/metrics"
+)
+
+// rendering is a configuration with its pool markers replaced by servers
+// and the backends generated from Kubernetes appended.
+type rendering struct {
+	// path is the rendered configuration, or the template itself when
+	// nothing is rendered
+	path     string
+	template []byte
+	content  []byte
+	usages   []discovery.Usage
+	servers  map[string][]discovery.Server
+	// generated holds the backends generated from Kubernetes
+	generated []byte
+	// synced are the auxiliary files deployed along with the rendering
+	synced []files.File
+}
+
+// renderer renders configurations with the servers of the pools and the
+// Kubernetes backends, and remembers the last applied rendering so
+// discovery changes can be applied without a new configuration.
+type renderer struct {
+	pools      *discovery.Pools
+	kubernetes *kubernetes.Watcher
+	dir        string
+	applied    *rendering
+
+	// generation is the Kubernetes generation of the last rendering
+	generation uint64
+}
+
+func newRenderer(pools *discovery.Pools, watcher *kubernetes.Watcher, config *Configuration) *renderer {
+	return &renderer{pools: pools, kubernetes: watcher, dir: filepath.Join(config.StateDir, "rendered")}
+}
+
+// render renders the configuration at configPath with the current servers.
+func (r *renderer) render(configPath string) (*rendering, error) {
+	if r.pools == nil && r.kubernetes == nil {
+		return &rendering{path: configPath}, nil
+	}
+
+	template, err := os.ReadFile(filepath.Clean(configPath))
+	if err != nil {
+		return nil, err
+	}
+	return r.renderTemplate(template, filepath.Base(configPath))
+}
+
+// rerender renders the last applied configuration with the current
+// servers.
+func (r *renderer) rerender() (*rendering, error) {
+	next, err := r.renderTemplate(r.applied.template, filepath.Base(r.applied.path))
+	if err != nil {
+		return nil, err
+	}
+	next.synced = r.applied.synced
+	return next, nil
+}
+
+// setApplied remembers candidate, deployed along with the synced auxiliary
+// files, as the applied rendering.
+func (r *renderer) setApplied(candidate *rendering, synced []files.File) {
+	candidate.synced = synced
+	r.applied = candidate
+}
+
+// kubernetesChanged reports whether Kubernetes objects changed since the
+// last rendering.
+func (r *renderer) kubernetesChanged() bool {
+	return r.kubernetes != nil && r.kubernetes.Generation() != r.generation
+}
+
+func (r *renderer) renderTemplate(template []byte, name string) (*rendering, error) {
+	next := &rendering{template: template, content: template}
+
+	if r.pools != nil {
+		next.servers = r.pools.Snapshot()
+		content, usages, err := discovery.Render(template, next.servers)
+		if err != nil {
+			return nil, fmt.Errorf("failed to render server pools: %w", err)
+		}
+		next.content, next.usages = content, usages
+	}
+
+	if r.kubernetes != nil {
+		if !r.kubernetes.Synced() {
+			return nil, errors.New("kubernetes objects aren't synced yet")
+		}
+		r.generation = r.kubernetes.Generation()
+		backends, err := r.kubernetes.Backends()
+		if err != nil {
+			return nil, fmt.Errorf("failed to render kubernetes backends: %w", err)
+		}
+
+		// Backends of the configuration take precedence
+		cfg, err := haproxy.ParseConfig(bytes.NewReader(next.content))
+		if err != nil {
+			return nil, err
+		}
+		skip := make(map[string]bool)
+		for _, name := range cfg.Backends() {
+			skip[name] = true
+		}
+		next.generated = kubernetes.Render(backends, skip)
+		next.content = append(append([]byte{}, next.content...), next.generated...)
+	}
+
+	if err := os.MkdirAll(r.dir, 0750); err != nil {
+		return nil, err
+	}
+	next.path = filepath.Join(r.dir, name)
+	if err := os.WriteFile(next.path, next.content, 0600); err != nil {
+		return nil, err
+	}
+	return next, nil
+}
+
+// applyDiscoveryChanges applies the changes of the server pools and of the
+// Kubernetes backends to the last applied configuration.
+//
+// Pool servers are added and removed through the runtime API when it's
+// configured and the Kubernetes backends didn't change. Otherwise, or if
+// that fails, the configuration is rendered again, validated and HAProxy is
+// reloaded. Changes are queued while maintenance restrictions forbid them.
+func applyDiscoveryChanges(ctx context.Context, inst *instance, validator *haproxy.Validator, detector *drift.Detector) {
+	renderer := inst.renderer
+	inst.discoveryPending = false
+	next, err := renderer.rerender()
+	if err != nil {
+		inst.log.Errorf("Failed to render service discovery changes: %v", err)
+		return
+	}
+	if bytes.Equal(next.content, renderer.applied.content) {
+		renderer.applied = next
+		return
+	}
+	if !maintenanceAllows(inst, "service discovery changes") {
+		inst.discoveryPending = true
+		return
+	}
+
+	if inst.config.RuntimeAPI != "" && bytes.Equal(next.generated, renderer.applied.generated) {
+		err := applyAtRuntime(haproxy.NewRuntimeClient(inst.config.RuntimeAPI), renderer.applied, next)
+		if err == nil {
+			if err := deployRendering(inst, next, detector); err != nil {
+				// The servers would be lost on the next reload, try again
+				// on the next iteration
+				inst.log.Errorf("Failed to deploy server pool changes applied through the runtime API: %v", err)
+				inst.discoveryPending = true
+				return
+			}
+			renderer.applied = next
+			metrics.RuntimeUpdatesCounter.WithLabelValues(inst.name, "success").Inc()
+			inst.log.Info("Server pool changes applied through the runtime API")
+			return
+		}
+		metrics.RuntimeUpdatesCounter.WithLabelValues(inst.name, "fallback").Inc()
+		inst.log.Warnf("Failed to apply server pool changes through the runtime API, reloading instead: %v", err)
+	}
+
+	if delay, _ := reloadDelay(inst); delay > 0 {
+		// Apply the changes once reloads are allowed again
+		inst.discoveryPending = true
+		return
+	}
+
+	// The auxiliary files are already deployed, seed the sandbox with the
+	// deployed copies
+	deployedFiles := make([]files.File, 0, len(next.synced))
+	for _, f := range next.synced {
+		deployedFiles = append(deployedFiles, files.File{Source: f.Target, Target: f.Target, TargetRoot: f.TargetRoot})
+	}
+	if _, err := validateCandidate(ctx, inst, next.path, deployedFiles, validator); err != nil {
+		if ctx.Err() != nil {
+			inst.discoveryPending = true
+			return
+		}
+		inst.log.Errorf("HAProxy configuration rendered with the new servers is invalid: %v", err)
+		metrics.InvalidConfigCounter.WithLabelValues(inst.name).Inc()
+		return
+	}
+	if err := deployRendering(inst, next, detector); err != nil {
+		inst.log.Errorf("Failed to deploy service discovery changes, not reloading HAProxy: %v", err)
+		inst.discoveryPending = true
+		return
+	}
+	renderer.applied = next
+
+	if err := reloadHAProxy(inst); err != nil {
+		inst.log.Errorf("Failed to reload HAProxy: %v", err)
+		return
+	}
+	metrics.HaproxyReloadCounter.WithLabelValues(inst.name).Inc()
+	inst.log.Info("Service discovery changes applied and HAProxy reloaded successfully!")
+}
+
+// applyAtRuntime adds and removes the servers that differ between the
+// applied rendering and next through the runtime API.
+func applyAtRuntime(client *haproxy.RuntimeClient, applied, next *rendering) error {
+	for _, usage := range next.usages {
+		added, removed := discovery.Diff(applied.servers[usage.Pool], next.servers[usage.Pool])
+		for _, s := range removed {
+			if err := client.DelServer(usage.Backend, discovery.ServerName(usage.Pool, s)); err != nil {
+				return err
+			}
+		}
+		for _, s := range added {
+			if err := client.AddServer(usage.Backend, discovery.ServerName(usage.Pool, s), s.Endpoint(), usage.Options); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// deployRendering writes a configuration rendered again with new servers,
+// so the servers survive the next reload, and records it as the desired
+// state.
+func deployRendering(inst *instance, next *rendering, detector *drift.Detector) error {
+	if err := copyConfig(next.path, inst.config.HaproxyConfigPath); err != nil {
+		return err
+	}
+	if err := detector.RecordFile(inst.config.HaproxyConfigPath, next.path); err != nil {
+		inst.log.Errorf("Failed to record desired state: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/zcubbs/hpxd/pkg/discovery"
+	"github.com/zcubbs/hpxd/pkg/drift"
+	"github.com/zcubbs/hpxd/pkg/files"
+	"github.com/zcubbs/hpxd/pkg/haproxy"
+)
+
+type fakeProvider struct {
+	servers []discovery.Server
+}
+
+func (p *fakeProvider) Resolve(context.Context) ([]discovery.Server, error) {
+	return p.servers, nil
+}
+
+func writeScript(t *testing.T, path, script string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte("#!/bin/sh\n"+script), 0700); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestApplyDiscoveryChanges_SyncedFiles(t *testing.T) {
+	dir, bin := t.TempDir(), t.TempDir()
+	// Reloads go through `sudo systemctl reload`
+	writeScript(t, filepath.Join(bin, "sudo"), "exit 0\n")
+	t.Setenv("PATH", bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+	// The configuration is only valid with the synced map next to it
+	validator := haproxy.NewValidator(filepath.Join(bin, "haproxy"))
+	writeScript(t, filepath.Join(bin, "haproxy"),
+		`while [ $# -gt 0 ]; do [ "$1" = "-C" ] && dir=$2; shift; done
+test -f "$dir/maps/hosts.map"
+`)
+
+	inst := newTestInstances(t, defaultInstanceName)[0]
+	inst.config.HaproxyConfigPath = filepath.Join(dir, "live", "haproxy.cfg")
+	inst.config.VersionCheck = versionCheckOff
+	inst.haproxyHandler = haproxy.NewHandlerForUnit(inst.config.HaproxyConfigPath, "")
+	provider := &fakeProvider{servers: []discovery.Server{{Address: "10.0.0.1", Port: 80}}}
+	pools := discovery.NewPools(map[string]discovery.Provider{"web": provider})
+	inst.renderer = newRenderer(pools, nil, inst.config)
+	refreshPools(inst)
+
+	template := filepath.Join(dir, "repo", "haproxy.cfg")
+	synced := []files.File{{
+		Source:     filepath.Join(dir, "repo", "maps", "hosts.map"),
+		Target:     filepath.Join(dir, "live", "maps", "hosts.map"),
+		TargetRoot: filepath.Join(dir, "live", "maps"),
+	}}
+	if err := os.MkdirAll(filepath.Join(dir, "repo", "maps"), 0750); err != nil {
+		t.Fatal(err)
+	}
+	for path, content := range map[string]string{
+		template:         "backend web\n    # hpxd:pool web\n",
+		synced[0].Source: "a b\n",
+	} {
+		if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	candidate, err := inst.renderer.render(template)
+	if err != nil {
+		t.Fatalf("Failed to render: %v", err)
+	}
+	if err := deployFiles(inst, candidate.path, synced); err != nil {
+		t.Fatalf("Failed to deploy: %v", err)
+	}
+	inst.renderer.setApplied(candidate, synced)
+
+	provider.servers = append(provider.servers, discovery.Server{Address: "10.0.0.2", Port: 80})
+	refreshPools(inst)
+	applyDiscoveryChanges(context.Background(), inst, validator, drift.NewDetector(filepath.Join(inst.config.StateDir, "drift")))
+
+	live, err := os.ReadFile(inst.config.HaproxyConfigPath)
+	if err != nil || !strings.Contains(string(live), "10.0.0.2:80") {
+		t.Errorf("Expected the new server to be deployed, but got: %s, %v", live, err)
+	}
+	if inst.discoveryPending {
+		t.Errorf("Expected no pending discovery changes")
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/zcubbs/hpxd/pkg/httpserver"
+	"github.com/zcubbs/hpxd/pkg/metrics"
+	"github.com/zcubbs/hpxd/pkg/rollout"
+)
+
+// newRollout returns the staged rollout of the instance, or nil when it's
+// disabled. Instances coordinate with the same instance of other hosts.
+func newRollout(inst *instance) *rollout.Rollout {
+	config := inst.config.Rollout
+	if !config.Enabled {
+		return nil
+	}
+
+	store, err := config.NewStore()
+	if err != nil {
+		inst.log.Fatalf("Error creating rollout store: %v", err)
+	}
+	r := rollout.New(config, inst.name, inst.hostname, store)
+	inst.log.Infof("Host %s belongs to rollout wave %s", inst.hostname, r.Wave().Name)
+	return r
+}
+
+// rolloutAllows reports whether the wave of the host may apply revision.
+// Revisions are held while the coordination store can't be reached.
+func rolloutAllows(inst *instance, revision string) bool {
+	if inst.rollout == nil {
+		return true
+	}
+
+	ok, reason, err := inst.rollout.Check(revision)
+	if err != nil {
+		inst.log.Errorf("Failed to check the rollout of revision %s, holding it: %v", revision, err)
+		inst.rolloutReason = "rollout coordination unavailable"
+		metrics.RolloutWaiting.WithLabelValues(inst.name).Set(1)
+		return false
+	}
+	if !ok {
+		if reason != inst.rolloutReason {
+			inst.log.Infof("Revision %s is held: %s", revision, reason)
+			inst.rolloutReason = reason
+		}
+		metrics.RolloutWaiting.WithLabelValues(inst.name).Set(1)
+		return false
+	}
+
+	inst.rolloutReason = ""
+	metrics.RolloutWaiting.WithLabelValues(inst.name).Set(0)
+	return true
+}
+
+// reportRollout reports the outcome of applying revision to the fleet. A
+// successful reload is only reported healthy once `rollout.healthCheckURL`,
+// if set, answers. The reported failure, if any, is returned.
+//
+// The health check stops when ctx is done, in which case nothing is
+// reported: the outcome is unknown, and failing the revision for the whole
+// fleet because hpxd is stopping would hold the later waves.
+func reportRollout(ctx context.Context, inst *instance, revision string, failure error) error {
+	if inst.rollout == nil {
+		return failure
+	}
+
+	if url := inst.config.Rollout.HealthCheckURL; failure == nil && url != "" {
+		failure = rollout.CheckHealth(ctx, url)
+		if ctx.Err() != nil {
+			inst.log.Warnf("Health check of revision %s interrupted, not reporting it to the fleet", revision)
+			return nil
+		}
+	}
+	if failure != nil {
+		inst.log.Warnf("Reporting revision %s as failed to the fleet: %v", revision, failure)
+	}
+	if err := inst.rollout.Report(revision, failure); err != nil {
+		inst.log.Errorf("Failed to report the rollout of revision %s: %v", revision, err)
+	}
+	return failure
+}
+
+// startRolloutEndpoint serves the file store of `rollout.dir` as the
+// coordination endpoint of hosts using the HTTP store, with the TLS and
+// authentication settings of `server`. Hosts need the read role to list
+// reports and the admin role to send them, which `rollout.token` grants.
+func startRolloutEndpoint(config *Configuration) *http.Server {
+	address := config.Rollout.Listen
+	listener, err := httpserver.Listen(address, config.Server.TLS)
+	if err != nil {
+		logrus.Fatalf("Error starting rollout endpoint: %v", err)
+	}
+
+	credentials := config.Server.Auth
+	if config.Rollout.Token != "" {
+		credentials = append(credentials[:len(credentials):len(credentials)],
+			httpserver.Credential{Token: config.Rollout.Token, Role: httpserver.RoleAdmin})
+	}
+	if len(credentials) == 0 && !strings.HasPrefix(address, "unix:") && !isLoopback(address) {
+		logrus.Warnf("Rollout endpoint listens on %s without authentication", address)
+	}
+
+	auth := httpserver.NewAuthenticator(credentials)
+	handler := rollout.Handler(rollout.NewFileStore(config.Rollout.Dir), "")
+	read, write := auth.Require(httpserver.RoleRead, handler), auth.Require(httpserver.RoleAdmin, handler)
+	server := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method == http.MethodGet {
+				read.ServeHTTP(w, r)
+				return
+			}
+			write.ServeHTTP(w, r)
+		}),
+		ReadHeaderTimeout: 3 * time.Second,
+	}
+	go func() {
+		err := server.Serve(listener)
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logrus.Fatalf("Error serving rollout endpoint: %v", err)
+		}
+	}()
+	return server
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/zcubbs/hpxd/pkg/git"
+	"github.com/zcubbs/hpxd/pkg/hostpath"
+	"github.com/zcubbs/hpxd/pkg/httpsource"
+	"github.com/zcubbs/hpxd/pkg/kvsource"
+	"github.com/zcubbs/hpxd/pkg/local"
+	"github.com/zcubbs/hpxd/pkg/s3source"
+	"github.com/zcubbs/hpxd/pkg/source"
+)
+
+// Supported values of the `sourceType` setting.
+const (
+	sourceTypeGit    = "git"
+	sourceTypeLocal  = "local"
+	sourceTypeHTTP   = "http"
+	sourceTypeS3     = "s3"
+	sourceTypeConsul = "consul"
+	sourceTypeEtcd   = "etcd"
+)
+
+// SourceConfig selects and configures a source. The main source is
+// configured at the top level of the configuration, inputs in the `inputs`
+// list.
+type SourceConfig struct {
+	SourceType string `mapstructure:"sourceType"`
+
+	RepoURL string `mapstructure:"repoURL"`
+	Branch  string `mapstructure:"branch"`
+	Path    string `mapstructure:"path"`
+
+	GitUsername string `mapstructure:"gitUsername"`
+	GitPassword string `mapstructure:"gitPassword"`
+
+	LocalDir      string        `mapstructure:"localDir"`
+	LocalDebounce time.Duration `mapstructure:"localDebounce"`
+
+	HTTP httpsource.Config `mapstructure:"http"`
+	S3   s3source.Config   `mapstructure:"s3"`
+
+	KV     KVConfig              `mapstructure:"kv"`
+	Consul kvsource.ConsulConfig `mapstructure:"consul"`
+	Etcd   kvsource.EtcdConfig   `mapstructure:"etcd"`
+}
+
+// KVConfig configures the key/value store sources.
+//
+// Every key below Prefix is materialized as a file. With Assemble, the
+// configuration is assembled from the keys below `<prefix>/<path>/`
+// instead, concatenated in key order.
+type KVConfig struct {
+	Prefix   string `mapstructure:"prefix"`
+	Assemble bool   `mapstructure:"assemble"`
+}
+
+// InputConfig configures a source contributing auxiliary files, such as
+// maps, certificates or server lists, to the configuration provided by the
+// main source. Its files are placed in the Target directory of the composed
+// tree.
+type InputConfig struct {
+	Name         string `mapstructure:"name"`
+	Target       string `mapstructure:"target"`
+	SourceConfig `mapstructure:",squash"`
+}
+
+// localPathSetter is implemented by sources staging their content in a
+// directory of their own.
+type localPathSetter interface {
+	SetLocalPath(path string)
+}
+
+// newSource creates the configuration source of an instance. With inputs,
+// the main source and the inputs are composed into one tree. With path
+// rules, the configuration of the host is selected in the tree of the main
+// source.
+func newSource(config *Configuration, instanceName string, selector *hostpath.Selector) (source.Source, error) {
+	sc := config.SourceConfig
+	path, err := selector.Fallback()
+	if err != nil && !selector.HasRules() {
+		return nil, err
+	}
+	sc.Path = path
+
+	base, err := newSingleSource(sc, config.HaproxyConfigPath)
+	if err != nil {
+		return nil, err
+	}
+	if setter, ok := base.(localPathSetter); ok && (instanceName != defaultInstanceName || stagingRoot != "") {
+		setter.SetLocalPath(stagingDir(instanceName, "source"))
+	}
+	if selector.HasRules() {
+		base = source.NewSelected(base, selector.Select)
+	}
+	if len(config.Inputs) == 0 {
+		return base, nil
+	}
+
+	inputs := make([]source.Input, 0, len(config.Inputs))
+	for _, in := range config.Inputs {
+		if in.LocalDebounce == 0 {
+			in.LocalDebounce = config.LocalDebounce
+		}
+		s, err := newSingleSource(in.SourceConfig, config.HaproxyConfigPath)
+		if err != nil {
+			return nil, fmt.Errorf("input %s: %w", in.Name, err)
+		}
+		if setter, ok := s.(localPathSetter); ok {
+			setter.SetLocalPath(stagingDir(instanceName, "input-"+in.Name))
+		}
+		inputs = append(inputs, source.Input{Name: in.Name, Source: s, Target: in.Target})
+	}
+	return source.NewComposite(base, inputs, stagingDir(instanceName, "composed")), nil
+}
+
+// newPathSelector selects the configuration of the host among `pathRules`,
+// falling back to `path`, with the facts of the host.
+func newPathSelector(config *Configuration) (*hostpath.Selector, error) {
+	facts, err := hostpath.LoadFacts(config.Hostname, config.HostLabelsFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load host facts: %w", err)
+	}
+	return hostpath.NewSelector(config.PathRules, config.Path, facts)
+}
+
+// newSingleSource creates the source selected by `sourceType`.
+func newSingleSource(sc SourceConfig, haproxyConfigPath string) (source.Source, error) {
+	switch sc.SourceType {
+	case sourceTypeLocal:
+		return local.NewHandler(sc.LocalDir, sc.Path, sc.LocalDebounce)
+	case sourceTypeHTTP:
+		return httpsource.NewHandler(sc.HTTP, sc.Path)
+	case sourceTypeS3:
+		return s3source.NewHandler(sc.S3, sc.Path)
+	case sourceTypeConsul:
+		return kvsource.NewHandler(kvsource.NewConsul(sc.Consul), sc.KV.Prefix, sc.Path, sc.KV.Assemble), nil
+	case sourceTypeEtcd:
+		return kvsource.NewHandler(kvsource.NewEtcd(sc.Etcd), sc.KV.Prefix, sc.Path, sc.KV.Assemble), nil
+	}
+
+	return git.NewHandler(
+		sc.RepoURL,
+		sc.Branch,
+		sc.GitUsername,
+		sc.GitPassword,
+		sc.Path,
+		haproxyConfigPath,
+	), nil
+}
+
+// validateSourceConfig checks the settings required by the selected source
+// type. Keys in errors are prefixed with prefix, to point at the input
+// they belong to.
+func validateSourceConfig(sc SourceConfig, prefix string) error {
+	switch sc.SourceType {
+	case sourceTypeGit:
+		if sc.RepoURL == "" {
+			return errors.New("missing required config: " + prefix + "repoURL")
+		}
+
+		if sc.Branch == "" {
+			return errors.New("missing required config: " + prefix + "branch")
+		}
+	case sourceTypeLocal:
+		if sc.LocalDir == "" {
+			return errors.New("missing required config: " + prefix + "localDir")
+		}
+	case sourceTypeHTTP:
+		if sc.HTTP.URL == "" {
+			return errors.New("missing required config: " + prefix + "http.url")
+		}
+	case sourceTypeS3:
+		if sc.S3.Endpoint == "" {
+			return errors.New("missing required config: " + prefix + "s3.endpoint")
+		}
+
+		if sc.S3.Bucket == "" {
+			return errors.New("missing required config: " + prefix + "s3.bucket")
+		}
+	case sourceTypeConsul, sourceTypeEtcd:
+		if sc.KV.Prefix == "" {
+			return errors.New("missing required config: " + prefix + "kv.prefix")
+		}
+	default:
+		return fmt.Errorf("invalid config: %ssourceType must be one of %s", prefix,
+			strings.Join([]string{sourceTypeGit, sourceTypeLocal, sourceTypeHTTP, sourceTypeS3, sourceTypeConsul, sourceTypeEtcd}, ", "))
+	}
+	return nil
+}
+
+// validateInputs checks the sources composed with the main one.
+func validateInputs(inputs []InputConfig) error {
+	names := make(map[string]bool, len(inputs))
+	for i, in := range inputs {
+		if in.Name == "" {
+			return fmt.Errorf("missing required config: inputs[%d].name", i)
+		}
+		if names[in.Name] {
+			return fmt.Errorf("invalid config: duplicate input name %s", in.Name)
+		}
+		names[in.Name] = true
+
+		prefix := fmt.Sprintf("inputs[%s].", in.Name)
+		if err := validateSourceConfig(in.SourceConfig, prefix); err != nil {
+			return err
+		}
+		// Single file artifacts are saved under path
+		if in.SourceType == sourceTypeHTTP && in.Path == "" {
+			return errors.New("missing required config: " + prefix + "path")
+		}
+	}
+	return nil
+}
+
+// forwardSourceChanges turns the change notifications of s, if it supports
+// them, into sync requests.
+func forwardSourceChanges(s source.Source, syncRequests chan<- struct{}) {
+	n, ok := s.(source.Notifier)
+	if !ok {
+		return
+	}
+
+	forwardChanges(n.Changes(), syncRequests)
+}
+
+// forwardChanges turns change notifications into sync requests.
+func forwardChanges(changes <-chan struct{}, syncRequests chan<- struct{}) {
+	go func() {
+		for range changes {
+			requestSync(syncRequests)
+		}
+	}()
+}
+
+// requestSync asks the main loop to sync right away. Requests made while
+// one is already pending are merged into it.
+func requestSync(syncRequests chan<- struct{}) {
+	select {
+	case syncRequests <- struct{}{}:
+	default:
+	}
+}
+
+// wait sleeps for the given duration, until a sync is requested or until
+// ctx is done.
+func wait(ctx context.Context, d time.Duration, syncRequests <-chan struct{}) {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+	case <-syncRequests:
+	case <-ctx.Done():
+	}
+}
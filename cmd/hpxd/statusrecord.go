@@ -0,0 +1,112 @@
+package main
+
+import (
+	"time"
+
+	"github.com/zcubbs/hpxd/pkg/git"
+	"github.com/zcubbs/hpxd/pkg/haproxy"
+)
+
+// Supported values of the `statusRecord.mode` setting.
+const (
+	statusRecordOff    = "off"
+	statusRecordNotes  = "notes"
+	statusRecordBranch = "branch"
+)
+
+// Results of updates, as recorded in the repository.
+const (
+	resultApplied = "applied"
+	resultFailed  = "failed"
+	resultInvalid = "invalid"
+)
+
+const defaultStatusBranch = "hpxd-status"
+
+// statusRecordQueue is how many status records may wait to be pushed.
+const statusRecordQueue = 16
+
+// StatusRecordConfig configures the status records pushed to the git
+// repository after every update, as notes of the applied commit or as
+// files of a status branch. Username and Password are pushed with instead
+// of the git credentials, when those can only read the repository.
+type StatusRecordConfig struct {
+	Mode     string `mapstructure:"mode"`
+	NotesRef string `mapstructure:"notesRef"`
+	Branch   string `mapstructure:"branch"`
+	Username string `mapstructure:"username"`
+	Password string `mapstructure:"password"`
+}
+
+// startStatusRecorder starts pushing the status records of the instance in
+// the background when they're enabled, so a slow or unreachable remote never
+// stalls the update loop.
+func startStatusRecorder(inst *instance) {
+	g := gitHandlerOf(inst.source)
+	if inst.config.StatusRecord.Mode == statusRecordOff || g == nil {
+		return
+	}
+
+	if config := inst.config.StatusRecord; config.Username != "" && config.Password != "" {
+		g.SetPushCredentials(config.Username, config.Password)
+	}
+	inst.statusRecords = make(chan git.StatusRecord, statusRecordQueue)
+	go func() {
+		for record := range inst.statusRecords {
+			pushStatus(inst, g, record)
+		}
+	}()
+}
+
+// recordStatus queues the result of an update to be pushed to the repository
+// it comes from. Records are dropped while the queue is full.
+func recordStatus(inst *instance, validator *haproxy.Validator, result string, failure error) {
+	if inst.statusRecords == nil {
+		return
+	}
+	g := gitHandlerOf(inst.source)
+
+	record := git.StatusRecord{
+		Node:           inst.hostname,
+		Revision:       g.Revision(),
+		Result:         result,
+		HAProxyVersion: haproxyVersion(inst, validator),
+		Time:           time.Now().UTC(),
+	}
+	if inst.name != defaultInstanceName {
+		record.Instance = inst.name
+	}
+	if failure != nil {
+		record.Message = failure.Error()
+	}
+
+	select {
+	case inst.statusRecords <- record:
+	default:
+		inst.log.Warnf("Too many status records waiting to be pushed, dropping the status of revision %s", record.Revision)
+	}
+}
+
+// pushStatus pushes a status record. Failures to push are only logged.
+func pushStatus(inst *instance, g *git.Handler, record git.StatusRecord) {
+	config := inst.config.StatusRecord
+	var err error
+	if config.Mode == statusRecordNotes {
+		err = g.PushNote(config.NotesRef, record)
+	} else {
+		err = g.PushStatusBranch(config.Branch, record)
+	}
+	if err != nil {
+		inst.log.Warnf("Failed to record the status of revision %s: %v", record.Revision, err)
+	}
+}
+
+// haproxyVersion returns the version of the running HAProxy, or of the
+// validation binary if it can't be found.
+func haproxyVersion(inst *instance, validator *haproxy.Validator) string {
+	if version, err := haproxy.RunningVersion(inst.config.HaproxyPidFile); err == nil {
+		return version
+	}
+	version, _ := validator.Version()
+	return version
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/sirupsen/logrus"
+	"github.com/zcubbs/hpxd/pkg/files"
+	"github.com/zcubbs/hpxd/pkg/haproxy"
+	"github.com/zcubbs/hpxd/pkg/metrics"
+)
+
+// Supported values of the `versionCheck` setting.
+const (
+	versionCheckOff    = "off"
+	versionCheckWarn   = "warn"
+	versionCheckStrict = "strict"
+)
+
+// validateCandidate validates the candidate configuration at configPath.
+//
+// The configuration and the auxiliary files it references are staged in a
+// sandbox laid out like the node, then checked with the configured HAProxy
+// binary, after making sure that binary matches the running HAProxy.
+//
+// The diagnostics reported by HAProxy are logged and counted whether the
+// configuration is valid or not. With `warningsAsErrors`, warnings make the
+// configuration invalid. HAProxy is stopped when ctx is done.
+func validateCandidate(ctx context.Context, inst *instance, configPath string, synced []files.File, validator *haproxy.Validator) ([]haproxy.Diagnostic, error) {
+	if err := checkVersion(inst, validator); err != nil {
+		return nil, err
+	}
+
+	sandbox, err := haproxy.NewSandbox(configPath, inst.config.HaproxyConfigPath, synced)
+	if err != nil {
+		return nil, fmt.Errorf("failed to prepare validation sandbox: %w", err)
+	}
+	defer func() {
+		if err := sandbox.Close(); err != nil {
+			inst.log.Warnf("Failed to remove validation sandbox %s: %v", sandbox.Dir, err)
+		}
+	}()
+
+	diags, err := validator.ValidateContext(ctx, sandbox.ConfigPath, sandbox.Dir)
+	for i := range diags {
+		diags[i].File = sandbox.Origin(diags[i].File)
+	}
+	reportDiagnostics(inst, diags)
+
+	if err == nil && inst.config.WarningsAsErrors {
+		if warnings := haproxy.Filter(diags, haproxy.SeverityWarning); len(warnings) > 0 {
+			err = fmt.Errorf("configuration has %d warning(s) and warningsAsErrors is enabled", len(warnings))
+		}
+	}
+	return diags, err
+}
+
+// reportDiagnostics logs the diagnostics reported by HAProxy at a level
+// matching their severity, and counts them by severity.
+func reportDiagnostics(inst *instance, diags []haproxy.Diagnostic) {
+	for _, d := range diags {
+		metrics.ValidationDiagnosticsCounter.WithLabelValues(inst.name, d.Severity).Inc()
+
+		entry := inst.log.WithFields(logrus.Fields{
+			"file":    d.File,
+			"line":    d.Line,
+			"section": d.Section,
+		})
+		switch d.Severity {
+		case haproxy.SeverityAlert:
+			entry.Errorf("HAProxy validation: %s", d.Message)
+		case haproxy.SeverityWarning:
+			entry.Warnf("HAProxy validation: %s", d.Message)
+		default:
+			entry.Debugf("HAProxy validation: %s", d.Message)
+		}
+	}
+}
+
+// checkVersion compares the version of the validation binary with the version
+// of the running HAProxy. A mismatch is only an error in strict mode.
+func checkVersion(inst *instance, validator *haproxy.Validator) error {
+	if inst.config.VersionCheck == versionCheckOff {
+		return nil
+	}
+
+	fail := func(format string, args ...interface{}) error {
+		err := fmt.Errorf(format, args...)
+		if inst.config.VersionCheck == versionCheckStrict {
+			return err
+		}
+		inst.log.Warnf("HAProxy version check: %v", err)
+		return nil
+	}
+
+	expected, err := haproxy.RunningVersion(inst.config.HaproxyPidFile)
+	if err != nil {
+		return fail("failed to get running HAProxy version: %v", err)
+	}
+	actual, err := validator.Version()
+	if err != nil {
+		return fail("%v", err)
+	}
+	if expected != actual {
+		return fail("validation binary %s is version %s but running HAProxy is version %s",
+			validator.Binary(), actual, expected)
+	}
+
+	return nil
+}
+
+// syncFiles copies the auxiliary files that changed to the node.
+func syncFiles(inst *instance, synced []files.File) error {
+	written, err := files.Sync(synced)
+	for _, target := range written {
+		inst.log.Infof("Synced %s", target)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to sync auxiliary files: %w", err)
+	}
+	return nil
+}
+
+// deployFiles copies the auxiliary files that changed to the node, then the
+// HAProxy configuration at configPath, so the configuration never refers to
+// files that weren't written.
+func deployFiles(inst *instance, configPath string, synced []files.File) error {
+	if err := syncFiles(inst, synced); err != nil {
+		return err
+	}
+	return copyConfig(configPath, inst.config.HaproxyConfigPath)
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/zcubbs/hpxd/pkg/files"
+)
+
+func TestDeployFiles_SyncFailure(t *testing.T) {
+	dir := t.TempDir()
+	inst := newTestInstances(t, defaultInstanceName)[0]
+	inst.config.HaproxyConfigPath = filepath.Join(dir, "haproxy.cfg")
+	if err := os.WriteFile(inst.config.HaproxyConfigPath, []byte("old\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	candidate := filepath.Join(dir, "candidate.cfg")
+	if err := os.WriteFile(candidate, []byte("new\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	synced := []files.File{{Source: filepath.Join(dir, "missing.map"), Target: filepath.Join(dir, "maps", "hosts.map")}}
+	if err := deployFiles(inst, candidate, synced); err == nil {
+		t.Fatalf("Expected an error for an auxiliary file that can't be synced")
+	}
+	if content, _ := os.ReadFile(inst.config.HaproxyConfigPath); string(content) != "old\n" {
+		t.Errorf("Expected the configuration to be left alone, but got: %q", content)
+	}
+
+	if err := deployFiles(inst, candidate, nil); err != nil {
+		t.Fatalf("Failed to deploy: %v", err)
+	}
+	if content, _ := os.ReadFile(inst.config.HaproxyConfigPath); string(content) != "new\n" {
+		t.Errorf("Expected the configuration to be deployed, but got: %q", content)
+	}
+}
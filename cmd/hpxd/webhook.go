@@ -0,0 +1,86 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/zcubbs/hpxd/pkg/httpserver"
+	"github.com/zcubbs/hpxd/pkg/webhook"
+)
+
+const (
+	defaultWebhookAddress = ":9101"
+	defaultWebhookPath    = "/webhook"
+)
+
+// WebhookConfig configures the push webhook receiver.
+//
+// Paths restricts the pushes that trigger a sync to the ones touching the
+// given paths. It defaults to the candidate configuration paths of the host
+// and the sources of the synced files.
+type WebhookConfig struct {
+	Enabled bool     `mapstructure:"enabled"`
+	Address string   `mapstructure:"address"`
+	Path    string   `mapstructure:"path"`
+	Secret  string   `mapstructure:"secret"`
+	Paths   []string `mapstructure:"paths"`
+}
+
+// startWebhookEndpoint starts the push webhook receiver on its own listener,
+// with the TLS and authentication settings of `server`. Git hosts need the
+// admin role, on top of `webhook.secret`. Every accepted push requests an
+// immediate sync.
+//
+// Each instance gets its own receiver, at `<webhook.path>/<instance>` when
+// several are managed, using its own branch, paths and secret.
+func startWebhookEndpoint(config *Configuration, instances []*instance) *http.Server {
+	listener, err := httpserver.Listen(config.Webhook.Address, config.Server.TLS)
+	if err != nil {
+		logrus.Fatalf("Error starting webhook endpoint: %v", err)
+	}
+
+	auth := httpserver.NewAuthenticator(config.Server.Auth)
+	mux := http.NewServeMux()
+	for _, inst := range instances {
+		if !inst.config.Webhook.Enabled {
+			continue
+		}
+
+		path := config.Webhook.Path
+		if len(instances) > 1 {
+			path = strings.TrimRight(path, "/") + "/" + inst.name
+		}
+		mux.Handle(path, auth.Require(httpserver.RoleAdmin, newWebhookReceiver(inst)))
+	}
+
+	server := &http.Server{
+		Handler:           mux,
+		ReadHeaderTimeout: 3 * time.Second,
+	}
+	go func() {
+		err := server.Serve(listener)
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logrus.Fatalf("Error serving webhook endpoint: %v", err)
+		}
+	}()
+	return server
+}
+
+// newWebhookReceiver returns the push webhook receiver of an instance.
+func newWebhookReceiver(inst *instance) *webhook.Receiver {
+	config := inst.config
+	paths := config.Webhook.Paths
+	if len(paths) == 0 {
+		paths = append(paths, inst.paths...)
+		for _, m := range config.SyncFiles {
+			paths = append(paths, m.Source)
+		}
+	}
+
+	return webhook.NewReceiver(config.Webhook.Secret, config.Branch, paths, func() {
+		requestSync(inst.syncRequests)
+	})
+}
@@ -0,0 +1,125 @@
+// Package checkreport formats the results of `hpxd check` for CI systems,
+// as JSON, JUnit XML or SARIF.
+//
+// A report holds one result per check and target, each with the findings
+// that explain it, such as HAProxy diagnostics or blast-radius violations.
+//
+// Author: zakaria.elbouwab
+package checkreport
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+)
+
+// Supported report formats.
+const (
+	FormatText  = "text"
+	FormatJSON  = "json"
+	FormatJUnit = "junit"
+	FormatSARIF = "sarif"
+)
+
+// Status is the outcome of a check.
+type Status string
+
+const (
+	StatusPass Status = "pass"
+	// StatusFail means the configuration doesn't pass the check
+	StatusFail Status = "fail"
+	// StatusError means the check couldn't run
+	StatusError   Status = "error"
+	StatusSkipped Status = "skipped"
+)
+
+// Finding severities, as understood by SARIF.
+const (
+	SeverityError   = "error"
+	SeverityWarning = "warning"
+	SeverityNote    = "note"
+)
+
+// Finding is a problem found by a check, optionally located in a file of
+// the repository.
+type Finding struct {
+	Severity string `json:"severity"`
+	File     string `json:"file,omitempty"`
+	Line     int    `json:"line,omitempty"`
+	Message  string `json:"message"`
+}
+
+// Result is the outcome of a check for a target.
+type Result struct {
+	Check       string        `json:"check"`
+	Description string        `json:"description"`
+	Target      string        `json:"target"`
+	Status      Status        `json:"status"`
+	Message     string        `json:"message,omitempty"`
+	Duration    time.Duration `json:"duration"`
+	Findings    []Finding     `json:"findings,omitempty"`
+}
+
+// Report holds the results of a run of the checks.
+type Report struct {
+	Version string   `json:"version"`
+	Results []Result `json:"results"`
+}
+
+// Failed reports whether a check failed or couldn't run.
+func (r Report) Failed() bool {
+	for _, result := range r.Results {
+		if result.Status == StatusFail || result.Status == StatusError {
+			return true
+		}
+	}
+	return false
+}
+
+// Write writes the report to w in the given format.
+func Write(w io.Writer, format string, r Report) error {
+	switch format {
+	case FormatText:
+		return writeText(w, r)
+	case FormatJSON:
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(r)
+	case FormatJUnit:
+		return writeJUnit(w, r)
+	case FormatSARIF:
+		return writeSARIF(w, r)
+	}
+	return fmt.Errorf("unknown report format %s", format)
+}
+
+func writeText(w io.Writer, r Report) error {
+	for _, result := range r.Results {
+		line := fmt.Sprintf("%-7s %s: %s", result.Status, result.Target, result.Check)
+		if result.Message != "" {
+			line += ": " + result.Message
+		}
+		if _, err := fmt.Fprintln(w, line); err != nil {
+			return err
+		}
+		for _, f := range result.Findings {
+			if _, err := fmt.Fprintf(w, "        %s %s\n", f.Severity, f.location()+f.Message); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// location returns where f was found, as `file:line: `.
+func (f Finding) location() string {
+	switch {
+	case f.File == "":
+		return ""
+	case f.Line > 0:
+		return fmt.Sprintf("%s:%d: ", f.File, f.Line)
+	default:
+		return f.File + ": "
+	}
+}
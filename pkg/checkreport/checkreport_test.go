@@ -0,0 +1,113 @@
+package checkreport
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"strings"
+	"testing"
+	"time"
+)
+
+func sampleReport() Report {
+	return Report{Version: "1.2.3", Results: []Result{
+		{Check: "select", Description: "Host configuration selection", Target: "lb-1", Status: StatusPass, Duration: time.Millisecond},
+		{Check: "haproxy", Description: "Validation with haproxy -c", Target: "lb-1", Status: StatusFail,
+			Message: "configuration is invalid", Duration: 2 * time.Second,
+			Findings: []Finding{
+				{Severity: SeverityError, File: "lb/lb-1.cfg", Line: 12, Message: "unknown keyword 'BROKEN'"},
+				{Severity: SeverityWarning, Message: "a warning without location"},
+			}},
+		{Check: "guard", Description: "Blast-radius thresholds", Target: "lb-1", Status: StatusSkipped, Message: "no previous revision"},
+		{Check: "files", Description: "Synced files", Target: "lb-2", Status: StatusError, Message: "checkout not found"},
+	}}
+}
+
+func TestReport_Failed(t *testing.T) {
+	if !sampleReport().Failed() {
+		t.Error("Expected the report to have failed")
+	}
+	if (Report{Results: []Result{{Status: StatusPass}, {Status: StatusSkipped}}}).Failed() {
+		t.Error("Expected the report to pass")
+	}
+}
+
+func TestWrite_JUnit(t *testing.T) {
+	var out bytes.Buffer
+	if err := Write(&out, FormatJUnit, sampleReport()); err != nil {
+		t.Fatal(err)
+	}
+
+	var suites junitSuites
+	if err := xml.Unmarshal(out.Bytes(), &suites); err != nil {
+		t.Fatalf("Expected valid XML, but got: %v\n%s", err, out.String())
+	}
+	if len(suites.Suites) != 2 {
+		t.Fatalf("Expected a suite per target, but got: %d", len(suites.Suites))
+	}
+	lb1 := suites.Suites[0]
+	if lb1.Tests != 3 || lb1.Failures != 1 || lb1.Skipped != 1 || lb1.Time != "2.001" {
+		t.Errorf("Unexpected counts for lb-1: %+v", lb1)
+	}
+	if f := lb1.Cases[1].Failure; f == nil || !strings.Contains(f.Text, "lb/lb-1.cfg:12: unknown keyword") {
+		t.Errorf("Expected the failure to list the findings, but got: %+v", f)
+	}
+	if suites.Suites[1].Errors != 1 {
+		t.Errorf("Expected lb-2 to have an error, but got: %+v", suites.Suites[1])
+	}
+}
+
+func TestWrite_SARIF(t *testing.T) {
+	var out bytes.Buffer
+	if err := Write(&out, FormatSARIF, sampleReport()); err != nil {
+		t.Fatal(err)
+	}
+
+	var log sarifLog
+	if err := json.Unmarshal(out.Bytes(), &log); err != nil {
+		t.Fatal(err)
+	}
+	if log.Version != "2.1.0" || len(log.Runs) != 1 {
+		t.Fatalf("Unexpected SARIF log: %s", out.String())
+	}
+	run := log.Runs[0]
+	if len(run.Tool.Driver.Rules) != 4 {
+		t.Errorf("Expected a rule per check, but got: %d", len(run.Tool.Driver.Rules))
+	}
+	// Two findings, plus the error of lb-2 which has none
+	if len(run.Results) != 3 {
+		t.Fatalf("Expected 3 results, but got: %d", len(run.Results))
+	}
+	located := run.Results[0]
+	if located.Level != SeverityError || len(located.Locations) != 1 ||
+		located.Locations[0].PhysicalLocation.ArtifactLocation.URI != "lb/lb-1.cfg" ||
+		located.Locations[0].PhysicalLocation.Region.StartLine != 12 {
+		t.Errorf("Unexpected located result: %+v", located)
+	}
+	if len(run.Results[1].Locations) != 0 {
+		t.Errorf("Expected no location for a finding without file, but got: %+v", run.Results[1].Locations)
+	}
+	if run.Results[2].RuleID != "files" || run.Results[2].Message.Text != "checkout not found" {
+		t.Errorf("Unexpected result for the failed check: %+v", run.Results[2])
+	}
+}
+
+func TestWrite_JSON(t *testing.T) {
+	var out bytes.Buffer
+	if err := Write(&out, FormatJSON, sampleReport()); err != nil {
+		t.Fatal(err)
+	}
+	var r Report
+	if err := json.Unmarshal(out.Bytes(), &r); err != nil {
+		t.Fatal(err)
+	}
+	if len(r.Results) != 4 || r.Results[1].Findings[0].Line != 12 {
+		t.Errorf("Unexpected decoded report: %+v", r)
+	}
+}
+
+func TestWrite_UnknownFormat(t *testing.T) {
+	if err := Write(&bytes.Buffer{}, "yaml", sampleReport()); err == nil {
+		t.Error("Expected an error for an unknown format")
+	}
+}
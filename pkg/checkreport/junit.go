@@ -0,0 +1,107 @@
+package checkreport
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strings"
+)
+
+type junitSuites struct {
+	XMLName xml.Name     `xml:"testsuites"`
+	Suites  []junitSuite `xml:"testsuite"`
+}
+
+type junitSuite struct {
+	Name     string      `xml:"name,attr"`
+	Tests    int         `xml:"tests,attr"`
+	Failures int         `xml:"failures,attr"`
+	Errors   int         `xml:"errors,attr"`
+	Skipped  int         `xml:"skipped,attr"`
+	Time     string      `xml:"time,attr"`
+	Cases    []junitCase `xml:"testcase"`
+}
+
+type junitCase struct {
+	ClassName string        `xml:"classname,attr"`
+	Name      string        `xml:"name,attr"`
+	Time      string        `xml:"time,attr"`
+	Failure   *junitMessage `xml:"failure,omitempty"`
+	Error     *junitMessage `xml:"error,omitempty"`
+	Skipped   *junitMessage `xml:"skipped,omitempty"`
+	SystemOut string        `xml:"system-out,omitempty"`
+}
+
+type junitMessage struct {
+	Message string `xml:"message,attr"`
+	Text    string `xml:",chardata"`
+}
+
+// writeJUnit writes the report as JUnit XML, with a test suite per target
+// and a test case per check.
+func writeJUnit(w io.Writer, r Report) error {
+	var suites junitSuites
+	index := map[string]int{}
+	var durations []float64
+	for _, result := range r.Results {
+		i, ok := index[result.Target]
+		if !ok {
+			i = len(suites.Suites)
+			index[result.Target] = i
+			suites.Suites = append(suites.Suites, junitSuite{Name: "hpxd check " + result.Target})
+			durations = append(durations, 0)
+		}
+		suite := &suites.Suites[i]
+
+		c := junitCase{
+			ClassName: "hpxd." + result.Target,
+			Name:      result.Check,
+			Time:      seconds(result.Duration.Seconds()),
+		}
+		details := findingsText(result.Findings)
+		message := result.Message
+		if message == "" {
+			message = result.Description
+		}
+		switch result.Status {
+		case StatusFail:
+			c.Failure = &junitMessage{Message: message, Text: details}
+			suite.Failures++
+		case StatusError:
+			c.Error = &junitMessage{Message: message, Text: details}
+			suite.Errors++
+		case StatusSkipped:
+			c.Skipped = &junitMessage{Message: message}
+			suite.Skipped++
+		default:
+			c.SystemOut = details
+		}
+		suite.Tests++
+		durations[i] += result.Duration.Seconds()
+		suite.Time = seconds(durations[i])
+		suite.Cases = append(suite.Cases, c)
+	}
+
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	encoder := xml.NewEncoder(w)
+	encoder.Indent("", "  ")
+	if err := encoder.Encode(suites); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\n")
+	return err
+}
+
+func findingsText(findings []Finding) string {
+	var b strings.Builder
+	for _, f := range findings {
+		fmt.Fprintf(&b, "%s: %s%s\n", f.Severity, f.location(), f.Message)
+	}
+	return b.String()
+}
+
+func seconds(s float64) string {
+	return fmt.Sprintf("%.3f", s)
+}
@@ -0,0 +1,123 @@
+package checkreport
+
+import (
+	"encoding/json"
+	"io"
+	"path/filepath"
+)
+
+const sarifSchema = "https://json.schemastore.org/sarif-2.1.0.json"
+
+type sarifLog struct {
+	Schema  string     `json:"$schema"`
+	Version string     `json:"version"`
+	Runs    []sarifRun `json:"runs"`
+}
+
+type sarifRun struct {
+	Tool    sarifTool     `json:"tool"`
+	Results []sarifResult `json:"results"`
+}
+
+type sarifTool struct {
+	Driver sarifDriver `json:"driver"`
+}
+
+type sarifDriver struct {
+	Name           string      `json:"name"`
+	Version        string      `json:"version,omitempty"`
+	InformationURI string      `json:"informationUri"`
+	Rules          []sarifRule `json:"rules"`
+}
+
+type sarifRule struct {
+	ID               string       `json:"id"`
+	ShortDescription sarifMessage `json:"shortDescription"`
+}
+
+type sarifMessage struct {
+	Text string `json:"text"`
+}
+
+type sarifResult struct {
+	RuleID     string                 `json:"ruleId"`
+	Level      string                 `json:"level"`
+	Message    sarifMessage           `json:"message"`
+	Locations  []sarifLocation        `json:"locations,omitempty"`
+	Properties map[string]interface{} `json:"properties,omitempty"`
+}
+
+type sarifLocation struct {
+	PhysicalLocation sarifPhysicalLocation `json:"physicalLocation"`
+}
+
+type sarifPhysicalLocation struct {
+	ArtifactLocation sarifArtifact `json:"artifactLocation"`
+	Region           *sarifRegion  `json:"region,omitempty"`
+}
+
+type sarifArtifact struct {
+	URI string `json:"uri"`
+}
+
+type sarifRegion struct {
+	StartLine int `json:"startLine"`
+}
+
+// writeSARIF writes the report as a SARIF 2.1.0 log, with a rule per check
+// and a result per finding. Checks failing without findings are reported
+// as a result of their own.
+func writeSARIF(w io.Writer, r Report) error {
+	driver := sarifDriver{
+		Name:           "hpxd",
+		Version:        r.Version,
+		InformationURI: "https://github.com/zcubbs/hpxd",
+		Rules:          []sarifRule{},
+	}
+	rules := map[string]bool{}
+	results := []sarifResult{}
+
+	for _, result := range r.Results {
+		if !rules[result.Check] {
+			rules[result.Check] = true
+			driver.Rules = append(driver.Rules, sarifRule{ID: result.Check, ShortDescription: sarifMessage{Text: result.Description}})
+		}
+		properties := map[string]interface{}{"target": result.Target}
+
+		for _, f := range result.Findings {
+			sr := sarifResult{
+				RuleID:     result.Check,
+				Level:      f.Severity,
+				Message:    sarifMessage{Text: f.Message},
+				Properties: properties,
+			}
+			if f.File != "" {
+				location := sarifLocation{PhysicalLocation: sarifPhysicalLocation{
+					ArtifactLocation: sarifArtifact{URI: filepath.ToSlash(f.File)},
+				}}
+				if f.Line > 0 {
+					location.PhysicalLocation.Region = &sarifRegion{StartLine: f.Line}
+				}
+				sr.Locations = []sarifLocation{location}
+			}
+			results = append(results, sr)
+		}
+
+		if len(result.Findings) == 0 && (result.Status == StatusFail || result.Status == StatusError) {
+			results = append(results, sarifResult{
+				RuleID:     result.Check,
+				Level:      SeverityError,
+				Message:    sarifMessage{Text: result.Message},
+				Properties: properties,
+			})
+		}
+	}
+
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(sarifLog{
+		Schema:  sarifSchema,
+		Version: "2.1.0",
+		Runs:    []sarifRun{{Tool: sarifTool{Driver: driver}, Results: results}},
+	})
+}
@@ -3,7 +3,11 @@
 // Author: zakaria.elbouwab
 package cmd
 
-import "os/exec"
+import (
+	"bytes"
+	"context"
+	"os/exec"
+)
 
 // RunCmd executes a system command without capturing its output.
 //
@@ -25,3 +29,22 @@ func RunCmdOutput(cmd string, args ...string) ([]byte, error) {
 func RunCmdCombinedOutput(cmd string, args ...string) ([]byte, error) {
 	return exec.Command(cmd, args...).CombinedOutput()
 }
+
+// RunCmdContext is like RunCmd, but the command is killed when ctx is done.
+func RunCmdContext(ctx context.Context, cmd string, args ...string) error {
+	return exec.CommandContext(ctx, cmd, args...).Run()
+}
+
+// RunCmdCombinedOutputContext is like RunCmdCombinedOutput, but the command
+// is killed when ctx is done.
+func RunCmdCombinedOutputContext(ctx context.Context, cmd string, args ...string) ([]byte, error) {
+	return exec.CommandContext(ctx, cmd, args...).CombinedOutput()
+}
+
+// RunCmdWithInput executes a system command with the given standard input
+// and returns its standard output.
+func RunCmdWithInput(input []byte, cmd string, args ...string) ([]byte, error) {
+	c := exec.Command(cmd, args...)
+	c.Stdin = bytes.NewReader(input)
+	return c.Output()
+}
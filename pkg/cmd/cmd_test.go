@@ -2,8 +2,10 @@ package cmd
 
 import (
 	"bytes"
+	"context"
 	"strings"
 	"testing"
+	"time"
 )
 
 func TestRunCmd(t *testing.T) {
@@ -56,3 +58,21 @@ func TestRunCmdCombinedOutput(t *testing.T) {
 		t.Fatalf("Expected error output to contain 'No such file or directory', but got: %s", output)
 	}
 }
+
+func TestRunCmdContext(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	if err := RunCmdContext(ctx, "sleep", "10"); err == nil {
+		t.Fatalf("Expected command to be killed, but it succeeded")
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("Expected command to be killed when the context is done, but it ran for %s", elapsed)
+	}
+
+	output, err := RunCmdCombinedOutputContext(context.Background(), "echo", "hello")
+	if err != nil || !bytes.Equal(output, []byte("hello\n")) {
+		t.Fatalf("Expected output to be 'hello\\n', but got: %s, %v", output, err)
+	}
+}
@@ -0,0 +1,196 @@
+// Package commitstatus reports the outcome of applying a revision back to
+// the git host, as a commit status of the applied commit.
+//
+// GitHub, GitLab and Gitea are supported. Statuses are posted in the
+// background, at most once every interval, and a status superseding one
+// that wasn't posted yet replaces it.
+//
+// Author: zakaria.elbouwab
+package commitstatus
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Supported values of Config.Provider.
+const (
+	ProviderGitHub = "github"
+	ProviderGitLab = "gitlab"
+	ProviderGitea  = "gitea"
+)
+
+// maxDescription is the longest description accepted by every provider.
+const maxDescription = 140
+
+// Config describes where statuses are posted.
+type Config struct {
+	Enabled  bool   `mapstructure:"enabled"`
+	Provider string `mapstructure:"provider"`
+	// APIURL is the base URL of the API, such as `https://api.github.com`,
+	// `https://gitlab.com/api/v4` or `https://gitea.example.com/api/v1`
+	APIURL string `mapstructure:"apiURL"`
+	// Repository is `owner/name`, or the project path or ID with GitLab
+	Repository string `mapstructure:"repository"`
+	Token      string `mapstructure:"token"`
+	// Context prefixes the context of statuses, suffixed with the node name
+	Context   string `mapstructure:"context"`
+	TargetURL string `mapstructure:"targetURL"`
+	// Interval is the minimum delay between two statuses
+	Interval time.Duration `mapstructure:"interval"`
+}
+
+// Validate checks the provider settings.
+func (c Config) Validate() error {
+	switch c.Provider {
+	case ProviderGitHub, ProviderGitLab:
+	case ProviderGitea:
+		if c.APIURL == "" {
+			return errors.New("missing API URL of the Gitea server")
+		}
+	default:
+		return fmt.Errorf("provider must be one of %s, %s or %s", ProviderGitHub, ProviderGitLab, ProviderGitea)
+	}
+	if c.Repository == "" {
+		return errors.New("missing repository")
+	}
+	if c.Token == "" {
+		return errors.New("missing token")
+	}
+	return nil
+}
+
+// State is the state of a commit status.
+type State string
+
+const (
+	StatePending State = "pending"
+	StateSuccess State = "success"
+	StateFailure State = "failure"
+	StateError   State = "error"
+)
+
+// Status is a commit status.
+type Status struct {
+	SHA         string
+	State       State
+	Context     string
+	Description string
+	TargetURL   string
+}
+
+// Client posts commit statuses to a git host.
+type Client interface {
+	Post(s Status) error
+}
+
+// NewClient returns the client of the configured provider.
+func NewClient(config Config) (Client, error) {
+	switch config.Provider {
+	case ProviderGitHub:
+		return NewGitHub(config.APIURL, config.Repository, config.Token), nil
+	case ProviderGitLab:
+		return NewGitLab(config.APIURL, config.Repository, config.Token), nil
+	case ProviderGitea:
+		return NewGitea(config.APIURL, config.Repository, config.Token), nil
+	}
+	return nil, fmt.Errorf("unknown provider %s", config.Provider)
+}
+
+// RepositoryFromURL returns the `owner/name` path of a repository URL, such
+// as `https://github.com/owner/name.git` or `git@github.com:owner/name.git`.
+func RepositoryFromURL(repoURL string) string {
+	path := repoURL
+	if u, err := url.Parse(repoURL); err == nil && u.Host != "" {
+		path = u.Path
+	} else if _, after, ok := strings.Cut(repoURL, ":"); ok {
+		path = after
+	}
+	return strings.TrimSuffix(strings.Trim(path, "/"), ".git")
+}
+
+// Reporter posts statuses through a client, rate-limited.
+type Reporter struct {
+	client   Client
+	interval time.Duration
+
+	mu sync.Mutex
+	// queue holds the statuses waiting to be posted, at most one per commit
+	// and context. last is the status last posted for each context.
+	queue []Status
+	last  map[string]Status
+	wake  chan struct{}
+}
+
+// NewReporter initializes and returns a new Reporter posting at most one
+// status every interval.
+func NewReporter(client Client, interval time.Duration) *Reporter {
+	r := &Reporter{
+		client:   client,
+		interval: interval,
+		last:     map[string]Status{},
+		wake:     make(chan struct{}, 1),
+	}
+	go r.run()
+	return r
+}
+
+// Report queues a status. It replaces the status of the same commit and
+// context still waiting to be posted, and is dropped if it's the one
+// last posted.
+func (r *Reporter) Report(s Status) {
+	if d := []rune(s.Description); len(d) > maxDescription {
+		s.Description = string(d[:maxDescription-3]) + "..."
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	key := s.SHA + "/" + s.Context
+	for i, queued := range r.queue {
+		if queued.SHA+"/"+queued.Context == key {
+			r.queue = append(r.queue[:i], r.queue[i+1:]...)
+			break
+		}
+	}
+	if r.last[s.Context] == s {
+		return
+	}
+	r.queue = append(r.queue, s)
+
+	select {
+	case r.wake <- struct{}{}:
+	default:
+	}
+}
+
+// run posts the queued statuses, one every interval.
+func (r *Reporter) run() {
+	for range r.wake {
+		for {
+			r.mu.Lock()
+			if len(r.queue) == 0 {
+				r.mu.Unlock()
+				break
+			}
+			s := r.queue[0]
+			r.queue = r.queue[1:]
+			r.mu.Unlock()
+
+			if err := r.client.Post(s); err != nil {
+				logrus.Warnf("Failed to post %s commit status for %s: %v", s.State, s.SHA, err)
+			} else {
+				r.mu.Lock()
+				r.last[s.Context] = s
+				r.mu.Unlock()
+			}
+			time.Sleep(r.interval)
+		}
+	}
+}
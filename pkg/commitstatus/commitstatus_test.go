@@ -0,0 +1,115 @@
+package commitstatus
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// standIn records the requests made to a fake git host API.
+type standIn struct {
+	mu       sync.Mutex
+	requests []*http.Request
+	bodies   []map[string]string
+}
+
+func (s *standIn) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var body map[string]string
+	_ = json.NewDecoder(r.Body).Decode(&body)
+	s.mu.Lock()
+	s.requests = append(s.requests, r)
+	s.bodies = append(s.bodies, body)
+	s.mu.Unlock()
+	w.WriteHeader(http.StatusCreated)
+}
+
+func (s *standIn) count() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.requests)
+}
+
+func TestProviders(t *testing.T) {
+	status := Status{SHA: "abc123", State: StateFailure, Context: "hpxd/lb-1", Description: "Rejected"}
+	tests := []struct {
+		name   string
+		client func(url string) Client
+		path   string
+		header string
+		value  string
+		state  string
+	}{
+		{"github", func(url string) Client { return NewGitHub(url, "acme/configs", "t0k") },
+			"/repos/acme/configs/statuses/abc123", "Authorization", "Bearer t0k", "failure"},
+		{"gitea", func(url string) Client { return NewGitea(url, "acme/configs", "t0k") },
+			"/repos/acme/configs/statuses/abc123", "Authorization", "token t0k", "failure"},
+		{"gitlab", func(url string) Client { return NewGitLab(url, "acme/configs", "t0k") },
+			"/projects/acme%2Fconfigs/statuses/abc123", "PRIVATE-TOKEN", "t0k", "failed"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &standIn{}
+			server := httptest.NewServer(s)
+			defer server.Close()
+
+			if err := tt.client(server.URL).Post(status); err != nil {
+				t.Fatalf("Failed to post status: %v", err)
+			}
+			r := s.requests[0]
+			if r.Method != http.MethodPost || r.URL.EscapedPath() != tt.path {
+				t.Errorf("Unexpected request: %s %s", r.Method, r.URL.EscapedPath())
+			}
+			if r.Header.Get(tt.header) != tt.value {
+				t.Errorf("Expected %s header %q, but got: %q", tt.header, tt.value, r.Header.Get(tt.header))
+			}
+			if s.bodies[0]["state"] != tt.state || s.bodies[0]["description"] != "Rejected" {
+				t.Errorf("Unexpected payload: %v", s.bodies[0])
+			}
+		})
+	}
+}
+
+func TestReporter(t *testing.T) {
+	s := &standIn{}
+	server := httptest.NewServer(s)
+	defer server.Close()
+
+	r := NewReporter(NewGitHub(server.URL, "acme/configs", "t0k"), 50*time.Millisecond)
+	pending := Status{SHA: "abc", State: StatePending, Context: "hpxd/lb-1", Description: "Waiting"}
+	r.Report(pending)
+	time.Sleep(20 * time.Millisecond)
+
+	// Posted within the interval, the pending status is replaced by the
+	// success, and the repeated success is dropped
+	r.Report(Status{SHA: "abc", State: StatePending, Context: "hpxd/lb-1", Description: "Still waiting"})
+	success := Status{SHA: "abc", State: StateSuccess, Context: "hpxd/lb-1", Description: "Applied"}
+	r.Report(success)
+	time.Sleep(100 * time.Millisecond)
+	r.Report(success)
+	time.Sleep(100 * time.Millisecond)
+
+	if got := s.count(); got != 2 {
+		t.Fatalf("Expected 2 statuses to be posted, but got: %d", got)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.bodies[1]["state"] != "success" {
+		t.Errorf("Expected the success to be posted last, but got: %v", s.bodies[1])
+	}
+}
+
+func TestRepositoryFromURL(t *testing.T) {
+	for url, want := range map[string]string{
+		"https://github.com/acme/configs.git":      "acme/configs",
+		"git@gitlab.com:acme/infra/configs.git":    "acme/infra/configs",
+		"https://gitea.example.com/acme/configs/":  "acme/configs",
+		"ssh://git@github.com:22/acme/configs.git": "acme/configs",
+	} {
+		if got := RepositoryFromURL(url); got != want {
+			t.Errorf("Expected %s for %s, but got: %s", want, url, got)
+		}
+	}
+}
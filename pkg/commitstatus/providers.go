@@ -0,0 +1,141 @@
+package commitstatus
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// apiClient posts JSON payloads to the API of a git host.
+type apiClient struct {
+	baseURL string
+	header  http.Header
+	client  *http.Client
+}
+
+func newAPIClient(baseURL, defaultURL string, header http.Header) apiClient {
+	if baseURL == "" {
+		baseURL = defaultURL
+	}
+	header.Set("Content-Type", "application/json")
+	return apiClient{
+		baseURL: strings.TrimRight(baseURL, "/"),
+		header:  header,
+		client:  &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+func (c apiClient) post(path string, payload interface{}) error {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, c.baseURL+path, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header = c.header.Clone()
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 4<<10))
+		return fmt.Errorf("unexpected status %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
+
+// statusPayload is the commit status accepted by GitHub and Gitea.
+type statusPayload struct {
+	State       State  `json:"state"`
+	TargetURL   string `json:"target_url,omitempty"`
+	Description string `json:"description"`
+	Context     string `json:"context"`
+}
+
+// GitHub posts statuses through the GitHub REST API.
+type GitHub struct {
+	api        apiClient
+	repository string
+}
+
+// NewGitHub initializes and returns a new GitHub client. apiURL defaults to
+// `https://api.github.com`.
+func NewGitHub(apiURL, repository, token string) *GitHub {
+	header := http.Header{}
+	header.Set("Accept", "application/vnd.github+json")
+	header.Set("Authorization", "Bearer "+token)
+	return &GitHub{api: newAPIClient(apiURL, "https://api.github.com", header), repository: repository}
+}
+
+// Post creates a commit status.
+func (g *GitHub) Post(s Status) error {
+	return g.api.post("/repos/"+g.repository+"/statuses/"+s.SHA, statusPayload{
+		State:       s.State,
+		TargetURL:   s.TargetURL,
+		Description: s.Description,
+		Context:     s.Context,
+	})
+}
+
+// Gitea posts statuses through the Gitea API.
+type Gitea struct {
+	api        apiClient
+	repository string
+}
+
+// NewGitea initializes and returns a new Gitea client. apiURL is the base
+// URL of the API, such as `https://gitea.example.com/api/v1`.
+func NewGitea(apiURL, repository, token string) *Gitea {
+	header := http.Header{}
+	header.Set("Authorization", "token "+token)
+	return &Gitea{api: newAPIClient(apiURL, "", header), repository: repository}
+}
+
+// Post creates a commit status.
+func (g *Gitea) Post(s Status) error {
+	return g.api.post("/repos/"+g.repository+"/statuses/"+s.SHA, statusPayload{
+		State:       s.State,
+		TargetURL:   s.TargetURL,
+		Description: s.Description,
+		Context:     s.Context,
+	})
+}
+
+// GitLab posts statuses through the GitLab REST API.
+type GitLab struct {
+	api     apiClient
+	project string
+}
+
+// NewGitLab initializes and returns a new GitLab client. apiURL defaults to
+// `https://gitlab.com/api/v4`, project is the path or ID of the project.
+func NewGitLab(apiURL, project, token string) *GitLab {
+	header := http.Header{}
+	header.Set("PRIVATE-TOKEN", token)
+	return &GitLab{api: newAPIClient(apiURL, "https://gitlab.com/api/v4", header), project: project}
+}
+
+// Post creates a commit status. GitLab has no error state, errors are
+// reported as failures.
+func (g *GitLab) Post(s Status) error {
+	state := string(s.State)
+	if s.State == StateFailure || s.State == StateError {
+		state = "failed"
+	}
+	return g.api.post("/projects/"+url.PathEscape(g.project)+"/statuses/"+s.SHA, struct {
+		State       string `json:"state"`
+		Name        string `json:"name"`
+		TargetURL   string `json:"target_url,omitempty"`
+		Description string `json:"description"`
+	}{state, s.Context, s.TargetURL, s.Description})
+}
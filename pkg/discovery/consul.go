@@ -0,0 +1,93 @@
+package discovery
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/zcubbs/hpxd/pkg/kvsource"
+)
+
+// ConsulCatalog resolves a pool from the healthy instances of a service
+// registered in the Consul catalog.
+type ConsulCatalog struct {
+	config  kvsource.ConsulConfig
+	service string
+	tag     string
+	client  *http.Client
+}
+
+// NewConsulCatalog initializes and returns a new ConsulCatalog provider for
+// the instances of service, optionally filtered by tag.
+func NewConsulCatalog(config kvsource.ConsulConfig, service, tag string) *ConsulCatalog {
+	if config.Address == "" {
+		config.Address = "http://127.0.0.1:8500"
+	}
+	return &ConsulCatalog{
+		config:  config,
+		service: service,
+		tag:     tag,
+		client:  &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+type consulServiceEntry struct {
+	Node struct {
+		Address string `json:"Address"`
+	} `json:"Node"`
+	Service struct {
+		Address string `json:"Address"`
+		Port    int    `json:"Port"`
+	} `json:"Service"`
+}
+
+// Resolve lists the instances of the service passing their health checks.
+func (c *ConsulCatalog) Resolve(ctx context.Context) ([]Server, error) {
+	query := url.Values{"passing": {"true"}}
+	if c.tag != "" {
+		query.Set("tag", c.tag)
+	}
+	if c.config.Datacenter != "" {
+		query.Set("dc", c.config.Datacenter)
+	}
+	u := strings.TrimRight(c.config.Address, "/") + "/v1/health/service/" + url.PathEscape(c.service) + "?" + query.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	if c.config.Token != "" {
+		req.Header.Set("X-Consul-Token", c.config.Token)
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, fmt.Errorf("unexpected status %s from consul: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+
+	var entries []consulServiceEntry
+	if err := json.NewDecoder(resp.Body).Decode(&entries); err != nil {
+		return nil, err
+	}
+
+	servers := make([]Server, 0, len(entries))
+	for _, e := range entries {
+		// Services registered without an address use the one of their node
+		address := e.Service.Address
+		if address == "" {
+			address = e.Node.Address
+		}
+		servers = append(servers, Server{Address: address, Port: e.Service.Port})
+	}
+	return servers, nil
+}
@@ -0,0 +1,199 @@
+// Package discovery fills named server pools from service discovery, so
+// backend servers don't have to be committed with the configuration.
+//
+// Configurations declare where the servers of a pool go with a marker
+// comment in a backend:
+//
+//	backend api
+//	    balance roundrobin
+//	    # hpxd:pool api check inter 2s
+//
+// Pools are resolved from DNS SRV records, the Consul catalog or a JSON
+// file, and the marker is rendered as one `server` line per address.
+//
+// Author: zakaria.elbouwab
+package discovery
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Server is a single address of a pool.
+type Server struct {
+	Address string `json:"address"`
+	Port    int    `json:"port"`
+}
+
+// Endpoint returns the `address:port` of the server.
+func (s Server) Endpoint() string {
+	if strings.Contains(s.Address, ":") {
+		// IPv6
+		return "[" + s.Address + "]:" + strconv.Itoa(s.Port)
+	}
+	return s.Address + ":" + strconv.Itoa(s.Port)
+}
+
+// ServerName returns the name of the server s of pool. The name only
+// depends on the address, so a server keeps it across renders and can be
+// added to or removed from HAProxy at runtime.
+func ServerName(pool string, s Server) string {
+	name := strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' {
+			return r
+		}
+		return '_'
+	}, s.Address)
+	return fmt.Sprintf("%s-%s-%d", pool, name, s.Port)
+}
+
+// Provider resolves the servers of a pool.
+type Provider interface {
+	Resolve(ctx context.Context) ([]Server, error)
+}
+
+// Notifier is implemented by providers able to signal changes as soon as
+// they happen.
+type Notifier interface {
+	Changes() <-chan struct{}
+}
+
+// Pools keeps the last resolved servers of every pool.
+type Pools struct {
+	providers map[string]Provider
+	changes   chan struct{}
+
+	mu      sync.Mutex
+	servers map[string][]Server
+}
+
+// NewPools initializes and returns new Pools resolved by providers, by pool
+// name.
+func NewPools(providers map[string]Provider) *Pools {
+	p := &Pools{
+		providers: providers,
+		changes:   make(chan struct{}, 1),
+		servers:   make(map[string][]Server),
+	}
+	for _, provider := range providers {
+		n, ok := provider.(Notifier)
+		if !ok {
+			continue
+		}
+		go func(changes <-chan struct{}) {
+			for range changes {
+				select {
+				case p.changes <- struct{}{}:
+				default:
+				}
+			}
+		}(n.Changes())
+	}
+	return p
+}
+
+// Refresh resolves every pool and returns the names of the pools whose
+// servers changed. Pools that fail to resolve keep their last servers.
+func (p *Pools) Refresh(ctx context.Context) ([]string, error) {
+	names := make([]string, 0, len(p.providers))
+	for name := range p.providers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var changed []string
+	var errs []error
+	for _, name := range names {
+		servers, err := p.providers[name].Resolve(ctx)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("pool %s: %w", name, err))
+			continue
+		}
+		servers = normalize(servers)
+
+		p.mu.Lock()
+		previous, known := p.servers[name]
+		p.servers[name] = servers
+		p.mu.Unlock()
+
+		if !known || !equal(previous, servers) {
+			changed = append(changed, name)
+		}
+	}
+	return changed, errors.Join(errs...)
+}
+
+// Snapshot returns the servers of every pool.
+func (p *Pools) Snapshot() map[string][]Server {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	snapshot := make(map[string][]Server, len(p.servers))
+	for name, servers := range p.servers {
+		snapshot[name] = servers
+	}
+	return snapshot
+}
+
+// Changes returns a channel receiving a value when a provider able to
+// signal changes reports one.
+func (p *Pools) Changes() <-chan struct{} {
+	return p.changes
+}
+
+// Diff returns the servers of next missing from previous, and those of
+// previous missing from next.
+func Diff(previous, next []Server) (added, removed []Server) {
+	seen := make(map[Server]bool, len(previous))
+	for _, s := range previous {
+		seen[s] = true
+	}
+	for _, s := range next {
+		if !seen[s] {
+			added = append(added, s)
+		}
+		delete(seen, s)
+	}
+	for _, s := range previous {
+		if seen[s] {
+			removed = append(removed, s)
+		}
+	}
+	return added, removed
+}
+
+// normalize sorts servers and removes duplicates, so pools can be compared.
+func normalize(servers []Server) []Server {
+	sort.Slice(servers, func(i, j int) bool {
+		if servers[i].Address != servers[j].Address {
+			return servers[i].Address < servers[j].Address
+		}
+		return servers[i].Port < servers[j].Port
+	})
+
+	out := make([]Server, 0, len(servers))
+	for i, s := range servers {
+		if i > 0 && s == servers[i-1] {
+			continue
+		}
+		out = append(out, s)
+	}
+	return out
+}
+
+func equal(a, b []Server) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,191 @@
+package discovery
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/zcubbs/hpxd/pkg/kvsource"
+)
+
+func TestRender(t *testing.T) {
+	template := "global\n" +
+		"backend api\n" +
+		"    balance roundrobin\n" +
+		"    # hpxd:pool api check inter 2s\n" +
+		"backend static\n" +
+		"    server s1 10.0.1.1:80\n"
+	pools := map[string][]Server{
+		"api": {{Address: "10.0.0.1", Port: 8080}, {Address: "10.0.0.2", Port: 8080}},
+	}
+
+	rendered, usages, err := Render([]byte(template), pools)
+	if err != nil {
+		t.Fatalf("Failed to render: %v", err)
+	}
+	expected := "global\n" +
+		"backend api\n" +
+		"    balance roundrobin\n" +
+		"    server api-10_0_0_1-8080 10.0.0.1:8080 check inter 2s\n" +
+		"    server api-10_0_0_2-8080 10.0.0.2:8080 check inter 2s\n" +
+		"backend static\n" +
+		"    server s1 10.0.1.1:80\n"
+	if string(rendered) != expected {
+		t.Errorf("Expected rendered config:\n%s\nbut got:\n%s", expected, rendered)
+	}
+	if len(usages) != 1 || usages[0].Backend != "api" || usages[0].Pool != "api" || len(usages[0].Options) != 3 {
+		t.Errorf("Unexpected usages: %+v", usages)
+	}
+}
+
+func TestRender_Errors(t *testing.T) {
+	for name, template := range map[string]string{
+		"unknown pool":    "backend api\n    # hpxd:pool missing\n",
+		"outside backend": "frontend http-in\n    # hpxd:pool api\n",
+	} {
+		if _, _, err := Render([]byte(template), map[string][]Server{"api": nil}); err == nil {
+			t.Errorf("%s: expected rendering to fail", name)
+		}
+	}
+}
+
+func TestServer_Endpoint(t *testing.T) {
+	if got := (Server{Address: "fd00::1", Port: 80}).Endpoint(); got != "[fd00::1]:80" {
+		t.Errorf("Expected bracketed IPv6 endpoint, but got %s", got)
+	}
+}
+
+func TestDiff(t *testing.T) {
+	a := Server{Address: "10.0.0.1", Port: 80}
+	b := Server{Address: "10.0.0.2", Port: 80}
+	c := Server{Address: "10.0.0.3", Port: 80}
+
+	added, removed := Diff([]Server{a, b}, []Server{b, c})
+	if len(added) != 1 || added[0] != c {
+		t.Errorf("Expected %v to be added, but got: %v", c, added)
+	}
+	if len(removed) != 1 || removed[0] != a {
+		t.Errorf("Expected %v to be removed, but got: %v", a, removed)
+	}
+}
+
+// staticProvider returns fixed servers, or an error.
+type staticProvider struct {
+	servers []Server
+	err     error
+}
+
+func (p *staticProvider) Resolve(_ context.Context) ([]Server, error) {
+	return p.servers, p.err
+}
+
+func TestPools_Refresh(t *testing.T) {
+	provider := &staticProvider{servers: []Server{{Address: "10.0.0.2", Port: 80}, {Address: "10.0.0.1", Port: 80}}}
+	pools := NewPools(map[string]Provider{"api": provider})
+
+	if changed, err := pools.Refresh(context.Background()); err != nil || len(changed) != 1 {
+		t.Fatalf("Expected first refresh to change the pool, but got: %v, %v", changed, err)
+	}
+	// The same servers in another order
+	provider.servers = []Server{{Address: "10.0.0.1", Port: 80}, {Address: "10.0.0.2", Port: 80}}
+	if changed, err := pools.Refresh(context.Background()); err != nil || len(changed) != 0 {
+		t.Errorf("Expected unchanged servers not to change the pool, but got: %v, %v", changed, err)
+	}
+
+	provider.err = errors.New("unreachable")
+	if _, err := pools.Refresh(context.Background()); err == nil {
+		t.Errorf("Expected resolution errors to be reported")
+	}
+	if servers := pools.Snapshot()["api"]; len(servers) != 2 {
+		t.Errorf("Expected the pool to keep its last servers, but got: %v", servers)
+	}
+}
+
+// fakeResolver answers SRV and host lookups from maps.
+type fakeResolver struct {
+	srv   []*net.SRV
+	hosts map[string][]string
+}
+
+func (r *fakeResolver) LookupSRV(_ context.Context, _, _, _ string) (string, []*net.SRV, error) {
+	return "", r.srv, nil
+}
+
+func (r *fakeResolver) LookupHost(_ context.Context, host string) ([]string, error) {
+	return r.hosts[host], nil
+}
+
+func TestDNS(t *testing.T) {
+	d := NewDNS("_http._tcp.api.service.consul")
+	d.resolver = &fakeResolver{
+		srv: []*net.SRV{{Target: "a.node.consul.", Port: 8080}, {Target: "b.node.consul.", Port: 8081}},
+		hosts: map[string][]string{
+			"a.node.consul": {"10.0.0.1"},
+			"b.node.consul": {"10.0.0.2", "10.0.0.3"},
+		},
+	}
+
+	servers, err := d.Resolve(context.Background())
+	if err != nil {
+		t.Fatalf("Failed to resolve: %v", err)
+	}
+	if len(servers) != 3 || servers[0] != (Server{Address: "10.0.0.1", Port: 8080}) || servers[2].Port != 8081 {
+		t.Errorf("Unexpected servers: %v", servers)
+	}
+}
+
+func TestConsulCatalog(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/health/service/api" || r.URL.Query().Get("passing") != "true" || r.URL.Query().Get("tag") != "v1" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		_ = json.NewEncoder(w).Encode([]map[string]interface{}{
+			{"Node": map[string]string{"Address": "10.0.0.1"}, "Service": map[string]interface{}{"Address": "", "Port": 8080}},
+			{"Node": map[string]string{"Address": "10.0.0.9"}, "Service": map[string]interface{}{"Address": "10.0.0.2", "Port": 8080}},
+		})
+	}))
+	defer server.Close()
+
+	servers, err := NewConsulCatalog(kvsource.ConsulConfig{Address: server.URL}, "api", "v1").Resolve(context.Background())
+	if err != nil {
+		t.Fatalf("Failed to resolve: %v", err)
+	}
+	if len(servers) != 2 || servers[0].Address != "10.0.0.1" || servers[1].Address != "10.0.0.2" {
+		t.Errorf("Expected node and service addresses, but got: %v", servers)
+	}
+}
+
+func TestFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "api.json")
+	if err := os.WriteFile(path, []byte(`[{"address": "10.0.0.1", "port": 80}]`), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := NewFile(path)
+	if err != nil {
+		t.Fatalf("Failed to create file provider: %v", err)
+	}
+	defer func() { _ = f.Close() }()
+
+	servers, err := f.Resolve(context.Background())
+	if err != nil || len(servers) != 1 || servers[0].Port != 80 {
+		t.Fatalf("Unexpected servers: %v, %v", servers, err)
+	}
+
+	if err := os.WriteFile(path, []byte(`[]`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-f.Changes():
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Expected the file change to be signalled")
+	}
+}
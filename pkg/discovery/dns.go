@@ -0,0 +1,47 @@
+package discovery
+
+import (
+	"context"
+	"net"
+	"strings"
+)
+
+// Resolver looks up DNS records. *net.Resolver implements it.
+type Resolver interface {
+	LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error)
+	LookupHost(ctx context.Context, host string) ([]string, error)
+}
+
+// DNS resolves a pool from the SRV records of a name, such as
+// `_http._tcp.api.service.consul`. Each target is resolved to its
+// addresses, served on the port of its record.
+type DNS struct {
+	name     string
+	resolver Resolver
+}
+
+// NewDNS initializes and returns a new DNS provider using the system
+// resolver.
+func NewDNS(name string) *DNS {
+	return &DNS{name: name, resolver: net.DefaultResolver}
+}
+
+// Resolve looks up the SRV records of the name and their targets.
+func (d *DNS) Resolve(ctx context.Context) ([]Server, error) {
+	_, records, err := d.resolver.LookupSRV(ctx, "", "", d.name)
+	if err != nil {
+		return nil, err
+	}
+
+	var servers []Server
+	for _, r := range records {
+		addresses, err := d.resolver.LookupHost(ctx, strings.TrimSuffix(r.Target, "."))
+		if err != nil {
+			return nil, err
+		}
+		for _, address := range addresses {
+			servers = append(servers, Server{Address: address, Port: int(r.Port)})
+		}
+	}
+	return servers, nil
+}
@@ -0,0 +1,89 @@
+package discovery
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/sirupsen/logrus"
+)
+
+// File resolves a pool from a JSON file listing its servers:
+//
+//	[{"address": "10.0.0.1", "port": 8080}, {"address": "10.0.0.2", "port": 8080}]
+//
+// The file is watched, so changes are signalled as soon as it's written.
+type File struct {
+	path    string
+	watcher *fsnotify.Watcher
+	changes chan struct{}
+}
+
+// NewFile initializes and returns a new File provider reading path.
+func NewFile(path string) (*File, error) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	// The directory is watched rather than the file, so the file can be
+	// replaced atomically by a rename
+	if err := watcher.Add(filepath.Dir(path)); err != nil {
+		_ = watcher.Close()
+		return nil, err
+	}
+
+	f := &File{path: path, watcher: watcher, changes: make(chan struct{}, 1)}
+	go f.run()
+	return f, nil
+}
+
+// Resolve reads the servers listed in the file.
+func (f *File) Resolve(_ context.Context) ([]Server, error) {
+	data, err := os.ReadFile(filepath.Clean(f.path))
+	if err != nil {
+		return nil, err
+	}
+
+	var servers []Server
+	if err := json.Unmarshal(data, &servers); err != nil {
+		return nil, err
+	}
+	return servers, nil
+}
+
+// Changes returns a channel receiving a value when the file changes.
+func (f *File) Changes() <-chan struct{} {
+	return f.changes
+}
+
+// Close stops watching the file.
+func (f *File) Close() error {
+	return f.watcher.Close()
+}
+
+// run consumes filesystem events until the watcher is closed.
+func (f *File) run() {
+	defer close(f.changes)
+	for {
+		select {
+		case event, ok := <-f.watcher.Events:
+			if !ok {
+				return
+			}
+			if filepath.Clean(event.Name) != filepath.Clean(f.path) {
+				continue
+			}
+			select {
+			case f.changes <- struct{}{}:
+			default:
+			}
+		case err, ok := <-f.watcher.Errors:
+			if !ok {
+				return
+			}
+			logrus.Warnf("Error watching pool file %s: %v", f.path, err)
+		}
+	}
+}
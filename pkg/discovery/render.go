@@ -0,0 +1,75 @@
+package discovery
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"strings"
+
+	"github.com/zcubbs/hpxd/pkg/haproxy"
+)
+
+// Marker is the comment declaring where the servers of a pool go.
+const Marker = "# hpxd:pool"
+
+// Usage is a pool used in a backend.
+type Usage struct {
+	Backend string
+	Pool    string
+	// Options are appended to every server of the pool
+	Options []string
+}
+
+// Render replaces every pool marker of template with the servers of the
+// pool, and returns the rendered configuration along with where pools are
+// used.
+func Render(template []byte, pools map[string][]Server) ([]byte, []Usage, error) {
+	cfg, err := haproxy.ParseConfig(bytes.NewReader(template))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var out bytes.Buffer
+	var usages []Usage
+	scanner := bufio.NewScanner(bytes.NewReader(template))
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		line := scanner.Text()
+		trimmed := strings.TrimSpace(line)
+		if !strings.HasPrefix(trimmed, Marker+" ") {
+			out.WriteString(line + "\n")
+			continue
+		}
+
+		fields := strings.Fields(strings.TrimPrefix(trimmed, Marker))
+		if len(fields) == 0 {
+			return nil, nil, fmt.Errorf("line %d: missing pool name", lineNo)
+		}
+		usage := Usage{Pool: fields[0], Options: fields[1:]}
+		section := cfg.SectionAt(lineNo)
+		if section == nil || (section.Type != haproxy.SectionBackend && section.Type != haproxy.SectionListen) {
+			return nil, nil, fmt.Errorf("line %d: pool %s must be used in a backend or listen section", lineNo, usage.Pool)
+		}
+		usage.Backend = section.Name
+
+		servers, ok := pools[usage.Pool]
+		if !ok {
+			return nil, nil, fmt.Errorf("line %d: unknown pool %s", lineNo, usage.Pool)
+		}
+		indent := line[:len(line)-len(strings.TrimLeft(line, " \t"))]
+		for _, s := range servers {
+			out.WriteString(indent + ServerLine(usage, s) + "\n")
+		}
+		usages = append(usages, usage)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, nil, err
+	}
+	return out.Bytes(), usages, nil
+}
+
+// ServerLine returns the `server` directive of s in the backend of usage.
+func ServerLine(usage Usage, s Server) string {
+	return strings.TrimSpace(fmt.Sprintf("server %s %s %s", ServerName(usage.Pool, s), s.Endpoint(), strings.Join(usage.Options, " ")))
+}
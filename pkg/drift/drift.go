@@ -0,0 +1,232 @@
+// Package drift detects changes made to the deployed HAProxy files outside
+// of hpxd, such as manual edits of /etc/haproxy/haproxy.cfg.
+//
+// Every time hpxd applies a configuration, the content of every deployed
+// file is recorded as the desired state. Comparing the node against that
+// state reveals drift, and the recorded content allows restoring it.
+//
+// Author: zakaria.elbouwab
+package drift
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/zcubbs/hpxd/pkg/files"
+)
+
+// Drift reasons.
+const (
+	ReasonModified = "modified"
+	ReasonMissing  = "missing"
+)
+
+const stateFile = "state.json"
+
+// Drift describes a deployed file that no longer matches the desired state.
+type Drift struct {
+	Target string
+	Reason string
+}
+
+// state is the desired state, mapping every deployed file to the hash of
+// its content, and to its mode when it was recorded.
+type state struct {
+	Files map[string]string      `json:"files"`
+	Modes map[string]os.FileMode `json:"modes,omitempty"`
+}
+
+// Detector records the desired state of the deployed files and compares
+// the node against it.
+type Detector struct {
+	dir string
+}
+
+// NewDetector initializes and returns a new Detector keeping its state,
+// along with a copy of the desired content, in dir.
+func NewDetector(dir string) *Detector {
+	return &Detector{dir: dir}
+}
+
+// Record stores the desired state. files maps every deployed target to the
+// source it was deployed from. The previous state is replaced.
+func (d *Detector) Record(files map[string]string) error {
+	s := state{Files: make(map[string]string, len(files)), Modes: make(map[string]os.FileMode, len(files))}
+	for target, source := range files {
+		if err := d.store(&s, target, source); err != nil {
+			return err
+		}
+	}
+	return d.save(s)
+}
+
+// RecordFile updates the desired state of a single target, deployed from
+// source, keeping the state of the other targets.
+func (d *Detector) RecordFile(target, source string) error {
+	s, err := d.load()
+	if err != nil {
+		return err
+	}
+	if s == nil {
+		s = &state{Files: make(map[string]string, 1)}
+	}
+	if s.Modes == nil {
+		s.Modes = make(map[string]os.FileMode, 1)
+	}
+	if err := d.store(s, target, source); err != nil {
+		return err
+	}
+	return d.save(*s)
+}
+
+// store keeps a copy of the content of source as the desired content of
+// target.
+func (d *Detector) store(s *state, target, source string) error {
+	if err := os.MkdirAll(filepath.Join(d.dir, "objects"), 0750); err != nil {
+		return err
+	}
+	content, err := os.ReadFile(filepath.Clean(source))
+	if err != nil {
+		return err
+	}
+	hash := hashOf(content)
+	if err := os.WriteFile(d.objectPath(hash), content, 0600); err != nil {
+		return err
+	}
+	s.Files[target] = hash
+	if info, err := os.Stat(target); err == nil {
+		s.Modes[target] = info.Mode().Perm()
+	}
+	return nil
+}
+
+// save writes the desired state and removes the content it no longer
+// references.
+func (d *Detector) save(s state) error {
+	if err := os.MkdirAll(filepath.Join(d.dir, "objects"), 0750); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(d.dir, stateFile), data, 0600); err != nil {
+		return err
+	}
+
+	return d.prune(s)
+}
+
+// Check compares the deployed files with the desired state. It returns no
+// drift if no state was recorded yet.
+func (d *Detector) Check() ([]Drift, error) {
+	s, err := d.load()
+	if err != nil || s == nil {
+		return nil, err
+	}
+
+	var drifts []Drift
+	for target, hash := range s.Files {
+		content, err := os.ReadFile(filepath.Clean(target))
+		switch {
+		case errors.Is(err, os.ErrNotExist):
+			drifts = append(drifts, Drift{Target: target, Reason: ReasonMissing})
+		case err != nil:
+			return nil, err
+		case hashOf(content) != hash:
+			drifts = append(drifts, Drift{Target: target, Reason: ReasonModified})
+		}
+	}
+
+	sort.Slice(drifts, func(i, j int) bool { return drifts[i].Target < drifts[j].Target })
+	return drifts, nil
+}
+
+// Restore writes the desired content back to the drifted files. Files are
+// replaced atomically and keep their mode, or get back the one they had
+// when recorded if they're missing.
+func (d *Detector) Restore(drifts []Drift) error {
+	s, err := d.load()
+	if err != nil {
+		return err
+	}
+	if s == nil {
+		return errors.New("no desired state recorded")
+	}
+
+	for _, drift := range drifts {
+		hash, ok := s.Files[drift.Target]
+		if !ok {
+			return fmt.Errorf("%s is not part of the desired state", drift.Target)
+		}
+		content, err := os.ReadFile(d.objectPath(hash))
+		if err != nil {
+			return err
+		}
+		if err := os.MkdirAll(filepath.Dir(drift.Target), 0750); err != nil {
+			return err
+		}
+		if err := files.WriteAtomic(drift.Target, content); err != nil {
+			return err
+		}
+		if mode, ok := s.Modes[drift.Target]; ok && drift.Reason == ReasonMissing {
+			if err := os.Chmod(drift.Target, mode); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// load reads the desired state, or returns nil if none was recorded.
+func (d *Detector) load() (*state, error) {
+	data, err := os.ReadFile(filepath.Join(d.dir, stateFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var s state
+	if err := json.Unmarshal(data, &s); err != nil {
+		return nil, fmt.Errorf("failed to decode desired state: %w", err)
+	}
+	return &s, nil
+}
+
+// prune removes the stored content no longer referenced by the state.
+func (d *Detector) prune(s state) error {
+	referenced := make(map[string]bool, len(s.Files))
+	for _, hash := range s.Files {
+		referenced[hash] = true
+	}
+
+	entries, err := os.ReadDir(filepath.Join(d.dir, "objects"))
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if !referenced[e.Name()] {
+			if err := os.Remove(d.objectPath(e.Name())); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (d *Detector) objectPath(hash string) string {
+	return filepath.Join(d.dir, "objects", hash)
+}
+
+func hashOf(content []byte) string {
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,120 @@
+package drift
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDetector(t *testing.T) {
+	repo := t.TempDir()
+	node := t.TempDir()
+	detector := NewDetector(t.TempDir())
+
+	if drifts, err := detector.Check(); err != nil || len(drifts) != 0 {
+		t.Fatalf("Expected no drift without a desired state, but got: %v, %v", drifts, err)
+	}
+
+	files := map[string]string{
+		filepath.Join(node, "haproxy.cfg"):   filepath.Join(repo, "haproxy.cfg"),
+		filepath.Join(node, "maps", "a.map"): filepath.Join(repo, "a.map"),
+	}
+	for target, source := range files {
+		for _, path := range []string{target, source} {
+			if err := os.MkdirAll(filepath.Dir(path), 0750); err != nil {
+				t.Fatalf("Failed to create directory: %v", err)
+			}
+			if err := os.WriteFile(path, []byte("content of "+filepath.Base(source)), 0600); err != nil {
+				t.Fatalf("Failed to write file: %v", err)
+			}
+		}
+	}
+
+	if err := detector.Record(files); err != nil {
+		t.Fatalf("Failed to record desired state: %v", err)
+	}
+	if drifts, err := detector.Check(); err != nil || len(drifts) != 0 {
+		t.Fatalf("Expected no drift right after recording, but got: %v, %v", drifts, err)
+	}
+
+	if err := os.WriteFile(filepath.Join(node, "haproxy.cfg"), []byte("edited by hand"), 0600); err != nil {
+		t.Fatalf("Failed to edit file: %v", err)
+	}
+	if err := os.Chmod(filepath.Join(node, "maps", "a.map"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := detector.RecordFile(filepath.Join(node, "maps", "a.map"), filepath.Join(repo, "a.map")); err != nil {
+		t.Fatalf("Failed to record file: %v", err)
+	}
+	if err := os.Remove(filepath.Join(node, "maps", "a.map")); err != nil {
+		t.Fatalf("Failed to remove file: %v", err)
+	}
+
+	drifts, err := detector.Check()
+	if err != nil {
+		t.Fatalf("Failed to check drift: %v", err)
+	}
+	expected := []Drift{
+		{Target: filepath.Join(node, "haproxy.cfg"), Reason: ReasonModified},
+		{Target: filepath.Join(node, "maps", "a.map"), Reason: ReasonMissing},
+	}
+	if len(drifts) != len(expected) || drifts[0] != expected[0] || drifts[1] != expected[1] {
+		t.Fatalf("Expected drifts %v, but got: %v", expected, drifts)
+	}
+
+	if err := detector.Restore(drifts); err != nil {
+		t.Fatalf("Failed to restore desired state: %v", err)
+	}
+	content, err := os.ReadFile(filepath.Join(node, "haproxy.cfg"))
+	if err != nil || string(content) != "content of haproxy.cfg" {
+		t.Errorf("Expected haproxy.cfg to be restored, but got: %q, %v", content, err)
+	}
+	if info, err := os.Stat(filepath.Join(node, "maps", "a.map")); err != nil || info.Mode().Perm() != 0644 {
+		t.Errorf("Expected a.map to be restored with its recorded mode, but got: %v, %v", info, err)
+	}
+	if drifts, err := detector.Check(); err != nil || len(drifts) != 0 {
+		t.Errorf("Expected no drift after restoring, but got: %v, %v", drifts, err)
+	}
+}
+
+func TestDetector_RecordFile(t *testing.T) {
+	repo := t.TempDir()
+	node := t.TempDir()
+	detector := NewDetector(t.TempDir())
+
+	for _, name := range []string{"haproxy.cfg", "a.map"} {
+		for _, dir := range []string{repo, node} {
+			if err := os.WriteFile(filepath.Join(dir, name), []byte("content of "+name), 0600); err != nil {
+				t.Fatalf("Failed to write file: %v", err)
+			}
+		}
+	}
+	err := detector.Record(map[string]string{
+		filepath.Join(node, "haproxy.cfg"): filepath.Join(repo, "haproxy.cfg"),
+		filepath.Join(node, "a.map"):       filepath.Join(repo, "a.map"),
+	})
+	if err != nil {
+		t.Fatalf("Failed to record desired state: %v", err)
+	}
+
+	// The configuration is rendered again, the map is left alone
+	if err := os.WriteFile(filepath.Join(repo, "haproxy.cfg"), []byte("rendered"), 0600); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(node, "haproxy.cfg"), []byte("rendered"), 0600); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+	if err := detector.RecordFile(filepath.Join(node, "haproxy.cfg"), filepath.Join(repo, "haproxy.cfg")); err != nil {
+		t.Fatalf("Failed to record file: %v", err)
+	}
+	if drifts, err := detector.Check(); err != nil || len(drifts) != 0 {
+		t.Fatalf("Expected no drift after recording the file, but got: %v, %v", drifts, err)
+	}
+
+	if err := os.Remove(filepath.Join(node, "a.map")); err != nil {
+		t.Fatalf("Failed to remove file: %v", err)
+	}
+	if drifts, err := detector.Check(); err != nil || len(drifts) != 1 {
+		t.Errorf("Expected the other files to stay in the desired state, but got: %v, %v", drifts, err)
+	}
+}
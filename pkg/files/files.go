@@ -0,0 +1,202 @@
+// Package files synchronises auxiliary HAProxy files, such as maps,
+// certificates and error files, from a source tree to the node.
+//
+// Author: zakaria.elbouwab
+package files
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// Mapping maps a file or directory of the source tree to its location on
+// the node. Directories are synchronised recursively.
+type Mapping struct {
+	Source string `mapstructure:"source"`
+	Target string `mapstructure:"target"`
+}
+
+// File is a single file to synchronise.
+//
+// TargetRoot is the target of the Mapping the file comes from. It equals
+// Target for file mappings and is the target directory otherwise.
+type File struct {
+	Source     string
+	Target     string
+	TargetRoot string
+}
+
+// Resolve expands the given mappings, relative to root, into the list of
+// files to synchronise.
+func Resolve(root string, mappings []Mapping) ([]File, error) {
+	var files []File
+	for _, m := range mappings {
+		src := filepath.Join(root, m.Source)
+		target := filepath.Clean(m.Target)
+
+		info, err := os.Stat(src)
+		if err != nil {
+			return nil, fmt.Errorf("failed to resolve %s: %w", m.Source, err)
+		}
+		if !info.IsDir() {
+			files = append(files, File{Source: src, Target: target, TargetRoot: target})
+			continue
+		}
+
+		err = filepath.WalkDir(src, func(path string, d fs.DirEntry, err error) error {
+			if err != nil || d.IsDir() {
+				return err
+			}
+			rel, err := filepath.Rel(src, path)
+			if err != nil {
+				return err
+			}
+			files = append(files, File{Source: path, Target: filepath.Join(target, rel), TargetRoot: target})
+			return nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to resolve %s: %w", m.Source, err)
+		}
+	}
+
+	sort.Slice(files, func(i, j int) bool { return files[i].Target < files[j].Target })
+	return files, nil
+}
+
+// Sync copies every file whose content differs from its target and returns
+// the targets that were written.
+func Sync(files []File) ([]string, error) {
+	var written []string
+	for _, f := range files {
+		changed, err := Copy(f.Source, f.Target)
+		if err != nil {
+			return written, err
+		}
+		if changed {
+			written = append(written, f.Target)
+		}
+	}
+	return written, nil
+}
+
+// Copy copies src to dest, creating the parent directories of dest as
+// needed. It returns false without writing anything if dest already holds
+// the same content.
+func Copy(src, dest string) (bool, error) {
+	input, err := os.ReadFile(filepath.Clean(src))
+	if err != nil {
+		return false, err
+	}
+
+	current, err := os.ReadFile(filepath.Clean(dest))
+	if err == nil && bytes.Equal(current, input) {
+		return false, nil
+	}
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return false, err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(dest), 0750); err != nil {
+		return false, err
+	}
+	return true, WriteAtomic(dest, input)
+}
+
+// WriteAtomic writes data to dest through a temporary file renamed over it,
+// so HAProxy never reads a partially written file, even if hpxd is stopped
+// midway. The mode of an existing dest is kept, and symbolic links are
+// followed. When the directory of dest isn't writable, dest is written in
+// place instead.
+func WriteAtomic(dest string, data []byte) error {
+	if resolved, err := filepath.EvalSymlinks(dest); err == nil {
+		dest = resolved
+	}
+	mode := os.FileMode(0600)
+	if info, err := os.Stat(dest); err == nil {
+		mode = info.Mode().Perm()
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(dest), "."+filepath.Base(dest)+".*")
+	if errors.Is(err, os.ErrPermission) {
+		return os.WriteFile(dest, data, mode)
+	}
+	if err != nil {
+		return err
+	}
+	defer func() { _ = os.Remove(tmp.Name()) }()
+
+	if _, err := tmp.Write(data); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), mode); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), dest)
+}
+
+// CopyTree recursively copies the regular files of the src directory into
+// dest. A missing src is not an error.
+func CopyTree(src, dest string) error {
+	err := filepath.WalkDir(src, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || !d.Type().IsRegular() {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		_, err = Copy(path, filepath.Join(dest, rel))
+		return err
+	})
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// Checksum returns a hash of the paths and contents of the regular files
+// below dir, ignoring the metadata of git repositories.
+func Checksum(dir string) (string, error) {
+	sum := sha256.New()
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() && d.Name() == ".git" {
+			return filepath.SkipDir
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		fileSum := sha256.Sum256(content)
+		_, err = fmt.Fprintf(sum, "%s %x\n", filepath.ToSlash(rel), fileSum)
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(sum.Sum(nil)), nil
+}
@@ -0,0 +1,121 @@
+package files
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeFile(t *testing.T, path, content string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0750); err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+}
+
+func TestResolveAndSync(t *testing.T) {
+	repo := t.TempDir()
+	node := t.TempDir()
+	writeFile(t, filepath.Join(repo, "maps", "hosts.map"), "example.com be_web\n")
+	writeFile(t, filepath.Join(repo, "maps", "nested", "paths.map"), "/api be_api\n")
+	writeFile(t, filepath.Join(repo, "errors", "503.http"), "HTTP/1.0 503\n")
+
+	files, err := Resolve(repo, []Mapping{
+		{Source: "maps", Target: filepath.Join(node, "maps")},
+		{Source: "errors/503.http", Target: filepath.Join(node, "errors", "503.http")},
+	})
+	if err != nil {
+		t.Fatalf("Failed to resolve mappings: %v", err)
+	}
+	if len(files) != 3 {
+		t.Fatalf("Expected 3 files, but got: %v", files)
+	}
+	if files[1].TargetRoot != filepath.Join(node, "maps") {
+		t.Errorf("Expected target root to be the maps directory, but got: %s", files[1].TargetRoot)
+	}
+
+	written, err := Sync(files)
+	if err != nil {
+		t.Fatalf("Failed to sync files: %v", err)
+	}
+	if len(written) != 3 {
+		t.Errorf("Expected 3 files to be written, but got: %v", written)
+	}
+
+	written, err = Sync(files)
+	if err != nil {
+		t.Fatalf("Failed to sync files: %v", err)
+	}
+	if len(written) != 0 {
+		t.Errorf("Expected unchanged files to be skipped, but got: %v", written)
+	}
+}
+
+func TestResolve_MissingSource(t *testing.T) {
+	if _, err := Resolve(t.TempDir(), []Mapping{{Source: "missing", Target: "/tmp/missing"}}); err == nil {
+		t.Errorf("Expected resolving a missing source to fail")
+	}
+}
+
+func TestChecksum(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "haproxy.cfg"), []byte("global\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	before, err := Checksum(dir)
+	if err != nil {
+		t.Fatalf("Failed to checksum directory: %v", err)
+	}
+
+	if err := os.Mkdir(filepath.Join(dir, ".git"), 0750); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, ".git", "HEAD"), []byte("ref\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if after, _ := Checksum(dir); after != before {
+		t.Errorf("Expected git metadata to be ignored")
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, "haproxy.cfg"), []byte("global\n    daemon\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if after, _ := Checksum(dir); after == before {
+		t.Errorf("Expected checksum to change with the content")
+	}
+}
+
+func TestWriteAtomic(t *testing.T) {
+	dir := t.TempDir()
+	target := filepath.Join(dir, "haproxy.cfg")
+	writeFile(t, target, "global\n")
+	if err := os.Chmod(target, 0644); err != nil {
+		t.Fatal(err)
+	}
+	link := filepath.Join(dir, "current.cfg")
+	if err := os.Symlink(target, link); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := WriteAtomic(link, []byte("defaults\n")); err != nil {
+		t.Fatalf("Failed to write: %v", err)
+	}
+	content, err := os.ReadFile(target)
+	if err != nil || string(content) != "defaults\n" {
+		t.Errorf("Expected the link target to be written, got %q, %v", content, err)
+	}
+	if info, err := os.Lstat(link); err != nil || info.Mode()&os.ModeSymlink == 0 {
+		t.Errorf("Expected the link to be kept")
+	}
+	if info, err := os.Stat(target); err != nil || info.Mode().Perm() != 0644 {
+		t.Errorf("Expected the mode to be kept, got %v", info.Mode())
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil || len(entries) != 2 {
+		t.Errorf("Expected no temporary file to be left, got %v", entries)
+	}
+}
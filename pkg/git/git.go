@@ -8,6 +8,7 @@
 package git
 
 import (
+	"context"
 	"fmt"
 	"github.com/sirupsen/logrus"
 	"github.com/zcubbs/hpxd/pkg/cmd"
@@ -15,6 +16,7 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
 )
 
 // Handler manages operations on a git repository.
@@ -30,6 +32,17 @@ type Handler struct {
 	localRepoPath     string
 	path              string
 	haproxyConfigPath string
+
+	// pushUsername and pushPassword are used instead of the credentials
+	// above to push status records
+	pushUsername string
+	pushPassword string
+
+	// mu serializes the commands changing the local copy, as status records
+	// are pushed from it while it's pulled. pulled is set once the local
+	// copy was pulled or cloned.
+	mu     sync.Mutex
+	pulled bool
 }
 
 // NewHandler initializes and returns a new Handler instance.
@@ -54,15 +67,70 @@ func NewHandler(repoURL, branch, username, password, path, haproxyConfigPath str
 // If it does exist, it pulls the latest changes. This function then
 // returns the path to the new configuration and a flag indicating if there
 // were any updates.
-func (g *Handler) PullAndUpdate() (string, bool, error) {
+//
+// The first call always reports an update, as a local copy left by a
+// previous process, such as before a restart, is new to this one.
+func (g *Handler) PullAndUpdate(ctx context.Context) (string, bool, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
 	// Check if repo already exists locally
 	if _, err := os.Stat(g.localRepoPath); os.IsNotExist(err) {
 		// Clone repo if it doesn't exist
-		return g.cloneRepo()
+		configPath, updated, err := g.cloneRepo(ctx)
+		g.pulled = g.pulled || err == nil
+		return configPath, updated, err
 	}
 
 	// Pull latest changes if repo exists
-	return g.pullRepo()
+	configPath, updated, err := g.pullRepo(ctx)
+	if err != nil {
+		return "", false, err
+	}
+	if !g.pulled {
+		g.pulled = true
+		return g.getHAProxyConfigPath(), true, nil
+	}
+	return configPath, updated, nil
+}
+
+// RepoPath returns the path to the local copy of the git repository.
+func (g *Handler) RepoPath() string {
+	return g.localRepoPath
+}
+
+// SetPushCredentials sets the credentials status records are pushed with,
+// when the credentials the repository is pulled with can only read it.
+func (g *Handler) SetPushCredentials(username, password string) {
+	g.pushUsername, g.pushPassword = username, password
+}
+
+// SetLocalPath changes where the repository is cloned, so several handlers
+// can be used side by side.
+func (g *Handler) SetLocalPath(path string) {
+	g.localRepoPath = path
+}
+
+// Revision returns the commit currently checked out in the local copy of
+// the repository, or an empty string if it wasn't cloned yet.
+func (g *Handler) Revision() string {
+	output, err := cmd.RunCmdCombinedOutput("git", "-C", g.localRepoPath, "rev-parse", "HEAD")
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(output))
+}
+
+// Trailer returns the values of the trailer key in the message of the
+// commit checked out, one per line, or an empty string if it has none.
+// Keys are matched regardless of case, as git does.
+func (g *Handler) Trailer(key string) (string, error) {
+	output, err := cmd.RunCmdOutput("git", "-C", g.localRepoPath, "log", "-1",
+		"--format=%(trailers:key="+key+",valueonly)")
+	if err != nil {
+		return "", fmt.Errorf("failed to read trailers of the commit: %w", err)
+	}
+	return strings.TrimSpace(string(output)), nil
 }
 
 // getHAProxyConfigPath constructs and returns the complete file path
@@ -75,9 +143,24 @@ func (g *Handler) getHAProxyConfigPath() string {
 //
 // If the username and password fields are empty, it returns the repo URL as is.
 func (g *Handler) getRepoURLWithCredentials() string {
-	if g.username != "" && g.password != "" {
+	return g.repoURLWith(g.username, g.password)
+}
+
+// getPushURLWithCredentials returns the repo URL with the push credentials
+// embedded, falling back to the credentials the repository is pulled with.
+func (g *Handler) getPushURLWithCredentials() string {
+	if g.pushUsername != "" && g.pushPassword != "" {
+		return g.repoURLWith(g.pushUsername, g.pushPassword)
+	}
+	return g.getRepoURLWithCredentials()
+}
+
+// repoURLWith returns the repo URL with username and password embedded, or
+// as is if either is empty.
+func (g *Handler) repoURLWith(username, password string) string {
+	if username != "" && password != "" {
 		// Embed the credentials in the repo URL
-		return strings.Replace(g.repoURL, "https://", fmt.Sprintf("https://%s:%s@", url.PathEscape(g.username), url.PathEscape(g.password)), 1)
+		return strings.Replace(g.repoURL, "https://", fmt.Sprintf("https://%s:%s@", url.PathEscape(username), url.PathEscape(password)), 1)
 	}
 	return g.repoURL
 }
@@ -86,8 +169,8 @@ func (g *Handler) getRepoURLWithCredentials() string {
 //
 // It returns the path to the HAProxy configuration and a flag indicating if
 // the clone operation was successful.
-func (g *Handler) cloneRepo() (string, bool, error) {
-	if err := cmd.RunCmd("git", "clone", "-b", g.branch, g.getRepoURLWithCredentials(), g.localRepoPath); err != nil {
+func (g *Handler) cloneRepo(ctx context.Context) (string, bool, error) {
+	if err := cmd.RunCmdContext(ctx, "git", "clone", "-b", g.branch, g.getRepoURLWithCredentials(), g.localRepoPath); err != nil {
 		return "", false, err
 	}
 	return g.getHAProxyConfigPath(), true, nil
@@ -97,8 +180,8 @@ func (g *Handler) cloneRepo() (string, bool, error) {
 //
 // It returns the path to the updated HAProxy configuration and a flag indicating
 // if there were any changes during the pull operation.
-func (g *Handler) pullRepo() (string, bool, error) {
-	output, err := cmd.RunCmdCombinedOutput("git", "-C", g.localRepoPath, "pull", g.getRepoURLWithCredentials(), g.branch)
+func (g *Handler) pullRepo(ctx context.Context) (string, bool, error) {
+	output, err := cmd.RunCmdCombinedOutputContext(ctx, "git", "-C", g.localRepoPath, "pull", g.getRepoURLWithCredentials(), g.branch)
 	if err != nil {
 		logrus.Debugf("Failed to pull repo: %v, details: %s", err, string(output))
 		return "", false, fmt.Errorf("failed to pull repo: %v, details: %s", err, string(output))
@@ -1,6 +1,7 @@
 package git
 
 import (
+	"context"
 	"os"
 	"testing"
 )
@@ -21,7 +22,7 @@ func TestNewGitHandler(t *testing.T) {
 
 func TestCloneRepo(t *testing.T) {
 	handler := NewHandler(testRepoURL, testRepoBranch, "", "", testHaproxyFilePath, testHaproxyConfigPath)
-	_, _, err := handler.cloneRepo()
+	_, _, err := handler.cloneRepo(context.Background())
 	if err != nil {
 		t.Errorf("Failed to clone the repo: %v", err)
 	}
@@ -35,11 +36,11 @@ func TestCloneRepo(t *testing.T) {
 
 func TestPullRepo(t *testing.T) {
 	handler := NewHandler(testRepoURL, testRepoBranch, "", "", testHaproxyFilePath, testHaproxyConfigPath)
-	_, _, err := handler.cloneRepo()
+	_, _, err := handler.cloneRepo(context.Background())
 	if err != nil {
 		t.Errorf("Failed to clone the repo: %v", err)
 	}
-	_, _, err = handler.pullRepo()
+	_, _, err = handler.pullRepo(context.Background())
 	if err != nil {
 		t.Errorf("Failed to pull the repo: %v", err)
 	}
@@ -47,8 +48,24 @@ func TestPullRepo(t *testing.T) {
 
 func TestPullAndUpdate(t *testing.T) {
 	handler := NewHandler(testRepoURL, testRepoBranch, "", "", testHaproxyFilePath, testHaproxyConfigPath)
-	_, _, err := handler.PullAndUpdate()
+	_, _, err := handler.PullAndUpdate(context.Background())
 	if err != nil {
 		t.Errorf("Failed to pull and update: %v", err)
 	}
 }
+
+func TestPullAndUpdate_ExistingCopy(t *testing.T) {
+	remote, _ := newTestRemote(t)
+	cloned := newTestHandler(t, remote)
+
+	// A new handler, such as after a restart, finds the local copy up to date
+	handler := NewHandler(remote, "main", "", "", "haproxy.cfg", "")
+	handler.SetLocalPath(cloned.RepoPath())
+	configPath, updated, err := handler.PullAndUpdate(context.Background())
+	if err != nil || !updated || configPath != cloned.getHAProxyConfigPath() {
+		t.Errorf("Expected the first pull to report an update, but got: %s, %v, %v", configPath, updated, err)
+	}
+	if _, updated, err := handler.PullAndUpdate(context.Background()); err != nil || updated {
+		t.Errorf("Expected no update on the second pull, but got: %v, %v", updated, err)
+	}
+}
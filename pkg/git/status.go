@@ -0,0 +1,237 @@
+package git
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/zcubbs/hpxd/pkg/cmd"
+)
+
+// DefaultNotesRef is the notes ref status records are added to.
+const DefaultNotesRef = "refs/notes/hpxd"
+
+// pushAttempts is how many times a status record is written again on top
+// of the latest remote state when its push is rejected, because another
+// node pushed in the meantime.
+const pushAttempts = 5
+
+// StatusRecord is the status of a node for a revision.
+type StatusRecord struct {
+	Node           string    `json:"node"`
+	Instance       string    `json:"instance,omitempty"`
+	Revision       string    `json:"revision"`
+	Result         string    `json:"result"`
+	Message        string    `json:"message,omitempty"`
+	HAProxyVersion string    `json:"haproxyVersion,omitempty"`
+	Time           time.Time `json:"time"`
+}
+
+// key identifies the node, and the instance on the node, a record is about.
+func (r StatusRecord) key() string {
+	if r.Instance == "" {
+		return r.Node
+	}
+	return r.Node + "-" + r.Instance
+}
+
+// PushNote records r in the git note of the revision it's about, under
+// ref, and pushes the notes. A note holds one JSON record per line and per
+// node, the record of the node replacing its previous one.
+func (g *Handler) PushNote(ref string, r StatusRecord) error {
+	return g.pushWithRetry(func() error {
+		if err := g.fetchRef(ref, ref); err != nil {
+			return err
+		}
+
+		var existing string
+		if output, err := g.git("notes", "--ref="+ref, "show", r.Revision); err == nil {
+			existing = string(output)
+		}
+		content, err := mergeRecord(existing, r)
+		if err != nil {
+			return err
+		}
+
+		file, err := g.writeTemp(content)
+		if err != nil {
+			return err
+		}
+		defer func() { _ = os.Remove(file) }()
+
+		if output, err := g.gitAs(r.Node, "notes", "--ref="+ref, "add", "-f", "-F", file, r.Revision); err != nil {
+			return fmt.Errorf("failed to add note: %v, details: %s", err, output)
+		}
+		return g.push(ref + ":" + ref)
+	})
+}
+
+// PushStatusBranch records r as the `<node>.json` file of branch, or
+// `<node>-<instance>.json`, in a commit of its own, and pushes the branch.
+// The branch only holds status records and shares no history with the
+// configuration.
+func (g *Handler) PushStatusBranch(branch string, r StatusRecord) error {
+	local := "refs/hpxd/" + branch
+	return g.pushWithRetry(func() error {
+		if err := g.fetchRef("refs/heads/"+branch, local); err != nil {
+			return err
+		}
+
+		data, err := json.MarshalIndent(r, "", "  ")
+		if err != nil {
+			return err
+		}
+		file, err := g.writeTemp(string(data) + "\n")
+		if err != nil {
+			return err
+		}
+		defer func() { _ = os.Remove(file) }()
+
+		blob, err := g.git("hash-object", "-w", file)
+		if err != nil {
+			return fmt.Errorf("failed to store status record: %w", err)
+		}
+
+		name := r.key() + ".json"
+		entries := []string{fmt.Sprintf("100644 blob %s\t%s", strings.TrimSpace(string(blob)), name)}
+		parent, _ := g.git("rev-parse", "--verify", "--quiet", local)
+		if len(parent) > 0 {
+			tree, err := g.git("ls-tree", local)
+			if err != nil {
+				return err
+			}
+			for _, line := range strings.Split(strings.TrimSpace(string(tree)), "\n") {
+				if line != "" && !strings.HasSuffix(line, "\t"+name) {
+					entries = append(entries, line)
+				}
+			}
+		}
+
+		tree, err := cmd.RunCmdWithInput([]byte(strings.Join(entries, "\n")+"\n"), "git", "-C", g.localRepoPath, "mktree")
+		if err != nil {
+			return fmt.Errorf("failed to write status tree: %w", err)
+		}
+		args := []string{"commit-tree", strings.TrimSpace(string(tree)),
+			"-m", fmt.Sprintf("%s: %s %s", r.key(), r.Result, r.Revision)}
+		if len(parent) > 0 {
+			args = append(args, "-p", strings.TrimSpace(string(parent)))
+		}
+		commit, err := g.gitAs(r.Node, args...)
+		if err != nil {
+			return fmt.Errorf("failed to commit status record: %v, details: %s", err, commit)
+		}
+		return g.push(strings.TrimSpace(string(commit)) + ":refs/heads/" + branch)
+	})
+}
+
+// errRejected is returned by push when the remote moved in the meantime.
+var errRejected = errors.New("push rejected")
+
+// pushWithRetry runs write until its push isn't rejected anymore. The local
+// copy isn't pulled while an attempt is running.
+func (g *Handler) pushWithRetry(write func() error) error {
+	var err error
+	for attempt := 1; attempt <= pushAttempts; attempt++ {
+		g.mu.Lock()
+		err = write()
+		g.mu.Unlock()
+		if !errors.Is(err, errRejected) {
+			return err
+		}
+		logrus.Debugf("Status push rejected, retrying (attempt %d of %d)", attempt, pushAttempts)
+	}
+	return err
+}
+
+// fetchRef replaces local with the remote ref. local is deleted if the
+// remote ref doesn't exist yet. FETCH_HEAD is left alone, as status
+// records are pushed while the configuration is pulled.
+func (g *Handler) fetchRef(remote, local string) error {
+	output, err := cmd.RunCmdCombinedOutput("git", "-C", g.localRepoPath, "fetch", "--quiet", "--no-write-fetch-head",
+		g.getPushURLWithCredentials(), "+"+remote+":"+local)
+	if err == nil {
+		return nil
+	}
+	if strings.Contains(string(output), "couldn't find remote ref") {
+		_, _ = g.git("update-ref", "-d", local)
+		return nil
+	}
+	return fmt.Errorf("failed to fetch %s: %v, details: %s", remote, err, output)
+}
+
+// push pushes refspec without forcing it, returning errRejected when the
+// remote ref moved since it was fetched.
+func (g *Handler) push(refspec string) error {
+	output, err := cmd.RunCmdCombinedOutput("git", "-C", g.localRepoPath, "push", "--quiet",
+		g.getPushURLWithCredentials(), refspec)
+	if err == nil {
+		return nil
+	}
+	out := string(output)
+	if strings.Contains(out, "rejected") || strings.Contains(out, "failed to update ref") ||
+		strings.Contains(out, "cannot lock ref") {
+		return errRejected
+	}
+	return fmt.Errorf("failed to push status: %v, details: %s", err, out)
+}
+
+// git runs a git command in the local copy of the repository and returns
+// its output.
+func (g *Handler) git(args ...string) ([]byte, error) {
+	return cmd.RunCmdOutput("git", append([]string{"-C", g.localRepoPath}, args...)...)
+}
+
+// gitAs runs a git command creating commits authored by hpxd on node.
+func (g *Handler) gitAs(node string, args ...string) ([]byte, error) {
+	return cmd.RunCmdCombinedOutput("git", append([]string{"-C", g.localRepoPath,
+		"-c", "user.name=hpxd", "-c", "user.email=hpxd@" + node}, args...)...)
+}
+
+// writeTemp writes content to a temporary file next to the local copy of
+// the repository.
+func (g *Handler) writeTemp(content string) (string, error) {
+	f, err := os.CreateTemp(filepath.Dir(g.localRepoPath), "hpxd-status-*")
+	if err != nil {
+		return "", err
+	}
+	defer func() { _ = f.Close() }()
+	if _, err := f.WriteString(content); err != nil {
+		return "", err
+	}
+	return f.Name(), nil
+}
+
+// mergeRecord replaces the record of the node of r among the JSON lines of
+// a note, keeping the records of other nodes sorted.
+func mergeRecord(note string, r StatusRecord) (string, error) {
+	records := map[string]string{}
+	for _, line := range strings.Split(note, "\n") {
+		var existing StatusRecord
+		if err := json.Unmarshal([]byte(line), &existing); err == nil && existing.Node != "" {
+			records[existing.key()] = line
+		}
+	}
+	data, err := json.Marshal(r)
+	if err != nil {
+		return "", err
+	}
+	records[r.key()] = string(data)
+
+	keys := make([]string, 0, len(records))
+	for k := range records {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var b strings.Builder
+	for _, k := range keys {
+		b.WriteString(records[k] + "\n")
+	}
+	return b.String(), nil
+}
@@ -0,0 +1,115 @@
+package guard
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	pendingFile  = "pending.json"
+	approvedFile = "approved"
+)
+
+// Pending describes an update held by the guard until it's approved.
+type Pending struct {
+	ID         string      `json:"id"`
+	HeldAt     time.Time   `json:"heldAt"`
+	Violations []Violation `json:"violations"`
+}
+
+// ApprovalStore keeps track of held updates and their approvals.
+//
+// The state lives in plain files inside a directory so that a separate
+// hpxd process (the approval CLI) can approve an update held by the
+// running daemon.
+type ApprovalStore struct {
+	dir string
+}
+
+// NewApprovalStore initializes and returns a new ApprovalStore that keeps
+// its state in dir.
+func NewApprovalStore(dir string) *ApprovalStore {
+	return &ApprovalStore{dir: dir}
+}
+
+// Fingerprint returns the identifier of a candidate configuration.
+//
+// Updates are identified by the content they would apply, so an approval
+// only covers the exact configuration that was reviewed.
+func Fingerprint(content []byte) string {
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:])
+}
+
+// Hold records the given update as pending approval.
+func (s *ApprovalStore) Hold(id string, violations []Violation) error {
+	if err := os.MkdirAll(s.dir, 0750); err != nil {
+		return err
+	}
+
+	data, err := json.MarshalIndent(Pending{ID: id, HeldAt: time.Now().UTC(), Violations: violations}, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(s.dir, pendingFile), data, 0600)
+}
+
+// Pending returns the update currently held, or nil if there is none.
+func (s *ApprovalStore) Pending() (*Pending, error) {
+	data, err := os.ReadFile(filepath.Join(s.dir, pendingFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var p Pending
+	if err := json.Unmarshal(data, &p); err != nil {
+		return nil, fmt.Errorf("failed to decode pending update: %w", err)
+	}
+	return &p, nil
+}
+
+// Approve approves the held update identified by id. An empty id approves
+// whichever update is currently held.
+func (s *ApprovalStore) Approve(id string) (string, error) {
+	p, err := s.Pending()
+	if err != nil {
+		return "", err
+	}
+	if p == nil {
+		return "", errors.New("no update is pending approval")
+	}
+	if id != "" && !strings.HasPrefix(p.ID, id) {
+		return "", fmt.Errorf("pending update is %s, not %s", p.ID, id)
+	}
+
+	return p.ID, os.WriteFile(filepath.Join(s.dir, approvedFile), []byte(p.ID), 0600)
+}
+
+// IsApproved reports whether the update identified by id has been approved.
+func (s *ApprovalStore) IsApproved(id string) bool {
+	data, err := os.ReadFile(filepath.Join(s.dir, approvedFile))
+	if err != nil {
+		return false
+	}
+	return strings.TrimSpace(string(data)) == id
+}
+
+// Clear forgets the held update and its approval.
+func (s *ApprovalStore) Clear() error {
+	for _, name := range []string{pendingFile, approvedFile} {
+		if err := os.Remove(filepath.Join(s.dir, name)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,113 @@
+// Package guard protects HAProxy from configuration changes that remove
+// too much at once.
+//
+// A configuration can be perfectly valid and still be a disaster, for
+// example after a bad merge drops half of the backends. The guard compares
+// the live configuration with the candidate one and reports every safety
+// threshold the change would exceed, so the update can be held until a
+// human approves it.
+//
+// Author: zakaria.elbouwab
+package guard
+
+import (
+	"fmt"
+
+	"github.com/zcubbs/hpxd/pkg/haproxy"
+)
+
+// Thresholds describes how much a single update is allowed to remove.
+//
+// Percentages are expressed from 0 to 100 and are computed against the
+// live configuration. A percentage of 0 disables the corresponding check.
+type Thresholds struct {
+	MaxBackendRemovalPercent  float64  `mapstructure:"maxBackendRemovalPercent"`
+	MaxServerRemovalPercent   float64  `mapstructure:"maxServerRemovalPercent"`
+	MaxFrontendRemovalPercent float64  `mapstructure:"maxFrontendRemovalPercent"`
+	ProtectedBackends         []string `mapstructure:"protectedBackends"`
+}
+
+// Enabled reports whether at least one check is configured.
+func (t Thresholds) Enabled() bool {
+	return t.MaxBackendRemovalPercent > 0 ||
+		t.MaxServerRemovalPercent > 0 ||
+		t.MaxFrontendRemovalPercent > 0 ||
+		len(t.ProtectedBackends) > 0
+}
+
+// Violation describes a single threshold exceeded by an update.
+type Violation struct {
+	Kind    string   `json:"kind"`
+	Removed []string `json:"removed"`
+	Message string   `json:"message"`
+}
+
+// Check compares the live configuration with the desired one and returns
+// every threshold the change would exceed. An empty result means the
+// update is safe to apply.
+func Check(live, desired *haproxy.Config, t Thresholds) []Violation {
+	var violations []Violation
+
+	removedBackends := removed(live.Backends(), desired.Backends())
+	for _, name := range t.ProtectedBackends {
+		if contains(removedBackends, name) {
+			violations = append(violations, Violation{
+				Kind:    "protected_backend",
+				Removed: []string{name},
+				Message: fmt.Sprintf("protected backend %q would be removed", name),
+			})
+		}
+	}
+
+	checks := []struct {
+		kind    string
+		live    []string
+		removed []string
+		max     float64
+	}{
+		{"backends", live.Backends(), removedBackends, t.MaxBackendRemovalPercent},
+		{"servers", live.Servers(), removed(live.Servers(), desired.Servers()), t.MaxServerRemovalPercent},
+		{"frontends", live.Frontends(), removed(live.Frontends(), desired.Frontends()), t.MaxFrontendRemovalPercent},
+	}
+	for _, c := range checks {
+		if c.max <= 0 || len(c.live) == 0 || len(c.removed) == 0 {
+			continue
+		}
+		pct := float64(len(c.removed)) * 100 / float64(len(c.live))
+		if pct > c.max {
+			violations = append(violations, Violation{
+				Kind:    c.kind,
+				Removed: c.removed,
+				Message: fmt.Sprintf("%d of %d %s would be removed (%.1f%%, max %.1f%%)",
+					len(c.removed), len(c.live), c.kind, pct, c.max),
+			})
+		}
+	}
+
+	return violations
+}
+
+// removed returns the elements of before that are missing from after.
+func removed(before, after []string) []string {
+	present := make(map[string]bool, len(after))
+	for _, name := range after {
+		present[name] = true
+	}
+
+	var out []string
+	for _, name := range before {
+		if !present[name] {
+			out = append(out, name)
+		}
+	}
+	return out
+}
+
+func contains(list []string, value string) bool {
+	for _, v := range list {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,102 @@
+package guard
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/zcubbs/hpxd/pkg/haproxy"
+)
+
+const liveConfig = `
+frontend http-in
+    bind *:80
+frontend https-in
+    bind *:443
+backend api
+    server api1 10.0.0.1:80
+    server api2 10.0.0.2:80
+backend web
+    server web1 10.0.1.1:80
+backend static
+    server static1 10.0.2.1:80
+backend admin
+    server admin1 10.0.3.1:80
+`
+
+func parse(t *testing.T, input string) *haproxy.Config {
+	t.Helper()
+	cfg, err := haproxy.ParseConfig(strings.NewReader(input))
+	if err != nil {
+		t.Fatalf("Failed to parse configuration: %v", err)
+	}
+	return cfg
+}
+
+func TestCheck_WithinThresholds(t *testing.T) {
+	desired := strings.Replace(liveConfig, "backend admin\n    server admin1 10.0.3.1:80\n", "", 1)
+
+	violations := Check(parse(t, liveConfig), parse(t, desired), Thresholds{
+		MaxBackendRemovalPercent: 30,
+		MaxServerRemovalPercent:  30,
+	})
+	if len(violations) != 0 {
+		t.Errorf("Expected no violations, but got: %v", violations)
+	}
+}
+
+func TestCheck_ExceedsThresholds(t *testing.T) {
+	desired := `
+frontend http-in
+    bind *:80
+backend api
+    server api1 10.0.0.1:80
+`
+	violations := Check(parse(t, liveConfig), parse(t, desired), Thresholds{
+		MaxBackendRemovalPercent:  50,
+		MaxServerRemovalPercent:   50,
+		MaxFrontendRemovalPercent: 0,
+		ProtectedBackends:         []string{"web", "api"},
+	})
+
+	kinds := make([]string, 0, len(violations))
+	for _, v := range violations {
+		kinds = append(kinds, v.Kind)
+	}
+	if got := strings.Join(kinds, ","); got != "protected_backend,backends,servers" {
+		t.Errorf("Expected violations protected_backend,backends,servers, but got: %s", got)
+	}
+}
+
+func TestApprovalStore(t *testing.T) {
+	store := NewApprovalStore(t.TempDir())
+	id := Fingerprint([]byte("backend api"))
+
+	if _, err := store.Approve(""); err == nil {
+		t.Errorf("Expected approval to fail without a pending update")
+	}
+
+	if err := store.Hold(id, []Violation{{Kind: "backends"}}); err != nil {
+		t.Fatalf("Failed to hold update: %v", err)
+	}
+	if store.IsApproved(id) {
+		t.Errorf("Expected update not to be approved yet")
+	}
+
+	if _, err := store.Approve("deadbeef"); err == nil {
+		t.Errorf("Expected approval of an unknown update to fail")
+	}
+	approved, err := store.Approve(id[:12])
+	if err != nil {
+		t.Fatalf("Failed to approve update: %v", err)
+	}
+	if approved != id || !store.IsApproved(id) {
+		t.Errorf("Expected update %s to be approved", id)
+	}
+
+	if err := store.Clear(); err != nil {
+		t.Fatalf("Failed to clear store: %v", err)
+	}
+	if p, _ := store.Pending(); p != nil || store.IsApproved(id) {
+		t.Errorf("Expected store to be empty after clear")
+	}
+}
@@ -0,0 +1,115 @@
+package haproxy
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Diagnostic severities reported by HAProxy.
+const (
+	SeverityAlert   = "ALERT"
+	SeverityWarning = "WARNING"
+	SeverityNotice  = "NOTICE"
+)
+
+var (
+	// matches "[ALERT]    (1234) : config : rest" as well as the older
+	// "[ALERT] 123/456789 (1234) : rest"
+	diagnosticRegexp = regexp.MustCompile(`^\[(ALERT|WARNING|NOTICE)\][^:]*:\s*(.*)$`)
+	// matches "parsing [file:line] : message" and "config : [file:line] : message"
+	locationRegexp = regexp.MustCompile(`\[([^\]:]+):(\d+)\]\s*:?\s*(.*)$`)
+	// matches "proxy 'name'", "backend 'name'" and the like
+	proxyRegexp = regexp.MustCompile(`(?i)\b(proxy|frontend|backend|listen)\s+'([^']+)'`)
+)
+
+// Diagnostic is a single message reported by 'haproxy -c'.
+type Diagnostic struct {
+	Severity string `json:"severity"`
+	File     string `json:"file,omitempty"`
+	Line     int    `json:"line,omitempty"`
+	Section  string `json:"section,omitempty"`
+	Message  string `json:"message"`
+}
+
+// String returns the diagnostic formatted as "file:line: [section] message".
+func (d Diagnostic) String() string {
+	var b strings.Builder
+	if d.File != "" {
+		b.WriteString(d.File)
+		if d.Line > 0 {
+			b.WriteString(":" + strconv.Itoa(d.Line))
+		}
+		b.WriteString(": ")
+	}
+	if d.Section != "" {
+		b.WriteString("[" + d.Section + "] ")
+	}
+	b.WriteString(d.Message)
+	return b.String()
+}
+
+// ParseDiagnostics extracts the diagnostics from the output of 'haproxy -c'.
+//
+// Lines that don't start with a severity tag are appended to the message of
+// the previous diagnostic, as HAProxy sometimes wraps long messages.
+func ParseDiagnostics(output string) []Diagnostic {
+	var diags []Diagnostic
+	for _, line := range strings.Split(output, "\n") {
+		line = strings.TrimRight(line, " \r")
+		m := diagnosticRegexp.FindStringSubmatch(line)
+		if m == nil {
+			if trimmed := strings.TrimSpace(line); trimmed != "" && len(diags) > 0 {
+				diags[len(diags)-1].Message += " " + trimmed
+			}
+			continue
+		}
+
+		d := Diagnostic{Severity: m[1], Message: strings.TrimPrefix(m[2], "config : ")}
+		if loc := locationRegexp.FindStringSubmatch(d.Message); loc != nil {
+			d.File = loc[1]
+			d.Line, _ = strconv.Atoi(loc[2])
+			d.Message = loc[3]
+		}
+		if p := proxyRegexp.FindStringSubmatch(d.Message); p != nil {
+			d.Section = strings.ToLower(p[1]) + " " + p[2]
+		}
+		diags = append(diags, d)
+	}
+	return diags
+}
+
+// ResolveSections fills in the section of the diagnostics that point at a
+// configuration line, by parsing the files they refer to.
+func ResolveSections(diags []Diagnostic) {
+	parsed := make(map[string]*Config)
+	for i := range diags {
+		d := &diags[i]
+		if d.Section != "" || d.File == "" || d.Line == 0 {
+			continue
+		}
+
+		cfg, ok := parsed[d.File]
+		if !ok {
+			cfg, _ = ParseConfigFile(d.File)
+			parsed[d.File] = cfg
+		}
+		if cfg == nil {
+			continue
+		}
+		if s := cfg.SectionAt(d.Line); s != nil {
+			d.Section = strings.TrimSpace(s.Type + " " + s.Name)
+		}
+	}
+}
+
+// Filter returns the diagnostics with the given severity.
+func Filter(diags []Diagnostic, severity string) []Diagnostic {
+	var out []Diagnostic
+	for _, d := range diags {
+		if d.Severity == severity {
+			out = append(out, d)
+		}
+	}
+	return out
+}
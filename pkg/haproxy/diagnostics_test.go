@@ -0,0 +1,69 @@
+package haproxy
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+const validationOutput = `[NOTICE]   (4242) : haproxy version is 2.8.3-1ubuntu1
+[WARNING]  (4242) : config : parsing [./testdata/valid_haproxy.cfg:24] : a 'http-request' rule placed after a 'use_backend' rule will still be processed before.
+[ALERT]    (4242) : config : Proxy 'http-in': unable to find required default_backend: 'servers_not_defined'.
+[ALERT] 287/101213 (4242) : parsing [/etc/haproxy/haproxy.cfg:3] : unknown keyword 'foo' in 'global' section
+  continued on the next line
+[ALERT]    (4242) : config : Fatal errors found in configuration.
+`
+
+func TestParseDiagnostics(t *testing.T) {
+	diags := ParseDiagnostics(validationOutput)
+	ResolveSections(diags)
+
+	expected := []Diagnostic{
+		{Severity: SeverityNotice, Message: "haproxy version is 2.8.3-1ubuntu1"},
+		{
+			Severity: SeverityWarning,
+			File:     "./testdata/valid_haproxy.cfg",
+			Line:     24,
+			Section:  "backend servers",
+			Message:  "a 'http-request' rule placed after a 'use_backend' rule will still be processed before.",
+		},
+		{
+			Severity: SeverityAlert,
+			Section:  "proxy http-in",
+			Message:  "Proxy 'http-in': unable to find required default_backend: 'servers_not_defined'.",
+		},
+		{
+			Severity: SeverityAlert,
+			File:     "/etc/haproxy/haproxy.cfg",
+			Line:     3,
+			Message:  "unknown keyword 'foo' in 'global' section continued on the next line",
+		},
+		{Severity: SeverityAlert, Message: "Fatal errors found in configuration."},
+	}
+
+	if len(diags) != len(expected) {
+		t.Fatalf("Expected %d diagnostics, but got %d: %v", len(expected), len(diags), diags)
+	}
+	for i := range expected {
+		if diags[i] != expected[i] {
+			t.Errorf("Diagnostic %d: expected %+v, but got %+v", i, expected[i], diags[i])
+		}
+	}
+
+	if got := len(Filter(diags, SeverityAlert)); got != 3 {
+		t.Errorf("Expected 3 alerts, but got %d", got)
+	}
+}
+
+func TestError_WithDiagnostics(t *testing.T) {
+	diags := ParseDiagnostics(validationOutput)
+	err := &Error{OriginalError: errors.New("exit status 1"), Output: validationOutput, Diagnostics: diags}
+
+	msg := err.Error()
+	if strings.Contains(msg, "NOTICE") || strings.Contains(msg, "haproxy version") {
+		t.Errorf("Expected only alerts in the error message, but got: %s", msg)
+	}
+	if !strings.Contains(msg, "/etc/haproxy/haproxy.cfg:3: unknown keyword 'foo'") {
+		t.Errorf("Expected located alert in the error message, but got: %s", msg)
+	}
+}
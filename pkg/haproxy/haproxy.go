@@ -11,44 +11,56 @@ import (
 	"strings"
 )
 
+// DefaultUnit is the systemd unit reloaded by default.
+const DefaultUnit = "haproxy"
+
 // Handler manages operations related to HAProxy.
 //
-// The Handler structure contains a field that represents the path
-// to the HAProxy configuration.
+// The Handler structure contains fields that represent the path
+// to the HAProxy configuration and the systemd unit running HAProxy.
 type Handler struct {
 	configPath string
+	unit       string
 }
 
 // NewHandler initializes and returns a new Handler instance for HAProxy.
 //
 // This function constructs a Handler given the path to the HAProxy configuration.
 func NewHandler(configPath string) *Handler {
+	return NewHandlerForUnit(configPath, DefaultUnit)
+}
+
+// NewHandlerForUnit initializes and returns a new Handler instance for the
+// HAProxy running as the given systemd unit, for hosts running several
+// HAProxy instances.
+func NewHandlerForUnit(configPath, unit string) *Handler {
+	if unit == "" {
+		unit = DefaultUnit
+	}
 	return &Handler{
 		configPath: configPath,
+		unit:       unit,
 	}
 }
 
 // ValidateConfig checks the validity of the current HAProxy configuration.
 //
-// This method runs the 'haproxy -c -f' command to validate the configuration.
+// This method runs the 'haproxy -c -f' command, using the first `haproxy`
+// on PATH, to validate the configuration. Use a Validator to pick the binary.
 // If the configuration is invalid, it returns an Error containing both the
 // original error and the output from the validation command.
 func (h *Handler) ValidateConfig() error {
-	output, err := cmd.RunCmdCombinedOutput("haproxy", "-c", "-f", h.configPath)
-	if err != nil {
-		return &Error{OriginalError: err, Output: string(output)}
-	}
-
-	return nil
+	_, err := NewValidator(DefaultBinary).Validate(h.configPath, "")
+	return err
 }
 
 // Reload gracefully restarts HAProxy.
 //
-// This method runs the 'sudo systemctl reload haproxy' command to gracefully
+// This method runs the 'sudo systemctl reload <unit>' command to gracefully
 // reload HAProxy. If there's an error during the reload, it returns an Error
 // containing both the original error and the output from the reload command.
 func (h *Handler) Reload() error {
-	output, err := cmd.RunCmdCombinedOutput("sudo", "systemctl", "reload", "haproxy")
+	output, err := cmd.RunCmdCombinedOutput("sudo", "systemctl", "reload", h.unit)
 	if err != nil && len(output) > 0 {
 		return &Error{OriginalError: err, Output: string(output)}
 	}
@@ -60,13 +72,26 @@ func (h *Handler) Reload() error {
 //
 // This structure extends the built-in error type to provide more context about
 // errors that occur when running commands related to HAProxy. It captures both
-// the original error and the command's output.
+// the original error and the command's output, along with the diagnostics
+// parsed from that output when it comes from a validation.
 type Error struct {
 	OriginalError error
 	Output        string
+	Diagnostics   []Diagnostic
 }
 
 // Error returns a concatenated string of the original error message and the command output.
+//
+// When alerts were parsed from the output, they replace the raw output.
 func (e *Error) Error() string {
-	return strings.TrimSpace(e.OriginalError.Error() + ": " + e.Output)
+	alerts := Filter(e.Diagnostics, SeverityAlert)
+	if len(alerts) == 0 {
+		return strings.TrimSpace(e.OriginalError.Error() + ": " + e.Output)
+	}
+
+	messages := make([]string, 0, len(alerts))
+	for _, d := range alerts {
+		messages = append(messages, d.String())
+	}
+	return e.OriginalError.Error() + ": " + strings.Join(messages, "; ")
 }
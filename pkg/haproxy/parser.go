@@ -0,0 +1,156 @@
+package haproxy
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Section types recognised by the parser.
+const (
+	SectionGlobal   = "global"
+	SectionDefaults = "defaults"
+	SectionFrontend = "frontend"
+	SectionBackend  = "backend"
+	SectionListen   = "listen"
+)
+
+// sectionKeywords lists every keyword that opens a new section in an
+// HAProxy configuration file.
+var sectionKeywords = map[string]bool{
+	SectionGlobal:   true,
+	SectionDefaults: true,
+	SectionFrontend: true,
+	SectionBackend:  true,
+	SectionListen:   true,
+	"peers":         true,
+	"resolvers":     true,
+	"userlist":      true,
+	"mailers":       true,
+	"program":       true,
+	"http-errors":   true,
+	"ring":          true,
+	"cache":         true,
+}
+
+// Section is a single section of an HAProxy configuration file, such as a
+// frontend or a backend, along with the servers it declares.
+type Section struct {
+	Type    string
+	Name    string
+	Line    int
+	Servers []string
+}
+
+// Config is a lightweight, structural view of an HAProxy configuration.
+//
+// It only records what hpxd needs to reason about a configuration change:
+// which sections exist and which servers they declare. It is not a full
+// HAProxy parser and does not validate directives.
+type Config struct {
+	Sections []Section
+}
+
+// ParseConfigFile reads and parses the HAProxy configuration at path.
+func ParseConfigFile(path string) (*Config, error) {
+	f, err := os.Open(filepath.Clean(path))
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = f.Close() }()
+
+	return ParseConfig(f)
+}
+
+// ParseConfig parses an HAProxy configuration from r.
+func ParseConfig(r io.Reader) (*Config, error) {
+	cfg := &Config{}
+	var current *Section
+
+	scanner := bufio.NewScanner(r)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		fields := strings.Fields(stripComment(scanner.Text()))
+		if len(fields) == 0 {
+			continue
+		}
+
+		if sectionKeywords[fields[0]] {
+			section := Section{Type: fields[0], Line: lineNo}
+			if len(fields) > 1 {
+				section.Name = fields[1]
+			}
+			cfg.Sections = append(cfg.Sections, section)
+			current = &cfg.Sections[len(cfg.Sections)-1]
+			continue
+		}
+
+		if current != nil && fields[0] == "server" && len(fields) > 1 {
+			current.Servers = append(current.Servers, fields[1])
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return cfg, nil
+}
+
+// SectionNames returns the names of every section of the given type.
+func (c *Config) SectionNames(sectionType string) []string {
+	var names []string
+	for _, s := range c.Sections {
+		if s.Type == sectionType {
+			names = append(names, s.Name)
+		}
+	}
+	return names
+}
+
+// Frontends returns the names of every section that accepts traffic,
+// which includes both frontend and listen sections.
+func (c *Config) Frontends() []string {
+	return append(c.SectionNames(SectionFrontend), c.SectionNames(SectionListen)...)
+}
+
+// Backends returns the names of every section that holds servers,
+// which includes both backend and listen sections.
+func (c *Config) Backends() []string {
+	return append(c.SectionNames(SectionBackend), c.SectionNames(SectionListen)...)
+}
+
+// Servers returns every server declared in the configuration, identified
+// as "<section>/<server>".
+func (c *Config) Servers() []string {
+	var servers []string
+	for _, s := range c.Sections {
+		for _, srv := range s.Servers {
+			servers = append(servers, s.Name+"/"+srv)
+		}
+	}
+	return servers
+}
+
+// SectionAt returns the section that contains the given line number,
+// or nil if the line precedes the first section.
+func (c *Config) SectionAt(line int) *Section {
+	var found *Section
+	for i := range c.Sections {
+		if c.Sections[i].Line > line {
+			break
+		}
+		found = &c.Sections[i]
+	}
+	return found
+}
+
+// stripComment removes a trailing '#' comment from a configuration line.
+func stripComment(line string) string {
+	if i := strings.IndexByte(line, '#'); i >= 0 {
+		return line[:i]
+	}
+	return line
+}
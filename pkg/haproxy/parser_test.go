@@ -0,0 +1,49 @@
+package haproxy
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseConfigFile(t *testing.T) {
+	cfg, err := ParseConfigFile("./testdata/valid_haproxy.cfg")
+	if err != nil {
+		t.Fatalf("Expected configuration to parse, but got error: %v", err)
+	}
+
+	if got := cfg.Frontends(); !reflect.DeepEqual(got, []string{"http-in"}) {
+		t.Errorf("Expected frontends [http-in], but got: %v", got)
+	}
+	if got := cfg.Backends(); !reflect.DeepEqual(got, []string{"servers"}) {
+		t.Errorf("Expected backends [servers], but got: %v", got)
+	}
+	if got := cfg.Servers(); !reflect.DeepEqual(got, []string{"servers/server1", "servers/server2"}) {
+		t.Errorf("Expected servers [servers/server1 servers/server2], but got: %v", got)
+	}
+}
+
+func TestParseConfig_ListenAndComments(t *testing.T) {
+	input := `
+listen stats # inline comment
+    bind *:8404
+    server local 127.0.0.1:8405
+# backend commented_out
+backend api
+    server api1 10.0.0.1:80 check
+`
+	cfg, err := ParseConfig(strings.NewReader(input))
+	if err != nil {
+		t.Fatalf("Expected configuration to parse, but got error: %v", err)
+	}
+
+	if got := cfg.Frontends(); !reflect.DeepEqual(got, []string{"stats"}) {
+		t.Errorf("Expected frontends [stats], but got: %v", got)
+	}
+	if got := cfg.Backends(); !reflect.DeepEqual(got, []string{"api", "stats"}) {
+		t.Errorf("Expected backends [api stats], but got: %v", got)
+	}
+	if got := cfg.Servers(); !reflect.DeepEqual(got, []string{"stats/local", "api/api1"}) {
+		t.Errorf("Expected servers [stats/local api/api1], but got: %v", got)
+	}
+}
@@ -0,0 +1,158 @@
+package haproxy
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const runtimeTimeout = 5 * time.Second
+
+// RuntimeClient sends commands to the HAProxy runtime API, exposed through
+// a `stats socket` of the global section.
+type RuntimeClient struct {
+	address string
+}
+
+// NewRuntimeClient initializes and returns a new RuntimeClient. address is
+// either the path of a unix socket or a `host:port` TCP address.
+func NewRuntimeClient(address string) *RuntimeClient {
+	return &RuntimeClient{address: address}
+}
+
+// Execute runs a single command and returns its output.
+func (c *RuntimeClient) Execute(command string) (string, error) {
+	network := "unix"
+	if !strings.HasPrefix(c.address, "/") && strings.Contains(c.address, ":") {
+		network = "tcp"
+	}
+
+	conn, err := net.DialTimeout(network, c.address, runtimeTimeout)
+	if err != nil {
+		return "", fmt.Errorf("failed to connect to the runtime API: %w", err)
+	}
+	defer func() { _ = conn.Close() }()
+	_ = conn.SetDeadline(time.Now().Add(runtimeTimeout))
+
+	if _, err := io.WriteString(conn, command+"\n"); err != nil {
+		return "", err
+	}
+	output, err := io.ReadAll(conn)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(output)), nil
+}
+
+// AddServer adds a server to a backend and enables it, as servers added at
+// runtime start in maintenance. Health checks are enabled along with the
+// server when its options ask for them.
+func (c *RuntimeClient) AddServer(backend, server, address string, options []string) error {
+	command := strings.TrimSpace(fmt.Sprintf("add server %s/%s %s %s", backend, server, address, strings.Join(options, " ")))
+	if err := c.expect(command, "New server registered"); err != nil {
+		return err
+	}
+	if err := c.expect(fmt.Sprintf("enable server %s/%s", backend, server), ""); err != nil {
+		return err
+	}
+	for _, option := range options {
+		if option == "check" {
+			return c.expect(fmt.Sprintf("enable health %s/%s", backend, server), "")
+		}
+	}
+	return nil
+}
+
+// DelServer puts a server in maintenance and removes it from its backend.
+func (c *RuntimeClient) DelServer(backend, server string) error {
+	if err := c.expect(fmt.Sprintf("disable server %s/%s", backend, server), ""); err != nil {
+		return err
+	}
+	return c.expect(fmt.Sprintf("del server %s/%s", backend, server), "Server deleted")
+}
+
+// expect runs command and fails unless its output starts with want. Commands
+// that succeed silently are expected with an empty want.
+func (c *RuntimeClient) expect(command, want string) error {
+	output, err := c.Execute(command)
+	if err != nil {
+		return err
+	}
+	if (want == "" && output != "") || !strings.HasPrefix(output, want) {
+		return fmt.Errorf("runtime API command %q failed: %s", command, output)
+	}
+	return nil
+}
+
+// Process is a process of HAProxy, as listed by `show proc` on the master
+// CLI. Old workers are the ones still draining connections after a reload.
+type Process struct {
+	PID     int    `json:"pid"`
+	Type    string `json:"type"`
+	Reloads int    `json:"reloads"`
+	Uptime  string `json:"uptime"`
+	Version string `json:"version,omitempty"`
+	Old     bool   `json:"old"`
+}
+
+// Processes lists the processes of HAProxy. The client must be connected
+// to the master CLI, enabled with `-S` or `master-worker` and a
+// `stats socket` of the master.
+func (c *RuntimeClient) Processes() ([]Process, error) {
+	output, err := c.Execute("show proc")
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(output, "#") {
+		return nil, fmt.Errorf("unexpected output of show proc: %s", output)
+	}
+	return ParseProcesses(output), nil
+}
+
+// ParseProcesses parses the output of `show proc`. Processes are listed in
+// sections, `# workers`, `# old workers` and `# programs`, after the master.
+func ParseProcesses(output string) []Process {
+	var processes []Process
+	old := false
+	for _, line := range strings.Split(output, "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "#") {
+			old = strings.Contains(line, "old")
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		pid, err := strconv.Atoi(fields[0])
+		if err != nil {
+			continue
+		}
+
+		p := Process{PID: pid, Type: fields[1], Old: old}
+		// Older versions show the former relative PID of old workers
+		rest := fields[2:]
+		if len(rest) > 0 && rest[0] == "[was:" {
+			rest = rest[min(2, len(rest)):]
+		}
+		if len(rest) > 0 {
+			p.Reloads, _ = strconv.Atoi(rest[0])
+			rest = rest[1:]
+		}
+		// The master shows its failed reloads, `[failed: 0]`
+		for len(rest) > 0 && (strings.HasPrefix(rest[0], "[") || strings.HasSuffix(rest[0], "]")) {
+			rest = rest[1:]
+		}
+		if len(rest) > 0 {
+			p.Uptime = rest[0]
+		}
+		if len(rest) > 1 {
+			p.Version = rest[1]
+		}
+		processes = append(processes, p)
+	}
+	return processes
+}
@@ -0,0 +1,120 @@
+package haproxy
+
+import (
+	"bufio"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// runtimeServer serves the runtime API on a unix socket, answering every
+// command from responses and recording it.
+func runtimeServer(t *testing.T, responses map[string]string) (string, *[]string) {
+	socket := filepath.Join(t.TempDir(), "admin.sock")
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	t.Cleanup(func() { _ = listener.Close() })
+
+	var commands []string
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			command, _ := bufio.NewReader(conn).ReadString('\n')
+			command = strings.TrimSpace(command)
+			commands = append(commands, command)
+			verb := strings.Join(strings.Fields(command)[:2], " ")
+			_, _ = conn.Write([]byte(responses[verb] + "\n\n"))
+			_ = conn.Close()
+		}
+	}()
+	return socket, &commands
+}
+
+func TestRuntimeClient(t *testing.T) {
+	socket, commands := runtimeServer(t, map[string]string{
+		"add server": "New server registered.",
+		"del server": "Server deleted.",
+	})
+	client := NewRuntimeClient(socket)
+
+	if err := client.AddServer("api", "api-1", "10.0.0.1:80", []string{"check"}); err != nil {
+		t.Fatalf("Failed to add server: %v", err)
+	}
+	if err := client.DelServer("api", "api-2"); err != nil {
+		t.Fatalf("Failed to delete server: %v", err)
+	}
+
+	expected := []string{
+		"add server api/api-1 10.0.0.1:80 check",
+		"enable server api/api-1",
+		"enable health api/api-1",
+		"disable server api/api-2",
+		"del server api/api-2",
+	}
+	if strings.Join(*commands, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("Expected commands %v, but got: %v", expected, *commands)
+	}
+}
+
+func TestRuntimeClient_Error(t *testing.T) {
+	socket, _ := runtimeServer(t, map[string]string{
+		"add server": "No such backend.",
+	})
+
+	if err := NewRuntimeClient(socket).AddServer("missing", "s", "10.0.0.1:80", nil); err == nil {
+		t.Errorf("Expected runtime API errors to be reported")
+	}
+}
+
+const showProc = `#<PID>          <type>          <reloads>       <uptime>        <version>
+1162            master          5 [failed: 0]   0d00h02m07s     2.8.3
+# workers
+1271            worker          0               0d00h00m03s     2.8.3
+# old workers
+1233            worker          1               0d00h00m43s     2.8.3
+1198            worker          2               0d00h01m30s     2.8.3
+# programs
+`
+
+func TestParseProcesses(t *testing.T) {
+	processes := ParseProcesses(showProc)
+	if len(processes) != 4 {
+		t.Fatalf("Expected 4 processes, but got: %+v", processes)
+	}
+
+	master := processes[0]
+	if master.PID != 1162 || master.Type != "master" || master.Reloads != 5 || master.Uptime != "0d00h02m07s" || master.Old {
+		t.Errorf("Unexpected master: %+v", master)
+	}
+	if processes[1].Old || !processes[2].Old || !processes[3].Old {
+		t.Errorf("Expected the last two workers to be old: %+v", processes)
+	}
+	if processes[3].PID != 1198 || processes[3].Reloads != 2 || processes[3].Version != "2.8.3" {
+		t.Errorf("Unexpected old worker: %+v", processes[3])
+	}
+
+	// Up to HAProxy 2.4, old workers show their former relative PID
+	legacy := ParseProcesses("#<PID> <type> <relative PID> <reloads> <uptime>\n# old workers\n1233 worker [was: 1] 3 0d00h00m43s\n")
+	if len(legacy) != 1 || legacy[0].Reloads != 3 || legacy[0].Uptime != "0d00h00m43s" || !legacy[0].Old {
+		t.Errorf("Unexpected legacy processes: %+v", legacy)
+	}
+}
+
+func TestRuntimeClient_Processes(t *testing.T) {
+	socket, _ := runtimeServer(t, map[string]string{"show proc": showProc})
+	processes, err := NewRuntimeClient(socket).Processes()
+	if err != nil || len(processes) != 4 {
+		t.Errorf("Expected 4 processes, but got: %+v, %v", processes, err)
+	}
+
+	socket, _ = runtimeServer(t, map[string]string{"show proc": "Unknown command."})
+	if _, err := NewRuntimeClient(socket).Processes(); err == nil {
+		t.Errorf("Expected sockets other than the master CLI to be reported")
+	}
+}
@@ -0,0 +1,122 @@
+package haproxy
+
+import (
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/zcubbs/hpxd/pkg/files"
+)
+
+// Sandbox is a temporary directory laid out like the node will be once an
+// update is applied: the candidate configuration alongside the synced
+// auxiliary files, at the same paths relative to the configuration.
+//
+// Validating inside a sandbox checks the files referenced by the candidate
+// configuration before they're deployed.
+type Sandbox struct {
+	Dir        string
+	ConfigPath string
+
+	// origins maps every staged path to the path it was staged from
+	origins map[string]string
+}
+
+// NewSandbox stages the candidate configuration at configPath and the given
+// files into a new temporary directory.
+//
+// liveConfigPath is where the configuration will be deployed. Files that
+// live next to it keep their relative path inside the sandbox, and every
+// reference to a synced path in the configuration is rewritten to point
+// inside the sandbox. Synced directories are seeded with their live content,
+// so files that aren't managed by hpxd are still found.
+func NewSandbox(configPath, liveConfigPath string, synced []files.File) (*Sandbox, error) {
+	dir, err := os.MkdirTemp("", "hpxd-validate-")
+	if err != nil {
+		return nil, err
+	}
+	s := &Sandbox{
+		Dir:        dir,
+		ConfigPath: filepath.Join(dir, filepath.Base(liveConfigPath)),
+		origins:    make(map[string]string),
+	}
+	s.origins[s.ConfigPath] = configPath
+
+	baseDir := filepath.Dir(filepath.Clean(liveConfigPath))
+	rewrites := make(map[string]string)
+	for _, f := range synced {
+		if f.TargetRoot != f.Target {
+			if _, ok := rewrites[f.TargetRoot]; !ok {
+				rewrites[f.TargetRoot] = s.path(baseDir, f.TargetRoot)
+				if err := files.CopyTree(f.TargetRoot, rewrites[f.TargetRoot]); err != nil {
+					_ = s.Close()
+					return nil, err
+				}
+			}
+		}
+		rewrites[f.Target] = s.path(baseDir, f.Target)
+		s.origins[rewrites[f.Target]] = f.Source
+		if _, err := files.Copy(f.Source, rewrites[f.Target]); err != nil {
+			_ = s.Close()
+			return nil, err
+		}
+	}
+
+	content, err := os.ReadFile(filepath.Clean(configPath))
+	if err != nil {
+		_ = s.Close()
+		return nil, err
+	}
+	if err := os.WriteFile(s.ConfigPath, []byte(rewritePaths(string(content), rewrites)), 0600); err != nil {
+		_ = s.Close()
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// Close removes the sandbox directory.
+func (s *Sandbox) Close() error {
+	return os.RemoveAll(s.Dir)
+}
+
+// Origin returns the path a staged file was copied from, so that paths
+// reported by HAProxy point at the source rather than at the sandbox.
+// Paths that weren't staged are returned as is.
+func (s *Sandbox) Origin(path string) string {
+	if origin, ok := s.origins[path]; ok {
+		return origin
+	}
+	return path
+}
+
+// path returns where target lives inside the sandbox.
+func (s *Sandbox) path(baseDir, target string) string {
+	if rel, err := filepath.Rel(baseDir, target); err == nil && !strings.HasPrefix(rel, "..") {
+		return filepath.Join(s.Dir, rel)
+	}
+	return filepath.Join(s.Dir, "_root", target)
+}
+
+// rewritePaths replaces every reference to one of the paths in rewrites
+// with its replacement. A path only matches as a whole path component.
+func rewritePaths(content string, rewrites map[string]string) string {
+	if len(rewrites) == 0 {
+		return content
+	}
+
+	paths := make([]string, 0, len(rewrites))
+	for p := range rewrites {
+		paths = append(paths, regexp.QuoteMeta(p))
+	}
+	// Longest first, so the most specific path wins
+	sort.Slice(paths, func(i, j int) bool { return len(paths[i]) > len(paths[j]) })
+
+	re := regexp.MustCompile(`(?m)(` + strings.Join(paths, "|") + `)([/\s"']|$)`)
+	return re.ReplaceAllStringFunc(content, func(match string) string {
+		m := re.FindStringSubmatch(match)
+		return rewrites[m[1]] + m[2]
+	})
+}
@@ -0,0 +1,71 @@
+package haproxy
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/zcubbs/hpxd/pkg/files"
+)
+
+func TestNewSandbox(t *testing.T) {
+	repo := t.TempDir()
+	node := t.TempDir()
+	liveConfigPath := filepath.Join(node, "haproxy.cfg")
+
+	configPath := filepath.Join(repo, "haproxy.cfg")
+	config := "frontend http-in\n" +
+		"    http-request set-var(txn.be) req.hdr(host),map(" + node + "/maps/hosts.map)\n" +
+		"    errorfile 503 /opt/errors/503.http\n" +
+		"    errorfile 504 " + node + "/maps-unrelated/504.http\n"
+	if err := os.WriteFile(configPath, []byte(config), 0600); err != nil {
+		t.Fatalf("Failed to write config: %v", err)
+	}
+	for path, content := range map[string]string{
+		filepath.Join(repo, "maps", "hosts.map"): "example.com be_web\n",
+		filepath.Join(repo, "503.http"):          "HTTP/1.0 503\n",
+		filepath.Join(node, "maps", "live.map"):  "unmanaged\n",
+	} {
+		if err := os.MkdirAll(filepath.Dir(path), 0750); err != nil {
+			t.Fatalf("Failed to create directory: %v", err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatalf("Failed to write file: %v", err)
+		}
+	}
+
+	synced, err := files.Resolve(repo, []files.Mapping{
+		{Source: "maps", Target: filepath.Join(node, "maps")},
+		{Source: "503.http", Target: "/opt/errors/503.http"},
+	})
+	if err != nil {
+		t.Fatalf("Failed to resolve files: %v", err)
+	}
+
+	sandbox, err := NewSandbox(configPath, liveConfigPath, synced)
+	if err != nil {
+		t.Fatalf("Failed to create sandbox: %v", err)
+	}
+	defer func() { _ = sandbox.Close() }()
+
+	for _, rel := range []string{"maps/hosts.map", "maps/live.map", "_root/opt/errors/503.http"} {
+		if _, err := os.Stat(filepath.Join(sandbox.Dir, rel)); err != nil {
+			t.Errorf("Expected %s to be staged in the sandbox: %v", rel, err)
+		}
+	}
+
+	staged, err := os.ReadFile(sandbox.ConfigPath)
+	if err != nil {
+		t.Fatalf("Failed to read staged config: %v", err)
+	}
+	for _, want := range []string{
+		"map(" + sandbox.Dir + "/maps/hosts.map)",
+		"errorfile 503 " + sandbox.Dir + "/_root/opt/errors/503.http",
+		"errorfile 504 " + node + "/maps-unrelated/504.http",
+	} {
+		if !strings.Contains(string(staged), want) {
+			t.Errorf("Expected staged config to contain %q, but got:\n%s", want, staged)
+		}
+	}
+}
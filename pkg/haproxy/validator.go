@@ -0,0 +1,133 @@
+package haproxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/zcubbs/hpxd/pkg/cmd"
+)
+
+// DefaultBinary is the HAProxy binary used when none is configured.
+const DefaultBinary = "haproxy"
+
+var versionRegexp = regexp.MustCompile(`(?i)version\s+(\S+)`)
+
+// Validator validates HAProxy configurations with a specific HAProxy binary.
+type Validator struct {
+	binary string
+}
+
+// NewValidator initializes and returns a new Validator using the given
+// HAProxy binary. An empty binary falls back to the first `haproxy` on PATH.
+func NewValidator(binary string) *Validator {
+	if binary == "" {
+		binary = DefaultBinary
+	}
+	return &Validator{binary: binary}
+}
+
+// Binary returns the HAProxy binary used by the validator.
+func (v *Validator) Binary() string {
+	return v.binary
+}
+
+// Validate checks the validity of the HAProxy configuration at configPath.
+//
+// This method runs 'haproxy -c -f <configPath>'. If workDir is not empty,
+// HAProxy changes to it before loading the configuration, so relative paths
+// in the configuration are resolved against it.
+//
+// The diagnostics reported by HAProxy are returned even when the
+// configuration is valid, so warnings can be surfaced. If the configuration
+// is invalid, it returns an Error containing the original error, the output
+// from the validation command and the same diagnostics.
+func (v *Validator) Validate(configPath, workDir string) ([]Diagnostic, error) {
+	return v.ValidateContext(context.Background(), configPath, workDir)
+}
+
+// ValidateContext is like Validate, but HAProxy is killed when ctx is done.
+func (v *Validator) ValidateContext(ctx context.Context, configPath, workDir string) ([]Diagnostic, error) {
+	args := []string{"-c", "-f", configPath}
+	if workDir != "" {
+		args = append(args, "-C", workDir)
+	}
+
+	output, err := cmd.RunCmdCombinedOutputContext(ctx, v.binary, args...)
+	diags := ParseDiagnostics(string(output))
+	ResolveSections(diags)
+	if err != nil {
+		return diags, &Error{OriginalError: err, Output: string(output), Diagnostics: diags}
+	}
+
+	return diags, nil
+}
+
+// Version returns the version reported by the validator's HAProxy binary.
+func (v *Validator) Version() (string, error) {
+	return binaryVersion(v.binary)
+}
+
+// RunningVersion returns the version of the HAProxy process currently running.
+//
+// The process is looked up from pidFile if provided, and by scanning /proc
+// otherwise. The version is read from the process executable itself, so it
+// reflects what's running even if the binary on disk was since upgraded.
+func RunningVersion(pidFile string) (string, error) {
+	pid, err := findPid(pidFile)
+	if err != nil {
+		return "", err
+	}
+	return binaryVersion(filepath.Join("/proc", strconv.Itoa(pid), "exe"))
+}
+
+// binaryVersion runs 'haproxy -v' and extracts the version from its output.
+func binaryVersion(binary string) (string, error) {
+	output, err := cmd.RunCmdOutput(binary, "-v")
+	if err != nil {
+		return "", fmt.Errorf("failed to get version of %s: %w", binary, err)
+	}
+
+	m := versionRegexp.FindStringSubmatch(string(output))
+	if m == nil {
+		return "", fmt.Errorf("failed to parse version of %s from %q", binary, strings.TrimSpace(string(output)))
+	}
+	return m[1], nil
+}
+
+// findPid returns the PID of a running HAProxy process.
+func findPid(pidFile string) (int, error) {
+	if pidFile != "" {
+		data, err := os.ReadFile(filepath.Clean(pidFile))
+		if err != nil {
+			return 0, err
+		}
+		// HAProxy writes one PID per line, the master comes first
+		fields := strings.Fields(string(data))
+		if len(fields) == 0 {
+			return 0, fmt.Errorf("pid file %s is empty", pidFile)
+		}
+		return strconv.Atoi(fields[0])
+	}
+
+	entries, err := os.ReadDir("/proc")
+	if err != nil {
+		return 0, err
+	}
+	for _, e := range entries {
+		pid, err := strconv.Atoi(e.Name())
+		if err != nil {
+			continue
+		}
+		comm, err := os.ReadFile(filepath.Join("/proc", e.Name(), "comm"))
+		if err == nil && strings.TrimSpace(string(comm)) == "haproxy" {
+			return pid, nil
+		}
+	}
+	return 0, errors.New("no running haproxy process found")
+}
@@ -0,0 +1,29 @@
+package haproxy
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestValidator_Version(t *testing.T) {
+	binary := filepath.Join(t.TempDir(), "haproxy")
+	script := "#!/bin/sh\necho 'HAProxy version 2.8.3-1ubuntu1 2023/09/07 - https://haproxy.org/'\n"
+	if err := os.WriteFile(binary, []byte(script), 0700); err != nil { // #nosec G306
+		t.Fatalf("Failed to write fake binary: %v", err)
+	}
+
+	version, err := NewValidator(binary).Version()
+	if err != nil {
+		t.Fatalf("Expected version to be read, but got error: %v", err)
+	}
+	if version != "2.8.3-1ubuntu1" {
+		t.Errorf("Expected version 2.8.3-1ubuntu1, but got: %s", version)
+	}
+}
+
+func TestValidator_DefaultBinary(t *testing.T) {
+	if got := NewValidator("").Binary(); got != DefaultBinary {
+		t.Errorf("Expected default binary %s, but got: %s", DefaultBinary, got)
+	}
+}
@@ -0,0 +1,178 @@
+// Package history keeps the configurations applied to a node, so a
+// previous one can be applied again.
+//
+// Every release holds the configuration as fetched from the source, before
+// server pools and Kubernetes backends are rendered into it, along with the
+// auxiliary files synced with it. Contents are stored once, by hash, and
+// only the most recent releases are kept.
+//
+// Author: zakaria.elbouwab
+package history
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const releasesFile = "releases.json"
+
+// Release is a configuration applied to the node.
+type Release struct {
+	ID        int       `json:"id"`
+	Revision  string    `json:"revision"`
+	AppliedAt time.Time `json:"appliedAt"`
+	// Reason tells how the release was applied, such as "update" or
+	// "rollback"
+	Reason string `json:"reason"`
+	// Config is the hash of the configuration, Files maps the target of
+	// every auxiliary file to the hash of its content
+	Config string            `json:"config"`
+	Files  map[string]string `json:"files,omitempty"`
+}
+
+// Store keeps releases in a directory.
+type Store struct {
+	dir   string
+	limit int
+}
+
+// NewStore initializes and returns a new Store keeping at most limit
+// releases in dir.
+func NewStore(dir string, limit int) *Store {
+	return &Store{dir: dir, limit: limit}
+}
+
+// Record stores a new release. configPath is the configuration as fetched
+// from the source, files maps the target of every auxiliary file to the
+// file it's deployed from.
+func (s *Store) Record(revision, reason, configPath string, files map[string]string) (Release, error) {
+	releases, err := s.List()
+	if err != nil {
+		return Release{}, err
+	}
+
+	r := Release{Revision: revision, Reason: reason, AppliedAt: time.Now().UTC(), Files: make(map[string]string, len(files))}
+	if len(releases) > 0 {
+		r.ID = releases[0].ID + 1
+	} else {
+		r.ID = 1
+	}
+	if r.Config, err = s.store(configPath); err != nil {
+		return Release{}, err
+	}
+	for target, source := range files {
+		if r.Files[target], err = s.store(source); err != nil {
+			return Release{}, err
+		}
+	}
+
+	releases = append([]Release{r}, releases...)
+	if s.limit > 0 && len(releases) > s.limit {
+		releases = releases[:s.limit]
+	}
+	if err := s.save(releases); err != nil {
+		return Release{}, err
+	}
+	return r, nil
+}
+
+// List returns the releases, the most recent first.
+func (s *Store) List() ([]Release, error) {
+	data, err := os.ReadFile(filepath.Join(s.dir, releasesFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var releases []Release
+	if err := json.Unmarshal(data, &releases); err != nil {
+		return nil, fmt.Errorf("failed to decode releases: %w", err)
+	}
+	return releases, nil
+}
+
+// Find returns the most recent release of the given revision, which may be
+// abbreviated, or the release with the given ID when prefixed with `#`.
+func (s *Store) Find(revision string) (*Release, error) {
+	if revision == "" {
+		return nil, errors.New("missing revision")
+	}
+	releases, err := s.List()
+	if err != nil {
+		return nil, err
+	}
+
+	id, byID := 0, strings.HasPrefix(revision, "#")
+	if byID {
+		if id, err = strconv.Atoi(revision[1:]); err != nil {
+			return nil, fmt.Errorf("invalid release ID %s", revision)
+		}
+	}
+	for i, r := range releases {
+		if (byID && r.ID == id) || (!byID && strings.HasPrefix(r.Revision, revision)) {
+			return &releases[i], nil
+		}
+	}
+	return nil, fmt.Errorf("no release of %s in the history", revision)
+}
+
+// ObjectPath returns the path of the content with the given hash.
+func (s *Store) ObjectPath(hash string) string {
+	return filepath.Join(s.dir, "objects", hash)
+}
+
+// store keeps a copy of the content of path and returns its hash.
+func (s *Store) store(path string) (string, error) {
+	if err := os.MkdirAll(filepath.Join(s.dir, "objects"), 0750); err != nil {
+		return "", err
+	}
+	content, err := os.ReadFile(filepath.Clean(path))
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(content)
+	hash := hex.EncodeToString(sum[:])
+	return hash, os.WriteFile(s.ObjectPath(hash), content, 0600)
+}
+
+// save writes the releases and removes the content they no longer
+// reference.
+func (s *Store) save(releases []Release) error {
+	data, err := json.MarshalIndent(releases, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(s.dir, releasesFile), data, 0600); err != nil {
+		return err
+	}
+
+	referenced := map[string]bool{}
+	for _, r := range releases {
+		referenced[r.Config] = true
+		for _, hash := range r.Files {
+			referenced[hash] = true
+		}
+	}
+	entries, err := os.ReadDir(filepath.Join(s.dir, "objects"))
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if !referenced[e.Name()] {
+			if err := os.Remove(s.ObjectPath(e.Name())); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
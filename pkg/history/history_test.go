@@ -0,0 +1,56 @@
+package history
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeFile(t *testing.T, path, content string) string {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestStore(t *testing.T) {
+	src := t.TempDir()
+	s := NewStore(t.TempDir(), 2)
+
+	for i, content := range []string{"one", "two", "three"} {
+		config := writeFile(t, filepath.Join(src, "haproxy.cfg"), content)
+		maps := writeFile(t, filepath.Join(src, "hosts.map"), "a b\n")
+		r, err := s.Record("rev"+content, "update", config, map[string]string{"/etc/haproxy/hosts.map": maps})
+		if err != nil {
+			t.Fatalf("Failed to record release: %v", err)
+		}
+		if r.ID != i+1 {
+			t.Errorf("Expected release %d, but got: %d", i+1, r.ID)
+		}
+	}
+
+	releases, err := s.List()
+	if err != nil || len(releases) != 2 || releases[0].Revision != "revthree" {
+		t.Fatalf("Expected the two most recent releases, but got: %v, %v", releases, err)
+	}
+
+	r, err := s.Find("revtw")
+	if err != nil || r.ID != 2 {
+		t.Fatalf("Expected to find release 2, but got: %v, %v", r, err)
+	}
+	if data, _ := os.ReadFile(s.ObjectPath(r.Config)); string(data) != "two" {
+		t.Errorf("Expected the configuration of release 2, but got: %q", data)
+	}
+	if r, err := s.Find("#3"); err != nil || r.Revision != "revthree" {
+		t.Errorf("Expected to find release 3 by ID, but got: %v, %v", r, err)
+	}
+	if _, err := s.Find("revone"); err == nil {
+		t.Errorf("Expected pruned releases not to be found")
+	}
+
+	entries, _ := os.ReadDir(filepath.Join(s.dir, "objects"))
+	if len(entries) != 3 {
+		t.Errorf("Expected unreferenced content to be pruned, but got %d objects", len(entries))
+	}
+}
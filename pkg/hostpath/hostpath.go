@@ -0,0 +1,226 @@
+// Package hostpath selects the HAProxy configuration of a host in a
+// repository shared by a whole fleet.
+//
+// Paths are templates, such as `hosts/{{hostname}}/haproxy.cfg`, expanded
+// with the facts of the host: its hostname and the labels of a local file.
+// Rules are tried in order and the first one matching the host, whose path
+// exists in the fetched tree, is selected.
+//
+// Author: zakaria.elbouwab
+package hostpath
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// placeholder matches the `{{name}}` placeholders of path templates.
+var placeholder = regexp.MustCompile(`\{\{\s*([A-Za-z0-9_.\-]+)\s*\}\}`)
+
+// Facts describes the host a configuration is selected for.
+type Facts struct {
+	Hostname string
+	Labels   map[string]string
+}
+
+// LoadFacts returns the facts of the host. The hostname defaults to the one
+// reported by the system. Labels are read from labelsFile, if set, holding
+// one `key=value` label per line. Label keys are lowercased, as they are in
+// the configuration.
+func LoadFacts(hostname, labelsFile string) (Facts, error) {
+	if hostname == "" {
+		var err error
+		if hostname, err = os.Hostname(); err != nil {
+			return Facts{}, err
+		}
+	}
+	facts := Facts{Hostname: hostname, Labels: map[string]string{}}
+	if labelsFile == "" {
+		return facts, nil
+	}
+
+	f, err := os.Open(filepath.Clean(labelsFile))
+	if err != nil {
+		return Facts{}, err
+	}
+	defer func() { _ = f.Close() }()
+
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			return Facts{}, fmt.Errorf("%s:%d: expected key=value", labelsFile, n)
+		}
+		facts.Labels[strings.ToLower(strings.TrimSpace(key))] = strings.Trim(strings.TrimSpace(value), `"'`)
+	}
+	return facts, scanner.Err()
+}
+
+// variables returns the values placeholders are replaced with: the labels,
+// `hostname` and `shortHostname`, the hostname up to its first dot.
+func (f Facts) variables() map[string]string {
+	vars := make(map[string]string, len(f.Labels)+2)
+	for k, v := range f.Labels {
+		vars[k] = v
+	}
+	vars["hostname"] = f.Hostname
+	vars["shortHostname"], _, _ = strings.Cut(f.Hostname, ".")
+	return vars
+}
+
+// Rule selects a path for the hosts it matches.
+//
+// Hostname is a regular expression the hostname must match, whose named
+// groups can be used as placeholders in Path. Labels must all be set to the
+// given values. A rule without conditions matches every host.
+type Rule struct {
+	Hostname string            `mapstructure:"hostname"`
+	Labels   map[string]string `mapstructure:"labels"`
+	Path     string            `mapstructure:"path"`
+}
+
+// Validate checks that the rule has a path and a valid hostname expression.
+func (r Rule) Validate() error {
+	if r.Path == "" {
+		return errors.New("missing path")
+	}
+	if _, err := regexp.Compile(r.Hostname); err != nil {
+		return fmt.Errorf("invalid hostname expression: %w", err)
+	}
+	return nil
+}
+
+// Expand replaces the placeholders of template with their values. It fails
+// on unknown placeholders and on paths escaping the tree they're relative
+// to. Templates without placeholders are returned as is.
+func Expand(template string, vars map[string]string) (string, error) {
+	if !placeholder.MatchString(template) {
+		return template, nil
+	}
+
+	var missing string
+	path := placeholder.ReplaceAllStringFunc(template, func(m string) string {
+		name := placeholder.FindStringSubmatch(m)[1]
+		value, ok := vars[name]
+		if !ok && missing == "" {
+			missing = name
+		}
+		return value
+	})
+	if missing != "" {
+		return "", fmt.Errorf("unknown variable %s in %s", missing, template)
+	}
+
+	path = filepath.Clean(path)
+	if filepath.IsAbs(path) || path == ".." || strings.HasPrefix(path, "../") {
+		return "", fmt.Errorf("%s expands outside of the tree: %s", template, path)
+	}
+	return path, nil
+}
+
+type compiledRule struct {
+	Rule
+	hostname *regexp.Regexp
+}
+
+// Selector selects the configuration path of a host.
+type Selector struct {
+	rules    []compiledRule
+	fallback string
+	facts    Facts
+}
+
+// NewSelector initializes and returns a new Selector trying rules in order,
+// then the fallback path.
+func NewSelector(rules []Rule, fallback string, facts Facts) (*Selector, error) {
+	s := &Selector{fallback: fallback, facts: facts}
+	for i, r := range rules {
+		if err := r.Validate(); err != nil {
+			return nil, fmt.Errorf("rule %d: %w", i, err)
+		}
+		s.rules = append(s.rules, compiledRule{Rule: r, hostname: regexp.MustCompile(r.Hostname)})
+	}
+	return s, nil
+}
+
+// HasRules reports whether the selector has rules, in which case the path
+// has to be selected in the fetched tree.
+func (s *Selector) HasRules() bool {
+	return len(s.rules) > 0
+}
+
+// Facts returns the facts of the host.
+func (s *Selector) Facts() Facts {
+	return s.facts
+}
+
+// Fallback returns the expanded fallback path.
+func (s *Selector) Fallback() (string, error) {
+	return Expand(s.fallback, s.facts.variables())
+}
+
+// Candidates returns the expanded paths of the rules matching the host, in
+// order, followed by the fallback. Rules referring to unknown variables are
+// skipped.
+func (s *Selector) Candidates() []string {
+	var candidates []string
+	for _, r := range s.rules {
+		vars, ok := s.match(r)
+		if !ok {
+			continue
+		}
+		if path, err := Expand(r.Path, vars); err == nil {
+			candidates = append(candidates, path)
+		}
+	}
+	if path, err := s.Fallback(); err == nil {
+		candidates = append(candidates, path)
+	}
+	return candidates
+}
+
+// Select returns the first candidate existing in the tree rooted at root.
+func (s *Selector) Select(root string) (string, error) {
+	candidates := s.Candidates()
+	for _, path := range candidates {
+		if info, err := os.Stat(filepath.Join(root, path)); err == nil && !info.IsDir() {
+			return path, nil
+		}
+	}
+	return "", fmt.Errorf("no configuration found for host %s, tried: %s",
+		s.facts.Hostname, strings.Join(candidates, ", "))
+}
+
+// match reports whether the rule matches the host, and returns the
+// variables its path is expanded with.
+func (s *Selector) match(r compiledRule) (map[string]string, bool) {
+	for k, v := range r.Labels {
+		if s.facts.Labels[strings.ToLower(k)] != v {
+			return nil, false
+		}
+	}
+
+	vars := s.facts.variables()
+	if r.Hostname == "" {
+		return vars, true
+	}
+	m := r.hostname.FindStringSubmatch(s.facts.Hostname)
+	if m == nil {
+		return nil, false
+	}
+	for i, name := range r.hostname.SubexpNames() {
+		if name != "" {
+			vars[name] = m[i]
+		}
+	}
+	return vars, true
+}
@@ -0,0 +1,89 @@
+package hostpath
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestLoadFacts(t *testing.T) {
+	labels := filepath.Join(t.TempDir(), "labels")
+	content := "# node labels\nCluster=eu-1\nrole = \"edge\"\n\n"
+	if err := os.WriteFile(labels, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	facts, err := LoadFacts("lb-1.example.com", labels)
+	if err != nil {
+		t.Fatalf("Failed to load facts: %v", err)
+	}
+	want := map[string]string{"cluster": "eu-1", "role": "edge"}
+	if facts.Hostname != "lb-1.example.com" || !reflect.DeepEqual(facts.Labels, want) {
+		t.Errorf("Unexpected facts: %+v", facts)
+	}
+
+	if err := os.WriteFile(labels, []byte("cluster\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadFacts("lb-1", labels); err == nil {
+		t.Errorf("Expected an error for a line without value")
+	}
+}
+
+func TestExpand(t *testing.T) {
+	vars := map[string]string{"hostname": "lb-1", "cluster": "eu-1"}
+
+	path, err := Expand("clusters/{{ cluster }}/{{hostname}}.cfg", vars)
+	if err != nil || path != "clusters/eu-1/lb-1.cfg" {
+		t.Errorf("Unexpected expansion: %s, %v", path, err)
+	}
+	if path, _ := Expand("./haproxy.cfg", vars); path != "./haproxy.cfg" {
+		t.Errorf("Expected paths without placeholders as is, but got: %s", path)
+	}
+	if _, err := Expand("clusters/{{region}}/haproxy.cfg", vars); err == nil {
+		t.Errorf("Expected an error for an unknown variable")
+	}
+	if _, err := Expand("{{cluster}}/../../haproxy.cfg", vars); err == nil {
+		t.Errorf("Expected an error for a path outside of the tree")
+	}
+}
+
+func TestSelector(t *testing.T) {
+	facts := Facts{Hostname: "edge-fra-2.example.com", Labels: map[string]string{"cluster": "eu-1"}}
+	rules := []Rule{
+		{Path: "hosts/{{shortHostname}}/haproxy.cfg"},
+		{Hostname: `^edge-(?P<region>[a-z]+)-\d+`, Path: "regions/{{region}}/haproxy.cfg"},
+		{Labels: map[string]string{"cluster": "us-1"}, Path: "clusters/us-1/haproxy.cfg"},
+		{Path: "racks/{{rack}}/haproxy.cfg"},
+	}
+	s, err := NewSelector(rules, "clusters/{{cluster}}/haproxy.cfg", facts)
+	if err != nil {
+		t.Fatalf("Failed to create selector: %v", err)
+	}
+
+	want := []string{"hosts/edge-fra-2/haproxy.cfg", "regions/fra/haproxy.cfg", "clusters/eu-1/haproxy.cfg"}
+	if got := s.Candidates(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected candidates %v, but got: %v", want, got)
+	}
+
+	root := t.TempDir()
+	if _, err := s.Select(root); err == nil {
+		t.Errorf("Expected an error when no candidate exists")
+	}
+	for _, p := range want[1:] {
+		if err := os.MkdirAll(filepath.Join(root, filepath.Dir(p)), 0750); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(root, p), []byte("global\n"), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if path, err := s.Select(root); err != nil || path != "regions/fra/haproxy.cfg" {
+		t.Errorf("Expected the first existing candidate, but got: %s, %v", path, err)
+	}
+
+	if _, err := NewSelector([]Rule{{Hostname: "(", Path: "a"}}, "b", facts); err == nil {
+		t.Errorf("Expected an error for an invalid hostname expression")
+	}
+}
@@ -0,0 +1,105 @@
+package httpserver
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Role is what a credential grants access to.
+type Role string
+
+const (
+	// RoleRead grants access to metrics and read-only endpoints
+	RoleRead Role = "read"
+	// RoleAdmin grants access to every endpoint
+	RoleAdmin Role = "admin"
+)
+
+// allows reports whether r grants access to endpoints requiring role.
+func (r Role) allows(role Role) bool {
+	return r == RoleAdmin || r == role
+}
+
+// Credential is a bearer token, or a username and password for basic auth,
+// granted a role.
+type Credential struct {
+	Token    string `mapstructure:"token"`
+	Username string `mapstructure:"username"`
+	Password string `mapstructure:"password"`
+	Role     Role   `mapstructure:"role"`
+}
+
+// Validate checks that c is either a token or a username and password.
+func (c Credential) Validate() error {
+	switch c.Role {
+	case RoleRead, RoleAdmin:
+	default:
+		return fmt.Errorf("role must be one of %s or %s", RoleRead, RoleAdmin)
+	}
+	switch {
+	case c.Token != "" && (c.Username != "" || c.Password != ""):
+		return errors.New("a credential is either a token or a username and password")
+	case c.Token == "" && (c.Username == "" || c.Password == ""):
+		return errors.New("missing token, or username and password")
+	}
+	return nil
+}
+
+// Authenticator checks the credentials of requests.
+type Authenticator struct {
+	credentials []Credential
+}
+
+// NewAuthenticator initializes and returns a new Authenticator accepting
+// credentials. Without credentials, every request is let through.
+func NewAuthenticator(credentials []Credential) *Authenticator {
+	return &Authenticator{credentials: credentials}
+}
+
+// Require serves next to requests authenticated with a credential granting
+// role.
+func (a *Authenticator) Require(role Role, next http.Handler) http.Handler {
+	if len(a.credentials) == 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		granted, ok := a.authenticate(r)
+		if !ok {
+			w.Header().Set("WWW-Authenticate", `Basic realm="hpxd"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if !granted.allows(role) {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// authenticate returns the role of the credential of r.
+func (a *Authenticator) authenticate(r *http.Request) (Role, bool) {
+	token, bearer := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	username, password, basic := r.BasicAuth()
+	if !bearer && !basic {
+		return "", false
+	}
+
+	for _, c := range a.credentials {
+		switch {
+		case bearer && c.Token != "" && equal(token, c.Token):
+			return c.Role, true
+		case basic && c.Token == "" && equal(username, c.Username) && equal(password, c.Password):
+			return c.Role, true
+		}
+	}
+	return "", false
+}
+
+// equal compares secrets in constant time.
+func equal(a, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
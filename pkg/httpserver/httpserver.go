@@ -0,0 +1,94 @@
+// Package httpserver serves the operator-facing HTTP endpoints of hpxd, the
+// metrics and the admin API, over TLS and behind authentication.
+//
+// Certificates are reloaded when their files change, so they can be renewed
+// without restarting hpxd. Clients can be required to present a certificate
+// signed by a CA, and to authenticate with a bearer token or basic auth
+// credentials, each granted the read-only or the admin role.
+//
+// Author: zakaria.elbouwab
+package httpserver
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+)
+
+// Config configures TLS and authentication. Both are disabled when unset.
+type Config struct {
+	TLS  TLSConfig    `mapstructure:"tls"`
+	Auth []Credential `mapstructure:"auth"`
+}
+
+// TLSConfig configures TLS. When ClientCAFile is set, clients must present
+// a certificate signed by one of its CAs.
+type TLSConfig struct {
+	CertFile     string `mapstructure:"certFile"`
+	KeyFile      string `mapstructure:"keyFile"`
+	ClientCAFile string `mapstructure:"clientCAFile"`
+}
+
+// Enabled reports whether TLS is configured.
+func (c TLSConfig) Enabled() bool {
+	return c.CertFile != "" || c.KeyFile != ""
+}
+
+// Validate checks the settings of c.
+func (c Config) Validate() error {
+	if c.TLS.Enabled() && (c.TLS.CertFile == "" || c.TLS.KeyFile == "") {
+		return errors.New("tls requires both certFile and keyFile")
+	}
+	if c.TLS.ClientCAFile != "" && !c.TLS.Enabled() {
+		return errors.New("tls.clientCAFile requires certFile and keyFile")
+	}
+	for i, cred := range c.Auth {
+		if err := cred.Validate(); err != nil {
+			return fmt.Errorf("auth[%d]: %w", i, err)
+		}
+	}
+	return nil
+}
+
+// Listen listens on address, a TCP address or a unix socket written as
+// `unix:/path/to/socket`, serving TLS when configured. Stale sockets are
+// removed first, and new ones are only accessible to their owner and group.
+func Listen(address string, config TLSConfig) (net.Listener, error) {
+	listener, err := listen(address)
+	if err != nil {
+		return nil, err
+	}
+	if !config.Enabled() {
+		return listener, nil
+	}
+
+	tlsConfig, err := NewTLSConfig(config)
+	if err != nil {
+		_ = listener.Close()
+		return nil, err
+	}
+	return tls.NewListener(listener, tlsConfig), nil
+}
+
+func listen(address string) (net.Listener, error) {
+	if !strings.HasPrefix(address, "unix:") {
+		return net.Listen("tcp", address)
+	}
+
+	path := strings.TrimPrefix(strings.TrimPrefix(address, "unix:"), "//")
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, 0660); err != nil {
+		_ = listener.Close()
+		return nil, err
+	}
+	return listener, nil
+}
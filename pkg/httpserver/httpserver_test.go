@@ -0,0 +1,198 @@
+package httpserver
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeCert writes a certificate for commonName signed by parent, or
+// self-signed, and returns it with its key.
+func writeCert(t *testing.T, dir, name, commonName string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: commonName},
+		DNSNames:              []string{commonName},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  parent == nil,
+	}
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	if err := os.WriteFile(filepath.Join(dir, name+".crt"), certPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, name+".key"), keyPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, key
+}
+
+func serveTLS(t *testing.T, config TLSConfig) string {
+	t.Helper()
+	listener, err := Listen("127.0.0.1:0", config)
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("ok"))
+	}), ReadHeaderTimeout: time.Second}
+	go func() { _ = server.Serve(listener) }()
+	t.Cleanup(func() { _ = server.Close() })
+	return "https://" + listener.Addr().String()
+}
+
+func client(roots *x509.CertPool, certs ...tls.Certificate) *http.Client {
+	return &http.Client{Transport: &http.Transport{
+		DisableKeepAlives: true,
+		TLSClientConfig:   &tls.Config{RootCAs: roots, Certificates: certs, ServerName: "localhost", MinVersion: tls.VersionTLS12},
+	}}
+}
+
+func TestListen_TLSReloadsCertificate(t *testing.T) {
+	dir := t.TempDir()
+	first, _ := writeCert(t, dir, "server", "localhost", nil, nil)
+	url := serveTLS(t, TLSConfig{CertFile: filepath.Join(dir, "server.crt"), KeyFile: filepath.Join(dir, "server.key")})
+
+	roots := x509.NewCertPool()
+	roots.AddCert(first)
+	resp, err := client(roots).Get(url)
+	if err != nil {
+		t.Fatalf("Expected the request to succeed, but got: %v", err)
+	}
+	_ = resp.Body.Close()
+
+	// Renew the certificate, make sure its modification time differs
+	time.Sleep(10 * time.Millisecond)
+	second, _ := writeCert(t, dir, "server", "localhost", nil, nil)
+	if _, err := client(roots).Get(url); err == nil {
+		t.Fatal("Expected the renewed certificate to be served")
+	}
+	roots = x509.NewCertPool()
+	roots.AddCert(second)
+	resp, err = client(roots).Get(url)
+	if err != nil {
+		t.Fatalf("Expected the renewed certificate to be trusted, but got: %v", err)
+	}
+	_ = resp.Body.Close()
+}
+
+func TestListen_ClientCertificates(t *testing.T) {
+	dir := t.TempDir()
+	ca, caKey := writeCert(t, dir, "ca", "hpxd-ca", nil, nil)
+	writeCert(t, dir, "server", "localhost", ca, caKey)
+	writeCert(t, dir, "client", "operator", ca, caKey)
+	url := serveTLS(t, TLSConfig{
+		CertFile:     filepath.Join(dir, "server.crt"),
+		KeyFile:      filepath.Join(dir, "server.key"),
+		ClientCAFile: filepath.Join(dir, "ca.crt"),
+	})
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+	if _, err := client(roots).Get(url); err == nil {
+		t.Fatal("Expected requests without a client certificate to be rejected")
+	}
+
+	cert, err := tls.LoadX509KeyPair(filepath.Join(dir, "client.crt"), filepath.Join(dir, "client.key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := client(roots, cert).Get(url)
+	if err != nil {
+		t.Fatalf("Expected requests with a client certificate to succeed, but got: %v", err)
+	}
+	_ = resp.Body.Close()
+}
+
+func TestAuthenticator_Require(t *testing.T) {
+	auth := NewAuthenticator([]Credential{
+		{Token: "read-token", Role: RoleRead},
+		{Username: "admin", Password: "secret", Role: RoleAdmin},
+	})
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+
+	tests := []struct {
+		name     string
+		role     Role
+		setup    func(r *http.Request)
+		expected int
+	}{
+		{"anonymous", RoleRead, func(r *http.Request) {}, http.StatusUnauthorized},
+		{"wrong token", RoleRead, func(r *http.Request) { r.Header.Set("Authorization", "Bearer nope") }, http.StatusUnauthorized},
+		{"read token", RoleRead, func(r *http.Request) { r.Header.Set("Authorization", "Bearer read-token") }, http.StatusOK},
+		{"read token on admin", RoleAdmin, func(r *http.Request) { r.Header.Set("Authorization", "Bearer read-token") }, http.StatusForbidden},
+		{"admin on read", RoleRead, func(r *http.Request) { r.SetBasicAuth("admin", "secret") }, http.StatusOK},
+		{"admin", RoleAdmin, func(r *http.Request) { r.SetBasicAuth("admin", "secret") }, http.StatusOK},
+		{"wrong password", RoleAdmin, func(r *http.Request) { r.SetBasicAuth("admin", "nope") }, http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			tt.setup(r)
+			w := httptest.NewRecorder()
+			auth.Require(tt.role, ok).ServeHTTP(w, r)
+			if w.Code != tt.expected {
+				t.Errorf("Expected status %d, but got: %d", tt.expected, w.Code)
+			}
+		})
+	}
+}
+
+func TestConfig_Validate(t *testing.T) {
+	invalid := []Config{
+		{TLS: TLSConfig{CertFile: "server.crt"}},
+		{TLS: TLSConfig{ClientCAFile: "ca.crt"}},
+		{Auth: []Credential{{Token: "t", Role: "root"}}},
+		{Auth: []Credential{{Token: "t", Username: "u", Password: "p", Role: RoleRead}}},
+		{Auth: []Credential{{Username: "u", Role: RoleRead}}},
+	}
+	for i, c := range invalid {
+		if err := c.Validate(); err == nil {
+			t.Errorf("Expected config %d to be invalid", i)
+		}
+	}
+
+	valid := Config{
+		TLS:  TLSConfig{CertFile: "server.crt", KeyFile: "server.key", ClientCAFile: "ca.crt"},
+		Auth: []Credential{{Token: "t", Role: RoleRead}, {Username: "u", Password: "p", Role: RoleAdmin}},
+	}
+	if err := valid.Validate(); err != nil {
+		t.Errorf("Expected config to be valid, but got: %v", err)
+	}
+}
@@ -0,0 +1,119 @@
+package httpserver
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+// certificates holds the server certificate and the client CAs, reloaded
+// when their files change.
+type certificates struct {
+	config TLSConfig
+
+	mu   sync.Mutex
+	cert *tls.Certificate
+	cas  *x509.CertPool
+	// stamp identifies the version of the files last loaded
+	stamp string
+}
+
+// NewTLSConfig returns a TLS configuration serving the certificate of
+// config, and verifying client certificates against its CAs if any. Files
+// are checked for changes on every handshake and reloaded when they change;
+// a reload failure keeps the previous certificates.
+func NewTLSConfig(config TLSConfig) (*tls.Config, error) {
+	c := &certificates{config: config}
+	if err := c.reload(); err != nil {
+		return nil, err
+	}
+
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			cert, cas := c.current()
+			next := &tls.Config{
+				MinVersion:   tls.VersionTLS12,
+				Certificates: []tls.Certificate{*cert},
+			}
+			if cas != nil {
+				next.ClientCAs = cas
+				next.ClientAuth = tls.RequireAndVerifyClientCert
+			}
+			return next, nil
+		},
+	}, nil
+}
+
+// current returns the certificates, reloading them first if their files
+// changed.
+func (c *certificates) current() (*tls.Certificate, *x509.CertPool) {
+	if err := c.reload(); err != nil {
+		logrus.Errorf("Failed to reload TLS certificates, keeping the previous ones: %v", err)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.cert, c.cas
+}
+
+// reload loads the certificates if their files changed since they were
+// last loaded.
+func (c *certificates) reload() error {
+	stamp, err := c.fileStamp()
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	unchanged := stamp == c.stamp
+	c.mu.Unlock()
+	if unchanged {
+		return nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(c.config.CertFile, c.config.KeyFile)
+	if err != nil {
+		return fmt.Errorf("failed to load certificate: %w", err)
+	}
+	var cas *x509.CertPool
+	if c.config.ClientCAFile != "" {
+		pem, err := os.ReadFile(filepath.Clean(c.config.ClientCAFile))
+		if err != nil {
+			return fmt.Errorf("failed to read client CAs: %w", err)
+		}
+		cas = x509.NewCertPool()
+		if !cas.AppendCertsFromPEM(pem) {
+			return errors.New("no certificate found in the client CA file")
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.stamp != "" {
+		logrus.Infof("Reloaded TLS certificate %s", c.config.CertFile)
+	}
+	c.cert, c.cas, c.stamp = &cert, cas, stamp
+	return nil
+}
+
+// fileStamp identifies the current version of the files, from their size
+// and modification time.
+func (c *certificates) fileStamp() (string, error) {
+	var stamp string
+	for _, path := range []string{c.config.CertFile, c.config.KeyFile, c.config.ClientCAFile} {
+		if path == "" {
+			continue
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			return "", err
+		}
+		stamp += fmt.Sprintf("%s:%d:%d;", path, info.Size(), info.ModTime().UnixNano())
+	}
+	return stamp, nil
+}
@@ -0,0 +1,90 @@
+package httpsource
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+var gzipMagic = []byte{0x1f, 0x8b}
+
+// isTarball reports whether the artifact is a (possibly gzipped) tarball,
+// based on its URL, its content type and its content.
+func isTarball(url, contentType string, body []byte) bool {
+	for _, ext := range []string{".tar", ".tar.gz", ".tgz"} {
+		if strings.HasSuffix(strings.SplitN(url, "?", 2)[0], ext) {
+			return true
+		}
+	}
+	switch contentType {
+	case "application/x-tar", "application/gzip", "application/x-gzip", "application/x-gtar":
+		return true
+	}
+	return bytes.HasPrefix(body, gzipMagic)
+}
+
+// extractTarball extracts the regular files and directories of a tarball,
+// gzipped or not, into dest. Entries escaping dest are rejected.
+func extractTarball(body []byte, dest string) error {
+	var r io.Reader = bytes.NewReader(body)
+	if bytes.HasPrefix(body, gzipMagic) {
+		gz, err := gzip.NewReader(r)
+		if err != nil {
+			return err
+		}
+		defer func() { _ = gz.Close() }()
+		r = gz
+	}
+
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		target := filepath.Join(dest, filepath.Clean("/"+hdr.Name))
+		if target == filepath.Clean(dest) {
+			// The root entry of archives created with `tar -C dir .`
+			continue
+		}
+		if !strings.HasPrefix(target, filepath.Clean(dest)+string(os.PathSeparator)) {
+			return fmt.Errorf("invalid path in archive: %s", hdr.Name)
+		}
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(target, 0750); err != nil {
+				return err
+			}
+		case tar.TypeReg:
+			if err := os.MkdirAll(filepath.Dir(target), 0750); err != nil {
+				return err
+			}
+			if err := writeEntry(target, tr, hdr.Size); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func writeEntry(target string, r io.Reader, size int64) error {
+	f, err := os.OpenFile(filepath.Clean(target), os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.CopyN(f, r, size); err != nil {
+		_ = f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,319 @@
+// Package httpsource provides a configuration source fetching HAProxy
+// configurations published over HTTP(S), such as build artifacts.
+//
+// The artifact is either a single configuration file or a tarball holding
+// the configuration along with its auxiliary files. Conditional requests
+// (ETag and If-Modified-Since) avoid downloading unchanged content, and the
+// artifact can be verified against a SHA256 checksum or a detached
+// signature before it's used.
+//
+// Author: zakaria.elbouwab
+package httpsource
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// maxArtifactSize caps the size of a downloaded artifact.
+const maxArtifactSize = 256 << 20
+
+// Config describes where and how to fetch the artifact.
+type Config struct {
+	URL string `mapstructure:"url"`
+
+	// SHA256 pins the expected checksum of the artifact, SHA256URL points
+	// at a checksum file published next to it ("<hex> [name]")
+	SHA256    string `mapstructure:"sha256"`
+	SHA256URL string `mapstructure:"sha256URL"`
+
+	// SignatureURL points at a detached signature of the artifact, made
+	// with the private key matching the PEM public key in PublicKeyFile
+	SignatureURL  string `mapstructure:"signatureURL"`
+	PublicKeyFile string `mapstructure:"publicKeyFile"`
+
+	BearerToken string `mapstructure:"bearerToken"`
+	CAFile      string `mapstructure:"caFile"`
+	CertFile    string `mapstructure:"certFile"`
+	KeyFile     string `mapstructure:"keyFile"`
+
+	Timeout time.Duration `mapstructure:"timeout"`
+}
+
+// Handler fetches the artifact and stages it in a local directory.
+type Handler struct {
+	config    Config
+	path      string
+	localPath string
+	client    *http.Client
+
+	etag         string
+	lastModified string
+	checksum     string
+}
+
+// NewHandler initializes and returns a new Handler. path is the location of
+// the HAProxy configuration inside the artifact, or the name the artifact is
+// saved under when it's a single file.
+func NewHandler(config Config, path string) (*Handler, error) {
+	if config.URL == "" {
+		return nil, errors.New("missing artifact URL")
+	}
+	if config.SignatureURL != "" && config.PublicKeyFile == "" {
+		return nil, errors.New("a public key is required to verify signatures")
+	}
+
+	client, err := newClient(config)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Handler{
+		config:    config,
+		path:      path,
+		localPath: filepath.Join(os.TempDir(), "hpxd-http-source"),
+		client:    client,
+	}, nil
+}
+
+// PullAndUpdate fetches the artifact.
+//
+// Unchanged artifacts, either reported as such by the server or with the
+// same content as the previous fetch, are not staged again. This function
+// returns the path to the HAProxy configuration and a flag indicating if
+// the artifact changed.
+func (h *Handler) PullAndUpdate(ctx context.Context) (string, bool, error) {
+	body, header, err := h.fetch(ctx)
+	if err != nil {
+		return "", false, err
+	}
+	if body == nil {
+		logrus.Debugf("Artifact %s not modified", h.config.URL)
+		return "", false, nil
+	}
+
+	sum := sha256.Sum256(body)
+	checksum := hex.EncodeToString(sum[:])
+	if checksum == h.checksum {
+		h.remember(header)
+		return "", false, nil
+	}
+
+	if err := h.verify(ctx, body, checksum); err != nil {
+		return "", false, err
+	}
+	if err := h.stage(body, header); err != nil {
+		return "", false, fmt.Errorf("failed to stage artifact: %w", err)
+	}
+
+	h.checksum = checksum
+	h.remember(header)
+	return h.getHAProxyConfigPath(), true, nil
+}
+
+// RepoPath returns the directory the artifact is staged in.
+func (h *Handler) RepoPath() string {
+	return h.localPath
+}
+
+// Revision returns the SHA256 checksum of the artifact last staged.
+func (h *Handler) Revision() string {
+	return h.checksum
+}
+
+// SetLocalPath changes where the artifact is staged, so several handlers
+// can be used side by side.
+func (h *Handler) SetLocalPath(path string) {
+	h.localPath = path
+}
+
+func (h *Handler) getHAProxyConfigPath() string {
+	return filepath.Join(h.localPath, h.path)
+}
+
+// fetch downloads the artifact with a conditional request. It returns a nil
+// body if the server reports it as not modified.
+func (h *Handler) fetch(ctx context.Context) ([]byte, http.Header, error) {
+	req, err := h.newRequest(ctx, h.config.URL)
+	if err != nil {
+		return nil, nil, err
+	}
+	if h.checksum != "" {
+		if h.etag != "" {
+			req.Header.Set("If-None-Match", h.etag)
+		}
+		if h.lastModified != "" {
+			req.Header.Set("If-Modified-Since", h.lastModified)
+		}
+	}
+
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to fetch artifact: %w", err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	switch resp.StatusCode {
+	case http.StatusNotModified:
+		return nil, resp.Header, nil
+	case http.StatusOK:
+	default:
+		return nil, nil, fmt.Errorf("failed to fetch artifact: unexpected status %s", resp.Status)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxArtifactSize+1))
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read artifact: %w", err)
+	}
+	if len(body) > maxArtifactSize {
+		return nil, nil, fmt.Errorf("artifact is larger than %d bytes", maxArtifactSize)
+	}
+	return body, resp.Header, nil
+}
+
+// fetchSmall downloads a small companion file, such as a checksum or a
+// signature.
+func (h *Handler) fetchSmall(ctx context.Context, url string) ([]byte, error) {
+	req, err := h.newRequest(ctx, url)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s fetching %s", resp.Status, url)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+}
+
+func (h *Handler) newRequest(ctx context.Context, url string) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	if h.config.BearerToken != "" {
+		req.Header.Set("Authorization", "Bearer "+h.config.BearerToken)
+	}
+	return req, nil
+}
+
+// remember stores the validators of the response for the next request.
+func (h *Handler) remember(header http.Header) {
+	h.etag = header.Get("ETag")
+	h.lastModified = header.Get("Last-Modified")
+}
+
+// verify checks the artifact against the configured checksum and signature.
+func (h *Handler) verify(ctx context.Context, body []byte, checksum string) error {
+	expected := strings.ToLower(strings.TrimSpace(h.config.SHA256))
+	if h.config.SHA256URL != "" {
+		data, err := h.fetchSmall(ctx, h.config.SHA256URL)
+		if err != nil {
+			return fmt.Errorf("failed to fetch checksum: %w", err)
+		}
+		fields := strings.Fields(string(data))
+		if len(fields) == 0 {
+			return errors.New("checksum file is empty")
+		}
+		expected = strings.ToLower(fields[0])
+	}
+	if expected != "" && expected != checksum {
+		return fmt.Errorf("artifact checksum mismatch: expected %s, got %s", expected, checksum)
+	}
+
+	if h.config.SignatureURL != "" {
+		signature, err := h.fetchSmall(ctx, h.config.SignatureURL)
+		if err != nil {
+			return fmt.Errorf("failed to fetch signature: %w", err)
+		}
+		if err := verifySignature(h.config.PublicKeyFile, body, signature); err != nil {
+			return fmt.Errorf("artifact signature verification failed: %w", err)
+		}
+	}
+	return nil
+}
+
+// stage replaces the content of the staging directory with the artifact.
+// The artifact is first written next to it, so a failure never leaves a
+// partially staged artifact behind.
+func (h *Handler) stage(body []byte, header http.Header) error {
+	next := h.localPath + ".new"
+	if err := os.RemoveAll(next); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(next, 0750); err != nil {
+		return err
+	}
+
+	var err error
+	if isTarball(h.config.URL, header.Get("Content-Type"), body) {
+		err = extractTarball(body, next)
+	} else {
+		target := filepath.Join(next, h.path)
+		if err = os.MkdirAll(filepath.Dir(target), 0750); err == nil {
+			err = os.WriteFile(target, body, 0600)
+		}
+	}
+	if err != nil {
+		_ = os.RemoveAll(next)
+		return err
+	}
+
+	if err := os.RemoveAll(h.localPath); err != nil {
+		return err
+	}
+	return os.Rename(next, h.localPath)
+}
+
+// newClient builds the HTTP client, with the configured CA and client
+// certificate for mTLS.
+func newClient(config Config) (*http.Client, error) {
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+
+	if config.CAFile != "" {
+		pem, err := os.ReadFile(filepath.Clean(config.CAFile))
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate found in %s", config.CAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if config.CertFile != "" || config.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(config.CertFile, config.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	timeout := config.Timeout
+	if timeout == 0 {
+		timeout = 30 * time.Second
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	return &http.Client{Transport: transport, Timeout: timeout}, nil
+}
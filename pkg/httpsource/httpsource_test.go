@@ -0,0 +1,175 @@
+package httpsource
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const testConfig = "global\n    daemon\n"
+
+// newTestHandler returns a handler staging into a temporary directory.
+func newTestHandler(t *testing.T, config Config, path string) *Handler {
+	t.Helper()
+	h, err := NewHandler(config, path)
+	if err != nil {
+		t.Fatalf("Failed to create handler: %v", err)
+	}
+	h.localPath = filepath.Join(t.TempDir(), "staging")
+	return h
+}
+
+func TestPullAndUpdate_ConditionalRequests(t *testing.T) {
+	content := testConfig
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if r.Header.Get("Authorization") != "Bearer token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		sum := sha256.Sum256([]byte(content))
+		etag := `"` + hex.EncodeToString(sum[:8]) + `"`
+		if r.Header.Get("If-None-Match") == etag {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", etag)
+		_, _ = w.Write([]byte(content))
+	}))
+	defer server.Close()
+
+	h := newTestHandler(t, Config{URL: server.URL + "/haproxy.cfg", BearerToken: "token"}, "haproxy.cfg")
+
+	configPath, updated, err := h.PullAndUpdate(context.Background())
+	if err != nil || !updated {
+		t.Fatalf("Expected first fetch to update, but got: %v, %v", updated, err)
+	}
+	if data, _ := os.ReadFile(configPath); string(data) != testConfig {
+		t.Errorf("Expected staged config %q, but got %q", testConfig, data)
+	}
+
+	if _, updated, err := h.PullAndUpdate(context.Background()); err != nil || updated {
+		t.Errorf("Expected unchanged artifact not to update, but got: %v, %v", updated, err)
+	}
+
+	content = "global\n"
+	if _, updated, err := h.PullAndUpdate(context.Background()); err != nil || !updated {
+		t.Errorf("Expected changed artifact to update, but got: %v, %v", updated, err)
+	}
+	if requests != 3 {
+		t.Errorf("Expected 3 requests, but got %d", requests)
+	}
+}
+
+func TestPullAndUpdate_TarballWithChecksum(t *testing.T) {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	for name, content := range map[string]string{"lb/haproxy.cfg": testConfig, "maps/hosts.map": "a b\n"} {
+		_ = tw.WriteHeader(&tar.Header{Name: name, Mode: 0600, Size: int64(len(content)), Typeflag: tar.TypeReg})
+		_, _ = tw.Write([]byte(content))
+	}
+	_ = tw.Close()
+	_ = gz.Close()
+	archive := buf.Bytes()
+	sum := sha256.Sum256(archive)
+	checksum := hex.EncodeToString(sum[:])
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/configs.tar.gz":
+			_, _ = w.Write(archive)
+		case "/configs.tar.gz.sha256":
+			_, _ = w.Write([]byte(checksum + "  configs.tar.gz\n"))
+		case "/wrong.sha256":
+			_, _ = w.Write([]byte("0000  configs.tar.gz\n"))
+		}
+	}))
+	defer server.Close()
+
+	h := newTestHandler(t, Config{URL: server.URL + "/configs.tar.gz", SHA256URL: server.URL + "/configs.tar.gz.sha256"}, "lb/haproxy.cfg")
+	configPath, updated, err := h.PullAndUpdate(context.Background())
+	if err != nil || !updated {
+		t.Fatalf("Expected tarball to be staged, but got: %v, %v", updated, err)
+	}
+	if data, _ := os.ReadFile(configPath); string(data) != testConfig {
+		t.Errorf("Expected staged config %q, but got %q", testConfig, data)
+	}
+	if _, err := os.Stat(filepath.Join(h.RepoPath(), "maps", "hosts.map")); err != nil {
+		t.Errorf("Expected auxiliary file to be staged: %v", err)
+	}
+
+	h = newTestHandler(t, Config{URL: server.URL + "/configs.tar.gz", SHA256URL: server.URL + "/wrong.sha256"}, "lb/haproxy.cfg")
+	if _, _, err := h.PullAndUpdate(context.Background()); err == nil {
+		t.Errorf("Expected checksum mismatch to fail")
+	}
+}
+
+func TestPullAndUpdate_Signature(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		t.Fatalf("Failed to marshal key: %v", err)
+	}
+	keyFile := filepath.Join(t.TempDir(), "key.pem")
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0600); err != nil {
+		t.Fatalf("Failed to write key: %v", err)
+	}
+
+	signature := base64.StdEncoding.EncodeToString(ed25519.Sign(priv, []byte(testConfig)))
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/haproxy.cfg":
+			_, _ = w.Write([]byte(testConfig))
+		case "/haproxy.cfg.sig":
+			_, _ = w.Write([]byte(signature))
+		case "/forged.sig":
+			_, _ = w.Write([]byte(base64.StdEncoding.EncodeToString(ed25519.Sign(priv, []byte("other")))))
+		}
+	}))
+	defer server.Close()
+
+	h := newTestHandler(t, Config{URL: server.URL + "/haproxy.cfg", SignatureURL: server.URL + "/haproxy.cfg.sig", PublicKeyFile: keyFile}, "haproxy.cfg")
+	if _, updated, err := h.PullAndUpdate(context.Background()); err != nil || !updated {
+		t.Errorf("Expected signed artifact to be staged, but got: %v, %v", updated, err)
+	}
+
+	h = newTestHandler(t, Config{URL: server.URL + "/haproxy.cfg", SignatureURL: server.URL + "/forged.sig", PublicKeyFile: keyFile}, "haproxy.cfg")
+	if _, _, err := h.PullAndUpdate(context.Background()); err == nil {
+		t.Errorf("Expected forged signature to fail")
+	}
+}
+
+func TestExtractTarball_RejectsTraversal(t *testing.T) {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	_ = tw.WriteHeader(&tar.Header{Name: "../../etc/passwd", Mode: 0600, Size: 1, Typeflag: tar.TypeReg})
+	_, _ = tw.Write([]byte("x"))
+	_ = tw.Close()
+
+	dest := t.TempDir()
+	if err := extractTarball(buf.Bytes(), dest); err != nil {
+		t.Fatalf("Failed to extract tarball: %v", err)
+	}
+	// The entry is confined to dest rather than written outside of it
+	if _, err := os.Stat(filepath.Join(dest, "etc", "passwd")); err != nil {
+		t.Errorf("Expected traversing entry to be confined to the destination: %v", err)
+	}
+}
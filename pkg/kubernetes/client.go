@@ -0,0 +1,197 @@
+package kubernetes
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Locations of the service account credentials mounted in pods.
+const (
+	inClusterTokenFile = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+	inClusterCAFile    = "/var/run/secrets/kubernetes.io/serviceaccount/ca.crt"
+)
+
+// watchTimeout bounds how long the API server keeps a watch open.
+const watchTimeout = 5 * time.Minute
+
+// errExpired is returned when the resource version of a watch is too old,
+// and the resources must be listed again.
+var errExpired = errors.New("resource version expired")
+
+// client is a minimal client of the Kubernetes REST API.
+type client struct {
+	server    string
+	token     string
+	tokenFile string
+	http      *http.Client
+}
+
+// newClient creates a client from the configuration, falling back to the
+// in-cluster service account when no API server is configured.
+func newClient(config Config) (*client, error) {
+	c := &client{server: config.APIServer, token: config.Token, tokenFile: config.TokenFile}
+	caFile := config.CAFile
+
+	if c.server == "" {
+		host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+		if host == "" || port == "" {
+			return nil, errors.New("no API server configured and not running in a cluster")
+		}
+		c.server = "https://" + net.JoinHostPort(host, port)
+		if c.token == "" && c.tokenFile == "" {
+			c.tokenFile = inClusterTokenFile
+		}
+		if caFile == "" {
+			caFile = inClusterCAFile
+		}
+	}
+
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	if caFile != "" {
+		pem, err := os.ReadFile(filepath.Clean(caFile))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CA: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate found in %s", caFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	c.http = &http.Client{Transport: &http.Transport{
+		Proxy:           http.ProxyFromEnvironment,
+		TLSClientConfig: tlsConfig,
+	}}
+	return c, nil
+}
+
+// list lists the resources at path and returns them along with the
+// resource version of the list.
+func (c *client) list(ctx context.Context, path string, query url.Values) ([]json.RawMessage, string, error) {
+	resp, err := c.get(ctx, path, query)
+	if err != nil {
+		return nil, "", err
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	var list struct {
+		Metadata listMeta          `json:"metadata"`
+		Items    []json.RawMessage `json:"items"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+		return nil, "", err
+	}
+	return list.Items, list.Metadata.ResourceVersion, nil
+}
+
+// watchEvent is a single event of a watch stream.
+type watchEvent struct {
+	Type   string          `json:"type"`
+	Object json.RawMessage `json:"object"`
+}
+
+// watch streams the changes of the resources at path after version to
+// handle, until the stream ends. It returns the resource version of the
+// last event.
+func (c *client) watch(ctx context.Context, path string, query url.Values, version string, handle func(watchEvent)) (string, error) {
+	q := url.Values{}
+	for k, v := range query {
+		q[k] = v
+	}
+	q.Set("watch", "true")
+	q.Set("resourceVersion", version)
+	q.Set("allowWatchBookmarks", "true")
+	q.Set("timeoutSeconds", fmt.Sprint(int(watchTimeout.Seconds())))
+
+	resp, err := c.get(ctx, path, q)
+	if err != nil {
+		return version, err
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	decoder := json.NewDecoder(resp.Body)
+	for {
+		var event watchEvent
+		if err := decoder.Decode(&event); err != nil {
+			if errors.Is(err, io.EOF) {
+				return version, nil
+			}
+			return version, err
+		}
+
+		if event.Type == "ERROR" {
+			var status struct {
+				Code    int    `json:"code"`
+				Message string `json:"message"`
+			}
+			_ = json.Unmarshal(event.Object, &status)
+			if status.Code == http.StatusGone {
+				return version, errExpired
+			}
+			return version, fmt.Errorf("watch failed: %s", status.Message)
+		}
+
+		var object struct {
+			Metadata objectMeta `json:"metadata"`
+		}
+		if err := json.Unmarshal(event.Object, &object); err == nil && object.Metadata.ResourceVersion != "" {
+			version = object.Metadata.ResourceVersion
+		}
+		if event.Type != "BOOKMARK" {
+			handle(event)
+		}
+	}
+}
+
+// get sends an authenticated GET request to the API server.
+func (c *client) get(ctx context.Context, path string, query url.Values) (*http.Response, error) {
+	u := strings.TrimRight(c.server, "/") + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+
+	token := c.token
+	if c.tokenFile != "" {
+		// Projected service account tokens are rotated, read it every time
+		data, err := os.ReadFile(filepath.Clean(c.tokenFile))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read token: %w", err)
+		}
+		token = strings.TrimSpace(string(data))
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusGone {
+		_ = resp.Body.Close()
+		return nil, errExpired
+	}
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		_ = resp.Body.Close()
+		return nil, fmt.Errorf("unexpected status %s from the API server: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return resp, nil
+}
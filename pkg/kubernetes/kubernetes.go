@@ -0,0 +1,460 @@
+// Package kubernetes renders HAProxy backends for Kubernetes services, for
+// edge nodes sitting in front of a cluster.
+//
+// Services, and the EndpointSlices or Nodes serving them, are listed and
+// watched through the Kubernetes API. Every selected service port becomes
+// a backend, whose servers are either the ready nodes on the NodePort of
+// the service, or its ready endpoints.
+//
+// Author: zakaria.elbouwab
+package kubernetes
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Supported values of Config.Mode.
+const (
+	ModeNodePort  = "nodePort"
+	ModeEndpoints = "endpoints"
+)
+
+// Annotations of services read by hpxd.
+const (
+	// AnnotationBackend overrides the name of the backends of the service
+	AnnotationBackend = "hpxd.io/backend"
+	// AnnotationServerOptions overrides the options of the servers
+	AnnotationServerOptions = "hpxd.io/server-options"
+)
+
+// Config describes how to reach the Kubernetes API and which services to
+// render.
+type Config struct {
+	Enabled bool `mapstructure:"enabled"`
+	// APIServer is the URL of the API server. When empty, the in-cluster
+	// service account is used.
+	APIServer string `mapstructure:"apiServer"`
+	Token     string `mapstructure:"token"`
+	TokenFile string `mapstructure:"tokenFile"`
+	CAFile    string `mapstructure:"caFile"`
+
+	// Namespaces to watch, every namespace when empty
+	Namespaces    []string `mapstructure:"namespaces"`
+	LabelSelector string   `mapstructure:"labelSelector"`
+	Mode          string   `mapstructure:"mode"`
+	ServerOptions string   `mapstructure:"serverOptions"`
+}
+
+// resource is a kind of object watched through the API.
+type resource struct {
+	name       string
+	path       string
+	namespaced bool
+}
+
+var (
+	services       = resource{name: "services", path: "/api/v1", namespaced: true}
+	endpointSlices = resource{name: "endpointslices", path: "/apis/discovery.k8s.io/v1", namespaced: true}
+	nodes          = resource{name: "nodes", path: "/api/v1"}
+)
+
+// Server is a server of a generated backend.
+type Server struct {
+	Name    string
+	Address string
+	Port    int
+}
+
+// Backend is a backend generated from a service port.
+type Backend struct {
+	Name    string
+	Options string
+	Servers []Server
+}
+
+// Watcher keeps the watched objects up to date and renders backends from
+// them.
+type Watcher struct {
+	config Config
+	client *client
+	retry  time.Duration
+	cancel context.CancelFunc
+
+	changes chan struct{}
+
+	mu         sync.Mutex
+	objects    map[string]map[string]json.RawMessage
+	synced     map[string]bool
+	watches    int
+	generation uint64
+}
+
+// NewWatcher initializes a new Watcher and starts watching the API.
+func NewWatcher(config Config) (*Watcher, error) {
+	if config.Mode == "" {
+		config.Mode = ModeNodePort
+	}
+	c, err := newClient(config)
+	if err != nil {
+		return nil, err
+	}
+	return newWatcher(config, c, 5*time.Second), nil
+}
+
+func newWatcher(config Config, c *client, retry time.Duration) *Watcher {
+	ctx, cancel := context.WithCancel(context.Background())
+	w := &Watcher{
+		config:  config,
+		client:  c,
+		retry:   retry,
+		cancel:  cancel,
+		changes: make(chan struct{}, 1),
+		objects: make(map[string]map[string]json.RawMessage),
+		synced:  make(map[string]bool),
+	}
+
+	watched := []resource{services, endpointSlices}
+	if config.Mode == ModeNodePort {
+		watched = []resource{services, nodes}
+	}
+	namespaces := config.Namespaces
+	if len(namespaces) == 0 {
+		namespaces = []string{""}
+	}
+	for _, r := range watched {
+		w.objects[r.name] = make(map[string]json.RawMessage)
+		if !r.namespaced {
+			w.watches++
+			go w.run(ctx, r, "")
+			continue
+		}
+		for _, ns := range namespaces {
+			w.watches++
+			go w.run(ctx, r, ns)
+		}
+	}
+	return w
+}
+
+// Changes returns a channel receiving a value when a watched object
+// changes.
+func (w *Watcher) Changes() <-chan struct{} {
+	return w.changes
+}
+
+// Generation is incremented every time a watched object changes.
+func (w *Watcher) Generation() uint64 {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.generation
+}
+
+// Synced reports whether every watched resource was listed at least once.
+func (w *Watcher) Synced() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return len(w.synced) == w.watches
+}
+
+// WaitSynced waits until every watched resource was listed, for at most
+// timeout, and reports whether they were.
+func (w *Watcher) WaitSynced(timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for !w.Synced() {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return true
+}
+
+// Close stops watching the API.
+func (w *Watcher) Close() error {
+	w.cancel()
+	return nil
+}
+
+// run lists and watches a resource in a namespace until ctx is done.
+func (w *Watcher) run(ctx context.Context, r resource, namespace string) {
+	path := r.path
+	if namespace != "" {
+		path += "/namespaces/" + url.PathEscape(namespace)
+	}
+	path += "/" + r.name
+	query := url.Values{}
+	if r == services && w.config.LabelSelector != "" {
+		query.Set("labelSelector", w.config.LabelSelector)
+	}
+
+	version := ""
+	for ctx.Err() == nil {
+		var err error
+		if version == "" {
+			version, err = w.list(ctx, r, namespace, path, query)
+		}
+		if err == nil {
+			version, err = w.client.watch(ctx, path, query, version, func(event watchEvent) {
+				w.apply(r, event)
+			})
+		}
+		if err == nil || ctx.Err() != nil {
+			continue
+		}
+
+		if errors.Is(err, errExpired) {
+			logrus.Debugf("Watch of Kubernetes %s expired, listing them again", r.name)
+		} else {
+			logrus.Warnf("Failed to watch Kubernetes %s: %v", r.name, err)
+		}
+		version = ""
+		select {
+		case <-time.After(w.retry):
+		case <-ctx.Done():
+		}
+	}
+}
+
+// list replaces the objects of a resource in a namespace with those
+// currently in the API.
+func (w *Watcher) list(ctx context.Context, r resource, namespace, path string, query url.Values) (string, error) {
+	items, version, err := w.client.list(ctx, path, query)
+	if err != nil {
+		return "", err
+	}
+
+	w.mu.Lock()
+	objects := w.objects[r.name]
+	for key := range objects {
+		if namespace == "" || strings.HasPrefix(key, namespace+"/") {
+			delete(objects, key)
+		}
+	}
+	for _, item := range items {
+		objects[keyOf(item)] = item
+	}
+	w.synced[r.name+"/"+namespace] = true
+	w.mu.Unlock()
+
+	w.changed()
+	return version, nil
+}
+
+// apply applies a watch event to the objects of a resource.
+func (w *Watcher) apply(r resource, event watchEvent) {
+	w.mu.Lock()
+	switch event.Type {
+	case "ADDED", "MODIFIED":
+		w.objects[r.name][keyOf(event.Object)] = event.Object
+	case "DELETED":
+		delete(w.objects[r.name], keyOf(event.Object))
+	}
+	w.mu.Unlock()
+
+	w.changed()
+}
+
+func (w *Watcher) changed() {
+	w.mu.Lock()
+	w.generation++
+	w.mu.Unlock()
+
+	select {
+	case w.changes <- struct{}{}:
+	default:
+	}
+}
+
+// keyOf returns the `namespace/name` key of an object.
+func keyOf(raw json.RawMessage) string {
+	var object struct {
+		Metadata objectMeta `json:"metadata"`
+	}
+	_ = json.Unmarshal(raw, &object)
+	return object.Metadata.Namespace + "/" + object.Metadata.Name
+}
+
+// decodeAll decodes every object of a resource into out, a pointer to a
+// slice, sorted by key.
+func (w *Watcher) decodeAll(r resource, out interface{}) error {
+	w.mu.Lock()
+	objects := w.objects[r.name]
+	keys := make([]string, 0, len(objects))
+	for key := range objects {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	raws := make([]json.RawMessage, 0, len(keys))
+	for _, key := range keys {
+		raws = append(raws, objects[key])
+	}
+	w.mu.Unlock()
+
+	data, err := json.Marshal(raws)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, out)
+}
+
+// Backends returns the backends generated from the watched services.
+func (w *Watcher) Backends() ([]Backend, error) {
+	var svcs []service
+	if err := w.decodeAll(services, &svcs); err != nil {
+		return nil, err
+	}
+
+	var backends []Backend
+	if w.config.Mode == ModeEndpoints {
+		var slices []endpointSlice
+		if err := w.decodeAll(endpointSlices, &slices); err != nil {
+			return nil, err
+		}
+		for _, svc := range svcs {
+			backends = append(backends, w.endpointBackends(svc, slices)...)
+		}
+		return backends, nil
+	}
+
+	var ns []node
+	if err := w.decodeAll(nodes, &ns); err != nil {
+		return nil, err
+	}
+	for _, svc := range svcs {
+		backends = append(backends, w.nodePortBackends(svc, ns)...)
+	}
+	return backends, nil
+}
+
+// nodePortBackends returns a backend for every NodePort of svc, served by
+// the ready nodes.
+func (w *Watcher) nodePortBackends(svc service, ns []node) []Backend {
+	var backends []Backend
+	for _, port := range svc.Spec.Ports {
+		if port.NodePort == 0 || (port.Protocol != "" && port.Protocol != "TCP") {
+			continue
+		}
+		backend := w.backendFor(svc, port)
+		for _, n := range ns {
+			if address := n.address(); n.ready() && address != "" {
+				backend.Servers = append(backend.Servers, Server{Name: n.Metadata.Name, Address: address, Port: port.NodePort})
+			}
+		}
+		backends = append(backends, backend)
+	}
+	return backends
+}
+
+// endpointBackends returns a backend for every port of svc, served by the
+// ready endpoints of its EndpointSlices.
+func (w *Watcher) endpointBackends(svc service, slices []endpointSlice) []Backend {
+	var backends []Backend
+	for _, port := range svc.Spec.Ports {
+		if port.Protocol != "" && port.Protocol != "TCP" {
+			continue
+		}
+		backend := w.backendFor(svc, port)
+		seen := make(map[string]bool)
+		for _, slice := range slices {
+			if slice.Metadata.Namespace != svc.Metadata.Namespace || slice.Metadata.Labels["kubernetes.io/service-name"] != svc.Metadata.Name {
+				continue
+			}
+			target := 0
+			for _, p := range slice.Ports {
+				name := ""
+				if p.Name != nil {
+					name = *p.Name
+				}
+				if name == port.Name && p.Port != nil {
+					target = *p.Port
+				}
+			}
+			if target == 0 {
+				continue
+			}
+			for _, e := range slice.Endpoints {
+				if e.Conditions.Ready != nil && !*e.Conditions.Ready {
+					continue
+				}
+				for _, address := range e.Addresses {
+					s := Server{Address: address, Port: target}
+					s.Name = serverName(s)
+					if !seen[s.Name] {
+						seen[s.Name] = true
+						backend.Servers = append(backend.Servers, s)
+					}
+				}
+			}
+		}
+		sort.Slice(backend.Servers, func(i, j int) bool { return backend.Servers[i].Name < backend.Servers[j].Name })
+		backends = append(backends, backend)
+	}
+	return backends
+}
+
+// backendFor returns the empty backend of a service port.
+func (w *Watcher) backendFor(svc service, port servicePort) Backend {
+	portName := port.Name
+	if portName == "" {
+		portName = strconv.Itoa(port.Port)
+	}
+
+	name := fmt.Sprintf("k8s-%s-%s-%s", svc.Metadata.Namespace, svc.Metadata.Name, portName)
+	if custom := svc.Metadata.Annotations[AnnotationBackend]; custom != "" {
+		name = custom
+		if len(svc.Spec.Ports) > 1 {
+			name += "-" + portName
+		}
+	}
+
+	options := w.config.ServerOptions
+	if custom, ok := svc.Metadata.Annotations[AnnotationServerOptions]; ok {
+		options = custom
+	}
+	return Backend{Name: name, Options: options}
+}
+
+// serverName returns the name of an endpoint server.
+func serverName(s Server) string {
+	name := strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' {
+			return r
+		}
+		return '_'
+	}, s.Address)
+	return fmt.Sprintf("%s-%d", name, s.Port)
+}
+
+// Render returns the backend sections of backends, leaving out those whose
+// name is in skip.
+func Render(backends []Backend, skip map[string]bool) []byte {
+	var out bytes.Buffer
+	out.WriteString("\n# Backends generated from Kubernetes services by hpxd\n")
+	for _, b := range backends {
+		if skip[b.Name] {
+			continue
+		}
+		fmt.Fprintf(&out, "backend %s\n", b.Name)
+		for _, s := range b.Servers {
+			endpoint := s.Address + ":" + strconv.Itoa(s.Port)
+			if strings.Contains(s.Address, ":") {
+				endpoint = "[" + s.Address + "]:" + strconv.Itoa(s.Port)
+			}
+			fmt.Fprintf(&out, "    %s\n", strings.TrimSpace(fmt.Sprintf("server %s %s %s", s.Name, endpoint, b.Options)))
+		}
+	}
+	return out.Bytes()
+}
@@ -0,0 +1,179 @@
+package kubernetes
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeAPIServer serves lists of objects by path, and streams the events
+// sent to it to watches.
+type fakeAPIServer struct {
+	mu     sync.Mutex
+	lists  map[string][]string
+	events map[string]chan string
+	// queries records the queries of list requests, by path
+	queries map[string]string
+}
+
+func newFakeAPIServer(t *testing.T, lists map[string][]string) (*fakeAPIServer, *httptest.Server) {
+	f := &fakeAPIServer{lists: lists, events: make(map[string]chan string), queries: make(map[string]string)}
+	for path := range lists {
+		f.events[path] = make(chan string, 10)
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		f.mu.Lock()
+		items, ok := f.lists[r.URL.Path]
+		events := f.events[r.URL.Path]
+		if r.URL.Query().Get("watch") == "" {
+			f.queries[r.URL.Path] = r.URL.RawQuery
+		}
+		f.mu.Unlock()
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		if r.URL.Query().Get("watch") != "true" {
+			fmt.Fprintf(w, `{"metadata":{"resourceVersion":"1"},"items":[%s]}`, strings.Join(items, ","))
+			return
+		}
+		w.(http.Flusher).Flush()
+		for {
+			select {
+			case event := <-events:
+				fmt.Fprintln(w, event)
+				w.(http.Flusher).Flush()
+			case <-r.Context().Done():
+				return
+			}
+		}
+	}))
+	t.Cleanup(server.Close)
+	return f, server
+}
+
+func testWatcher(t *testing.T, config Config, server *httptest.Server) *Watcher {
+	config.APIServer = server.URL
+	config.Token = "token"
+	c, err := newClient(config)
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	w := newWatcher(config, c, 10*time.Millisecond)
+	t.Cleanup(func() { _ = w.Close() })
+
+	if !w.WaitSynced(5 * time.Second) {
+		t.Fatalf("Expected the watcher to sync")
+	}
+	return w
+}
+
+func nodeJSON(name, address, ready string) string {
+	return fmt.Sprintf(`{"metadata":{"name":%q,"resourceVersion":"2"},"status":{"addresses":[{"type":"InternalIP","address":%q}],"conditions":[{"type":"Ready","status":%q}]}}`,
+		name, address, ready)
+}
+
+const webService = `{"metadata":{"name":"web","namespace":"default"},"spec":{"type":"NodePort","ports":[{"name":"http","protocol":"TCP","port":80,"nodePort":30080}]}}`
+
+func TestWatcher_NodePort(t *testing.T) {
+	api, server := newFakeAPIServer(t, map[string][]string{
+		"/api/v1/namespaces/default/services": {webService},
+		"/api/v1/nodes": {
+			nodeJSON("node-1", "10.0.0.1", "True"),
+			nodeJSON("node-2", "10.0.0.2", "False"),
+		},
+	})
+	w := testWatcher(t, Config{Namespaces: []string{"default"}, Mode: ModeNodePort, LabelSelector: "hpxd.io/expose=true", ServerOptions: "check"}, server)
+
+	backends, err := w.Backends()
+	if err != nil {
+		t.Fatalf("Failed to get backends: %v", err)
+	}
+	if len(backends) != 1 || backends[0].Name != "k8s-default-web-http" || len(backends[0].Servers) != 1 {
+		t.Fatalf("Expected one backend served by the ready node, but got: %+v", backends)
+	}
+	if s := backends[0].Servers[0]; s.Name != "node-1" || s.Address != "10.0.0.1" || s.Port != 30080 {
+		t.Errorf("Unexpected server: %+v", s)
+	}
+	if !strings.Contains(api.queries["/api/v1/namespaces/default/services"], "labelSelector=hpxd.io%2Fexpose%3Dtrue") {
+		t.Errorf("Expected services to be selected by label, but got query: %s", api.queries["/api/v1/namespaces/default/services"])
+	}
+
+	// Drain the changes signalled by the initial lists
+	select {
+	case <-w.Changes():
+	default:
+	}
+	generation := w.Generation()
+	api.events["/api/v1/nodes"] <- fmt.Sprintf(`{"type":"MODIFIED","object":%s}`, nodeJSON("node-2", "10.0.0.2", "True"))
+	select {
+	case <-w.Changes():
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Expected the watch to signal the change")
+	}
+	if w.Generation() == generation {
+		t.Errorf("Expected the generation to change")
+	}
+
+	backends, _ = w.Backends()
+	if len(backends) != 1 || len(backends[0].Servers) != 2 {
+		t.Errorf("Expected the node that became ready to serve the backend, but got: %+v", backends)
+	}
+}
+
+func TestWatcher_Endpoints(t *testing.T) {
+	_, server := newFakeAPIServer(t, map[string][]string{
+		"/api/v1/services": {
+			`{"metadata":{"name":"api","namespace":"shop","annotations":{"hpxd.io/backend":"shop-api","hpxd.io/server-options":"check inter 1s"}},"spec":{"type":"ClusterIP","ports":[{"name":"http","port":80}]}}`,
+		},
+		"/apis/discovery.k8s.io/v1/endpointslices": {
+			`{"metadata":{"name":"api-abc","namespace":"shop","labels":{"kubernetes.io/service-name":"api"}},"ports":[{"name":"http","port":8080}],"endpoints":[{"addresses":["10.1.0.2"],"conditions":{"ready":true}},{"addresses":["10.1.0.3"],"conditions":{"ready":false}}]}`,
+			`{"metadata":{"name":"api-def","namespace":"shop","labels":{"kubernetes.io/service-name":"api"}},"ports":[{"name":"http","port":8080}],"endpoints":[{"addresses":["10.1.0.1"]}]}`,
+			`{"metadata":{"name":"other","namespace":"shop","labels":{"kubernetes.io/service-name":"other"}},"ports":[{"name":"http","port":9090}],"endpoints":[{"addresses":["10.1.0.9"]}]}`,
+		},
+	})
+	w := testWatcher(t, Config{Mode: ModeEndpoints}, server)
+
+	backends, err := w.Backends()
+	if err != nil {
+		t.Fatalf("Failed to get backends: %v", err)
+	}
+	expected := "\n# Backends generated from Kubernetes services by hpxd\n" +
+		"backend shop-api\n" +
+		"    server 10_1_0_1-8080 10.1.0.1:8080 check inter 1s\n" +
+		"    server 10_1_0_2-8080 10.1.0.2:8080 check inter 1s\n"
+	if got := string(Render(backends, nil)); got != expected {
+		t.Errorf("Expected rendered backends:\n%s\nbut got:\n%s", expected, got)
+	}
+
+	if got := string(Render(backends, map[string]bool{"shop-api": true})); strings.Contains(got, "backend shop-api") {
+		t.Errorf("Expected skipped backends not to be rendered, but got:\n%s", got)
+	}
+}
+
+func TestClient_WatchExpired(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(watchEvent{Type: "ERROR", Object: json.RawMessage(`{"code":410,"message":"too old resource version"}`)})
+	}))
+	defer server.Close()
+
+	c, err := newClient(Config{APIServer: server.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.watch(context.Background(), "/api/v1/nodes", nil, "1", func(watchEvent) {}); err != errExpired {
+		t.Errorf("Expected an expired watch, but got: %v", err)
+	}
+}
@@ -0,0 +1,126 @@
+package kvsource
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// consulWait is how long a blocking query waits for a change.
+const consulWait = 5 * time.Minute
+
+// ConsulConfig describes how to reach Consul KV.
+type ConsulConfig struct {
+	Address    string `mapstructure:"address"`
+	Token      string `mapstructure:"token"`
+	Datacenter string `mapstructure:"datacenter"`
+}
+
+// Consul is a Store backed by Consul KV, watched with blocking queries.
+type Consul struct {
+	config ConsulConfig
+	client *http.Client
+}
+
+// NewConsul initializes and returns a new Consul store.
+func NewConsul(config ConsulConfig) *Consul {
+	if config.Address == "" {
+		config.Address = "http://127.0.0.1:8500"
+	}
+	return &Consul{
+		config: config,
+		// Blocking queries may take up to consulWait, plus the jitter
+		// Consul adds to it
+		client: &http.Client{Timeout: consulWait + time.Minute},
+	}
+}
+
+// Name identifies the store in logs.
+func (c *Consul) Name() string {
+	return "consul"
+}
+
+type consulPair struct {
+	Key   string `json:"Key"`
+	Value []byte `json:"Value"`
+}
+
+// List returns every key below prefix.
+func (c *Consul) List(ctx context.Context, prefix string) (map[string][]byte, uint64, error) {
+	return c.get(ctx, prefix, 0)
+}
+
+// Watch runs a blocking query until the index of the prefix moves past
+// revision.
+func (c *Consul) Watch(ctx context.Context, prefix string, revision uint64) (uint64, error) {
+	for {
+		_, index, err := c.get(ctx, prefix, revision)
+		if err != nil {
+			return revision, err
+		}
+		// The query also returns when the wait time elapses, with the same
+		// index. Consul may also reset the index, which counts as a change.
+		if index != revision {
+			return index, nil
+		}
+	}
+}
+
+// get reads the prefix, blocking until its index moves past index when it's
+// not 0.
+func (c *Consul) get(ctx context.Context, prefix string, index uint64) (map[string][]byte, uint64, error) {
+	query := url.Values{"recurse": {"true"}}
+	if c.config.Datacenter != "" {
+		query.Set("dc", c.config.Datacenter)
+	}
+	if index > 0 {
+		query.Set("index", strconv.FormatUint(index, 10))
+		query.Set("wait", consulWait.String())
+	}
+
+	u := strings.TrimRight(c.config.Address, "/") + "/v1/kv/" + prefix + "?" + query.Encode()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	if c.config.Token != "" {
+		req.Header.Set("X-Consul-Token", c.config.Token)
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	newIndex, _ := strconv.ParseUint(resp.Header.Get("X-Consul-Index"), 10, 64)
+	switch resp.StatusCode {
+	case http.StatusNotFound:
+		// No key below the prefix
+		return map[string][]byte{}, newIndex, nil
+	case http.StatusOK:
+	default:
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, 0, fmt.Errorf("unexpected status %s from consul: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+
+	var pairs []consulPair
+	if err := json.NewDecoder(resp.Body).Decode(&pairs); err != nil {
+		return nil, 0, fmt.Errorf("failed to decode consul response: %w", err)
+	}
+
+	kvs := make(map[string][]byte, len(pairs))
+	for _, p := range pairs {
+		// Keys ending with a slash are folders
+		if !strings.HasSuffix(p.Key, "/") {
+			kvs[p.Key] = p.Value
+		}
+	}
+	return kvs, newIndex, nil
+}
@@ -0,0 +1,224 @@
+package kvsource
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// EtcdConfig describes how to reach etcd through its JSON gateway.
+type EtcdConfig struct {
+	Endpoint string `mapstructure:"endpoint"`
+	Username string `mapstructure:"username"`
+	Password string `mapstructure:"password"`
+}
+
+// Etcd is a Store backed by etcd v3, read and watched through the
+// grpc-gateway JSON API.
+type Etcd struct {
+	config EtcdConfig
+	client *http.Client
+}
+
+// NewEtcd initializes and returns a new Etcd store.
+func NewEtcd(config EtcdConfig) *Etcd {
+	if config.Endpoint == "" {
+		config.Endpoint = "http://127.0.0.1:2379"
+	}
+	return &Etcd{config: config, client: &http.Client{}}
+}
+
+// Name identifies the store in logs.
+func (e *Etcd) Name() string {
+	return "etcd"
+}
+
+type etcdHeader struct {
+	Revision string `json:"revision"`
+}
+
+type etcdKV struct {
+	Key   []byte `json:"key"`
+	Value []byte `json:"value"`
+}
+
+type etcdRangeResponse struct {
+	Header etcdHeader `json:"header"`
+	KVs    []etcdKV   `json:"kvs"`
+}
+
+type etcdWatchResponse struct {
+	Result *struct {
+		Header   etcdHeader        `json:"header"`
+		Created  bool              `json:"created"`
+		Canceled bool              `json:"canceled"`
+		Events   []json.RawMessage `json:"events"`
+	} `json:"result"`
+	Error *struct {
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+// List returns every key below prefix.
+func (e *Etcd) List(ctx context.Context, prefix string) (map[string][]byte, uint64, error) {
+	var resp etcdRangeResponse
+	err := e.call(ctx, "/v3/kv/range", map[string][]byte{
+		"key":       []byte(prefix),
+		"range_end": prefixEnd(prefix),
+	}, &resp)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	kvs := make(map[string][]byte, len(resp.KVs))
+	for _, kv := range resp.KVs {
+		kvs[string(kv.Key)] = kv.Value
+	}
+	revision, _ := strconv.ParseUint(resp.Header.Revision, 10, 64)
+	return kvs, revision, nil
+}
+
+// Watch streams the changes below prefix after revision, and returns the
+// revision of the first one.
+func (e *Etcd) Watch(ctx context.Context, prefix string, revision uint64) (uint64, error) {
+	if revision == 0 {
+		// Nothing listed yet, start from the current revision
+		_, current, err := e.List(ctx, prefix)
+		return current, err
+	}
+
+	body, err := json.Marshal(map[string]interface{}{
+		"create_request": map[string]interface{}{
+			"key":            []byte(prefix),
+			"range_end":      prefixEnd(prefix),
+			"start_revision": strconv.FormatUint(revision+1, 10),
+		},
+	})
+	if err != nil {
+		return revision, err
+	}
+	resp, err := e.post(ctx, "/v3/watch", body)
+	if err != nil {
+		return revision, err
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	decoder := json.NewDecoder(resp.Body)
+	for {
+		var msg etcdWatchResponse
+		if err := decoder.Decode(&msg); err != nil {
+			if errors.Is(err, io.EOF) {
+				return revision, errors.New("etcd watch stream closed")
+			}
+			return revision, err
+		}
+		if msg.Error != nil {
+			return revision, errors.New(msg.Error.Message)
+		}
+		if msg.Result == nil {
+			continue
+		}
+		if msg.Result.Canceled {
+			return revision, errors.New("etcd watch canceled")
+		}
+		if len(msg.Result.Events) > 0 {
+			return strconv.ParseUint(msg.Result.Header.Revision, 10, 64)
+		}
+	}
+}
+
+// call posts a JSON request and decodes the JSON response into out.
+func (e *Etcd) call(ctx context.Context, path string, in interface{}, out interface{}) error {
+	body, err := json.Marshal(in)
+	if err != nil {
+		return err
+	}
+	resp, err := e.post(ctx, path, body)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// post sends a request to the gateway, authenticating first if credentials
+// are configured.
+func (e *Etcd) post(ctx context.Context, path string, body []byte) (*http.Response, error) {
+	token := ""
+	if e.config.Username != "" {
+		var err error
+		if token, err = e.authenticate(ctx); err != nil {
+			return nil, fmt.Errorf("failed to authenticate to etcd: %w", err)
+		}
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimRight(e.config.Endpoint, "/")+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("Authorization", token)
+	}
+
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		_ = resp.Body.Close()
+		return nil, fmt.Errorf("unexpected status %s from etcd: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return resp, nil
+}
+
+// authenticate exchanges the configured credentials for a token.
+func (e *Etcd) authenticate(ctx context.Context) (string, error) {
+	body, err := json.Marshal(map[string]string{"name": e.config.Username, "password": e.config.Password})
+	if err != nil {
+		return "", err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimRight(e.config.Endpoint, "/")+"/v3/auth/authenticate", bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	var out struct {
+		Token string `json:"token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		return "", err
+	}
+	return out.Token, nil
+}
+
+// prefixEnd returns the range end matching every key starting with prefix.
+func prefixEnd(prefix string) []byte {
+	end := []byte(prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return end[:i+1]
+		}
+	}
+	// Every byte is 0xff, or the prefix is empty: the whole keyspace
+	return []byte{0}
+}
@@ -0,0 +1,247 @@
+// Package kvsource provides configuration sources backed by key/value
+// stores, such as Consul KV and etcd.
+//
+// Every key below a prefix is materialized as a file in a staging
+// directory, at its path relative to the prefix. Alternatively, the HAProxy
+// configuration can be assembled from fragments: every key below
+// `<prefix>/<path>/` is concatenated, in key order, into the configuration.
+// Stores are watched, so changes are picked up as soon as they're written.
+//
+// Author: zakaria.elbouwab
+package kvsource
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// watchRetryDelay is how long to wait before watching again after an error.
+const watchRetryDelay = 5 * time.Second
+
+// Store is a key/value store holding HAProxy configurations.
+type Store interface {
+	// Name identifies the store in logs.
+	Name() string
+	// List returns every key below prefix along with its value, and the
+	// revision of the store at the time of the listing.
+	List(ctx context.Context, prefix string) (map[string][]byte, uint64, error)
+	// Watch blocks until a key below prefix changes after revision, and
+	// returns the new revision.
+	Watch(ctx context.Context, prefix string, revision uint64) (uint64, error)
+}
+
+// Handler materializes the keys of a Store below a prefix.
+type Handler struct {
+	store     Store
+	prefix    string
+	path      string
+	assemble  bool
+	localPath string
+
+	changes chan struct{}
+	cancel  context.CancelFunc
+
+	mu       sync.Mutex
+	revision uint64
+	checksum string
+}
+
+// NewHandler initializes and returns a new Handler, and starts watching the
+// store. path is the location of the HAProxy configuration relative to
+// prefix. With assemble, it's the key directory holding the fragments the
+// configuration is assembled from.
+func NewHandler(store Store, prefix, path string, assemble bool) *Handler {
+	prefix = strings.TrimPrefix(prefix, "/")
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	h := &Handler{
+		store:     store,
+		prefix:    prefix,
+		path:      strings.Trim(path, "/"),
+		assemble:  assemble,
+		localPath: filepath.Join(os.TempDir(), "hpxd-"+store.Name()+"-source"),
+		changes:   make(chan struct{}, 1),
+		cancel:    cancel,
+	}
+	go h.watch(ctx)
+	return h
+}
+
+// PullAndUpdate lists the keys below the prefix and materializes them if
+// their content changed since the previous call. This function returns the
+// path to the HAProxy configuration and a flag indicating if any key
+// changed.
+func (h *Handler) PullAndUpdate(ctx context.Context) (string, bool, error) {
+	kvs, revision, err := h.store.List(ctx, h.prefix)
+	if err != nil {
+		return "", false, err
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.revision = revision
+
+	checksum := checksumOf(kvs)
+	if checksum == h.checksum {
+		return "", false, nil
+	}
+	if err := h.materialize(kvs); err != nil {
+		return "", false, err
+	}
+	h.checksum = checksum
+
+	return filepath.Join(h.localPath, h.configFile()), true, nil
+}
+
+// RepoPath returns the staging directory.
+func (h *Handler) RepoPath() string {
+	return h.localPath
+}
+
+// Revision returns a checksum of the keys last materialized.
+func (h *Handler) Revision() string {
+	return h.checksum
+}
+
+// SetLocalPath changes where the keys are materialized, so several handlers
+// can be used side by side.
+func (h *Handler) SetLocalPath(path string) {
+	h.localPath = path
+}
+
+// Changes returns a channel receiving a value every time the store reports
+// a change below the prefix.
+func (h *Handler) Changes() <-chan struct{} {
+	return h.changes
+}
+
+// Close stops watching the store.
+func (h *Handler) Close() error {
+	h.cancel()
+	return nil
+}
+
+// configFile returns the path of the configuration in the staging directory.
+func (h *Handler) configFile() string {
+	if h.assemble {
+		return h.path + ".cfg"
+	}
+	return h.path
+}
+
+// materialize replaces the staging directory with the given keys.
+func (h *Handler) materialize(kvs map[string][]byte) error {
+	next := h.localPath + ".new"
+	if err := os.RemoveAll(next); err != nil {
+		return err
+	}
+
+	keys := sortedKeys(kvs)
+	var fragments []byte
+	for _, key := range keys {
+		rel := strings.TrimPrefix(key, h.prefix)
+		if h.assemble && strings.HasPrefix(rel, h.path+"/") {
+			fragments = append(fragments, kvs[key]...)
+			if len(kvs[key]) > 0 && kvs[key][len(kvs[key])-1] != '\n' {
+				fragments = append(fragments, '\n')
+			}
+			continue
+		}
+		if err := writeFile(filepath.Join(next, filepath.Clean("/"+rel)), kvs[key]); err != nil {
+			return err
+		}
+	}
+	if h.assemble {
+		if len(fragments) == 0 {
+			return errors.New("no configuration fragment found below " + h.prefix + h.path + "/")
+		}
+		if err := writeFile(filepath.Join(next, h.configFile()), fragments); err != nil {
+			return err
+		}
+	}
+	if err := os.MkdirAll(next, 0750); err != nil {
+		return err
+	}
+
+	if err := os.RemoveAll(h.localPath); err != nil {
+		return err
+	}
+	return os.Rename(next, h.localPath)
+}
+
+// watch signals a change every time the store reports one, until ctx is
+// cancelled.
+func (h *Handler) watch(ctx context.Context) {
+	for {
+		h.mu.Lock()
+		revision := h.revision
+		h.mu.Unlock()
+
+		next, err := h.store.Watch(ctx, h.prefix, revision)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			logrus.Warnf("Failed to watch %s prefix %q: %v", h.store.Name(), h.prefix, err)
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(watchRetryDelay):
+			}
+			continue
+		}
+
+		h.mu.Lock()
+		changed := next != h.revision
+		h.revision = next
+		h.mu.Unlock()
+
+		if changed {
+			select {
+			case h.changes <- struct{}{}:
+			default:
+			}
+		}
+	}
+}
+
+func writeFile(path string, content []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0750); err != nil {
+		return err
+	}
+	return os.WriteFile(path, content, 0600)
+}
+
+func sortedKeys(kvs map[string][]byte) []string {
+	keys := make([]string, 0, len(kvs))
+	for k := range kvs {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// checksumOf returns a hash of the keys and their values.
+func checksumOf(kvs map[string][]byte) string {
+	sum := sha256.New()
+	for _, k := range sortedKeys(kvs) {
+		sum.Write([]byte(k))
+		sum.Write([]byte{0})
+		sum.Write(kvs[k])
+		sum.Write([]byte{0})
+	}
+	return hex.EncodeToString(sum.Sum(nil))
+}
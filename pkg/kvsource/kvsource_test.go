@@ -0,0 +1,197 @@
+package kvsource
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeKV is an in-memory key/value store shared by the fake servers.
+type fakeKV struct {
+	mu       sync.Mutex
+	kvs      map[string]string
+	revision uint64
+	changed  chan struct{}
+}
+
+func newFakeKV() *fakeKV {
+	return &fakeKV{kvs: map[string]string{}, revision: 1, changed: make(chan struct{})}
+}
+
+func (f *fakeKV) put(key, value string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.kvs[key] = value
+	f.revision++
+	close(f.changed)
+	f.changed = make(chan struct{})
+}
+
+func (f *fakeKV) snapshot(prefix string) (map[string]string, uint64, chan struct{}) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	out := map[string]string{}
+	for k, v := range f.kvs {
+		if strings.HasPrefix(k, prefix) {
+			out[k] = v
+		}
+	}
+	return out, f.revision, f.changed
+}
+
+// consulServer serves the Consul KV API, with blocking queries.
+func consulServer(t *testing.T, kv *fakeKV) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Consul-Token") != "token" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		prefix := strings.TrimPrefix(r.URL.Path, "/v1/kv/")
+		kvs, revision, changed := kv.snapshot(prefix)
+		if index, _ := strconv.ParseUint(r.URL.Query().Get("index"), 10, 64); index == revision {
+			select {
+			case <-changed:
+			case <-time.After(2 * time.Second):
+			}
+			kvs, revision, _ = kv.snapshot(prefix)
+		}
+
+		w.Header().Set("X-Consul-Index", strconv.FormatUint(revision, 10))
+		var pairs []consulPair
+		for k, v := range kvs {
+			pairs = append(pairs, consulPair{Key: k, Value: []byte(v)})
+		}
+		_ = json.NewEncoder(w).Encode(pairs)
+	}))
+}
+
+// etcdServer serves the etcd v3 JSON gateway range and watch APIs.
+func etcdServer(t *testing.T, kv *fakeKV) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v3/kv/range":
+			var req struct {
+				Key []byte `json:"key"`
+			}
+			_ = json.NewDecoder(r.Body).Decode(&req)
+			kvs, revision, _ := kv.snapshot(string(req.Key))
+			resp := etcdRangeResponse{Header: etcdHeader{Revision: strconv.FormatUint(revision, 10)}}
+			for k, v := range kvs {
+				resp.KVs = append(resp.KVs, etcdKV{Key: []byte(k), Value: []byte(v)})
+			}
+			_ = json.NewEncoder(w).Encode(resp)
+		case "/v3/watch":
+			_, revision, changed := kv.snapshot("")
+			fmt.Fprintf(w, `{"result":{"header":{"revision":"%d"},"created":true}}`+"\n", revision)
+			w.(http.Flusher).Flush()
+			select {
+			case <-changed:
+			case <-r.Context().Done():
+				return
+			}
+			_, revision, _ = kv.snapshot("")
+			fmt.Fprintf(w, `{"result":{"header":{"revision":"%d"},"events":[{"type":"PUT"}]}}`+"\n", revision)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+}
+
+func testStore(t *testing.T, store Store, kv *fakeKV) {
+	kv.put("haproxy/edge/haproxy.cfg", "global\n")
+	kv.put("haproxy/edge/maps/hosts.map", "a b\n")
+	kv.put("haproxy/internal/haproxy.cfg", "other\n")
+
+	h := NewHandler(store, "haproxy/edge", "haproxy.cfg", false)
+	h.localPath = filepath.Join(t.TempDir(), "staging")
+	defer func() { _ = h.Close() }()
+
+	configPath, updated, err := h.PullAndUpdate(context.Background())
+	if err != nil || !updated {
+		t.Fatalf("Expected first pull to update, but got: %v, %v", updated, err)
+	}
+	if data, _ := os.ReadFile(configPath); string(data) != "global\n" {
+		t.Errorf("Expected materialized config, but got: %q", data)
+	}
+	if _, err := os.Stat(filepath.Join(h.RepoPath(), "maps", "hosts.map")); err != nil {
+		t.Errorf("Expected map to be materialized: %v", err)
+	}
+	if _, updated, err := h.PullAndUpdate(context.Background()); err != nil || updated {
+		t.Errorf("Expected unchanged keys not to update, but got: %v, %v", updated, err)
+	}
+
+	// Drain the change signalled when the watch starts
+	select {
+	case <-h.Changes():
+	case <-time.After(100 * time.Millisecond):
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	kv.put("haproxy/edge/haproxy.cfg", "global\n    daemon\n")
+	select {
+	case <-h.Changes():
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Expected the watch to signal the change")
+	}
+	if _, updated, err := h.PullAndUpdate(context.Background()); err != nil || !updated {
+		t.Errorf("Expected changed keys to update, but got: %v, %v", updated, err)
+	}
+}
+
+func TestConsul(t *testing.T) {
+	kv := newFakeKV()
+	server := consulServer(t, kv)
+	defer server.Close()
+
+	testStore(t, NewConsul(ConsulConfig{Address: server.URL, Token: "token"}), kv)
+}
+
+func TestEtcd(t *testing.T) {
+	kv := newFakeKV()
+	server := etcdServer(t, kv)
+	defer server.Close()
+
+	testStore(t, NewEtcd(EtcdConfig{Endpoint: server.URL}), kv)
+}
+
+func TestHandler_Assemble(t *testing.T) {
+	kv := newFakeKV()
+	server := consulServer(t, kv)
+	defer server.Close()
+
+	kv.put("lb/fragments/20-backends", "backend api\n    server a 10.0.0.1:80")
+	kv.put("lb/fragments/00-global", "global\n")
+	kv.put("lb/fragments/10-frontends", "frontend http-in\n")
+	kv.put("lb/maps/hosts.map", "a b\n")
+
+	h := NewHandler(NewConsul(ConsulConfig{Address: server.URL, Token: "token"}), "lb", "fragments", true)
+	h.localPath = filepath.Join(t.TempDir(), "staging")
+	defer func() { _ = h.Close() }()
+
+	configPath, updated, err := h.PullAndUpdate(context.Background())
+	if err != nil || !updated {
+		t.Fatalf("Expected first pull to update, but got: %v, %v", updated, err)
+	}
+	expected := "global\nfrontend http-in\nbackend api\n    server a 10.0.0.1:80\n"
+	if data, _ := os.ReadFile(configPath); string(data) != expected {
+		t.Errorf("Expected assembled config %q, but got %q", expected, data)
+	}
+	if _, err := os.Stat(filepath.Join(h.RepoPath(), "maps", "hosts.map")); err != nil {
+		t.Errorf("Expected map to be materialized: %v", err)
+	}
+}
+
+func TestPrefixEnd(t *testing.T) {
+	if got := string(prefixEnd("haproxy/")); got != "haproxy0" {
+		t.Errorf("Expected range end haproxy0, but got %q", got)
+	}
+}
@@ -0,0 +1,153 @@
+// Package local provides a configuration source backed by a local directory.
+//
+// It's meant for development and for nodes fed by a configuration
+// management tool rather than git. The directory is watched with fsnotify,
+// so changes are picked up as soon as they're written.
+//
+// Author: zakaria.elbouwab
+package local
+
+import (
+	"context"
+	"io/fs"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/sirupsen/logrus"
+	"github.com/zcubbs/hpxd/pkg/files"
+)
+
+// Handler watches a local directory holding the HAProxy configuration.
+//
+// Filesystem events are debounced: editors and configuration management
+// tools often write a file several times in a row, and all of those writes
+// only trigger one change.
+type Handler struct {
+	dir      string
+	path     string
+	debounce time.Duration
+
+	watcher *fsnotify.Watcher
+	changes chan struct{}
+
+	mu      sync.Mutex
+	changed bool
+}
+
+// NewHandler initializes and returns a new Handler watching dir. path is
+// the location of the HAProxy configuration relative to dir.
+func NewHandler(dir, path string, debounce time.Duration) (*Handler, error) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+
+	h := &Handler{
+		dir:      dir,
+		path:     path,
+		debounce: debounce,
+		watcher:  watcher,
+		changes:  make(chan struct{}, 1),
+		// The first call to PullAndUpdate always reports a change, so the
+		// current content gets applied at startup
+		changed: true,
+	}
+	if err := h.watchTree(dir); err != nil {
+		_ = watcher.Close()
+		return nil, err
+	}
+
+	go h.run()
+	return h, nil
+}
+
+// PullAndUpdate returns the path to the HAProxy configuration and a flag
+// indicating if the directory changed since the previous call.
+func (h *Handler) PullAndUpdate(_ context.Context) (string, bool, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	changed := h.changed
+	h.changed = false
+	return filepath.Join(h.dir, h.path), changed, nil
+}
+
+// RepoPath returns the watched directory.
+func (h *Handler) RepoPath() string {
+	return h.dir
+}
+
+// Revision returns a checksum of the watched directory.
+func (h *Handler) Revision() string {
+	checksum, err := files.Checksum(h.dir)
+	if err != nil {
+		return ""
+	}
+	return checksum
+}
+
+// Changes returns a channel receiving a value after each debounced change,
+// so callers can apply it right away instead of waiting for the next poll.
+func (h *Handler) Changes() <-chan struct{} {
+	return h.changes
+}
+
+// Close stops watching the directory.
+func (h *Handler) Close() error {
+	return h.watcher.Close()
+}
+
+// run consumes filesystem events until the watcher is closed.
+func (h *Handler) run() {
+	timer := time.NewTimer(h.debounce)
+	timer.Stop()
+
+	for {
+		select {
+		case event, ok := <-h.watcher.Events:
+			if !ok {
+				timer.Stop()
+				return
+			}
+			logrus.Debugf("Local source event: %s", event)
+			if event.Has(fsnotify.Create) {
+				// Watch directories created after startup as well
+				if err := h.watchTree(event.Name); err != nil {
+					logrus.Warnf("Failed to watch %s: %v", event.Name, err)
+				}
+			}
+			timer.Reset(h.debounce)
+
+		case err, ok := <-h.watcher.Errors:
+			if !ok {
+				timer.Stop()
+				return
+			}
+			logrus.Errorf("Local source watcher error: %v", err)
+
+		case <-timer.C:
+			h.mu.Lock()
+			h.changed = true
+			h.mu.Unlock()
+
+			select {
+			case h.changes <- struct{}{}:
+			default:
+				// A change is already pending
+			}
+		}
+	}
+}
+
+// watchTree adds root and all its subdirectories to the watcher. Files are
+// ignored, fsnotify reports their events through their directory.
+func (h *Handler) watchTree(root string) error {
+	return filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || !d.IsDir() {
+			return err
+		}
+		return h.watcher.Add(path)
+	})
+}
@@ -0,0 +1,55 @@
+package local
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestHandler(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "haproxy.cfg"), []byte("global\n"), 0600); err != nil {
+		t.Fatalf("Failed to write config: %v", err)
+	}
+
+	handler, err := NewHandler(dir, "haproxy.cfg", 50*time.Millisecond)
+	if err != nil {
+		t.Fatalf("Failed to create handler: %v", err)
+	}
+	defer func() { _ = handler.Close() }()
+
+	configPath, updated, err := handler.PullAndUpdate(context.Background())
+	if err != nil || !updated || configPath != filepath.Join(dir, "haproxy.cfg") {
+		t.Fatalf("Expected the first call to report a change, but got: %s, %v, %v", configPath, updated, err)
+	}
+	if _, updated, _ := handler.PullAndUpdate(context.Background()); updated {
+		t.Fatalf("Expected no change without filesystem events")
+	}
+
+	// Several quick writes, including in a new subdirectory
+	if err := os.Mkdir(filepath.Join(dir, "maps"), 0750); err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		if err := os.WriteFile(filepath.Join(dir, "haproxy.cfg"), []byte("global\n    daemon\n"), 0600); err != nil {
+			t.Fatalf("Failed to write config: %v", err)
+		}
+	}
+
+	select {
+	case <-handler.Changes():
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Expected a change to be signalled")
+	}
+	if _, updated, _ := handler.PullAndUpdate(context.Background()); !updated {
+		t.Errorf("Expected a change after writing the config")
+	}
+
+	select {
+	case <-handler.Changes():
+		t.Errorf("Expected the writes to be debounced into a single change")
+	case <-time.After(200 * time.Millisecond):
+	}
+}
@@ -0,0 +1,250 @@
+// Package maintenance restricts when configuration changes may be applied:
+// within maintenance windows, outside of blackout periods and while no
+// freeze is declared.
+//
+// Windows and blackouts are either recurring, opened by a cron expression
+// for a duration, or fixed, between a start and an end. Freezes are
+// declared by the presence of a file, and emergency changes go through
+// time-limited overrides.
+//
+// Author: zakaria.elbouwab
+package maintenance
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// searchHorizon bounds the search for the next opening of a window.
+const searchHorizon = 366 * 24 * time.Hour
+
+// maxDuration bounds the duration of recurring periods.
+const maxDuration = 31 * 24 * time.Hour
+
+// Period is a recurring or fixed period of time.
+//
+// Recurring periods open every time Cron fires and last Duration. Fixed
+// periods run from Start to End, as RFC 3339 times or local times such as
+// `2024-12-20 18:00`, in the timezone of the configuration.
+type Period struct {
+	Cron     string        `mapstructure:"cron"`
+	Duration time.Duration `mapstructure:"duration"`
+	Start    string        `mapstructure:"start"`
+	End      string        `mapstructure:"end"`
+	// Reason describes the period in logs and statuses
+	Reason string `mapstructure:"reason"`
+}
+
+// Config describes when changes may be applied.
+type Config struct {
+	// Timezone is the IANA timezone periods are evaluated in, the local
+	// one by default
+	Timezone string `mapstructure:"timezone"`
+	// Windows are the periods changes may be applied in. Changes may be
+	// applied at any time without windows.
+	Windows []Period `mapstructure:"windows"`
+	// Blackouts are periods changes may never be applied in
+	Blackouts []Period `mapstructure:"blackouts"`
+
+	// FreezeFile is a file of the repository declaring a freeze while it
+	// exists, and NodeFreezeFile a file of the node. Their content is the
+	// reason of the freeze.
+	FreezeFile     string `mapstructure:"freezeFile"`
+	NodeFreezeFile string `mapstructure:"nodeFreezeFile"`
+
+	// OverrideTrailer is the commit trailer letting an emergency change
+	// through, with its justification as value
+	OverrideTrailer string `mapstructure:"overrideTrailer"`
+}
+
+// Enabled reports whether changes are restricted in any way.
+func (c Config) Enabled() bool {
+	return len(c.Windows) > 0 || len(c.Blackouts) > 0 || c.FreezeFile != "" || c.NodeFreezeFile != ""
+}
+
+// Validate checks the timezone and the periods.
+func (c Config) Validate() error {
+	_, err := NewSchedule(c)
+	return err
+}
+
+// Decision tells whether changes may be applied at a given time.
+type Decision struct {
+	Allowed bool
+	// Reason is why changes may not be applied
+	Reason string
+	// Next is when the period preventing changes ends, or when the next
+	// window opens, if known
+	Next time.Time
+}
+
+// Schedule evaluates the windows and blackouts of a configuration.
+type Schedule struct {
+	location  *time.Location
+	windows   []period
+	blackouts []period
+}
+
+type period struct {
+	cron       *cronExpr
+	duration   time.Duration
+	start, end time.Time
+	reason     string
+}
+
+// NewSchedule compiles the windows and blackouts of c.
+func NewSchedule(c Config) (*Schedule, error) {
+	location := time.Local
+	if c.Timezone != "" {
+		var err error
+		if location, err = time.LoadLocation(c.Timezone); err != nil {
+			return nil, fmt.Errorf("invalid timezone %s: %w", c.Timezone, err)
+		}
+	}
+
+	s := &Schedule{location: location}
+	for i, p := range c.Windows {
+		compiled, err := compile(p, location)
+		if err != nil {
+			return nil, fmt.Errorf("windows[%d]: %w", i, err)
+		}
+		s.windows = append(s.windows, compiled)
+	}
+	for i, p := range c.Blackouts {
+		compiled, err := compile(p, location)
+		if err != nil {
+			return nil, fmt.Errorf("blackouts[%d]: %w", i, err)
+		}
+		s.blackouts = append(s.blackouts, compiled)
+	}
+	return s, nil
+}
+
+func compile(p Period, location *time.Location) (period, error) {
+	compiled := period{duration: p.Duration, reason: p.Reason}
+	if p.Cron != "" {
+		if p.Start != "" || p.End != "" {
+			return period{}, errors.New("cron can't be combined with start and end")
+		}
+		if p.Duration <= 0 || p.Duration > maxDuration {
+			return period{}, fmt.Errorf("duration must be between 1m and %s", maxDuration)
+		}
+		var err error
+		compiled.cron, err = parseCron(p.Cron)
+		return compiled, err
+	}
+
+	if p.Start == "" || p.End == "" {
+		return period{}, errors.New("either cron and duration, or start and end, are required")
+	}
+	var err error
+	if compiled.start, err = parseTime(p.Start, location); err != nil {
+		return period{}, err
+	}
+	if compiled.end, err = parseTime(p.End, location); err != nil {
+		return period{}, err
+	}
+	if !compiled.end.After(compiled.start) {
+		return period{}, errors.New("end must be after start")
+	}
+	return compiled, nil
+}
+
+func parseTime(value string, location *time.Location) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	for _, layout := range []string{"2006-01-02T15:04", "2006-01-02 15:04", "2006-01-02"} {
+		if t, err := time.ParseInLocation(layout, value, location); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid time %q, expected RFC 3339 or YYYY-MM-DD[ HH:MM]", value)
+}
+
+// activeAt reports whether the period covers t, and when it ends.
+func (p period) activeAt(t time.Time) (bool, time.Time) {
+	if p.cron == nil {
+		return !t.Before(p.start) && t.Before(p.end), p.end
+	}
+	// The most recent opening is the one ending last
+	earliest := t.Add(-p.duration)
+	for start := t.Truncate(time.Minute); start.After(earliest); start = start.Add(-time.Minute) {
+		if p.cron.match(start) {
+			return true, start.Add(p.duration)
+		}
+	}
+	return false, time.Time{}
+}
+
+// nextStart returns when the period next opens after t, or the zero time
+// if it doesn't within the search horizon.
+func (p period) nextStart(t time.Time) time.Time {
+	if p.cron == nil {
+		if p.start.After(t) {
+			return p.start
+		}
+		return time.Time{}
+	}
+	return p.cron.next(t, t.Add(searchHorizon))
+}
+
+func (p period) describe(kind string) string {
+	if p.reason != "" {
+		return fmt.Sprintf("%s %q", kind, p.reason)
+	}
+	return kind
+}
+
+// Check tells whether changes may be applied at t: outside of every
+// blackout and, when windows are defined, within one of them.
+func (s *Schedule) Check(t time.Time) Decision {
+	t = t.In(s.location)
+	for _, b := range s.blackouts {
+		if ok, end := b.activeAt(t); ok {
+			return Decision{
+				Reason: fmt.Sprintf("in %s until %s", b.describe("blackout"), end.Format(time.RFC3339)),
+				Next:   end,
+			}
+		}
+	}
+	if len(s.windows) == 0 {
+		return Decision{Allowed: true}
+	}
+
+	var next time.Time
+	for _, w := range s.windows {
+		if ok, _ := w.activeAt(t); ok {
+			return Decision{Allowed: true}
+		}
+		if start := w.nextStart(t); !start.IsZero() && (next.IsZero() || start.Before(next)) {
+			next = start
+		}
+	}
+	d := Decision{Reason: "outside maintenance windows", Next: next}
+	if !next.IsZero() {
+		d.Reason += ", next one opens at " + next.Format(time.RFC3339)
+	}
+	return d
+}
+
+// Frozen reports whether the freeze file at path exists, and returns the
+// reason of the freeze it holds.
+func Frozen(path string) (bool, string, error) {
+	content, err := os.ReadFile(filepath.Clean(path))
+	if errors.Is(err, os.ErrNotExist) {
+		return false, "", nil
+	}
+	if err != nil {
+		return false, "", err
+	}
+	reason, _, _ := strings.Cut(strings.TrimSpace(string(content)), "\n")
+	if reason = strings.TrimSpace(reason); reason == "" {
+		reason = "declared in " + path
+	}
+	return true, reason, nil
+}
@@ -0,0 +1,180 @@
+package maintenance
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func date(t *testing.T, value string) time.Time {
+	t.Helper()
+	parsed, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return parsed
+}
+
+func TestParseCron(t *testing.T) {
+	e, err := parseCron("*/15 22-23 * jan-mar mon,wed,7")
+	if err != nil {
+		t.Fatalf("Failed to parse: %v", err)
+	}
+	tests := []struct {
+		at    string
+		match bool
+	}{
+		{"2024-01-01T22:30:00Z", true},  // Monday
+		{"2024-01-07T23:45:00Z", true},  // Sunday, as 7
+		{"2024-01-02T22:30:00Z", false}, // Tuesday
+		{"2024-01-01T22:20:00Z", false}, // not on the step
+		{"2024-01-01T21:30:00Z", false},
+		{"2024-04-01T22:30:00Z", false},
+	}
+	for _, tt := range tests {
+		if got := e.match(date(t, tt.at)); got != tt.match {
+			t.Errorf("match(%s) = %t, want %t", tt.at, got, tt.match)
+		}
+	}
+
+	for _, spec := range []string{"* * * *", "60 * * * *", "* * * * mon-xyz", "*/0 * * * *", "5-1 * * * *"} {
+		if _, err := parseCron(spec); err == nil {
+			t.Errorf("Expected %q to be invalid", spec)
+		}
+	}
+}
+
+func TestParseCron_DayFields(t *testing.T) {
+	// With both day fields restricted, either one matches
+	e, err := parseCron("0 0 13 * fri")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !e.match(date(t, "2024-02-13T00:00:00Z")) || !e.match(date(t, "2024-02-16T00:00:00Z")) {
+		t.Error("Expected the 13th and Fridays to match")
+	}
+	if e.match(date(t, "2024-02-14T00:00:00Z")) {
+		t.Error("Expected other days not to match")
+	}
+}
+
+func TestCronNext(t *testing.T) {
+	e, err := parseCron("30 2 1 * *")
+	if err != nil {
+		t.Fatal(err)
+	}
+	from := date(t, "2024-01-15T10:00:00Z")
+	if got := e.next(from, from.Add(searchHorizon)); !got.Equal(date(t, "2024-02-01T02:30:00Z")) {
+		t.Errorf("Unexpected next time %s", got)
+	}
+	if got := e.next(from, from.Add(24*time.Hour)); !got.IsZero() {
+		t.Errorf("Expected no next time within a day, got %s", got)
+	}
+}
+
+func TestSchedule_Windows(t *testing.T) {
+	s, err := NewSchedule(Config{
+		Timezone: "UTC",
+		Windows:  []Period{{Cron: "0 22 * * mon-thu", Duration: 4 * time.Hour}},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create schedule: %v", err)
+	}
+
+	// Monday 23:00 and Tuesday 01:59 are within the window opened Monday 22:00
+	for _, at := range []string{"2024-01-01T23:00:00Z", "2024-01-02T01:59:00Z"} {
+		if d := s.Check(date(t, at)); !d.Allowed {
+			t.Errorf("Expected changes to be allowed at %s: %s", at, d.Reason)
+		}
+	}
+
+	d := s.Check(date(t, "2024-01-05T12:00:00Z")) // Friday
+	if d.Allowed {
+		t.Fatal("Expected changes to be denied on Friday")
+	}
+	if !d.Next.Equal(date(t, "2024-01-08T22:00:00Z")) || !strings.Contains(d.Reason, "outside maintenance windows") {
+		t.Errorf("Unexpected decision: %+v", d)
+	}
+}
+
+func TestSchedule_Blackouts(t *testing.T) {
+	s, err := NewSchedule(Config{
+		Timezone: "UTC",
+		Blackouts: []Period{
+			{Start: "2024-12-20", End: "2025-01-03", Reason: "year-end freeze"},
+			{Cron: "0 18 * * fri", Duration: 62 * time.Hour},
+		},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create schedule: %v", err)
+	}
+
+	d := s.Check(date(t, "2024-12-24T10:00:00Z"))
+	if d.Allowed || !strings.Contains(d.Reason, "year-end freeze") || !d.Next.Equal(date(t, "2025-01-03T00:00:00Z")) {
+		t.Errorf("Expected the year-end freeze, got %+v", d)
+	}
+	d = s.Check(date(t, "2024-01-07T10:00:00Z")) // Sunday
+	if d.Allowed || !d.Next.Equal(date(t, "2024-01-08T08:00:00Z")) {
+		t.Errorf("Expected the weekend blackout, got %+v", d)
+	}
+	if d := s.Check(date(t, "2024-01-08T09:00:00Z")); !d.Allowed {
+		t.Errorf("Expected changes to be allowed on Monday: %s", d.Reason)
+	}
+}
+
+func TestConfig_Validate(t *testing.T) {
+	invalid := []Config{
+		{Timezone: "Nowhere/Atlantis"},
+		{Windows: []Period{{Cron: "0 22 * * *"}}},
+		{Windows: []Period{{Cron: "0 22 * * *", Duration: time.Hour, Start: "2024-01-01"}}},
+		{Blackouts: []Period{{Start: "2024-01-02", End: "2024-01-01"}}},
+		{Blackouts: []Period{{Start: "tomorrow", End: "2024-01-01"}}},
+		{Blackouts: []Period{{Reason: "nothing"}}},
+	}
+	for i, c := range invalid {
+		if err := c.Validate(); err == nil {
+			t.Errorf("Expected config %d to be invalid", i)
+		}
+	}
+}
+
+func TestFrozen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "FREEZE")
+	if frozen, _, err := Frozen(path); err != nil || frozen {
+		t.Fatalf("Expected no freeze, got %t, %v", frozen, err)
+	}
+
+	if err := os.WriteFile(path, []byte("Black Friday\nuntil Monday\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	frozen, reason, err := Frozen(path)
+	if err != nil || !frozen || reason != "Black Friday" {
+		t.Errorf("Unexpected freeze %t %q: %v", frozen, reason, err)
+	}
+}
+
+func TestOverrideStore(t *testing.T) {
+	store := NewOverrideStore(filepath.Join(t.TempDir(), "state", "override.json"))
+	now := time.Now()
+
+	if o, err := store.Active(now); err != nil || o != nil {
+		t.Fatalf("Expected no override, got %v, %v", o, err)
+	}
+	if _, err := store.Grant(now.Add(time.Hour), "INC-42"); err != nil {
+		t.Fatalf("Failed to grant override: %v", err)
+	}
+	if o, err := store.Active(now); err != nil || o == nil || o.Reason != "INC-42" {
+		t.Errorf("Expected an active override, got %v, %v", o, err)
+	}
+	if o, _ := store.Active(now.Add(2 * time.Hour)); o != nil {
+		t.Error("Expected the override to expire")
+	}
+	if err := store.Clear(); err != nil {
+		t.Fatal(err)
+	}
+	if o, _ := store.Active(now); o != nil {
+		t.Error("Expected the override to be cleared")
+	}
+}
@@ -10,35 +10,204 @@ var (
 	// GitPullCounter tracks the number of times the config is pulled from Git.
 	//
 	// This metric is a counter that can be labeled with 'status' which can be either
-	// 'success' or 'failure' depending on the outcome of the pull operation.
+	// 'success' or 'failure' depending on the outcome of the pull operation, and
+	// with 'instance', the managed HAProxy instance.
 	GitPullCounter = prometheus.NewCounterVec(
 		prometheus.CounterOpts{
 			Name: "hpxd_git_pulls_total",
 			Help: "Total number of times the config is pulled from Git",
 		},
-		[]string{"status"}, // success or failure
+		[]string{"instance", "status"}, // status is success or failure
 	)
 
 	// HaproxyReloadCounter tracks the number of times HAProxy is reloaded.
 	//
-	// This is a simple counter metric without labels. It increments every time HAProxy
-	// is reloaded by the hpxd application.
-	HaproxyReloadCounter = prometheus.NewCounter(
+	// This counter metric is labeled with 'instance'. It increments every time
+	// HAProxy is reloaded by the hpxd application.
+	HaproxyReloadCounter = prometheus.NewCounterVec(
 		prometheus.CounterOpts{
 			Name: "hpxd_haproxy_reloads_total",
 			Help: "Total number of times HAProxy is reloaded",
 		},
+		[]string{"instance"},
 	)
 
 	// InvalidConfigCounter tracks the number of times an invalid config is detected.
 	//
-	// This counter metric increments each time the hpxd application detects
-	// an invalid configuration for HAProxy.
-	InvalidConfigCounter = prometheus.NewCounter(
+	// This counter metric is labeled with 'instance' and increments each time
+	// the hpxd application detects an invalid configuration for HAProxy.
+	InvalidConfigCounter = prometheus.NewCounterVec(
 		prometheus.CounterOpts{
 			Name: "hpxd_invalid_configs_total",
 			Help: "Total number of times an invalid config is detected",
 		},
+		[]string{"instance"},
+	)
+
+	// ValidationDiagnosticsCounter tracks the diagnostics reported by HAProxy validations.
+	//
+	// This counter metric is labeled with 'instance' and 'severity' which can be
+	// 'ALERT', 'WARNING' or 'NOTICE'.
+	ValidationDiagnosticsCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "hpxd_validation_diagnostics_total",
+			Help: "Total number of diagnostics reported by HAProxy config validations",
+		},
+		[]string{"instance", "severity"},
+	)
+
+	// GuardHeldUpdatesCounter tracks the number of updates held by the blast-radius guard.
+	//
+	// This counter metric is labeled with 'instance' and 'kind', the threshold that was exceeded:
+	// 'backends', 'servers', 'frontends' or 'protected_backend'.
+	GuardHeldUpdatesCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "hpxd_guard_held_updates_total",
+			Help: "Total number of updates held by the blast-radius guard",
+		},
+		[]string{"instance", "kind"},
+	)
+
+	// GuardPendingApproval reports whether an update is waiting for approval.
+	//
+	// This gauge metric is labeled with 'instance'. It's set to 1 while an update
+	// is held by the blast-radius guard and back to 0 once it's approved, applied
+	// or superseded.
+	GuardPendingApproval = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "hpxd_guard_pending_approval",
+			Help: "Whether an update is held pending approval (1) or not (0)",
+		},
+		[]string{"instance"},
+	)
+
+	// DriftedFiles reports the number of deployed files that drifted from the
+	// last applied configuration.
+	//
+	// This gauge metric is labeled with 'instance'. It's updated on every drift
+	// check and drops back to 0 once the drift is corrected, by hpxd or by hand.
+	DriftedFiles = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "hpxd_drifted_files",
+			Help: "Number of deployed files that drifted from the last applied configuration",
+		},
+		[]string{"instance"},
+	)
+
+	// DriftCorrectionsCounter tracks the number of times drift is corrected.
+	//
+	// This counter metric is labeled with 'instance' and increments each time
+	// hpxd restores the last applied configuration in `enforce` mode and
+	// reloads HAProxy.
+	DriftCorrectionsCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "hpxd_drift_corrections_total",
+			Help: "Total number of times drift is corrected",
+		},
+		[]string{"instance"},
+	)
+
+	// WebhookCounter tracks the number of webhook deliveries received.
+	//
+	// This counter metric is labeled with 'provider' (github, gitlab, gitea or
+	// bitbucket) and 'result', which can be 'triggered', 'ignored' or 'rejected'.
+	WebhookCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "hpxd_webhooks_total",
+			Help: "Total number of webhook deliveries received",
+		},
+		[]string{"provider", "result"},
+	)
+
+	// PoolServers tracks the number of servers resolved for each server pool.
+	//
+	// This gauge metric is labeled with 'instance' and 'pool', the name of the pool, and is
+	// updated every time pools are resolved from service discovery.
+	PoolServers = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "hpxd_pool_servers",
+			Help: "Number of servers resolved for each server pool",
+		},
+		[]string{"instance", "pool"},
+	)
+
+	// RuntimeUpdatesCounter tracks the server pool changes applied through the runtime API.
+	//
+	// This counter metric is labeled with 'instance' and 'result', which can be 'success', or
+	// 'fallback' when the change had to be applied with a reload instead.
+	RuntimeUpdatesCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "hpxd_runtime_updates_total",
+			Help: "Total number of server pool changes applied through the HAProxy runtime API",
+		},
+		[]string{"instance", "result"},
+	)
+
+	// RolloutWaiting reports whether a revision is waiting for the rollout wave
+	// of the host.
+	//
+	// This gauge metric is labeled with 'instance'. It's set to 1 while a
+	// revision is held by a staged rollout and back to 0 once it's applied.
+	RolloutWaiting = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "hpxd_rollout_waiting",
+			Help: "Whether a revision is waiting for the rollout wave of the host (1) or not (0)",
+		},
+		[]string{"instance"},
+	)
+
+	// MaintenanceQueued reports whether a revision is queued by maintenance
+	// windows, blackouts or freezes.
+	//
+	// This gauge metric is labeled with 'instance'. It's set to 1 while a
+	// revision waits for changes to be allowed and back to 0 once it's applied.
+	MaintenanceQueued = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "hpxd_maintenance_queued",
+			Help: "Whether a revision is queued until changes are allowed (1) or not (0)",
+		},
+		[]string{"instance"},
+	)
+
+	// ReloadDeferred reports whether a reload of HAProxy is held by the
+	// reload limits.
+	//
+	// This gauge metric is labeled with 'instance'. It's set to 1 while a reload
+	// waits for `reload.minInterval` or for old workers to exit, and back to 0
+	// once it's allowed.
+	ReloadDeferred = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "hpxd_reload_deferred",
+			Help: "Whether a reload of HAProxy is held by the reload limits (1) or not (0)",
+		},
+		[]string{"instance"},
+	)
+
+	// HaproxyOldWorkers reports the number of old HAProxy workers still
+	// draining connections after a reload.
+	//
+	// This gauge metric is labeled with 'instance'. It's updated from the master
+	// CLI before every reload when `reload.maxOldWorkers` is set.
+	HaproxyOldWorkers = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "hpxd_haproxy_old_workers",
+			Help: "Number of old HAProxy workers still draining connections",
+		},
+		[]string{"instance"},
+	)
+
+	// DryRunPendingChanges reports the number of deployed files the last
+	// revision evaluated in dry-run mode would change.
+	//
+	// This gauge metric is labeled with 'instance'. It's updated every time a
+	// revision is evaluated in dry-run mode and drops back to 0 when the mode
+	// is turned off.
+	DryRunPendingChanges = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "hpxd_dry_run_pending_changes",
+			Help: "Number of deployed files the last revision evaluated in dry-run mode would change",
+		},
+		[]string{"instance"},
 	)
 
 	// ApplicationInfo provides details about the running application.
@@ -58,5 +227,23 @@ var (
 func init() {
 	// Registering the metrics with Prometheus's default registry ensures they are
 	// exposed for scraping by a Prometheus server.
-	prometheus.MustRegister(GitPullCounter, HaproxyReloadCounter, InvalidConfigCounter, ApplicationInfo)
+	prometheus.MustRegister(
+		GitPullCounter,
+		HaproxyReloadCounter,
+		InvalidConfigCounter,
+		ValidationDiagnosticsCounter,
+		GuardHeldUpdatesCounter,
+		GuardPendingApproval,
+		DriftedFiles,
+		DriftCorrectionsCounter,
+		WebhookCounter,
+		PoolServers,
+		RuntimeUpdatesCounter,
+		RolloutWaiting,
+		MaintenanceQueued,
+		ReloadDeferred,
+		HaproxyOldWorkers,
+		DryRunPendingChanges,
+		ApplicationInfo,
+	)
 }
@@ -0,0 +1,342 @@
+// Package rollout stages the rollout of new revisions across a fleet.
+//
+// Hosts are assigned to waves, explicitly or by hashing their hostname.
+// The first wave, the canaries, applies a revision as soon as it appears.
+// Every later wave waits for its delay to elapse since any host first saw
+// the revision, and for the earlier waves to report it healthy. Hosts
+// coordinate through a shared Store, a directory or an HTTP endpoint.
+//
+// Author: zakaria.elbouwab
+package rollout
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Supported values of Config.Store.
+const (
+	StoreFile = "file"
+	StoreHTTP = "http"
+)
+
+// Wave is a group of hosts applying revisions together.
+//
+// Percent is the share of the fleet assigned to the wave by hashing
+// hostnames. Delay is how long the wave waits after a revision first
+// appears before applying it.
+type Wave struct {
+	Name    string        `mapstructure:"name"`
+	Percent int           `mapstructure:"percent"`
+	Delay   time.Duration `mapstructure:"delay"`
+}
+
+// Config describes the waves and how hosts coordinate.
+type Config struct {
+	Enabled bool   `mapstructure:"enabled"`
+	Waves   []Wave `mapstructure:"waves"`
+	// Wave assigns the host to a wave by name instead of by hashing
+	Wave string `mapstructure:"wave"`
+	// MinHealthy is the number of healthy reports required from each
+	// earlier wave
+	MinHealthy int `mapstructure:"minHealthy"`
+
+	Store string `mapstructure:"store"`
+	// Dir is the shared directory of the file store
+	Dir string `mapstructure:"dir"`
+	// URL and Token locate the coordination endpoint of the HTTP store
+	URL   string `mapstructure:"url"`
+	Token string `mapstructure:"token"`
+	// CAFile verifies the certificate of an HTTPS endpoint, and CertFile
+	// and KeyFile are presented when it requires client certificates
+	CAFile   string `mapstructure:"caFile"`
+	CertFile string `mapstructure:"certFile"`
+	KeyFile  string `mapstructure:"keyFile"`
+	// Listen serves the file store as a coordination endpoint
+	Listen string `mapstructure:"listen"`
+
+	// HealthCheckURL is requested after every reload, the revision is
+	// reported as failed unless it answers with a 2xx status
+	HealthCheckURL string `mapstructure:"healthCheckURL"`
+}
+
+// Validate checks the waves and the store settings.
+func (c Config) Validate() error {
+	if len(c.Waves) == 0 {
+		return errors.New("no wave defined")
+	}
+	names := make(map[string]bool, len(c.Waves))
+	total := 0
+	for i, w := range c.Waves {
+		if w.Name == "" {
+			return fmt.Errorf("missing name of wave %d", i)
+		}
+		if names[w.Name] {
+			return fmt.Errorf("duplicate wave %s", w.Name)
+		}
+		names[w.Name] = true
+		if w.Percent < 0 || w.Delay < 0 {
+			return fmt.Errorf("wave %s: percent and delay can't be negative", w.Name)
+		}
+		total += w.Percent
+	}
+	if total > 100 {
+		return fmt.Errorf("waves add up to %d%% of the fleet", total)
+	}
+	if c.Wave != "" && !names[c.Wave] {
+		return fmt.Errorf("unknown wave %s", c.Wave)
+	}
+
+	switch c.Store {
+	case StoreFile:
+		if c.Dir == "" {
+			return errors.New("missing directory of the file store")
+		}
+	case StoreHTTP:
+		if c.URL == "" {
+			return errors.New("missing URL of the HTTP store")
+		}
+		if c.Listen != "" {
+			return errors.New("only the file store can be served")
+		}
+		if (c.CertFile == "") != (c.KeyFile == "") {
+			return errors.New("client certificates require both certFile and keyFile")
+		}
+	default:
+		return fmt.Errorf("store must be one of %s or %s", StoreFile, StoreHTTP)
+	}
+	return nil
+}
+
+// NewStore returns the store selected by the configuration.
+func (c Config) NewStore() (Store, error) {
+	if c.Store != StoreHTTP {
+		return NewFileStore(c.Dir), nil
+	}
+
+	store := NewHTTPStore(c.URL, c.Token)
+	if c.CAFile == "" && c.CertFile == "" {
+		return store, nil
+	}
+	tlsConfig, err := c.clientTLSConfig()
+	if err != nil {
+		return nil, err
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	store.client.Transport = transport
+	return store, nil
+}
+
+// clientTLSConfig returns the TLS configuration of the HTTP store.
+func (c Config) clientTLSConfig() (*tls.Config, error) {
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+
+	if c.CAFile != "" {
+		pem, err := os.ReadFile(filepath.Clean(c.CAFile))
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate found in %s", c.CAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if c.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConfig, nil
+}
+
+// AssignWave returns the index of the wave of host. Hostnames are hashed
+// into 100 buckets, given out to waves according to their percentage. Hosts
+// falling beyond the last percentage belong to the last wave.
+func AssignWave(waves []Wave, host string) int {
+	sum := fnv.New32a()
+	_, _ = sum.Write([]byte(host))
+	bucket := int(sum.Sum32() % 100)
+
+	upper := 0
+	for i, w := range waves {
+		upper += w.Percent
+		if bucket < upper {
+			return i
+		}
+	}
+	return len(waves) - 1
+}
+
+// Rollout decides when the host applies a revision.
+type Rollout struct {
+	config Config
+	fleet  string
+	host   string
+	wave   int
+	store  Store
+	now    func() time.Time
+}
+
+// New initializes and returns a new Rollout for host. Hosts of the same
+// fleet, such as the same HAProxy instance across hosts, coordinate with
+// each other.
+func New(config Config, fleet, host string, store Store) *Rollout {
+	wave := AssignWave(config.Waves, host)
+	for i, w := range config.Waves {
+		if w.Name == config.Wave {
+			wave = i
+		}
+	}
+	if config.MinHealthy == 0 {
+		config.MinHealthy = 1
+	}
+
+	return &Rollout{
+		config: config,
+		fleet:  fleet,
+		host:   host,
+		wave:   wave,
+		store:  store,
+		now:    time.Now,
+	}
+}
+
+// Wave returns the wave of the host.
+func (r *Rollout) Wave() Wave {
+	return r.config.Waves[r.wave]
+}
+
+// Check records that the host saw revision, and reports whether it can
+// apply it. If it can't yet, the reason is returned.
+func (r *Rollout) Check(revision string) (bool, string, error) {
+	reports, err := r.store.List(r.fleet, revision)
+	if err != nil {
+		return false, "", err
+	}
+	if r.own(reports) == nil {
+		seen := Report{Host: r.host, Wave: r.Wave().Name, Status: StatusSeen, SeenAt: r.now().UTC()}
+		seen.UpdatedAt = seen.SeenAt
+		if err := r.store.Put(r.fleet, revision, seen); err != nil {
+			return false, "", err
+		}
+		reports = append(reports, seen)
+	}
+	if r.wave == 0 {
+		return true, "", nil
+	}
+
+	firstSeen := reports[0].SeenAt
+	for _, rep := range reports {
+		if rep.SeenAt.Before(firstSeen) {
+			firstSeen = rep.SeenAt
+		}
+	}
+	if due := firstSeen.Add(r.Wave().Delay); r.now().Before(due) {
+		return false, fmt.Sprintf("wave %s waits until %s", r.Wave().Name, due.Local().Format(time.RFC3339)), nil
+	}
+
+	for _, w := range r.config.Waves[:r.wave] {
+		healthy := 0
+		for _, rep := range reports {
+			if rep.Wave != w.Name {
+				continue
+			}
+			switch rep.Status {
+			case StatusFailed:
+				return false, fmt.Sprintf("host %s of wave %s reported it failed: %s", rep.Host, w.Name, rep.Message), nil
+			case StatusHealthy:
+				healthy++
+			}
+		}
+		if healthy < r.config.MinHealthy {
+			return false, fmt.Sprintf("waiting for wave %s, %d of %d healthy reports", w.Name, healthy, r.config.MinHealthy), nil
+		}
+	}
+	return true, "", nil
+}
+
+// Report records the outcome of applying revision on the host. A non-nil
+// failure reports it failed, which halts the rollout of later waves.
+func (r *Rollout) Report(revision string, failure error) error {
+	reports, err := r.store.List(r.fleet, revision)
+	if err != nil {
+		return err
+	}
+
+	now := r.now().UTC()
+	report := Report{Host: r.host, Wave: r.Wave().Name, Status: StatusHealthy, SeenAt: now, UpdatedAt: now}
+	if own := r.own(reports); own != nil {
+		report.SeenAt = own.SeenAt
+	}
+	if failure != nil {
+		report.Status = StatusFailed
+		report.Message = failure.Error()
+	}
+	return r.store.Put(r.fleet, revision, report)
+}
+
+// own returns the report of the host among reports.
+func (r *Rollout) own(reports []Report) *Report {
+	for i := range reports {
+		if reports[i].Host == r.host {
+			return &reports[i]
+		}
+	}
+	return nil
+}
+
+// CheckHealth requests url until it answers with a 2xx status, giving up
+// after a few attempts or when ctx is done.
+func CheckHealth(ctx context.Context, url string) error {
+	client := &http.Client{Timeout: 5 * time.Second}
+
+	var err error
+	for attempt := 0; attempt < healthCheckAttempts; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-time.After(healthCheckInterval):
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+		var req *http.Request
+		req, err = http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+		if err != nil {
+			return err
+		}
+		var resp *http.Response
+		resp, err = client.Do(req)
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			continue
+		}
+		_ = resp.Body.Close()
+		if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+			return nil
+		}
+		err = fmt.Errorf("health check %s answered %s", url, resp.Status)
+	}
+	return err
+}
+
+// healthCheckAttempts and healthCheckInterval give HAProxy some time to
+// come back after a reload.
+var (
+	healthCheckAttempts = 5
+	healthCheckInterval = 2 * time.Second
+)
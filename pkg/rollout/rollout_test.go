@@ -0,0 +1,180 @@
+package rollout
+
+import (
+	"context"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+var testWaves = []Wave{
+	{Name: "canary", Percent: 10},
+	{Name: "early", Percent: 30, Delay: 10 * time.Minute},
+	{Name: "all", Delay: time.Hour},
+}
+
+func newTestRollout(store Store, host, wave string, now *time.Time) *Rollout {
+	r := New(Config{Waves: testWaves, Wave: wave}, "edge", host, store)
+	r.now = func() time.Time { return *now }
+	return r
+}
+
+func TestAssignWave(t *testing.T) {
+	counts := make([]int, len(testWaves))
+	for i := 0; i < 1000; i++ {
+		counts[AssignWave(testWaves, fmt.Sprintf("lb-%d", i))]++
+	}
+	if counts[0] == 0 || counts[1] == 0 || counts[2] < counts[1] {
+		t.Errorf("Unexpected wave distribution: %v", counts)
+	}
+	if AssignWave(testWaves, "lb-1") != AssignWave(testWaves, "lb-1") {
+		t.Errorf("Expected wave assignment to be stable")
+	}
+}
+
+func TestRollout(t *testing.T) {
+	store := NewFileStore(t.TempDir())
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	canary := newTestRollout(store, "lb-1", "canary", &now)
+	early := newTestRollout(store, "lb-2", "early", &now)
+
+	if ok, reason, err := early.Check("abc"); err != nil || ok {
+		t.Fatalf("Expected early wave to wait for its delay, but got: %v, %s, %v", ok, reason, err)
+	}
+	if ok, _, err := canary.Check("abc"); err != nil || !ok {
+		t.Fatalf("Expected canary to apply right away, but got: %v, %v", ok, err)
+	}
+
+	now = now.Add(15 * time.Minute)
+	if ok, reason, _ := early.Check("abc"); ok || !strings.Contains(reason, "0 of 1 healthy") {
+		t.Errorf("Expected early wave to wait for the canary, but got: %v, %s", ok, reason)
+	}
+
+	if err := canary.Report("abc", nil); err != nil {
+		t.Fatalf("Failed to report: %v", err)
+	}
+	if ok, reason, _ := early.Check("abc"); !ok {
+		t.Errorf("Expected early wave to apply once the canary is healthy, but got: %s", reason)
+	}
+
+	// A failure halts later waves
+	if err := canary.Report("def", errors.New("reload failed")); err != nil {
+		t.Fatalf("Failed to report: %v", err)
+	}
+	now = now.Add(time.Hour)
+	if ok, reason, _ := early.Check("def"); ok || !strings.Contains(reason, "reload failed") {
+		t.Errorf("Expected early wave to be halted, but got: %v, %s", ok, reason)
+	}
+
+	reports, err := store.List("edge", "abc")
+	if err != nil || len(reports) != 2 {
+		t.Fatalf("Expected two reports, but got: %v, %v", reports, err)
+	}
+	if reports[0].Status != StatusHealthy || !reports[0].SeenAt.Before(reports[0].UpdatedAt) {
+		t.Errorf("Expected the canary report to keep when it first saw the revision, but got: %+v", reports[0])
+	}
+}
+
+func TestHTTPStore(t *testing.T) {
+	server := httptest.NewServer(Handler(NewFileStore(t.TempDir()), "secret"))
+	defer server.Close()
+
+	store := NewHTTPStore(server.URL, "secret")
+	report := Report{Host: "lb-1", Wave: "canary", Status: StatusSeen, SeenAt: time.Now().UTC()}
+	if err := store.Put("edge", "abc", report); err != nil {
+		t.Fatalf("Failed to put report: %v", err)
+	}
+	reports, err := store.List("edge", "abc")
+	if err != nil || len(reports) != 1 || reports[0].Host != "lb-1" {
+		t.Errorf("Expected the report back, but got: %v, %v", reports, err)
+	}
+	if reports, err := store.List("edge", "unknown"); err != nil || len(reports) != 0 {
+		t.Errorf("Expected no report, but got: %v, %v", reports, err)
+	}
+
+	if _, err := NewHTTPStore(server.URL, "wrong").List("edge", "abc"); err == nil {
+		t.Errorf("Expected an error with a wrong token")
+	}
+	if err := NewFileStore(t.TempDir()).Put("edge", "../abc", report); err == nil {
+		t.Errorf("Expected an error for an invalid revision")
+	}
+}
+
+func TestHTTPStore_TLS(t *testing.T) {
+	server := httptest.NewTLSServer(Handler(NewFileStore(t.TempDir()), ""))
+	defer server.Close()
+
+	config := Config{Store: StoreHTTP, URL: server.URL}
+	store, err := config.NewStore()
+	if err != nil {
+		t.Fatalf("Failed to create store: %v", err)
+	}
+	if _, err := store.List("edge", "abc"); err == nil {
+		t.Errorf("Expected an error for an unknown CA")
+	}
+
+	config.CAFile = filepath.Join(t.TempDir(), "ca.crt")
+	cert := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	if err := os.WriteFile(config.CAFile, cert, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if store, err = config.NewStore(); err != nil {
+		t.Fatalf("Failed to create store: %v", err)
+	}
+	if _, err := store.List("edge", "abc"); err != nil {
+		t.Errorf("Expected the endpoint to be trusted, but got: %v", err)
+	}
+}
+
+func TestConfig_Validate(t *testing.T) {
+	config := Config{Waves: testWaves, Store: StoreFile, Dir: "/shared"}
+	if err := config.Validate(); err != nil {
+		t.Errorf("Expected config to be valid, but got: %v", err)
+	}
+
+	config.Wave = "unknown"
+	if err := config.Validate(); err == nil {
+		t.Errorf("Expected an error for an unknown wave")
+	}
+
+	config = Config{Waves: []Wave{{Name: "a", Percent: 60}, {Name: "b", Percent: 50}}, Store: StoreFile, Dir: "/shared"}
+	if err := config.Validate(); err == nil {
+		t.Errorf("Expected an error for waves above 100%%")
+	}
+}
+
+func TestCheckHealth(t *testing.T) {
+	interval := healthCheckInterval
+	healthCheckInterval = 10 * time.Millisecond
+	defer func() { healthCheckInterval = interval }()
+
+	status := http.StatusServiceUnavailable
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+
+	if err := CheckHealth(context.Background(), server.URL); err == nil || !strings.Contains(err.Error(), "503") {
+		t.Errorf("Expected the unhealthy endpoint to be reported, but got: %v", err)
+	}
+	status = http.StatusOK
+	if err := CheckHealth(context.Background(), server.URL); err != nil {
+		t.Errorf("Expected the endpoint to be healthy, but got: %v", err)
+	}
+
+	// A done context stops the attempts right away
+	healthCheckInterval = time.Hour
+	status = http.StatusServiceUnavailable
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	if err := CheckHealth(ctx, server.URL); !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected the health check to stop with the context, but got: %v", err)
+	}
+}
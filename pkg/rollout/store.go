@@ -0,0 +1,255 @@
+package rollout
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Status of a host for a revision.
+type Status string
+
+const (
+	// StatusSeen is reported as soon as a host sees a revision
+	StatusSeen Status = "seen"
+	// StatusHealthy is reported once a host applied a revision
+	StatusHealthy Status = "healthy"
+	// StatusFailed is reported when a revision is invalid or fails to apply
+	StatusFailed Status = "failed"
+)
+
+// Report is the status of a host for a revision.
+type Report struct {
+	Host      string    `json:"host"`
+	Wave      string    `json:"wave"`
+	Status    Status    `json:"status"`
+	Message   string    `json:"message,omitempty"`
+	SeenAt    time.Time `json:"seenAt"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+// Store is where hosts of a fleet share their reports.
+type Store interface {
+	// Put records the report of a host, replacing its previous one.
+	Put(fleet, revision string, report Report) error
+	// List returns the reports of every host for a revision.
+	List(fleet, revision string) ([]Report, error)
+}
+
+// FileStore keeps reports in a directory, shared by the fleet over a
+// network filesystem or served by one of the hosts. Every report is a file,
+// at `<fleet>/<revision>/<host>.json`.
+type FileStore struct {
+	dir string
+}
+
+// NewFileStore initializes and returns a new FileStore keeping its reports
+// in dir.
+func NewFileStore(dir string) *FileStore {
+	return &FileStore{dir: dir}
+}
+
+// Put writes the report next to its final location before renaming it, so
+// readers never see a partial report.
+func (s *FileStore) Put(fleet, revision string, report Report) error {
+	dir, err := s.revisionDir(fleet, revision)
+	if err != nil {
+		return err
+	}
+	if err := validName(report.Host); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		return err
+	}
+
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(dir, report.Host+".json")
+	if err := os.WriteFile(path+".tmp", data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// List reads the reports of a revision, sorted by host.
+func (s *FileStore) List(fleet, revision string) ([]Report, error) {
+	dir, err := s.revisionDir(fleet, revision)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := os.ReadDir(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var reports []Report
+	for _, e := range entries {
+		if e.IsDir() || filepath.Ext(e.Name()) != ".json" {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(dir, e.Name()))
+		if err != nil {
+			return nil, err
+		}
+		var r Report
+		if err := json.Unmarshal(data, &r); err != nil {
+			return nil, fmt.Errorf("failed to decode report %s: %w", e.Name(), err)
+		}
+		reports = append(reports, r)
+	}
+	sort.Slice(reports, func(i, j int) bool { return reports[i].Host < reports[j].Host })
+	return reports, nil
+}
+
+func (s *FileStore) revisionDir(fleet, revision string) (string, error) {
+	if err := validName(fleet); err != nil {
+		return "", err
+	}
+	if err := validName(revision); err != nil {
+		return "", err
+	}
+	return filepath.Join(s.dir, fleet, revision), nil
+}
+
+// validName rejects names that can't be used as a single path element.
+func validName(name string) error {
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, `/\`) {
+		return fmt.Errorf("invalid name %q", name)
+	}
+	return nil
+}
+
+// HTTPStore shares reports through a coordination endpoint, such as the
+// one served by Handler.
+type HTTPStore struct {
+	url    string
+	token  string
+	client *http.Client
+}
+
+// NewHTTPStore initializes and returns a new HTTPStore. token, if set, is
+// sent as a bearer token.
+func NewHTTPStore(baseURL, token string) *HTTPStore {
+	return &HTTPStore{
+		url:    strings.TrimRight(baseURL, "/"),
+		token:  token,
+		client: &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// Put sends the report with a `PUT <url>/<fleet>/<revision>/<host>`.
+func (s *HTTPStore) Put(fleet, revision string, report Report) error {
+	data, err := json.Marshal(report)
+	if err != nil {
+		return err
+	}
+	_, err = s.do(http.MethodPut, s.path(fleet, revision, report.Host), data)
+	return err
+}
+
+// List fetches the reports with a `GET <url>/<fleet>/<revision>`.
+func (s *HTTPStore) List(fleet, revision string) ([]Report, error) {
+	body, err := s.do(http.MethodGet, s.path(fleet, revision), nil)
+	if err != nil {
+		return nil, err
+	}
+	var reports []Report
+	if err := json.Unmarshal(body, &reports); err != nil {
+		return nil, fmt.Errorf("failed to decode reports: %w", err)
+	}
+	return reports, nil
+}
+
+func (s *HTTPStore) path(elems ...string) string {
+	path := s.url
+	for _, e := range elems {
+		path += "/" + url.PathEscape(e)
+	}
+	return path
+}
+
+func (s *HTTPStore) do(method, target string, data []byte) ([]byte, error) {
+	req, err := http.NewRequest(method, target, bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	if data != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if s.token != "" {
+		req.Header.Set("Authorization", "Bearer "+s.token)
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return nil, fmt.Errorf("coordination endpoint answered %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	return body, nil
+}
+
+// Handler serves a store as the coordination endpoint of HTTPStore. Requests
+// must carry token as a bearer token, if set.
+func Handler(store Store, token string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if token != "" && r.Header.Get("Authorization") != "Bearer "+token {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		elems := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+		switch {
+		case r.Method == http.MethodGet && len(elems) == 2:
+			reports, err := store.List(elems[0], elems[1])
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if reports == nil {
+				reports = []Report{}
+			}
+			w.Header().Set("Content-Type", "application/json")
+			_ = json.NewEncoder(w).Encode(reports)
+		case r.Method == http.MethodPut && len(elems) == 3:
+			var report Report
+			if err := json.NewDecoder(io.LimitReader(r.Body, 1<<20)).Decode(&report); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if report.Host != elems[2] {
+				http.Error(w, "host doesn't match the report", http.StatusBadRequest)
+				return
+			}
+			if err := store.Put(elems[0], elems[1], report); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			http.NotFound(w, r)
+		}
+	})
+}
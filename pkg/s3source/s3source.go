@@ -0,0 +1,387 @@
+// Package s3source provides a configuration source backed by an
+// S3-compatible object storage bucket, such as AWS S3 or MinIO.
+//
+// The objects below a prefix are tracked through their ETags, and through
+// their version IDs when the bucket is versioned. On every poll the prefix is
+// listed and, when anything changed, the staging directory is replaced with
+// the objects, which keep their path relative to the prefix. Only new or
+// changed objects are downloaded.
+// Requests are signed with AWS Signature Version 4.
+//
+// Author: zakaria.elbouwab
+package s3source
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/zcubbs/hpxd/pkg/files"
+)
+
+const defaultRegion = "us-east-1"
+
+// Config describes the bucket prefix to track and how to access it.
+type Config struct {
+	Endpoint string `mapstructure:"endpoint"`
+	Region   string `mapstructure:"region"`
+	Bucket   string `mapstructure:"bucket"`
+	Prefix   string `mapstructure:"prefix"`
+
+	// PathStyle addresses the bucket as https://endpoint/bucket rather than
+	// https://bucket.endpoint, as MinIO and most on-prem stores expect
+	PathStyle bool `mapstructure:"pathStyle"`
+
+	// Versioned lists the object versions of a versioned bucket, so
+	// overwriting an object with identical content is noticed too, and
+	// downloads the exact versions listed
+	Versioned bool `mapstructure:"versioned"`
+
+	AccessKey    string `mapstructure:"accessKey"`
+	SecretKey    string `mapstructure:"secretKey"`
+	SessionToken string `mapstructure:"sessionToken"`
+
+	Timeout time.Duration `mapstructure:"timeout"`
+}
+
+// object is an entry of a bucket listing.
+type object struct {
+	Key       string `xml:"Key"`
+	ETag      string `xml:"ETag"`
+	VersionID string `xml:"VersionId"`
+	IsLatest  bool   `xml:"IsLatest"`
+}
+
+// fingerprint identifies the content of an object: its ETag, and its
+// version ID when the bucket is versioned.
+func (o object) fingerprint() string {
+	if o.VersionID == "" || o.VersionID == "null" {
+		return o.ETag
+	}
+	return o.ETag + " " + o.VersionID
+}
+
+// listResult is the response of ListObjectsV2.
+type listResult struct {
+	Contents              []object `xml:"Contents"`
+	IsTruncated           bool     `xml:"IsTruncated"`
+	NextContinuationToken string   `xml:"NextContinuationToken"`
+}
+
+// listVersionsResult is the response of ListObjectVersions. Delete markers
+// are left out, so deleted objects have no latest version.
+type listVersionsResult struct {
+	Versions            []object `xml:"Version"`
+	IsTruncated         bool     `xml:"IsTruncated"`
+	NextKeyMarker       string   `xml:"NextKeyMarker"`
+	NextVersionIDMarker string   `xml:"NextVersionIdMarker"`
+}
+
+// Handler tracks the objects below a bucket prefix.
+type Handler struct {
+	config    Config
+	endpoint  *url.URL
+	path      string
+	localPath string
+	client    *http.Client
+	signer    *signer
+
+	// fingerprints of the objects currently staged, by key. staged tells
+	// the staging directory was written by this handler.
+	fingerprints map[string]string
+	staged       bool
+}
+
+// NewHandler initializes and returns a new Handler. path is the location of
+// the HAProxy configuration relative to the prefix.
+func NewHandler(config Config, path string) (*Handler, error) {
+	if config.Endpoint == "" || config.Bucket == "" {
+		return nil, errors.New("missing S3 endpoint or bucket")
+	}
+	endpoint, err := url.Parse(config.Endpoint)
+	if err != nil || endpoint.Host == "" {
+		return nil, fmt.Errorf("invalid S3 endpoint %q", config.Endpoint)
+	}
+	if config.Region == "" {
+		config.Region = defaultRegion
+	}
+	if config.Prefix != "" && !strings.HasSuffix(config.Prefix, "/") {
+		config.Prefix += "/"
+	}
+
+	timeout := config.Timeout
+	if timeout == 0 {
+		timeout = 30 * time.Second
+	}
+
+	return &Handler{
+		config:    config,
+		endpoint:  endpoint,
+		path:      path,
+		localPath: filepath.Join(os.TempDir(), "hpxd-s3-source"),
+		client:    &http.Client{Timeout: timeout},
+		signer: &signer{
+			accessKey:    config.AccessKey,
+			secretKey:    config.SecretKey,
+			sessionToken: config.SessionToken,
+			region:       config.Region,
+			service:      "s3",
+		},
+		fingerprints: make(map[string]string),
+	}, nil
+}
+
+// PullAndUpdate lists the prefix and stages the objects again if any of them
+// was added, changed or deleted since the previous call. This function
+// returns the path to the HAProxy configuration and a flag indicating if
+// any object changed.
+//
+// The staging directory is always staged again on the first call, so
+// objects deleted while hpxd wasn't running don't linger.
+func (h *Handler) PullAndUpdate(ctx context.Context) (string, bool, error) {
+	objects, err := h.list(ctx)
+	if err != nil {
+		return "", false, err
+	}
+
+	changed := !h.staged || len(objects) != len(h.fingerprints)
+	current := make(map[string]string, len(objects))
+	for _, o := range objects {
+		current[o.Key] = o.fingerprint()
+		if h.fingerprints[o.Key] != o.fingerprint() {
+			changed = true
+		}
+	}
+	if !changed {
+		return "", false, nil
+	}
+
+	if err := h.stage(ctx, objects); err != nil {
+		return "", false, err
+	}
+	h.fingerprints, h.staged = current, true
+	return filepath.Join(h.localPath, h.path), true, nil
+}
+
+// stage replaces the content of the staging directory with objects. They're
+// first written next to it, so a failure never leaves a mix of old and new
+// objects behind. Unchanged objects are copied from the current staging
+// directory, and the others are downloaded.
+func (h *Handler) stage(ctx context.Context, objects []object) error {
+	next := h.localPath + ".new"
+	if err := os.RemoveAll(next); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(next, 0750); err != nil {
+		return err
+	}
+
+	for _, o := range objects {
+		target := h.localFile(next, o.Key)
+		if h.fingerprints[o.Key] == o.fingerprint() {
+			if _, err := files.Copy(h.localFile(h.localPath, o.Key), target); err == nil {
+				continue
+			}
+		}
+		if err := h.download(ctx, o, target); err != nil {
+			_ = os.RemoveAll(next)
+			return err
+		}
+		logrus.Debugf("Downloaded s3://%s/%s (%s)", h.config.Bucket, o.Key, o.fingerprint())
+	}
+
+	if err := os.RemoveAll(h.localPath); err != nil {
+		return err
+	}
+	return os.Rename(next, h.localPath)
+}
+
+// RepoPath returns the staging directory.
+func (h *Handler) RepoPath() string {
+	return h.localPath
+}
+
+// Revision returns a hash of the keys, ETags and version IDs of the objects
+// currently staged.
+func (h *Handler) Revision() string {
+	keys := make([]string, 0, len(h.fingerprints))
+	for key := range h.fingerprints {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	sum := sha256.New()
+	for _, key := range keys {
+		fmt.Fprintf(sum, "%s %s\n", key, h.fingerprints[key])
+	}
+	return hex.EncodeToString(sum.Sum(nil))
+}
+
+// SetLocalPath changes where the objects are staged, so several handlers
+// can be used side by side.
+func (h *Handler) SetLocalPath(path string) {
+	h.localPath = path
+}
+
+// list returns every object below the prefix, following pagination.
+func (h *Handler) list(ctx context.Context) ([]object, error) {
+	if h.config.Versioned {
+		return h.listVersions(ctx)
+	}
+
+	var objects []object
+	token := ""
+	for {
+		query := url.Values{"list-type": {"2"}}
+		if h.config.Prefix != "" {
+			query.Set("prefix", h.config.Prefix)
+		}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+
+		resp, err := h.do(ctx, h.bucketURL("", query))
+		if err != nil {
+			return nil, fmt.Errorf("failed to list s3://%s/%s: %w", h.config.Bucket, h.config.Prefix, err)
+		}
+		var result listResult
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		_ = resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode bucket listing: %w", err)
+		}
+
+		for _, o := range result.Contents {
+			if !strings.HasSuffix(o.Key, "/") {
+				objects = append(objects, o)
+			}
+		}
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			return objects, nil
+		}
+		token = result.NextContinuationToken
+	}
+}
+
+// listVersions returns the latest version of every object below the prefix,
+// following pagination.
+func (h *Handler) listVersions(ctx context.Context) ([]object, error) {
+	var objects []object
+	keyMarker, versionMarker := "", ""
+	for {
+		query := url.Values{"versions": {""}}
+		if h.config.Prefix != "" {
+			query.Set("prefix", h.config.Prefix)
+		}
+		if keyMarker != "" {
+			query.Set("key-marker", keyMarker)
+			query.Set("version-id-marker", versionMarker)
+		}
+
+		resp, err := h.do(ctx, h.bucketURL("", query))
+		if err != nil {
+			return nil, fmt.Errorf("failed to list versions of s3://%s/%s: %w", h.config.Bucket, h.config.Prefix, err)
+		}
+		var result listVersionsResult
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		_ = resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode bucket version listing: %w", err)
+		}
+
+		for _, o := range result.Versions {
+			if o.IsLatest && !strings.HasSuffix(o.Key, "/") {
+				objects = append(objects, o)
+			}
+		}
+		if !result.IsTruncated || result.NextKeyMarker == "" {
+			return objects, nil
+		}
+		keyMarker, versionMarker = result.NextKeyMarker, result.NextVersionIDMarker
+	}
+}
+
+// download fetches an object into target, at the version listed when the
+// bucket is versioned.
+func (h *Handler) download(ctx context.Context, o object, target string) error {
+	var query url.Values
+	if o.VersionID != "" && o.VersionID != "null" {
+		query = url.Values{"versionId": {o.VersionID}}
+	}
+	resp, err := h.do(ctx, h.bucketURL(o.Key, query))
+	if err != nil {
+		return fmt.Errorf("failed to download s3://%s/%s: %w", h.config.Bucket, o.Key, err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	if err := os.MkdirAll(filepath.Dir(target), 0750); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(filepath.Clean(target), os.O_CREATE|os.O_WRONLY|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, resp.Body); err != nil {
+		_ = f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// do sends a signed GET request and checks its status.
+func (h *Handler) do(ctx context.Context, u *url.URL) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	if h.config.AccessKey != "" {
+		h.signer.sign(req, time.Now())
+	}
+
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		_ = resp.Body.Close()
+		return nil, fmt.Errorf("unexpected status %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	return resp, nil
+}
+
+// bucketURL returns the URL of an object, or of the bucket if key is empty.
+func (h *Handler) bucketURL(key string, query url.Values) *url.URL {
+	u := *h.endpoint
+	if h.config.PathStyle {
+		u.Path = path.Join("/", h.config.Bucket, key)
+	} else {
+		u.Host = h.config.Bucket + "." + u.Host
+		u.Path = "/" + key
+	}
+	if key == "" && !strings.HasSuffix(u.Path, "/") {
+		u.Path += "/"
+	}
+	u.RawQuery = query.Encode()
+	return &u
+}
+
+// localFile returns where an object is staged in dir, relative to the
+// prefix. Keys are confined to dir.
+func (h *Handler) localFile(dir, key string) string {
+	rel := strings.TrimPrefix(key, h.config.Prefix)
+	return filepath.Join(dir, filepath.Clean("/"+rel))
+}
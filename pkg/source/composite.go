@@ -0,0 +1,196 @@
+package source
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/zcubbs/hpxd/pkg/files"
+)
+
+// Input is a source contributing files to a Composite.
+type Input struct {
+	// Name identifies the input in logs and in the composed revision
+	Name string
+	// Source provides the files
+	Source Source
+	// Target is the directory, relative to the composed tree, the files of
+	// the input are placed in
+	Target string
+}
+
+// Composite composes a base source, providing the HAProxy configuration,
+// with inputs providing auxiliary files.
+//
+// The composed tree is the tree of the base source with the tree of every
+// input laid over it, each in its target directory. It's rebuilt whenever
+// any of the sources changes, and its revision changes along with the
+// revision of any of them.
+type Composite struct {
+	base      Source
+	inputs    []Input
+	localPath string
+
+	// configPath is the path of the configuration relative to the base tree,
+	// remembered as sources only report it when they change. pending is set
+	// while a change of any source isn't composed yet, as sources only
+	// report it once.
+	configPath string
+	pending    bool
+	changes    chan struct{}
+}
+
+// NewComposite initializes and returns a new Composite staging the composed
+// tree in localPath.
+func NewComposite(base Source, inputs []Input, localPath string) *Composite {
+	c := &Composite{
+		base:      base,
+		inputs:    inputs,
+		localPath: localPath,
+		changes:   make(chan struct{}, 1),
+	}
+	c.forwardChanges()
+	return c
+}
+
+// PullAndUpdate pulls every source and rebuilds the composed tree if any of
+// them changed, or if the tree couldn't be rebuilt after a previous change. This function returns the path to the HAProxy configuration
+// in the composed tree and a flag indicating if it changed.
+func (c *Composite) PullAndUpdate(ctx context.Context) (string, bool, error) {
+	configPath, changed, err := c.base.PullAndUpdate(ctx)
+	if err != nil {
+		return "", false, fmt.Errorf("base source: %w", err)
+	}
+	if changed {
+		c.pending = true
+		rel, err := filepath.Rel(c.base.RepoPath(), configPath)
+		if err != nil {
+			return "", false, err
+		}
+		c.configPath = rel
+	}
+
+	for _, in := range c.inputs {
+		_, inputChanged, err := in.Source.PullAndUpdate(ctx)
+		if err != nil {
+			return "", false, fmt.Errorf("input %s: %w", in.Name, err)
+		}
+		c.pending = c.pending || inputChanged
+	}
+
+	if !c.pending {
+		return "", false, nil
+	}
+	if c.configPath == "" {
+		return "", false, errors.New("base source didn't provide a configuration yet")
+	}
+	if err := c.compose(); err != nil {
+		return "", false, fmt.Errorf("failed to compose sources: %w", err)
+	}
+	c.pending = false
+	return filepath.Join(c.localPath, c.configPath), true, nil
+}
+
+// Base returns the source providing the configuration.
+func (c *Composite) Base() Source {
+	return c.base
+}
+
+// RepoPath returns the root of the composed tree.
+func (c *Composite) RepoPath() string {
+	return c.localPath
+}
+
+// Revision returns a hash of the revisions of every source.
+func (c *Composite) Revision() string {
+	sum := sha256.New()
+	sum.Write([]byte("base=" + c.base.Revision() + "\n"))
+	for _, in := range c.inputs {
+		sum.Write([]byte(in.Name + "=" + in.Source.Revision() + "\n"))
+	}
+	return hex.EncodeToString(sum.Sum(nil))[:12]
+}
+
+// Changes returns a channel receiving a value when any source able to
+// signal changes reports one.
+func (c *Composite) Changes() <-chan struct{} {
+	return c.changes
+}
+
+// compose rebuilds the composed tree next to the current one, then swaps
+// them, so a failure never leaves a partially composed tree behind.
+func (c *Composite) compose() error {
+	next := c.localPath + ".new"
+	if err := os.RemoveAll(next); err != nil {
+		return err
+	}
+
+	if err := copyTree(c.base.RepoPath(), next); err != nil {
+		return err
+	}
+	for _, in := range c.inputs {
+		target := filepath.Join(next, filepath.Clean("/"+in.Target))
+		if err := copyTree(in.Source.RepoPath(), target); err != nil {
+			return fmt.Errorf("input %s: %w", in.Name, err)
+		}
+	}
+
+	if err := os.RemoveAll(c.localPath); err != nil {
+		return err
+	}
+	return os.Rename(next, c.localPath)
+}
+
+// forwardChanges merges the change notifications of every source.
+func (c *Composite) forwardChanges() {
+	sources := []Source{c.base}
+	for _, in := range c.inputs {
+		sources = append(sources, in.Source)
+	}
+
+	for _, s := range sources {
+		n, ok := s.(Notifier)
+		if !ok {
+			continue
+		}
+		go func(changes <-chan struct{}) {
+			for range changes {
+				select {
+				case c.changes <- struct{}{}:
+				default:
+				}
+			}
+		}(n.Changes())
+	}
+}
+
+// copyTree copies the regular files of src into dest, skipping the
+// metadata of git repositories.
+func copyTree(src, dest string) error {
+	if err := os.MkdirAll(dest, 0750); err != nil {
+		return err
+	}
+	return filepath.WalkDir(src, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() && d.Name() == ".git" {
+			return filepath.SkipDir
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil || strings.HasPrefix(rel, "..") {
+			return err
+		}
+		_, err = files.Copy(path, filepath.Join(dest, rel))
+		return err
+	})
+}
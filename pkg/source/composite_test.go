@@ -0,0 +1,134 @@
+package source
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// fakeSource serves a directory, reporting a change when told to, or
+// failing with err.
+type fakeSource struct {
+	dir      string
+	path     string
+	revision string
+	changed  bool
+	err      error
+}
+
+func (f *fakeSource) PullAndUpdate(_ context.Context) (string, bool, error) {
+	if f.err != nil {
+		return "", false, f.err
+	}
+	if !f.changed {
+		return "", false, nil
+	}
+	f.changed = false
+	return filepath.Join(f.dir, f.path), true, nil
+}
+
+func (f *fakeSource) RepoPath() string { return f.dir }
+
+func (f *fakeSource) Revision() string { return f.revision }
+
+func writeFile(t *testing.T, path, content string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0750); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestComposite(t *testing.T) {
+	baseDir, mapsDir := t.TempDir(), t.TempDir()
+	writeFile(t, filepath.Join(baseDir, "haproxy.cfg"), "global\n")
+	writeFile(t, filepath.Join(baseDir, ".git", "HEAD"), "ref\n")
+	writeFile(t, filepath.Join(mapsDir, "hosts.map"), "a b\n")
+
+	base := &fakeSource{dir: baseDir, path: "haproxy.cfg", revision: "1", changed: true}
+	maps := &fakeSource{dir: mapsDir, revision: "1", changed: true}
+	c := NewComposite(base, []Input{{Name: "maps", Source: maps, Target: "maps"}}, filepath.Join(t.TempDir(), "composed"))
+
+	configPath, updated, err := c.PullAndUpdate(context.Background())
+	if err != nil || !updated {
+		t.Fatalf("Expected first pull to update, but got: %v, %v", updated, err)
+	}
+	if configPath != filepath.Join(c.RepoPath(), "haproxy.cfg") {
+		t.Errorf("Expected config in the composed tree, but got: %s", configPath)
+	}
+	if data, _ := os.ReadFile(filepath.Join(c.RepoPath(), "maps", "hosts.map")); string(data) != "a b\n" {
+		t.Errorf("Expected input files in their target, but got: %q", data)
+	}
+	if _, err := os.Stat(filepath.Join(c.RepoPath(), ".git")); err == nil {
+		t.Errorf("Expected git metadata not to be composed")
+	}
+
+	if _, updated, err := c.PullAndUpdate(context.Background()); err != nil || updated {
+		t.Errorf("Expected unchanged sources not to update, but got: %v, %v", updated, err)
+	}
+
+	// A change to an input alone still yields the base configuration
+	revision := c.Revision()
+	writeFile(t, filepath.Join(mapsDir, "hosts.map"), "a c\n")
+	maps.revision, maps.changed = "2", true
+
+	configPath, updated, err = c.PullAndUpdate(context.Background())
+	if err != nil || !updated {
+		t.Fatalf("Expected input change to update, but got: %v, %v", updated, err)
+	}
+	if configPath != filepath.Join(c.RepoPath(), "haproxy.cfg") {
+		t.Errorf("Expected config in the composed tree, but got: %s", configPath)
+	}
+	if data, _ := os.ReadFile(filepath.Join(c.RepoPath(), "maps", "hosts.map")); string(data) != "a c\n" {
+		t.Errorf("Expected updated input files, but got: %q", data)
+	}
+	if c.Revision() == revision {
+		t.Errorf("Expected the composed revision to change with an input")
+	}
+}
+
+func TestComposite_NoBaseConfig(t *testing.T) {
+	base := &fakeSource{dir: t.TempDir(), revision: "1"}
+	input := &fakeSource{dir: t.TempDir(), revision: "1", changed: true}
+	c := NewComposite(base, []Input{{Name: "certs", Source: input}}, filepath.Join(t.TempDir(), "composed"))
+
+	if _, _, err := c.PullAndUpdate(context.Background()); err == nil {
+		t.Errorf("Expected composing without a base configuration to fail")
+	}
+}
+
+func TestComposite_InputFailure(t *testing.T) {
+	baseDir := t.TempDir()
+	writeFile(t, filepath.Join(baseDir, "haproxy.cfg"), "global\n")
+	base := &fakeSource{dir: baseDir, path: "haproxy.cfg", revision: "1", changed: true}
+	maps := &fakeSource{dir: t.TempDir(), revision: "1", changed: true}
+	c := NewComposite(base, []Input{{Name: "maps", Source: maps, Target: "maps"}}, filepath.Join(t.TempDir(), "composed"))
+	if _, _, err := c.PullAndUpdate(context.Background()); err != nil {
+		t.Fatalf("Failed to pull: %v", err)
+	}
+
+	// The base changes while the input fails
+	writeFile(t, filepath.Join(baseDir, "haproxy.cfg"), "global\n    daemon\n")
+	base.revision, base.changed = "2", true
+	maps.err = errors.New("unreachable")
+	if _, _, err := c.PullAndUpdate(context.Background()); err == nil {
+		t.Fatal("Expected the input failure to be reported")
+	}
+
+	// The change of the base is still applied on the next poll
+	maps.err = nil
+	configPath, updated, err := c.PullAndUpdate(context.Background())
+	if err != nil || !updated {
+		t.Fatalf("Expected the base change to be kept, but got: %v, %v", updated, err)
+	}
+	if data, _ := os.ReadFile(configPath); string(data) != "global\n    daemon\n" {
+		t.Errorf("Expected the changed configuration, but got: %q", data)
+	}
+	if _, updated, _ := c.PullAndUpdate(context.Background()); updated {
+		t.Errorf("Expected no update once the change is composed")
+	}
+}
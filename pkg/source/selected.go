@@ -0,0 +1,74 @@
+package source
+
+import (
+	"context"
+	"path/filepath"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Selected is a source whose configuration path is selected in the fetched
+// tree every time its content changes, such as the configuration of the
+// host in a repository shared by a fleet.
+type Selected struct {
+	Source
+	selectPath func(root string) (string, error)
+
+	// selected is the path last selected, relative to the tree. pending is
+	// set while no configuration could be selected for a change, as the
+	// wrapped source only reports it once.
+	selected string
+	pending  bool
+	changes  chan struct{}
+}
+
+// NewSelected initializes and returns a new Selected wrapping src.
+// selectPath returns the path of the configuration relative to the tree.
+func NewSelected(src Source, selectPath func(root string) (string, error)) *Selected {
+	s := &Selected{
+		Source:     src,
+		selectPath: selectPath,
+		changes:    make(chan struct{}, 1),
+	}
+	if n, ok := src.(Notifier); ok {
+		go func() {
+			for range n.Changes() {
+				select {
+				case s.changes <- struct{}{}:
+				default:
+				}
+			}
+		}()
+	}
+	return s
+}
+
+// PullAndUpdate pulls the wrapped source and, if its content changed,
+// selects the configuration in its tree.
+func (s *Selected) PullAndUpdate(ctx context.Context) (string, bool, error) {
+	_, changed, err := s.Source.PullAndUpdate(ctx)
+	if err != nil {
+		return "", false, err
+	}
+	if !changed && !s.pending {
+		return "", false, nil
+	}
+
+	path, err := s.selectPath(s.RepoPath())
+	if err != nil {
+		s.pending = true
+		return "", false, err
+	}
+	s.pending = false
+	if path != s.selected {
+		logrus.Infof("Selected configuration %s", path)
+		s.selected = path
+	}
+	return filepath.Join(s.RepoPath(), path), true, nil
+}
+
+// Changes returns a channel receiving a value every time the wrapped
+// source, if able to signal changes, reports one.
+func (s *Selected) Changes() <-chan struct{} {
+	return s.changes
+}
@@ -0,0 +1,36 @@
+package source
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSelected(t *testing.T) {
+	dir := t.TempDir()
+	src := &fakeSource{dir: dir, revision: "1", changed: true}
+	var candidate string
+	s := NewSelected(src, func(root string) (string, error) {
+		if _, err := os.Stat(filepath.Join(root, candidate)); err != nil {
+			return "", err
+		}
+		return candidate, nil
+	})
+
+	candidate = "hosts/lb-1.cfg"
+	if _, updated, err := s.PullAndUpdate(context.Background()); err == nil || updated {
+		t.Fatalf("Expected selection to fail, but got: %v, %v", updated, err)
+	}
+
+	// The change is selected again on the next pull, even though the source
+	// doesn't report it anymore
+	writeFile(t, filepath.Join(dir, candidate), "global\n")
+	configPath, updated, err := s.PullAndUpdate(context.Background())
+	if err != nil || !updated || configPath != filepath.Join(dir, candidate) {
+		t.Fatalf("Expected the selected configuration, but got: %s, %v, %v", configPath, updated, err)
+	}
+	if _, updated, _ := s.PullAndUpdate(context.Background()); updated {
+		t.Errorf("Expected no update without changes")
+	}
+}
@@ -0,0 +1,30 @@
+// Package source defines where HAProxy configurations come from.
+//
+// Every source (git, local directory, HTTP artifact, S3 bucket, Consul KV,
+// etcd) fetches a tree of files into a local directory and reports a
+// revision identifying its content. Sources can be composed, so that one
+// source provides the base configuration while others provide map files,
+// certificates or server lists.
+//
+// Author: zakaria.elbouwab
+package source
+
+import "context"
+
+// Source is where HAProxy configurations are fetched from.
+type Source interface {
+	// PullAndUpdate fetches the latest content and returns the path to the
+	// HAProxy configuration, along with a flag indicating if the content
+	// changed since the previous call. Fetching stops when ctx is done.
+	PullAndUpdate(ctx context.Context) (string, bool, error)
+	// RepoPath returns the root of the fetched tree.
+	RepoPath() string
+	// Revision identifies the content last fetched.
+	Revision() string
+}
+
+// Notifier is implemented by sources able to signal changes as soon as they
+// happen, rather than waiting for the next poll.
+type Notifier interface {
+	Changes() <-chan struct{}
+}
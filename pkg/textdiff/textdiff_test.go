@@ -0,0 +1,81 @@
+package textdiff
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestUnified_Equal(t *testing.T) {
+	if d := Unified("a", "b", []byte("same\n"), []byte("same\n")); d != "" {
+		t.Errorf("Expected no diff, but got:\n%s", d)
+	}
+}
+
+func TestUnified(t *testing.T) {
+	a := "global\n  daemon\n\nbackend web\n  server s1 10.0.0.1:80\n  server s2 10.0.0.2:80\n"
+	b := "global\n  daemon\n\nbackend web\n  server s1 10.0.0.1:80\n  server s3 10.0.0.3:80\n  server s4 10.0.0.4:80\n"
+
+	expected := "--- live\n+++ candidate\n@@ -3,4 +3,5 @@\n \n backend web\n   server s1 10.0.0.1:80\n" +
+		"-  server s2 10.0.0.2:80\n+  server s3 10.0.0.3:80\n+  server s4 10.0.0.4:80\n"
+	if d := Unified("live", "candidate", []byte(a), []byte(b)); d != expected {
+		t.Errorf("Unexpected diff:\n%s", d)
+	}
+}
+
+func TestUnified_SeparateHunks(t *testing.T) {
+	var a, b []string
+	for i := 1; i <= 20; i++ {
+		a = append(a, fmt.Sprintf("line %d\n", i))
+		b = append(b, fmt.Sprintf("line %d\n", i))
+	}
+	b[1] = "changed 2\n"
+	b[17] = "changed 18\n"
+
+	d := Unified("a", "b", []byte(strings.Join(a, "")), []byte(strings.Join(b, "")))
+	if !strings.Contains(d, "@@ -1,5 +1,5 @@\n") || !strings.Contains(d, "@@ -15,6 +15,6 @@\n") {
+		t.Errorf("Expected two hunks, but got:\n%s", d)
+	}
+}
+
+func TestUnified_Empty(t *testing.T) {
+	expected := "--- a\n+++ b\n@@ -0,0 +1,1 @@\n+new\n"
+	if d := Unified("a", "b", nil, []byte("new\n")); d != expected {
+		t.Errorf("Unexpected diff:\n%s", d)
+	}
+}
+
+func TestUnified_NoFinalNewline(t *testing.T) {
+	d := Unified("a", "b", []byte("one\ntwo"), []byte("one\nthree"))
+	if !strings.Contains(d, "-two\n\\ No newline at end of file\n+three\n\\ No newline at end of file\n") {
+		t.Errorf("Expected missing newlines to be flagged, but got:\n%s", d)
+	}
+}
+
+// apply rebuilds both texts from an edit script.
+func apply(edits []edit) (string, string) {
+	var a, b strings.Builder
+	for _, e := range edits {
+		if e.kind != '+' {
+			a.WriteString(e.line)
+		}
+		if e.kind != '-' {
+			b.WriteString(e.line)
+		}
+	}
+	return a.String(), b.String()
+}
+
+func TestDiff_RoundTrip(t *testing.T) {
+	tests := [][2]string{
+		{"a\nb\nc\n", "c\nb\na\n"},
+		{"x\ny\n", ""},
+		{"1\n2\n3\n4\n5\n", "0\n2\n3\n5\n6\n"},
+	}
+	for _, tt := range tests {
+		a, b := apply(diff(splitLines(tt[0]), splitLines(tt[1])))
+		if a != tt[0] || b != tt[1] {
+			t.Errorf("Edit script of %q and %q rebuilds %q and %q", tt[0], tt[1], a, b)
+		}
+	}
+}
@@ -0,0 +1,122 @@
+package webhook
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// gitPushPayload is the push payload shared by GitHub, GitLab and Gitea.
+type gitPushPayload struct {
+	Ref     string `json:"ref"`
+	Commits []struct {
+		Added    []string `json:"added"`
+		Modified []string `json:"modified"`
+		Removed  []string `json:"removed"`
+	} `json:"commits"`
+}
+
+// bitbucketCloudPayload is the "repo:push" payload of Bitbucket Cloud.
+type bitbucketCloudPayload struct {
+	Push struct {
+		Changes []struct {
+			New *struct {
+				Type string `json:"type"`
+				Name string `json:"name"`
+			} `json:"new"`
+		} `json:"changes"`
+	} `json:"push"`
+}
+
+// bitbucketServerPayload is the "repo:refs_changed" payload of Bitbucket
+// Server and Data Center.
+type bitbucketServerPayload struct {
+	Changes []struct {
+		RefID string `json:"refId"`
+		Type  string `json:"type"`
+	} `json:"changes"`
+}
+
+// parsePush extracts the push details from a delivery.
+func parsePush(provider string, header http.Header, body []byte) (push, error) {
+	switch provider {
+	case ProviderGitHub:
+		if header.Get("X-GitHub-Event") != "push" {
+			return push{}, nil
+		}
+		return parseGitPush(body)
+	case ProviderGitea:
+		if header.Get("X-Gitea-Event") != "push" {
+			return push{}, nil
+		}
+		return parseGitPush(body)
+	case ProviderGitLab:
+		if header.Get("X-Gitlab-Event") != "Push Hook" {
+			return push{}, nil
+		}
+		return parseGitPush(body)
+	case ProviderBitbucket:
+		return parseBitbucketPush(header.Get("X-Event-Key"), body)
+	}
+	return push{}, errUnknownProvider
+}
+
+// parseGitPush parses a GitHub, GitLab or Gitea push payload.
+func parseGitPush(body []byte) (push, error) {
+	var payload gitPushPayload
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return push{}, fmt.Errorf("invalid push payload: %w", err)
+	}
+
+	p := push{isPush: true}
+	if branch, ok := strings.CutPrefix(payload.Ref, "refs/heads/"); ok {
+		p.branches = []string{branch}
+	}
+
+	// Providers cap the number of commits in a payload, in which case the
+	// changed files aren't fully known
+	if len(payload.Commits) == 0 || len(payload.Commits) >= 20 {
+		return p, nil
+	}
+	p.files = []string{}
+	for _, c := range payload.Commits {
+		p.files = append(p.files, c.Added...)
+		p.files = append(p.files, c.Modified...)
+		p.files = append(p.files, c.Removed...)
+	}
+	return p, nil
+}
+
+// parseBitbucketPush parses a Bitbucket Cloud or Server push payload.
+// Bitbucket doesn't report changed files, so pushes can't be filtered on
+// paths.
+func parseBitbucketPush(event string, body []byte) (push, error) {
+	switch event {
+	case "repo:push":
+		var payload bitbucketCloudPayload
+		if err := json.Unmarshal(body, &payload); err != nil {
+			return push{}, fmt.Errorf("invalid push payload: %w", err)
+		}
+		p := push{isPush: true}
+		for _, c := range payload.Push.Changes {
+			if c.New != nil && c.New.Type == "branch" {
+				p.branches = append(p.branches, c.New.Name)
+			}
+		}
+		return p, nil
+	case "repo:refs_changed":
+		var payload bitbucketServerPayload
+		if err := json.Unmarshal(body, &payload); err != nil {
+			return push{}, fmt.Errorf("invalid push payload: %w", err)
+		}
+		p := push{isPush: true}
+		for _, c := range payload.Changes {
+			if branch, ok := strings.CutPrefix(c.RefID, "refs/heads/"); ok && c.Type != "DELETE" {
+				p.branches = append(p.branches, branch)
+			}
+		}
+		return p, nil
+	}
+	return push{}, nil
+}
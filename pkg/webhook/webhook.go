@@ -0,0 +1,210 @@
+// Package webhook receives push webhooks from git hosting services and
+// triggers an immediate sync, so changes don't wait for the next poll.
+//
+// GitHub, GitLab, Gitea and Bitbucket webhooks are supported. Deliveries
+// are authenticated with the shared secret configured on the git host, and
+// only pushes to the watched branch touching the watched paths trigger a
+// sync.
+//
+// Author: zakaria.elbouwab
+package webhook
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	"github.com/zcubbs/hpxd/pkg/metrics"
+)
+
+// Supported providers.
+const (
+	ProviderGitHub    = "github"
+	ProviderGitLab    = "gitlab"
+	ProviderGitea     = "gitea"
+	ProviderBitbucket = "bitbucket"
+)
+
+// maxPayloadSize caps the size of a webhook payload.
+const maxPayloadSize = 5 << 20
+
+var (
+	errUnknownProvider  = errors.New("unknown webhook provider")
+	errInvalidSignature = errors.New("invalid webhook signature")
+)
+
+// push is the part of a push event hpxd cares about, whatever the provider.
+type push struct {
+	// isPush is false for other events, such as pings
+	isPush bool
+	// branches pushed to
+	branches []string
+	// files changed by the push. A nil slice means the provider doesn't
+	// report them, so the push can't be filtered on paths.
+	files []string
+}
+
+// Receiver is an http.Handler receiving push webhooks.
+type Receiver struct {
+	secret  string
+	branch  string
+	paths   []string
+	trigger func()
+}
+
+// NewReceiver initializes and returns a new Receiver.
+//
+// Deliveries must be signed with secret. trigger is called for every push
+// to branch touching at least one of paths. Paths are patterns matched with
+// path.Match, or directories matching everything below them. With no paths,
+// every push to branch triggers a sync.
+func NewReceiver(secret, branch string, paths []string, trigger func()) *Receiver {
+	return &Receiver{
+		secret:  secret,
+		branch:  branch,
+		paths:   paths,
+		trigger: trigger,
+	}
+}
+
+// ServeHTTP handles a single webhook delivery.
+func (r *Receiver) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	provider := detectProvider(req.Header)
+	result := func(status int, outcome, msg string) {
+		metrics.WebhookCounter.WithLabelValues(provider, outcome).Inc()
+		w.WriteHeader(status)
+		_, _ = io.WriteString(w, msg+"\n")
+	}
+
+	if provider == "" {
+		provider = "unknown"
+		result(http.StatusBadRequest, "rejected", errUnknownProvider.Error())
+		return
+	}
+
+	body, err := io.ReadAll(http.MaxBytesReader(w, req.Body, maxPayloadSize))
+	if err != nil {
+		result(http.StatusBadRequest, "rejected", "failed to read payload")
+		return
+	}
+
+	if err := r.verify(provider, req.Header, body); err != nil {
+		logrus.Warnf("Rejected %s webhook from %s: %v", provider, req.RemoteAddr, err)
+		result(http.StatusUnauthorized, "rejected", err.Error())
+		return
+	}
+
+	p, err := parsePush(provider, req.Header, body)
+	if err != nil {
+		result(http.StatusBadRequest, "rejected", err.Error())
+		return
+	}
+
+	if !p.isPush {
+		result(http.StatusOK, "ignored", "not a push event")
+		return
+	}
+	if !contains(p.branches, r.branch) {
+		logrus.Debugf("Ignored %s webhook for branches %v", provider, p.branches)
+		result(http.StatusOK, "ignored", "branch not watched")
+		return
+	}
+	if !r.touchesPaths(p.files) {
+		logrus.Debugf("Ignored %s webhook, no watched path changed", provider)
+		result(http.StatusOK, "ignored", "no watched path changed")
+		return
+	}
+
+	logrus.Infof("Received %s push webhook for branch %s, triggering sync", provider, r.branch)
+	r.trigger()
+	result(http.StatusAccepted, "triggered", "sync triggered")
+}
+
+// verify checks the signature or token of a delivery.
+func (r *Receiver) verify(provider string, header http.Header, body []byte) error {
+	switch provider {
+	case ProviderGitLab:
+		token := header.Get("X-Gitlab-Token")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(r.secret)) != 1 {
+			return errInvalidSignature
+		}
+		return nil
+	case ProviderGitea:
+		return verifyHMAC(r.secret, header.Get("X-Gitea-Signature"), body)
+	case ProviderGitHub:
+		return verifyHMAC(r.secret, strings.TrimPrefix(header.Get("X-Hub-Signature-256"), "sha256="), body)
+	case ProviderBitbucket:
+		return verifyHMAC(r.secret, strings.TrimPrefix(header.Get("X-Hub-Signature"), "sha256="), body)
+	}
+	return errUnknownProvider
+}
+
+// touchesPaths reports whether any of files matches the watched paths.
+func (r *Receiver) touchesPaths(files []string) bool {
+	if len(r.paths) == 0 || files == nil {
+		return true
+	}
+
+	for _, f := range files {
+		for _, pattern := range r.paths {
+			pattern = strings.Trim(pattern, "/")
+			if matched, _ := path.Match(pattern, f); matched || strings.HasPrefix(f, pattern+"/") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// detectProvider identifies the provider that sent a delivery from its
+// headers. Gitea also sends GitHub headers, so it's checked first.
+func detectProvider(header http.Header) string {
+	switch {
+	case header.Get("X-Gitea-Event") != "":
+		return ProviderGitea
+	case header.Get("X-Gitlab-Event") != "":
+		return ProviderGitLab
+	case header.Get("X-GitHub-Event") != "":
+		return ProviderGitHub
+	case header.Get("X-Event-Key") != "":
+		return ProviderBitbucket
+	}
+	return ""
+}
+
+// verifyHMAC checks that signature is the hex-encoded HMAC-SHA256 of body.
+func verifyHMAC(secret, signature string, body []byte) error {
+	expected, err := hex.DecodeString(signature)
+	if err != nil || len(expected) == 0 {
+		return errInvalidSignature
+	}
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	if !hmac.Equal(mac.Sum(nil), expected) {
+		return errInvalidSignature
+	}
+	return nil
+}
+
+func contains(list []string, value string) bool {
+	for _, v := range list {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,137 @@
+package webhook
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+const testSecret = "s3cr3t"
+
+func sign(body string) string {
+	mac := hmac.New(sha256.New, []byte(testSecret))
+	mac.Write([]byte(body))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func TestReceiver(t *testing.T) {
+	githubPush := `{"ref":"refs/heads/main","commits":[{"added":[],"modified":["lb/haproxy.cfg"],"removed":[]}]}`
+	githubOtherPath := `{"ref":"refs/heads/main","commits":[{"added":["README.md"],"modified":[],"removed":[]}]}`
+	githubOtherBranch := `{"ref":"refs/heads/feature","commits":[{"modified":["lb/haproxy.cfg"]}]}`
+	bitbucketCloud := `{"push":{"changes":[{"new":{"type":"branch","name":"main"}}]}}`
+	bitbucketServer := `{"changes":[{"refId":"refs/heads/main","type":"UPDATE"}]}`
+
+	tests := []struct {
+		name      string
+		headers   map[string]string
+		body      string
+		status    int
+		triggered bool
+	}{
+		{
+			name:      "github push",
+			headers:   map[string]string{"X-GitHub-Event": "push", "X-Hub-Signature-256": "sha256=" + sign(githubPush)},
+			body:      githubPush,
+			status:    http.StatusAccepted,
+			triggered: true,
+		},
+		{
+			name:    "github bad signature",
+			headers: map[string]string{"X-GitHub-Event": "push", "X-Hub-Signature-256": "sha256=" + sign("other")},
+			body:    githubPush,
+			status:  http.StatusUnauthorized,
+		},
+		{
+			name:    "github ping",
+			headers: map[string]string{"X-GitHub-Event": "ping", "X-Hub-Signature-256": "sha256=" + sign("{}")},
+			body:    "{}",
+			status:  http.StatusOK,
+		},
+		{
+			name:    "github other branch",
+			headers: map[string]string{"X-GitHub-Event": "push", "X-Hub-Signature-256": "sha256=" + sign(githubOtherBranch)},
+			body:    githubOtherBranch,
+			status:  http.StatusOK,
+		},
+		{
+			name:    "github other path",
+			headers: map[string]string{"X-GitHub-Event": "push", "X-Hub-Signature-256": "sha256=" + sign(githubOtherPath)},
+			body:    githubOtherPath,
+			status:  http.StatusOK,
+		},
+		{
+			name:      "gitea push",
+			headers:   map[string]string{"X-Gitea-Event": "push", "X-GitHub-Event": "push", "X-Gitea-Signature": sign(githubPush)},
+			body:      githubPush,
+			status:    http.StatusAccepted,
+			triggered: true,
+		},
+		{
+			name:      "gitlab push",
+			headers:   map[string]string{"X-Gitlab-Event": "Push Hook", "X-Gitlab-Token": testSecret},
+			body:      githubPush,
+			status:    http.StatusAccepted,
+			triggered: true,
+		},
+		{
+			name:    "gitlab bad token",
+			headers: map[string]string{"X-Gitlab-Event": "Push Hook", "X-Gitlab-Token": "wrong"},
+			body:    githubPush,
+			status:  http.StatusUnauthorized,
+		},
+		{
+			name:      "bitbucket cloud push",
+			headers:   map[string]string{"X-Event-Key": "repo:push", "X-Hub-Signature": "sha256=" + sign(bitbucketCloud)},
+			body:      bitbucketCloud,
+			status:    http.StatusAccepted,
+			triggered: true,
+		},
+		{
+			name:      "bitbucket server push",
+			headers:   map[string]string{"X-Event-Key": "repo:refs_changed", "X-Hub-Signature": "sha256=" + sign(bitbucketServer)},
+			body:      bitbucketServer,
+			status:    http.StatusAccepted,
+			triggered: true,
+		},
+		{
+			name:   "unknown provider",
+			body:   githubPush,
+			status: http.StatusBadRequest,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			triggered := false
+			receiver := NewReceiver(testSecret, "main", []string{"lb/", "maps/*.map"}, func() { triggered = true })
+
+			req := httptest.NewRequest(http.MethodPost, "/webhook", strings.NewReader(tt.body))
+			for k, v := range tt.headers {
+				req.Header.Set(k, v)
+			}
+			rec := httptest.NewRecorder()
+			receiver.ServeHTTP(rec, req)
+
+			if rec.Code != tt.status {
+				t.Errorf("Expected status %d, but got %d: %s", tt.status, rec.Code, rec.Body.String())
+			}
+			if triggered != tt.triggered {
+				t.Errorf("Expected triggered to be %v, but got %v", tt.triggered, triggered)
+			}
+		})
+	}
+}
+
+func TestReceiver_MethodNotAllowed(t *testing.T) {
+	receiver := NewReceiver(testSecret, "main", nil, func() {})
+	rec := httptest.NewRecorder()
+	receiver.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/webhook", nil))
+
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("Expected status %d, but got %d", http.StatusMethodNotAllowed, rec.Code)
+	}
+}
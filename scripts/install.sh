@@ -164,7 +164,8 @@ Description=HPXD Service
 After=network.target
 
 [Service]
-ExecStart=$INSTALL_DIR/hpxd -config $INSTALL_DIR/config
+ExecStart=$INSTALL_DIR/hpxd run -config $INSTALL_DIR/config
+ExecReload=/bin/kill -HUP \$MAINPID
 EnvironmentFile=$ENV_FILE
 Restart=always
 User=$HPXD_USER